@@ -104,7 +104,7 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 				}
 			}
 
-		case subnet.EventRemoved:
+		case subnet.EventRemoved, subnet.EventExpired:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
 
 			if evt.Lease.Attrs.BackendType != "extension" {
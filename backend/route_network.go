@@ -115,7 +115,7 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 				continue
 			}
 
-		case subnet.EventRemoved:
+		case subnet.EventRemoved, subnet.EventExpired:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
 
 			if evt.Lease.Attrs.BackendType != n.BackendType {
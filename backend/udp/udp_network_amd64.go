@@ -190,7 +190,7 @@ func (n *network) processSubnetEvents(batch []subnet.Event) {
 
 			setRoute(n.ctl, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, n.port)
 
-		case subnet.EventRemoved:
+		case subnet.EventRemoved, subnet.EventExpired:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
 
 			removeRoute(n.ctl, evt.Lease.Subnet)
@@ -169,7 +169,7 @@ func (nw *network) handleSubnetEvents(batch []subnet.Event) {
 					continue
 				}
 			}
-		case subnet.EventRemoved:
+		case subnet.EventRemoved, subnet.EventExpired:
 			if directRoutingOK {
 				log.V(2).Infof("Removing direct route to subnet: %s PublicIP: %s", sn, attrs.PublicIP)
 				if err := netlink.RouteDel(&directRoute); err != nil {
@@ -15,11 +15,14 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -83,6 +86,49 @@ type CmdLineOpts struct {
 	kubeSubnetMgr          bool
 	kubeApiUrl             string
 	kubeConfigFile         string
+	kubeTokenFile          string
+	kubeCAFile             string
+	kubeNodeNameStrategies flagSlice
+	kubeHostnameFile       string
+	kubeNetConfPath        string
+	kubeNetConfConfigMap   string
+	kubeNetConfKey         string
+	kubeNetConfStrict      bool
+	kubeNetConfCheck       time.Duration
+	kubeNetConfRestart     bool
+	kubeAnnotationPrefix   string
+	kubeResyncPeriod       time.Duration
+	kubeResyncJitter       float64
+	kubeLeaseExpiration    time.Duration
+	kubeNoLeaseExpiration  bool
+	kubeAPITimeout         time.Duration
+	kubeAPIQPS             float64
+	kubeAPIBurst           int
+	kubeUserAgent          string
+	kubeNodeSelector       string
+	kubeNodeFieldSelector  string
+	kubePodCIDRWaitTimeout time.Duration
+	kubePodLookupTimeout   time.Duration
+	kubeSyncTimeout        time.Duration
+	kubeEventDebounce      time.Duration
+	kubeDryRun             bool
+	kubeTolerantPatch      bool
+	kubeLeaseNodeLabels    flagSlice
+	kubeLeaseNodeAnnos     flagSlice
+	kubeDrainTaints        flagSlice
+	kubePodCIDRWarnOnly    bool
+	kubePublicIPFallback   bool
+	kubePublicIPAddrType   string
+	kubeManagedNodeLabel   string
+	kubePolicyLabel        string
+	kubeExpireLeasesAfter  time.Duration
+	kubeCompressThreshold  int
+	kubeAcquireWindow      time.Duration
+	kubeInformerWatchdog   time.Duration
+	kubeUnhealthyTimeout   time.Duration
+	kubeReconcileInterval  time.Duration
+	kubeWatchBatchSize     int
+	kubeDumpLeases         bool
 	iface                  flagSlice
 	ifaceRegex             flagSlice
 	ipMasq                 bool
@@ -92,6 +138,7 @@ type CmdLineOpts struct {
 	subnetLeaseRenewMargin int
 	healthzIP              string
 	healthzPort            int
+	debugAddr              string
 }
 
 var (
@@ -118,9 +165,53 @@ func init() {
 	flannelFlags.BoolVar(&opts.kubeSubnetMgr, "kube-subnet-mgr", false, "contact the Kubernetes API for subnet assignment instead of etcd.")
 	flannelFlags.StringVar(&opts.kubeApiUrl, "kube-api-url", "", "Kubernetes API server URL. Does not need to be specified if flannel is running in a pod.")
 	flannelFlags.StringVar(&opts.kubeConfigFile, "kubeconfig-file", "", "kubeconfig file location. Does not need to be specified if flannel is running in a pod.")
+	flannelFlags.StringVar(&opts.kubeTokenFile, "kube-token-file", "", "service account token file to use in cluster. Defaults to "+kube.DefaultServiceAccountDir+"/token.")
+	flannelFlags.StringVar(&opts.kubeCAFile, "kube-ca-file", "", "CA certificate file to use in cluster. Defaults to "+kube.DefaultServiceAccountDir+"/ca.crt.")
+	flannelFlags.Var(&opts.kubeNodeNameStrategies, "kube-node-name-strategy", "way of finding the node flannel runs on: env, pod, hostname or internal-ip (may be repeated, tried in order). Defaults to env, then pod.")
+	flannelFlags.StringVar(&opts.kubeHostnameFile, "kube-hostname-file", "", "file holding the node name for the hostname node name strategy. Defaults to the hostname.")
+	flannelFlags.StringVar(&opts.kubeNetConfPath, "net-config-path", "", "path to the network configuration file used by the kube subnet manager. Defaults to $NET_CONF_PATH or "+kube.DefaultNetConfPath+".")
+	flannelFlags.StringVar(&opts.kubeNetConfConfigMap, "net-config-configmap", "", "ConfigMap (namespace/name) to read the network configuration of the kube subnet manager from through the API, instead of net-config-path.")
+	flannelFlags.StringVar(&opts.kubeNetConfKey, "net-config-configmap-key", kube.DefaultNetConfConfigMapKey, "key of the network configuration in net-config-configmap.")
+	flannelFlags.BoolVar(&opts.kubeNetConfStrict, "net-config-strict", false, "reject unknown keys in the network configuration of the kube subnet manager, and warn about settings that have no effect.")
+	flannelFlags.DurationVar(&opts.kubeNetConfCheck, "net-config-check-interval", 0, "how often the kube subnet manager checks its network configuration for changes. Defaults to kube-resync-period, a negative value disables it.")
+	flannelFlags.BoolVar(&opts.kubeNetConfRestart, "net-config-restart", false, "shut down when the network or backend settings of the kube subnet manager's network configuration change, for flannel to be restarted with them.")
+	flannelFlags.StringVar(&opts.kubeAnnotationPrefix, "kube-annotation-prefix", kube.DefaultAnnotationPrefix, "prefix of the node annotations written by the kube subnet manager.")
+	flannelFlags.DurationVar(&opts.kubeResyncPeriod, "kube-resync-period", kube.DefaultResyncPeriod, "how often the kube subnet manager resyncs all nodes.")
+	flannelFlags.Float64Var(&opts.kubeResyncJitter, "kube-resync-jitter", kube.DefaultResyncJitter, "fraction of kube-resync-period by which each flannel instance randomly shifts its resync period, so instances don't resync at once. A negative value disables it.")
+	flannelFlags.DurationVar(&opts.kubeLeaseExpiration, "kube-lease-expiration", kube.DefaultLeaseExpiration, "expiration of leases handed out by the kube subnet manager.")
+	flannelFlags.BoolVar(&opts.kubeNoLeaseExpiration, "kube-no-lease-expiration", false, "hand out kube subnet manager leases that never expire, as their nodes' existence is what counts.")
+	flannelFlags.DurationVar(&opts.kubeAPITimeout, "kube-api-timeout", kube.DefaultAPITimeout, "timeout of the Kubernetes API calls made by the kube subnet manager.")
+	flannelFlags.Float64Var(&opts.kubeAPIQPS, "kube-api-qps", float64(kube.DefaultQPS), "maximum rate of Kubernetes API requests per second made by the kube subnet manager.")
+	flannelFlags.IntVar(&opts.kubeAPIBurst, "kube-api-burst", kube.DefaultBurst, "maximum burst of Kubernetes API requests made by the kube subnet manager.")
+	flannelFlags.StringVar(&opts.kubeUserAgent, "kube-user-agent", "", "user agent of the Kubernetes API requests made by the kube subnet manager. Defaults to flanneld/<version> (<os>/<arch>) node/<node name>.")
+	flannelFlags.StringVar(&opts.kubeNodeSelector, "kube-node-selector", "", "label selector of the nodes the kube subnet manager watches. Defaults to all nodes.")
+	flannelFlags.StringVar(&opts.kubeNodeFieldSelector, "kube-node-field-selector", "", "field selector of the nodes the kube subnet manager watches, e.g. metadata.name. Defaults to all nodes.")
+	flannelFlags.DurationVar(&opts.kubePodCIDRWaitTimeout, "kube-pod-cidr-wait-timeout", kube.DefaultPodCIDRWaitTimeout, "how long the kube subnet manager waits for the node to be assigned a pod CIDR.")
+	flannelFlags.DurationVar(&opts.kubePodLookupTimeout, "kube-pod-lookup-timeout", kube.DefaultPodLookupTimeout, "how long to keep retrying to get flannel's pod, to find the node name, while the API server is unavailable.")
+	flannelFlags.DurationVar(&opts.kubeSyncTimeout, "kube-sync-timeout", kube.DefaultSyncTimeout, "how long the kube subnet manager waits for its node cache to sync when starting.")
+	flannelFlags.DurationVar(&opts.kubeEventDebounce, "kube-event-debounce", kube.DefaultEventDebounce, "how long the kube subnet manager coalesces lease updates of a node. A negative value disables coalescing.")
+	flannelFlags.Var(&opts.kubeLeaseNodeLabels, "kube-lease-node-label", "key of a node label to pass on to the backend with the node's lease (may be repeated).")
+	flannelFlags.Var(&opts.kubeLeaseNodeAnnos, "kube-lease-node-annotation", "key of a node annotation to pass on to the backend with the node's lease (may be repeated, at most 16 times).")
+	flannelFlags.BoolVar(&opts.kubePublicIPFallback, "kube-public-ip-from-internal-ip", false, "use the InternalIP of nodes without a public IP annotation as the public IP of their lease.")
+	flannelFlags.StringVar(&opts.kubePublicIPAddrType, "kube-public-ip-address-type", "", "type of node address, InternalIP or ExternalIP, used as the public IP of the lease of nodes without a public IP annotation.")
+	flannelFlags.StringVar(&opts.kubeManagedNodeLabel, "kube-managed-node-label", "", "key of a label the kube subnet manager sets to true on the node while it holds a lease, e.g. flannel.io/managed. Defaults to none.")
+	flannelFlags.StringVar(&opts.kubePolicyLabel, "kube-policy-enforced-label", "", "key of a node label set to true on nodes enforcing network policy, whose leases are then marked as such for policy-aware backends. Defaults to none.")
+	flannelFlags.DurationVar(&opts.kubeExpireLeasesAfter, "kube-expire-leases-after", 0, "hand out the lease of a node not updated for this long as expired, for consumers expecting leases to expire. Defaults to never.")
+	flannelFlags.IntVar(&opts.kubeCompressThreshold, "kube-backend-data-compression-threshold", 0, "size in bytes above which the kube subnet manager writes the node's backend data gzip compressed. Defaults to never.")
+	flannelFlags.DurationVar(&opts.kubeAcquireWindow, "kube-acquire-lease-window", 0, "return the same lease again, without reading or patching the node, to lease acquisitions repeating the previous one within this long. Defaults to never.")
+	flannelFlags.DurationVar(&opts.kubeInformerWatchdog, "kube-informer-watchdog-timeout", 0, "restart the kube subnet manager's node informer after this long without a watch event. Defaults to never.")
+	flannelFlags.DurationVar(&opts.kubeUnhealthyTimeout, "kube-unhealthy-timeout", kube.DefaultUnhealthyTimeout, "how long the kube subnet manager's node informer may be unhealthy before the watch of leases fails. A negative value disables the check.")
+	flannelFlags.BoolVar(&opts.kubePodCIDRWarnOnly, "kube-pod-cidr-check-warn-only", false, "only warn when the node's pod CIDR isn't within the flannel network, instead of failing to acquire a lease.")
+	flannelFlags.Var(&opts.kubeDrainTaints, "kube-drain-taint", "key of a node taint that withdraws the node's lease from the overlay while present (may be repeated).")
+	flannelFlags.DurationVar(&opts.kubeReconcileInterval, "kube-reconcile-interval", kube.DefaultReconcileInterval, "how often the kube subnet manager restores the node's annotations if they were removed. A negative value disables it.")
+	flannelFlags.IntVar(&opts.kubeWatchBatchSize, "kube-watch-batch-size", kube.DefaultWatchBatchSize, "most lease events the kube subnet manager hands to the backend at once.")
+	flannelFlags.BoolVar(&opts.kubeDryRun, "kube-dry-run", false, "log the changes the kube subnet manager would make to nodes instead of making them.")
+	flannelFlags.BoolVar(&opts.kubeTolerantPatch, "kube-tolerate-failed-patch", false, "acquire the lease when patching the node fails, if the node already has the lease's annotations.")
+	flannelFlags.BoolVar(&opts.kubeDumpLeases, "kube-dump-leases", false, "print the leases of all flannel managed nodes as JSON and exit, without modifying anything. Uses the kube-api-url and kubeconfig-file options to connect.")
 	flannelFlags.BoolVar(&opts.version, "version", false, "print version and exit")
 	flannelFlags.StringVar(&opts.healthzIP, "healthz-ip", "0.0.0.0", "the IP address for healthz server to listen")
 	flannelFlags.IntVar(&opts.healthzPort, "healthz-port", 0, "the port for healthz server to listen(0 to disable)")
+	flannelFlags.StringVar(&opts.debugAddr, "debug-addr", "", "address (host:port) of a debug server serving pprof profiles under /debug/pprof/. Defaults to none.")
 
 	// glog will log to tmp files by default. override so all entries
 	// can flow into journald (if running under systemd)
@@ -148,9 +239,80 @@ func usage() {
 	os.Exit(0)
 }
 
-func newSubnetManager() (subnet.Manager, error) {
+// kubeSubnetManagerConfig returns the kube subnet manager config set by the
+// command line.
+func kubeSubnetManagerConfig() *kube.SubnetManagerConfig {
+	var strategies []kube.NodeNameStrategy
+	for _, s := range opts.kubeNodeNameStrategies {
+		strategies = append(strategies, kube.NodeNameStrategy(s))
+	}
+	return &kube.SubnetManagerConfig{
+		ApiUrl:                 opts.kubeApiUrl,
+		Kubeconfig:             opts.kubeConfigFile,
+		TokenFile:              opts.kubeTokenFile,
+		CAFile:                 opts.kubeCAFile,
+		NodeNameStrategies:     strategies,
+		HostnameFile:           opts.kubeHostnameFile,
+		NetConfPath:            opts.kubeNetConfPath,
+		NetConfConfigMap:       opts.kubeNetConfConfigMap,
+		NetConfConfigMapKey:    opts.kubeNetConfKey,
+		StrictNetConf:          opts.kubeNetConfStrict,
+		NetConfCheckInterval:   opts.kubeNetConfCheck,
+		AnnotationPrefix:       opts.kubeAnnotationPrefix,
+		ResyncPeriod:           opts.kubeResyncPeriod,
+		ResyncJitter:           opts.kubeResyncJitter,
+		LeaseExpiration:        opts.kubeLeaseExpiration,
+		NoLeaseExpiration:      opts.kubeNoLeaseExpiration,
+		APITimeout:             opts.kubeAPITimeout,
+		QPS:                    float32(opts.kubeAPIQPS),
+		Burst:                  opts.kubeAPIBurst,
+		UserAgent:              opts.kubeUserAgent,
+		NodeLabelSelector:      opts.kubeNodeSelector,
+		NodeFieldSelector:      opts.kubeNodeFieldSelector,
+		PodCIDRWaitTimeout:     opts.kubePodCIDRWaitTimeout,
+		PodLookupTimeout:       opts.kubePodLookupTimeout,
+		SyncTimeout:            opts.kubeSyncTimeout,
+		EventDebounce:          opts.kubeEventDebounce,
+		DryRun:                 opts.kubeDryRun,
+		TolerateFailedPatch:    opts.kubeTolerantPatch,
+		LeaseNodeLabels:        opts.kubeLeaseNodeLabels,
+		LeaseNodeAnnotations:   opts.kubeLeaseNodeAnnos,
+		DrainTaints:            opts.kubeDrainTaints,
+		PodCIDRCheckWarnOnly:   opts.kubePodCIDRWarnOnly,
+		PublicIPFromInternalIP: opts.kubePublicIPFallback,
+		PublicIPAddressType:    opts.kubePublicIPAddrType,
+		ManagedNodeLabel:       opts.kubeManagedNodeLabel,
+		PolicyEnforcedLabel:    opts.kubePolicyLabel,
+		ExpireLeasesAfter:      opts.kubeExpireLeasesAfter,
+		CompressionThreshold:   opts.kubeCompressThreshold,
+		AcquireLeaseWindow:     opts.kubeAcquireWindow,
+		WatchdogTimeout:        opts.kubeInformerWatchdog,
+		UnhealthyTimeout:       opts.kubeUnhealthyTimeout,
+		ReconcileInterval:      opts.kubeReconcileInterval,
+		WatchBatchSize:         opts.kubeWatchBatchSize,
+	}
+}
+
+// dumpLeases prints the leases of all flannel managed nodes as JSON.
+func dumpLeases() error {
+	leases, err := kube.DumpLeases(context.Background(), kubeSubnetManagerConfig())
+	if err != nil {
+		return err
+	}
+	if leases == nil {
+		leases = []kube.LeaseInfo{}
+	}
+	b, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(b))
+	return err
+}
+
+func newSubnetManager(ctx context.Context) (subnet.Manager, error) {
 	if opts.kubeSubnetMgr {
-		return kube.NewSubnetManager(opts.kubeApiUrl, opts.kubeConfigFile)
+		return kube.NewSubnetManager(ctx, kubeSubnetManagerConfig())
 	}
 
 	cfg := &etcdv2.EtcdConfig{
@@ -177,6 +339,14 @@ func main() {
 
 	flagutil.SetFlagsFromEnv(flannelFlags, "FLANNELD")
 
+	if opts.kubeDumpLeases {
+		if err := dumpLeases(); err != nil {
+			log.Error("Failed to dump leases: ", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Validate flags
 	if opts.subnetLeaseRenewMargin >= 24*60 || opts.subnetLeaseRenewMargin <= 0 {
 		log.Error("Invalid subnet-lease-renew-margin option, out of acceptable range")
@@ -227,9 +397,17 @@ func main() {
 		}
 	}
 
-	sm, err := newSubnetManager()
+	// This is the main context that everything should run in.
+	// All spawned goroutines should exit when cancel is called on this context.
+	// Go routines spawned from main.go coordinate using a WaitGroup. This provides a mechanism to allow the shutdownHandler goroutine
+	// to block until all the goroutines return . If those goroutines spawn other goroutines then they are responsible for
+	// blocking and returning only when cancel() is called.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sm, err := newSubnetManager(ctx)
 	if err != nil {
 		log.Error("Failed to create SubnetManager: ", err)
+		cancel()
 		os.Exit(1)
 	}
 	log.Infof("Created subnet manager: %s", sm.Name())
@@ -239,12 +417,6 @@ func main() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 
-	// This is the main context that everything should run in.
-	// All spawned goroutines should exit when cancel is called on this context.
-	// Go routines spawned from main.go coordinate using a WaitGroup. This provides a mechanism to allow the shutdownHandler goroutine
-	// to block until all the goroutines return . If those goroutines spawn other goroutines then they are responsible for
-	// blocking and returning only when cancel() is called.
-	ctx, cancel := context.WithCancel(context.Background())
 	wg := sync.WaitGroup{}
 
 	wg.Add(1)
@@ -255,7 +427,10 @@ func main() {
 
 	if opts.healthzPort > 0 {
 		// It's not super easy to shutdown the HTTP server so don't attempt to stop it cleanly
-		go mustRunHealthz()
+		go mustRunHealthz(sm)
+	}
+	if opts.debugAddr != "" {
+		go runDebugServer(opts.debugAddr)
 	}
 
 	// Fetch the network config (i.e. what backend to use etc..).
@@ -308,6 +483,14 @@ func main() {
 		wg.Done()
 	}()
 
+	if w, ok := sm.(kube.NetConfWatcher); ok && opts.kubeNetConfRestart {
+		wg.Add(1)
+		go func() {
+			shutdownOnNetConfChange(ctx, w, cancel)
+			wg.Done()
+		}()
+	}
+
 	daemon.SdNotify(false, "READY=1")
 
 	// Kube subnet mgr doesn't lease the subnet for this node - it just uses the podCidr that's already assigned.
@@ -341,6 +524,17 @@ func shutdownHandler(ctx context.Context, sigs chan os.Signal, cancel context.Ca
 	signal.Stop(sigs)
 }
 
+// shutdownOnNetConfChange shuts flannel down once the network config changes,
+// for it to be restarted with the new one, e.g. by its DaemonSet.
+func shutdownOnNetConfChange(ctx context.Context, w kube.NetConfWatcher, cancel context.CancelFunc) {
+	select {
+	case <-ctx.Done():
+	case sc := <-w.NetConfChanges():
+		log.Infof("Network config changed - Network: %s, Backend type: %s, shutting down to apply it", sc.Network, sc.BackendType)
+		cancel()
+	}
+}
+
 func getConfig(ctx context.Context, sm subnet.Manager) (*subnet.Config, error) {
 	// Retry every second until it succeeds
 	for {
@@ -373,27 +567,42 @@ func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg
 	}()
 
 	renewMargin := time.Duration(opts.subnetLeaseRenewMargin) * time.Minute
-	dur := bn.Lease().Expiration.Sub(time.Now()) - renewMargin
+	// renew fires when the lease is due for renewal, never if it doesn't expire
+	var renew <-chan time.Time
+	renewBeforeExpiration := func() {
+		renew = nil
+		if !bn.Lease().Expires() {
+			log.Info("Lease never expires, not renewing it")
+			return
+		}
+		dur := bn.Lease().Expiration.Sub(time.Now()) - renewMargin
+		log.Infof("Waiting for %s to renew lease", dur)
+		renew = time.After(dur)
+	}
+	renewBeforeExpiration()
 
 	for {
 		select {
-		case <-time.After(dur):
+		case <-renew:
 			err := sm.RenewLease(ctx, bn.Lease())
 			if err != nil {
 				log.Error("Error renewing lease (trying again in 1 min): ", err)
-				dur = time.Minute
+				renew = time.After(time.Minute)
 				continue
 			}
 
 			log.Info("Lease renewed, new expiration: ", bn.Lease().Expiration)
-			dur = bn.Lease().Expiration.Sub(time.Now()) - renewMargin
+			renewBeforeExpiration()
 
 		case e := <-evts:
 			switch e.Type {
 			case subnet.EventAdded:
-				bn.Lease().Expiration = e.Lease.Expiration
-				dur = bn.Lease().Expiration.Sub(time.Now()) - renewMargin
-				log.Infof("Waiting for %s to renew lease", dur)
+				// Leases watched through the kube subnet manager don't carry
+				// the expiration, which is only known to the lease holder
+				if e.Lease.Expires() {
+					bn.Lease().Expiration = e.Lease.Expiration
+					renewBeforeExpiration()
+				}
 
 			case subnet.EventRemoved:
 				log.Error("Lease has been revoked. Shutting down daemon.")
@@ -543,21 +752,47 @@ func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network)
 	//TODO - is this safe? What if it's not on the same FS?
 }
 
-func mustRunHealthz() {
+func mustRunHealthz(sm subnet.Manager) {
 	address := net.JoinHostPort(opts.healthzIP, strconv.Itoa(opts.healthzPort))
 	log.Infof("Start healthz server on %s", address)
 
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+	// Not the default mux, which net/http/pprof registers the profiles on
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("flanneld is running"))
 	})
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	// Subnet managers that can tell whether they are keeping up get a readiness endpoint
+	if h, ok := sm.(interface {
+		HealthzHandler() http.HandlerFunc
+	}); ok {
+		mux.HandleFunc("/readyz", h.HealthzHandler())
+	}
 
-	if err := http.ListenAndServe(address, nil); err != nil {
+	if err := http.ListenAndServe(address, mux); err != nil {
 		log.Errorf("Start healthz server error. %v", err)
 		panic(err)
 	}
 }
 
+// runDebugServer serves the pprof profiles on address, e.g. the goroutine
+// dump of /debug/pprof/goroutine?debug=2 to find stuck lease watches. It's
+// only there for diagnosis, so flannel carries on if it fails.
+func runDebugServer(address string) {
+	log.Infof("Start debug server on %s", address)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Errorf("Debug server error: %v", err)
+	}
+}
+
 func ReadSubnetFromSubnetFile(path string) ip.IP4Net {
 	var prevSubnet ip.IP4Net
 	if _, err := os.Stat(path); !os.IsNotExist(err) {
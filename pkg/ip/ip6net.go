@@ -0,0 +1,141 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+)
+
+type IP6 [net.IPv6len]byte
+
+func FromIP6(ip net.IP) IP6 {
+	var ip6 IP6
+	copy(ip6[:], ip.To16())
+	return ip6
+}
+
+func ParseIP6(s string) (IP6, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return IP6{}, errors.New("Invalid IPv6 address format")
+	}
+	return FromIP6(ip), nil
+}
+
+func MustParseIP6(s string) IP6 {
+	ip, err := ParseIP6(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip
+}
+
+func (ip IP6) ToIP() net.IP {
+	return net.IP(ip[:])
+}
+
+func (ip IP6) String() string {
+	return ip.ToIP().String()
+}
+
+// json.Marshaler impl
+func (ip IP6) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, ip)), nil
+}
+
+// json.Unmarshaler impl
+func (ip *IP6) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if val, err := ParseIP6(string(j)); err != nil {
+		return err
+	} else {
+		*ip = val
+		return nil
+	}
+}
+
+// similar to net.IPNet but has a comparable representation
+type IP6Net struct {
+	IP        IP6
+	PrefixLen uint
+}
+
+func (n IP6Net) String() string {
+	return fmt.Sprintf("%s/%d", n.IP.String(), n.PrefixLen)
+}
+
+func FromIP6Net(n *net.IPNet) IP6Net {
+	prefixLen, _ := n.Mask.Size()
+	return IP6Net{
+		FromIP6(n.IP),
+		uint(prefixLen),
+	}
+}
+
+func (n IP6Net) ToIPNet() *net.IPNet {
+	return &net.IPNet{
+		IP:   n.IP.ToIP(),
+		Mask: net.CIDRMask(int(n.PrefixLen), 128),
+	}
+}
+
+func (n IP6Net) Network() IP6Net {
+	return FromIP6Net(&net.IPNet{
+		IP:   n.IP.ToIP().Mask(net.CIDRMask(int(n.PrefixLen), 128)),
+		Mask: net.CIDRMask(int(n.PrefixLen), 128),
+	})
+}
+
+func (n IP6Net) Overlaps(other IP6Net) bool {
+	prefixLen := n.PrefixLen
+	if other.PrefixLen < prefixLen {
+		prefixLen = other.PrefixLen
+	}
+	mask := net.CIDRMask(int(prefixLen), 128)
+	return n.IP.ToIP().Mask(mask).Equal(other.IP.ToIP().Mask(mask))
+}
+
+func (n IP6Net) Equal(other IP6Net) bool {
+	return n.IP == other.IP && n.PrefixLen == other.PrefixLen
+}
+
+func (n IP6Net) Contains(ip IP6) bool {
+	return n.ToIPNet().Contains(ip.ToIP())
+}
+
+func (n IP6Net) Empty() bool {
+	return n.IP == IP6{} && n.PrefixLen == uint(0)
+}
+
+// json.Marshaler impl
+func (n IP6Net) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, n)), nil
+}
+
+// json.Unmarshaler impl
+func (n *IP6Net) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if ip, val, err := net.ParseCIDR(string(j)); err != nil {
+		return err
+	} else if ip.To4() != nil {
+		return fmt.Errorf("%s is not an IPv6 network", j)
+	} else {
+		*n = FromIP6Net(val)
+		return nil
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func mkIP6Net(s string) IP6Net {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return FromIP6Net(n)
+}
+
+func TestIP6(t *testing.T) {
+	ip, err := ParseIP6("fd00::1")
+	if err != nil {
+		t.Fatal("ParseIP6 failed with: ", err)
+	}
+
+	if ip.String() != "fd00::1" {
+		t.Error("String failed")
+	}
+
+	if _, err := ParseIP6("1.2.3.4"); err == nil {
+		t.Error("ParseIP6 accepted an IPv4 address")
+	}
+
+	j, err := json.Marshal(ip)
+	if err != nil {
+		t.Error("Marshal of IP6 failed: ", err)
+	} else if string(j) != `"fd00::1"` {
+		t.Error("Marshal of IP6 failed with unexpected value: ", j)
+	}
+}
+
+func TestIP6Net(t *testing.T) {
+	n1 := mkIP6Net("fd00:10:244:1::/64")
+
+	if n1.ToIPNet().String() != "fd00:10:244:1::/64" {
+		t.Error("ToIPNet failed")
+	}
+
+	if !n1.Overlaps(n1) {
+		t.Errorf("%s does not overlap %s", n1, n1)
+	}
+
+	n2 := mkIP6Net("fd00:10:244::/48")
+	if !n1.Overlaps(n2) {
+		t.Errorf("%s does not overlap %s", n1, n2)
+	}
+
+	n2 = mkIP6Net("fd00:10:244:2::/64")
+	if n1.Overlaps(n2) {
+		t.Errorf("%s overlaps %s", n1, n2)
+	}
+
+	if !n1.Contains(MustParseIP6("fd00:10:244:1::5")) {
+		t.Error("Contains failed")
+	}
+
+	if n1.Contains(MustParseIP6("fd00:10:244:2::5")) {
+		t.Error("Contains failed")
+	}
+
+	j, err := json.Marshal(n1)
+	if err != nil {
+		t.Error("Marshal of IP6Net failed: ", err)
+	} else if string(j) != `"fd00:10:244:1::/64"` {
+		t.Error("Marshal of IP6Net failed with unexpected value: ", j)
+	}
+
+	var n3 IP6Net
+	if err := json.Unmarshal(j, &n3); err != nil {
+		t.Error("Unmarshal of IP6Net failed: ", err)
+	} else if !n3.Equal(n1) {
+		t.Errorf("Unmarshal of IP6Net returned %s, expected %s", n3, n1)
+	}
+}
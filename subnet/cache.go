@@ -0,0 +1,224 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// cacheHistory is how many lease events a CachingManager or CompositeManager
+// keeps for its watchers. A watcher that falls further behind gets a snapshot instead.
+const cacheHistory = 1000
+
+// CachingManager wraps a Manager for several consumers in one process. A
+// single watch of the wrapped manager's leases feeds a shared cache, from
+// which each WatchLeases caller gets a snapshot and then the events since,
+// and the network config is only fetched once. The other methods are passed
+// through.
+type CachingManager struct {
+	Manager
+
+	configMux sync.Mutex
+	config    *Config
+
+	mux     sync.Mutex
+	lw      leaseWatcher
+	history leaseHistory
+}
+
+// NewCachingManager returns a CachingManager wrapping m. It watches the leases
+// of m until ctx is done, after which its watches return ErrShuttingDown.
+func NewCachingManager(ctx context.Context, m Manager) *CachingManager {
+	c := &CachingManager{
+		Manager: m,
+		history: newLeaseHistory(),
+	}
+	go c.run(ctx)
+	return c
+}
+
+// GetNetworkConfig returns the network config of the wrapped manager, which is
+// only asked once it has returned a config. The config is shared by all
+// callers, who must not modify it.
+func (c *CachingManager) GetNetworkConfig(ctx context.Context) (*Config, error) {
+	c.configMux.Lock()
+	defer c.configMux.Unlock()
+	if c.config != nil {
+		return c.config, nil
+	}
+	config, err := c.Manager.GetNetworkConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.config = config
+	return config, nil
+}
+
+// WatchLeases watches the cached leases. The first call (nil cursor) returns
+// a snapshot of the current leases, waiting for the cache to be filled if need
+// be. Later calls, passing back the cursor returned by the previous one, wait
+// for the next events and return all of them since the cursor, or a snapshot
+// if the watch fell too far behind.
+func (c *CachingManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	return c.history.watch(ctx, &c.mux, cursor, func() []Lease {
+		return append([]Lease{}, c.lw.leases...)
+	})
+}
+
+// run feeds the cache from a watch of the wrapped manager until ctx is done
+// or the manager shuts down.
+func (c *CachingManager) run(ctx context.Context) {
+	err := watchSource(ctx, c.Manager, func(res LeaseWatchResult) {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		var batch []Event
+		if len(res.Events) > 0 {
+			batch = c.lw.update(res.Events)
+		} else {
+			batch = c.lw.reset(res.Snapshot)
+		}
+		c.history.add(batch)
+	})
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.history.stop(err)
+}
+
+// watchSource watches the leases of m, handing each result to handle, until
+// ctx is done or m shuts down. It then returns ErrShuttingDown. Other errors
+// are logged and the watch retried.
+func watchSource(ctx context.Context, m Manager, handle func(res LeaseWatchResult)) error {
+	var cursor interface{}
+	for {
+		res, err := m.WatchLeases(ctx, cursor)
+		if err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded || err == ErrShuttingDown {
+				return ErrShuttingDown
+			}
+
+			log.Errorf("Watch subnets: %v", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		cursor = res.Cursor
+		handle(res)
+	}
+}
+
+// leaseHistory holds the last lease events of a manager for its watchers,
+// which get a snapshot first and then the events since. It is guarded by a
+// mutex of its owner.
+type leaseHistory struct {
+	ready bool
+	// err ends the watches once they have caught up.
+	err error
+	// changed is closed, and replaced, whenever something changes.
+	changed chan struct{}
+	// events holds the last lease events; version is the number of events
+	// seen so far, and base the number seen before events[0].
+	events  []Event
+	base    uint64
+	version uint64
+}
+
+// historyCursor is the cursor handed out by leaseHistory watches: the number
+// of events seen.
+type historyCursor struct {
+	version uint64
+}
+
+func newLeaseHistory() leaseHistory {
+	return leaseHistory{changed: make(chan struct{})}
+}
+
+// watch returns a snapshot of the leases, from snapshot, for a nil cursor or
+// one that fell more than cacheHistory events behind, and otherwise waits for
+// the events after the cursor. It waits for the history to be ready, i.e.
+// for the first add, too. mux is the mutex guarding h, and is taken by watch.
+func (h *leaseHistory) watch(ctx context.Context, mux *sync.Mutex, cursor interface{}, snapshot func() []Lease) (LeaseWatchResult, error) {
+	var from *historyCursor
+	if cursor != nil {
+		hc, ok := cursor.(historyCursor)
+		if !ok {
+			return LeaseWatchResult{}, fmt.Errorf("invalid cursor %v", cursor)
+		}
+		from = &hc
+	}
+
+	mux.Lock()
+	for {
+		if h.ready {
+			switch {
+			case from == nil || from.version < h.base:
+				defer mux.Unlock()
+				return LeaseWatchResult{
+					Snapshot: snapshot(),
+					Cursor:   historyCursor{version: h.version},
+				}, nil
+			case from.version < h.version:
+				defer mux.Unlock()
+				return LeaseWatchResult{
+					Events: append([]Event(nil), h.events[from.version-h.base:]...),
+					Cursor: historyCursor{version: h.version},
+				}, nil
+			}
+		}
+		if h.err != nil {
+			defer mux.Unlock()
+			return LeaseWatchResult{}, h.err
+		}
+
+		changed := h.changed
+		mux.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return LeaseWatchResult{}, ctx.Err()
+		}
+		mux.Lock()
+	}
+}
+
+// add appends a batch of events, making the history ready.
+func (h *leaseHistory) add(batch []Event) {
+	h.events = append(h.events, batch...)
+	h.version += uint64(len(batch))
+	if n := len(h.events) - cacheHistory; n > 0 {
+		h.events = append([]Event(nil), h.events[n:]...)
+		h.base += uint64(n)
+	}
+	h.ready = true
+	h.notify()
+}
+
+// stop ends the watches with err.
+func (h *leaseHistory) stop(err error) {
+	h.err = err
+	h.notify()
+}
+
+// notify wakes up the waiting watches.
+func (h *leaseHistory) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// watchManager is a Manager whose lease watch hands out the results sent to
+// it, and whose network config calls are counted.
+type watchManager struct {
+	Manager
+	results       chan LeaseWatchResult
+	configCalls   int32
+	watchesOpened int32
+}
+
+func (m *watchManager) GetNetworkConfig(ctx context.Context) (*Config, error) {
+	atomic.AddInt32(&m.configCalls, 1)
+	return ParseConfig(`{"Network": "10.244.0.0/16"}`)
+}
+
+func (m *watchManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	if cursor == nil {
+		atomic.AddInt32(&m.watchesOpened, 1)
+	}
+	select {
+	case res, ok := <-m.results:
+		if !ok {
+			return LeaseWatchResult{}, ErrShuttingDown
+		}
+		return res, nil
+	case <-ctx.Done():
+		return LeaseWatchResult{}, ctx.Err()
+	}
+}
+
+func testLease(s string) Lease {
+	_, n, _ := net.ParseCIDR(s)
+	return Lease{Subnet: ip.FromIPNet(n)}
+}
+
+func watchOrFail(t *testing.T, m Manager, cursor interface{}) LeaseWatchResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := m.WatchLeases(ctx, cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	return res
+}
+
+func TestCachingManager(t *testing.T) {
+	m := &watchManager{results: make(chan LeaseWatchResult)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewCachingManager(ctx, m)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetNetworkConfig(ctx); err != nil {
+			t.Fatalf("GetNetworkConfig failed: %v", err)
+		}
+	}
+	if calls := atomic.LoadInt32(&m.configCalls); calls != 1 {
+		t.Errorf("expected the network config to be fetched once, got %d calls", calls)
+	}
+
+	m.results <- LeaseWatchResult{Snapshot: []Lease{testLease("10.244.1.0/24")}, Cursor: 1}
+
+	// Each subscriber gets a snapshot, then the events since
+	a := watchOrFail(t, c, nil)
+	b := watchOrFail(t, c, nil)
+	if len(a.Snapshot) != 1 || len(b.Snapshot) != 1 {
+		t.Fatalf("expected snapshots of one lease, got %v and %v", a.Snapshot, b.Snapshot)
+	}
+
+	m.results <- LeaseWatchResult{Events: []Event{{Type: EventAdded, Lease: testLease("10.244.2.0/24")}}, Cursor: 2}
+	m.results <- LeaseWatchResult{Events: []Event{{Type: EventRemoved, Lease: testLease("10.244.1.0/24")}}, Cursor: 3}
+	// This send only goes through once the removal has been cached
+	m.results <- LeaseWatchResult{Events: []Event{{Type: EventAdded, Lease: testLease("10.244.3.0/24")}}, Cursor: 4}
+
+	a = watchOrFail(t, c, a.Cursor)
+	if len(a.Events) < 2 || a.Events[0].Lease.Subnet.String() != "10.244.2.0/24" || a.Events[1].Type != EventRemoved {
+		t.Errorf("expected the added and removed leases, got %+v", a.Events)
+	}
+	for len(a.Events) < 3 {
+		res := watchOrFail(t, c, a.Cursor)
+		a.Events, a.Cursor = append(a.Events, res.Events...), res.Cursor
+	}
+	b = watchOrFail(t, c, b.Cursor)
+	for len(b.Events) < 3 {
+		res := watchOrFail(t, c, b.Cursor)
+		b.Events, b.Cursor = append(b.Events, res.Events...), res.Cursor
+	}
+	if len(a.Events) != 3 || len(b.Events) != 3 {
+		t.Errorf("expected both subscribers to see 3 events, got %+v and %+v", a.Events, b.Events)
+	}
+
+	// Late subscribers start from the current leases
+	res := watchOrFail(t, c, nil)
+	if len(res.Snapshot) != 2 {
+		t.Errorf("expected a snapshot of 2 leases, got %v", res.Snapshot)
+	}
+	if opened := atomic.LoadInt32(&m.watchesOpened); opened != 1 {
+		t.Errorf("expected a single watch of the wrapped manager, got %d", opened)
+	}
+
+	// Watches end once the wrapped manager shuts down
+	close(m.results)
+	wctx, wcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer wcancel()
+	if _, err := c.WatchLeases(wctx, res.Cursor); err != ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+}
+
+func TestCachingManagerFallBehind(t *testing.T) {
+	m := &watchManager{results: make(chan LeaseWatchResult)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewCachingManager(ctx, m)
+
+	m.results <- LeaseWatchResult{Snapshot: []Lease{}, Cursor: 0}
+	res := watchOrFail(t, c, nil)
+	for i := 0; i <= cacheHistory; i++ {
+		l := testLease("10.244.1.0/24")
+		et := EventAdded
+		if i%2 == 1 {
+			et = EventRemoved
+		}
+		m.results <- LeaseWatchResult{Events: []Event{{Type: et, Lease: l}}, Cursor: i}
+	}
+	// Wait for the last result to be taken in
+	m.results <- LeaseWatchResult{Events: []Event{{Type: EventAdded, Lease: testLease("10.244.2.0/24")}}}
+
+	res = watchOrFail(t, c, res.Cursor)
+	if res.Events != nil || res.Snapshot == nil {
+		t.Errorf("expected a snapshot after falling behind, got %+v", res)
+	}
+}
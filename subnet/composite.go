@@ -0,0 +1,230 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// CompositeManager gives a single view of the leases of several managers, e.g.
+// of etcd and Kubernetes while migrating from one to the other. WatchLeases
+// merges the leases of all of them: when several hold a lease for the same
+// subnet, the one of the manager coming first wins. The local lease is
+// acquired, renewed and watched through the first manager, which also tells
+// the capabilities.
+type CompositeManager struct {
+	managers []Manager
+
+	mux sync.Mutex
+	// sources holds the leases of each manager, and synced whether the
+	// watch of each has returned its first result yet.
+	sources []leaseWatcher
+	synced  []bool
+	history leaseHistory
+}
+
+// NewCompositeManager returns a CompositeManager over primary and others, in
+// order of precedence. It watches the leases of all of them until ctx is
+// done, or until one of them shuts down, after which its watches return
+// ErrShuttingDown.
+func NewCompositeManager(ctx context.Context, primary Manager, others ...Manager) *CompositeManager {
+	managers := append([]Manager{primary}, others...)
+	c := &CompositeManager{
+		managers: managers,
+		sources:  make([]leaseWatcher, len(managers)),
+		synced:   make([]bool, len(managers)),
+		history:  newLeaseHistory(),
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	for i, m := range managers {
+		go func(i int, m Manager) {
+			err := watchSource(ctx, m, func(res LeaseWatchResult) { c.update(i, res) })
+			cancel()
+			c.mux.Lock()
+			defer c.mux.Unlock()
+			c.history.stop(err)
+		}(i, m)
+	}
+	return c
+}
+
+// GetNetworkConfig returns the network config of the first manager, once it
+// checked that the others have the same network, subnet length and backend
+// type: their leases wouldn't mix otherwise.
+func (c *CompositeManager) GetNetworkConfig(ctx context.Context) (*Config, error) {
+	config, err := c.managers[0].GetNetworkConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range c.managers[1:] {
+		other, err := m.GetNetworkConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if diff := configDiff(config, other); len(diff) > 0 {
+			return nil, fmt.Errorf("network config of %s doesn't match that of %s: %s differ",
+				m.Name(), c.managers[0].Name(), strings.Join(diff, ", "))
+		}
+	}
+	return config, nil
+}
+
+// configDiff returns the settings that differ between a and b, of those that
+// matter for leases of one to be used along with those of the other.
+func configDiff(a, b *Config) []string {
+	var diff []string
+	if !a.Network.Equal(b.Network) {
+		diff = append(diff, "Network")
+	}
+	if a.SubnetLen != b.SubnetLen {
+		diff = append(diff, "SubnetLen")
+	}
+	if a.EnableIPv6 != b.EnableIPv6 {
+		diff = append(diff, "EnableIPv6")
+	}
+	if !a.IPv6Network.Equal(b.IPv6Network) {
+		diff = append(diff, "IPv6Network")
+	}
+	if a.BackendType != b.BackendType {
+		diff = append(diff, "BackendType")
+	}
+	return diff
+}
+
+func (c *CompositeManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Lease, error) {
+	return c.managers[0].AcquireLease(ctx, attrs)
+}
+
+func (c *CompositeManager) RenewLease(ctx context.Context, lease *Lease) error {
+	return c.managers[0].RenewLease(ctx, lease)
+}
+
+func (c *CompositeManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
+	return c.managers[0].WatchLease(ctx, sn, cursor)
+}
+
+// WatchLeases watches the merged leases. The first call (nil cursor) returns
+// a snapshot of the current leases, waiting for the watches of all managers
+// to return their first result if need be. Later calls, passing back the
+// cursor returned by the previous one, wait for the next events and return
+// all of them since the cursor, or a snapshot if the watch fell too far
+// behind.
+func (c *CompositeManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	return c.history.watch(ctx, &c.mux, cursor, c.merged)
+}
+
+func (c *CompositeManager) Capabilities() Capabilities {
+	return c.managers[0].Capabilities()
+}
+
+func (c *CompositeManager) Name() string {
+	names := make([]string, 0, len(c.managers))
+	for _, m := range c.managers {
+		names = append(names, m.Name())
+	}
+	return "Composite of " + strings.Join(names, ", ")
+}
+
+// update applies a watch result of manager i, turning the changes it makes
+// to the merged leases into events.
+func (c *CompositeManager) update(i int, res LeaseWatchResult) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	before := c.merged()
+	var batch []Event
+	if len(res.Events) > 0 {
+		batch = c.sources[i].update(res.Events)
+	} else {
+		batch = c.sources[i].reset(res.Snapshot)
+	}
+	c.synced[i] = true
+	for _, synced := range c.synced {
+		if !synced {
+			return
+		}
+	}
+	if !c.history.ready {
+		c.history.add(nil)
+		return
+	}
+
+	// A lease going away keeps the type of the event that removed it
+	removals := make(map[string]EventType)
+	for _, e := range batch {
+		if e.Type != EventAdded {
+			removals[leaseKey(&e.Lease)] = e.Type
+		}
+	}
+	after := c.merged()
+	old := make(map[string]Lease, len(before))
+	for _, l := range before {
+		old[leaseKey(&l)] = l
+	}
+	var events []Event
+	for _, l := range after {
+		k := leaseKey(&l)
+		if ol, ok := old[k]; !ok || !reflect.DeepEqual(ol, l) {
+			events = append(events, Event{Type: EventAdded, Lease: l})
+		}
+		delete(old, k)
+	}
+	for _, l := range before {
+		k := leaseKey(&l)
+		if _, ok := old[k]; !ok {
+			continue
+		}
+		et, ok := removals[k]
+		if !ok {
+			et = EventRemoved
+		}
+		events = append(events, Event{Type: et, Lease: l})
+	}
+	c.history.add(events)
+}
+
+// merged returns the leases of all managers, the first manager's winning
+// when several have a lease for a subnet. c.mux must be held.
+func (c *CompositeManager) merged() []Lease {
+	seen := make(map[string]bool)
+	leases := []Lease{}
+	for _, src := range c.sources {
+		for _, l := range src.leases {
+			k := leaseKey(&l)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			leases = append(leases, l)
+		}
+	}
+	return leases
+}
+
+// leaseKey identifies the subnet of l: its IPv4 subnet, or its IPv6 subnet
+// for IPv6 only leases.
+func leaseKey(l *Lease) string {
+	if l.Subnet.Empty() {
+		return l.IPv6Subnet.String()
+	}
+	return l.Subnet.String()
+}
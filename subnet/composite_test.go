@@ -0,0 +1,103 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// networkManager is a watchManager with a network config of its own.
+type networkManager struct {
+	*watchManager
+	network string
+}
+
+func (m *networkManager) GetNetworkConfig(ctx context.Context) (*Config, error) {
+	return ParseConfig(`{"Network": "` + m.network + `"}`)
+}
+
+func (m *networkManager) Name() string {
+	return "network " + m.network
+}
+
+func publicLease(sn, publicIP string) Lease {
+	l := testLease(sn)
+	l.Attrs.PublicIP = ip.MustParseIP4(publicIP)
+	return l
+}
+
+func TestCompositeManager(t *testing.T) {
+	a := &networkManager{&watchManager{results: make(chan LeaseWatchResult)}, "10.244.0.0/16"}
+	b := &networkManager{&watchManager{results: make(chan LeaseWatchResult)}, "10.244.0.0/16"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewCompositeManager(ctx, a, b)
+
+	if _, err := c.GetNetworkConfig(ctx); err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	// Composites have a watch of their own of each manager
+	same := &networkManager{&watchManager{results: make(chan LeaseWatchResult)}, "10.244.0.0/16"}
+	other := &networkManager{&watchManager{results: make(chan LeaseWatchResult)}, "10.245.0.0/16"}
+	if _, err := NewCompositeManager(ctx, same, other).GetNetworkConfig(ctx); err == nil {
+		t.Error("expected managers of different networks to be rejected")
+	}
+
+	a.results <- LeaseWatchResult{Snapshot: []Lease{publicLease("10.244.1.0/24", "192.168.0.1"), publicLease("10.244.2.0/24", "192.168.0.1")}}
+	b.results <- LeaseWatchResult{Snapshot: []Lease{publicLease("10.244.2.0/24", "192.168.0.2"), publicLease("10.244.3.0/24", "192.168.0.2")}}
+
+	// The first manager wins
+	res := watchOrFail(t, c, nil)
+	leases := make(map[string]string)
+	for _, l := range res.Snapshot {
+		leases[l.Subnet.String()] = l.Attrs.PublicIP.String()
+	}
+	if len(leases) != 3 || leases["10.244.2.0/24"] != "192.168.0.1" {
+		t.Errorf("expected 3 leases, 10.244.2.0/24 of the first manager, got %v", res.Snapshot)
+	}
+
+	// Once the first manager's lease goes away, the second one's shows
+	a.results <- LeaseWatchResult{Events: []Event{{Type: EventRemoved, Lease: publicLease("10.244.2.0/24", "192.168.0.1")}}}
+	b.results <- LeaseWatchResult{Events: []Event{{Type: EventExpired, Lease: publicLease("10.244.3.0/24", "192.168.0.2")}}}
+	var events []Event
+	for len(events) < 2 {
+		res = watchOrFail(t, c, res.Cursor)
+		events = append(events, res.Events...)
+	}
+	// The managers are watched independently, so the events come in any order
+	bySubnet := make(map[string]Event)
+	for _, e := range events {
+		bySubnet[e.Lease.Subnet.String()] = e
+	}
+	if e := bySubnet["10.244.2.0/24"]; len(events) != 2 || e.Type != EventAdded || e.Lease.Attrs.PublicIP.String() != "192.168.0.2" {
+		t.Errorf("expected the second manager's lease for 10.244.2.0/24 to be added, got %+v", events)
+	}
+	if e := bySubnet["10.244.3.0/24"]; e.Type != EventExpired {
+		t.Errorf("expected the lease for 10.244.3.0/24 to expire, got %+v", events)
+	}
+
+	// Watches end once a manager shuts down
+	close(b.results)
+	wctx, wcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer wcancel()
+	if _, err := c.WatchLeases(wctx, res.Cursor); err != ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+}
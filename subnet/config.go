@@ -18,6 +18,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/coreos/flannel/pkg/ip"
 )
@@ -29,6 +32,24 @@ type Config struct {
 	SubnetLen   uint
 	BackendType string          `json:"-"`
 	Backend     json.RawMessage `json:",omitempty"`
+	EnableIPv6  bool
+	IPv6Network ip.IP6Net
+	// AllowedBackends lists the backend types leases may use. Empty means
+	// any.
+	AllowedBackends []string `json:",omitempty"`
+}
+
+// BackendAllowed reports whether leases may use backend type bt.
+func (c *Config) BackendAllowed(bt string) bool {
+	if len(c.AllowedBackends) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedBackends {
+		if bt == allowed {
+			return true
+		}
+	}
+	return false
 }
 
 func parseBackendType(be json.RawMessage) (string, error) {
@@ -93,11 +114,77 @@ func ParseConfig(s string) (*Config, error) {
 		return nil, fmt.Errorf("SubnetMax is not on a SubnetLen boundary: %v", cfg.SubnetMax)
 	}
 
+	if cfg.EnableIPv6 && cfg.IPv6Network.Empty() {
+		return nil, errors.New("IPv6Network must be set when EnableIPv6 is true")
+	}
+
 	bt, err := parseBackendType(cfg.Backend)
 	if err != nil {
 		return nil, err
 	}
 	cfg.BackendType = bt
 
+	if !cfg.BackendAllowed(cfg.BackendType) {
+		return nil, fmt.Errorf("Backend type %q is not in AllowedBackends", cfg.BackendType)
+	}
+
 	return cfg, nil
 }
+
+// ParseConfigStrict parses s like ParseConfig, but rejects the top-level keys
+// that aren't settings, which ParseConfig ignores, so that typos such as
+// "SubentLen" are caught rather than silently falling back to the default.
+// Keys match settings regardless of case, as they do for ParseConfig. It also
+// returns warnings about settings that are accepted but likely don't do what
+// was meant.
+func ParseConfigStrict(s string) (*Config, []string, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &keys); err != nil {
+		return nil, nil, err
+	}
+	var unknown []string
+	for k := range keys {
+		if !isConfigKey(k) {
+			unknown = append(unknown, fmt.Sprintf("%q", k))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, nil, fmt.Errorf("unknown keys in network config: %s", strings.Join(unknown, ", "))
+	}
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	var warnings []string
+	if len(cfg.Backend) == 0 {
+		warnings = append(warnings, fmt.Sprintf("no Backend set, using backend type %q", cfg.BackendType))
+	} else if cfg.BackendType == "" {
+		warnings = append(warnings, "Backend has no Type")
+	}
+	if !cfg.EnableIPv6 && !cfg.IPv6Network.Empty() {
+		warnings = append(warnings, "IPv6Network is ignored unless EnableIPv6 is true")
+	}
+	return cfg, warnings, nil
+}
+
+// isConfigKey reports whether k names a setting of Config, as encoding/json
+// matches keys to fields.
+func isConfigKey(k string) bool {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
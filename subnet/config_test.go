@@ -15,6 +15,7 @@
 package subnet
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -69,3 +70,84 @@ func TestConfigOverrides(t *testing.T) {
 		t.Errorf("SubnetLen mismatch: expected 28, got %d", cfg.SubnetLen)
 	}
 }
+
+func TestConfigIPv6(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "EnableIPv6": true, "IPv6Network": "fd00:10:244::/56" }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if cfg.IPv6Network.String() != "fd00:10:244::/56" {
+		t.Errorf("IPv6Network mismatch: expected fd00:10:244::/56, got %s", cfg.IPv6Network)
+	}
+
+	s = `{ "Network": "10.3.0.0/16", "EnableIPv6": true }`
+	if _, err := ParseConfig(s); err == nil {
+		t.Error("ParseConfig accepted EnableIPv6 without an IPv6Network")
+	}
+}
+
+func TestConfigAllowedBackends(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan" }, "AllowedBackends": ["vxlan", "host-gw"] }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if !cfg.BackendAllowed("host-gw") {
+		t.Error("host-gw should be allowed")
+	}
+
+	if cfg.BackendAllowed("udp") {
+		t.Error("udp should not be allowed")
+	}
+
+	s = `{ "Network": "10.3.0.0/16", "Backend": { "Type": "udp" }, "AllowedBackends": ["vxlan"] }`
+	if _, err := ParseConfig(s); err == nil {
+		t.Error("ParseConfig accepted a backend type missing from AllowedBackends")
+	}
+
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if !cfg.BackendAllowed("anything") {
+		t.Error("an empty AllowedBackends should allow any backend")
+	}
+}
+
+func TestParseConfigStrict(t *testing.T) {
+	s := `{ "network": "10.3.0.0/16", "SubentLen": 28, "Backend": { "Type": "vxlan" } }`
+	if _, err := ParseConfig(s); err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if _, _, err := ParseConfigStrict(s); err == nil || !strings.Contains(err.Error(), `"SubentLen"`) {
+		t.Errorf("expected the unknown key to be rejected, got %v", err)
+	}
+
+	// Keys match regardless of case
+	s = `{ "network": "10.3.0.0/16", "subnetLen": 28, "Backend": { "Type": "vxlan" } }`
+	cfg, warnings, err := ParseConfigStrict(s)
+	if err != nil {
+		t.Fatalf("ParseConfigStrict failed: %s", err)
+	}
+	if cfg.SubnetLen != 28 || len(warnings) != 0 {
+		t.Errorf("unexpected SubnetLen %d or warnings %v", cfg.SubnetLen, warnings)
+	}
+
+	// The backend type isn't a key of its own
+	if _, _, err := ParseConfigStrict(`{ "Network": "10.3.0.0/16", "BackendType": "vxlan" }`); err == nil {
+		t.Error("expected BackendType to be rejected")
+	}
+
+	_, warnings, err = ParseConfigStrict(`{ "Network": "10.3.0.0/16", "IPv6Network": "fd00:10:244::/56" }`)
+	if err != nil {
+		t.Fatalf("ParseConfigStrict failed: %s", err)
+	}
+	if len(warnings) != 2 {
+		t.Errorf("expected warnings about the backend and IPv6Network, got %v", warnings)
+	}
+}
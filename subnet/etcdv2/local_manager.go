@@ -377,6 +377,10 @@ func isSubnetConfigCompat(config *Config, sn ip.IP4Net) bool {
 	return sn.PrefixLen == config.SubnetLen
 }
 
+func (m *LocalManager) Capabilities() Capabilities {
+	return Capabilities{SupportsRenew: true, SupportsSingleLeaseWatch: true}
+}
+
 func (m *LocalManager) Name() string {
 	previousSubnet := m.previousSubnet.String()
 	if m.previousSubnet.Empty() {
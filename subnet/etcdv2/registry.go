@@ -270,8 +270,8 @@ func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
 	switch resp.Action {
 	case "delete", "expire":
 		return Event{
-			EventRemoved,
-			Lease{Subnet: *sn},
+			Type:  EventRemoved,
+			Lease: Lease{Subnet: *sn},
 		}, nil
 
 	default:
@@ -287,8 +287,8 @@ func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
 		}
 
 		evt := Event{
-			EventAdded,
-			Lease{
+			Type: EventAdded,
+			Lease: Lease{
 				Subnet:     *sn,
 				Attrs:      *attrs,
 				Expiration: exp,
@@ -35,13 +35,13 @@ func newDummyRegistry() *MockSubnetRegistry {
 
 	subnets := []Lease{
 		// leases within SubnetMin-SubnetMax range
-		{ip.IP4Net{ip.MustParseIP4("10.3.1.0"), 24}, attrs, exp, 10},
-		{ip.IP4Net{ip.MustParseIP4("10.3.2.0"), 24}, attrs, exp, 11},
-		{ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}, attrs, exp, 12},
-		{ip.IP4Net{ip.MustParseIP4("10.3.5.0"), 24}, attrs, exp, 13},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.1.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 10},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.2.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 11},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 12},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.5.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 13},
 
 		// hand created lease outside the range of subnetMin-SubnetMax for testing removal
-		{ip.IP4Net{ip.MustParseIP4("10.3.31.0"), 24}, attrs, exp, 13},
+		{Subnet: ip.IP4Net{ip.MustParseIP4("10.3.31.0"), 24}, Attrs: attrs, Expiration: exp, Asof: 13},
 	}
 
 	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0" }`
@@ -296,6 +296,9 @@ func TestRenewLease(t *testing.T) {
 
 	fakeClock.Advance(24 * time.Hour)
 
+	if !sm.Capabilities().SupportsRenew {
+		t.Fatal("expected renewing to be supported")
+	}
 	if err := sm.RenewLease(ctx, l); err != nil {
 		t.Fatal("RenewLease failed: ", err)
 	}
@@ -0,0 +1,93 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/subnet"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// acquireCache remembers the latest lease acquisition, so AcquireLease calls
+// repeating it within the acquire window return its lease without reading or
+// patching the node. Callers reconciling in a tight loop would hammer the API
+// server otherwise. The acquisition is forgotten as soon as the local node
+// stops handing out its lease, e.g. because its pod CIDR or annotations
+// changed behind flannel's back, and when the lease is released.
+type acquireCache struct {
+	mux    sync.Mutex
+	window time.Duration
+	// attrs are those AcquireLease was called with, and lease the lease
+	// it returned, attributes as set by the acquisition. lease is nil if
+	// there is nothing to hand out again.
+	attrs subnet.LeaseAttrs
+	lease *subnet.Lease
+	at    time.Time
+}
+
+// get returns a copy of the lease acquired with attrs less than the window
+// before now, nil if there is none.
+func (c *acquireCache) get(attrs *subnet.LeaseAttrs, now time.Time) *subnet.Lease {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.lease == nil || now.Sub(c.at) >= c.window || !reflect.DeepEqual(*attrs, c.attrs) {
+		return nil
+	}
+	l := *c.lease
+	return &l
+}
+
+// put remembers that acquiring a lease with attrs returned l at now.
+func (c *acquireCache) put(attrs subnet.LeaseAttrs, l *subnet.Lease, now time.Time) {
+	if c.window <= 0 {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	cl := *l
+	c.attrs, c.lease, c.at = attrs, &cl, now
+}
+
+func (c *acquireCache) forget() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.lease = nil
+}
+
+// noteLocalNode forgets the remembered acquisition unless n, the local node
+// as just seen by the informer, still hands out its lease. Nodes other than
+// the local one are ignored.
+func (ksm *kubeSubnetManager) noteLocalNode(n *v1.Node, removed bool) {
+	if n.ObjectMeta.Name != ksm.nodeName {
+		return
+	}
+	c := &ksm.acquired
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.lease == nil {
+		return
+	}
+	if removed || n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" {
+		c.lease = nil
+		return
+	}
+	if l, err := ksm.nodeToLease(*n); err != nil || !sameLease(&l, c.lease) {
+		c.lease = nil
+	}
+}
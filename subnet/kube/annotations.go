@@ -0,0 +1,74 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const DefaultAnnotationPrefix = "flannel.alpha.coreos.com"
+
+// annotations holds the node annotation keys used by a kube subnet manager.
+// They all share a prefix so that several flannel daemons managing different
+// networks can annotate the same nodes without stepping on each other.
+type annotations struct {
+	SubnetKubeManaged          string
+	BackendData                string
+	BackendDataEncoding        string
+	BackendV6Data              string
+	BackendType                string
+	BackendTypeOverride        string
+	BackendConfigOverride      string
+	PolicyEnforced             string
+	BackendPublicIP            string
+	BackendPublicIPOverwrite   string
+	BackendPublicIPv6          string
+	BackendPublicIPv6Overwrite string
+	AllowUnroutablePublicIP    string
+	MTUOverride                string
+	SubnetOverride             string
+	PreferredSubnet            string
+	Version                    string
+}
+
+func newAnnotations(prefix string) (annotations, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if errs := validation.IsDNS1123Subdomain(prefix); len(errs) > 0 {
+		return annotations{}, fmt.Errorf("invalid annotation prefix %q: %s", prefix, strings.Join(errs, ", "))
+	}
+
+	return annotations{
+		SubnetKubeManaged:          prefix + "/kube-subnet-manager",
+		BackendData:                prefix + "/backend-data",
+		BackendDataEncoding:        prefix + "/backend-data-encoding",
+		BackendV6Data:              prefix + "/backend-data-v6",
+		BackendType:                prefix + "/backend-type",
+		BackendTypeOverride:        prefix + "/backend-type-override",
+		BackendConfigOverride:      prefix + "/backend-config-override",
+		PolicyEnforced:             prefix + "/network-policy-enforced",
+		BackendPublicIP:            prefix + "/public-ip",
+		BackendPublicIPOverwrite:   prefix + "/public-ip-overwrite",
+		BackendPublicIPv6:          prefix + "/public-ipv6",
+		BackendPublicIPv6Overwrite: prefix + "/public-ipv6-overwrite",
+		AllowUnroutablePublicIP:    prefix + "/allow-unroutable-public-ip",
+		MTUOverride:                prefix + "/mtu-override",
+		SubnetOverride:             prefix + "/subnet-override",
+		PreferredSubnet:            prefix + "/preferred-subnet",
+		Version:                    prefix + "/version",
+	}, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// Kinds of backend settings, as decoded from JSON.
+const (
+	settingInt  = "integer"
+	settingBool = "boolean"
+	settingAny  = "any"
+)
+
+// backendSettings are the known backend types, which a backend-type-override
+// annotation may select, along with the settings of their Backend section
+// that a backend-config-override annotation may set, and their kinds. Node
+// annotations are no place for credentials, and may be written by more than
+// the cluster admins, so neither the ali-vpc keys nor the extension commands
+// can be overridden.
+var backendSettings = map[string]map[string]string{
+	"alloc":     {},
+	"ali-vpc":   {},
+	"aws-vpc":   {"RouteTableID": settingAny},
+	"extension": {},
+	"gce":       {},
+	"host-gw":   {},
+	"ipip":      {"DirectRouting": settingBool},
+	"udp":       {"Port": settingInt},
+	"vxlan":     {"VNI": settingInt, "Port": settingInt, "GBP": settingBool, "DirectRouting": settingBool},
+}
+
+// withBackendConfig returns a copy of sc whose Backend section has the
+// settings of override, a JSON object, merged in. The settings must be known
+// settings of sc's backend type, of the right kind.
+func withBackendConfig(sc *subnet.Config, override string) (*subnet.Config, error) {
+	var o map[string]interface{}
+	if err := json.Unmarshal([]byte(override), &o); err != nil || o == nil {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	settings := backendSettings[sc.BackendType]
+	names := make([]string, 0, len(o))
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kind, ok := settings[name]
+		if !ok {
+			if name == "Type" {
+				return nil, fmt.Errorf("the backend type can't be set, use the backend-type-override annotation")
+			}
+			return nil, fmt.Errorf("%s is not a setting of backend type %q", name, sc.BackendType)
+		}
+		if !isSettingKind(o[name], kind) {
+			return nil, fmt.Errorf("setting %s of backend type %q must be of type %s", name, sc.BackendType, kind)
+		}
+	}
+
+	be := map[string]interface{}{}
+	if len(sc.Backend) > 0 {
+		if err := json.Unmarshal(sc.Backend, &be); err != nil {
+			return nil, fmt.Errorf("error decoding Backend property of config: %v", err)
+		}
+	}
+	for name, v := range o {
+		be[name] = v
+	}
+	backend, err := json.Marshal(be)
+	if err != nil {
+		return nil, err
+	}
+
+	c := *sc
+	c.Backend = backend
+	return &c, nil
+}
+
+// isSettingKind reports whether the decoded JSON value v is of kind.
+func isSettingKind(v interface{}, kind string) bool {
+	switch kind {
+	case settingInt:
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case settingBool:
+		_, ok := v.(bool)
+		return ok
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// The backend data of some backends grows with the cluster, and the
+// annotations of a node may not exceed 256KiB altogether. Backend data above a
+// threshold can be written gzip compressed and base64 encoded instead of as
+// plain JSON, which the backend data encoding annotation tells. Every manager
+// decodes it, whether or not it compresses what it writes.
+
+// BackendDataEncodingGzip is the encoding of gzip compressed, base64 encoded
+// backend data.
+const BackendDataEncodingGzip = "gzip+base64"
+
+// maxBackendDataSize bounds decompressed backend data, so a malicious
+// annotation can't exhaust memory.
+const maxBackendDataSize = 4 << 20
+
+// encodeBackendData returns the annotation value and encoding of backend data
+// bd: gzip compressed if threshold is positive and bd larger than it, plain
+// with an empty encoding otherwise.
+func encodeBackendData(bd []byte, threshold int) (string, string, error) {
+	if threshold <= 0 || len(bd) <= threshold {
+		return string(bd), "", nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(bd); err != nil {
+		return "", "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), BackendDataEncodingGzip, nil
+}
+
+// decodeBackendData returns the backend data held by annotation value v of
+// the given encoding.
+func decodeBackendData(v, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(v), nil
+	case BackendDataEncodingGzip:
+		compressed, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		bd, err := ioutil.ReadAll(io.LimitReader(r, maxBackendDataSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(bd) > maxBackendDataSize {
+			return nil, fmt.Errorf("backend data exceeds %d bytes", maxBackendDataSize)
+		}
+		return bd, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+// nodeBackendData returns the backend data of n, decoded.
+func (ksm *kubeSubnetManager) nodeBackendData(n *v1.Node) ([]byte, error) {
+	return decodeBackendData(n.Annotations[ksm.annotations.BackendData], n.Annotations[ksm.annotations.BackendDataEncoding])
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+)
+
+// The vendored client library reads client certificate files once, when the
+// transport is built. A daemon running for months outlives its certificate if
+// it is rotated on disk, so client certificates given as files are read again
+// whenever a connection is made, and used if they changed.
+
+// certReloader hands out the client certificate in certFile and keyFile,
+// reloading it when the files change. A pair that fails to load, e.g. because
+// only one of the files has been replaced yet, is ignored until it loads.
+type certReloader struct {
+	certFile, keyFile string
+
+	mux      sync.Mutex
+	cert     *tls.Certificate
+	certData []byte
+	keyData  []byte
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate if the files changed. r.mux must be held, or r
+// not shared yet.
+func (r *certReloader) reload() error {
+	certData, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyData, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && bytes.Equal(certData, r.certData) && bytes.Equal(keyData, r.keyData) {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate %s: %v", r.certFile, err)
+	}
+	if r.cert != nil {
+		glog.Infof("Client certificate %s changed, using it for new connections", r.certFile)
+	}
+	r.cert, r.certData, r.keyData = &cert, certData, keyData
+	return nil
+}
+
+// getClientCertificate is a tls.Config GetClientCertificate.
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if err := r.reload(); err != nil {
+		glog.Warningf("Keeping the current client certificate: %v", err)
+	}
+	return r.cert, nil
+}
+
+// reloadClientCert makes cfg read its client certificate files again when
+// they change, by giving it a transport of its own. Configs with certificate
+// data, or a transport already, are left alone.
+func reloadClientCert(cfg *rest.Config) error {
+	if cfg.CertFile == "" || cfg.KeyFile == "" || len(cfg.CertData) > 0 || len(cfg.KeyData) > 0 || cfg.Transport != nil {
+		return nil
+	}
+	r, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	// The rest of the TLS config is built as the client library would
+	tc := *cfg
+	tc.CertFile, tc.KeyFile = "", ""
+	tlsConfig, err := rest.TLSConfigFor(&tc)
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	tlsConfig.GetClientCertificate = r.getClientCertificate
+
+	cfg.Transport = utilnet.SetTransportDefaults(&http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 25,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+	})
+	cfg.TLSClientConfig = rest.TLSClientConfig{}
+	return nil
+}
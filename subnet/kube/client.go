@@ -0,0 +1,326 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/coreos/flannel/version"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+// The typed clients of the vendored client-go don't take a context, so the
+// calls the manager makes outside of the informer go through the REST client,
+// whose requests do. Nodes are read as JSON and decoded by decodeNode, which
+// keeps the pod CIDRs the vendored types have no field for. Each call is bounded by a timeout so a hung API server
+// produces an error instead of blocking flannel.
+
+const DefaultAPITimeout = 30 * time.Second
+
+// Flannel makes few requests once running: a single node watch, and patches
+// and events of its own node. The burst leaves room for the calls it makes
+// when starting up.
+const (
+	DefaultQPS   float32 = 5
+	DefaultBurst         = 20
+)
+
+// setRateLimits sets the client rate limits of cfg from config.
+func setRateLimits(cfg *rest.Config, config *SubnetManagerConfig, log Logger) {
+	cfg.QPS = config.QPS
+	switch {
+	case cfg.QPS == 0:
+		cfg.QPS = DefaultQPS
+	case cfg.QPS < 0:
+		log.Warningf("Invalid QPS %v, using default of %v", cfg.QPS, DefaultQPS)
+		cfg.QPS = DefaultQPS
+	}
+	cfg.Burst = config.Burst
+	switch {
+	case cfg.Burst == 0:
+		cfg.Burst = DefaultBurst
+	case cfg.Burst < 0:
+		log.Warningf("Invalid burst %v, using default of %v", cfg.Burst, DefaultBurst)
+		cfg.Burst = DefaultBurst
+	}
+	log.Infof("Limiting Kubernetes API requests to %v per second, bursts of %d", cfg.QPS, cfg.Burst)
+}
+
+// setUserAgent sets the user agent of cfg to that of config, or else to the
+// one cfg has, or else to the default one for nodeName, empty if not known
+// yet. It reports whether the user agent is a custom one.
+func setUserAgent(cfg *rest.Config, config *SubnetManagerConfig, nodeName string) bool {
+	if config.UserAgent != "" {
+		cfg.UserAgent = config.UserAgent
+		return true
+	}
+	if config.RestConfig != nil && config.RestConfig.UserAgent != "" {
+		return true
+	}
+	cfg.UserAgent = defaultUserAgent(nodeName)
+	return false
+}
+
+// defaultUserAgent returns the user agent of flannel on nodeName, in the
+// form client-go uses for Kubernetes components.
+func defaultUserAgent(nodeName string) string {
+	agent := fmt.Sprintf("flanneld/%s (%s/%s)", version.Version, runtime.GOOS, runtime.GOARCH)
+	if nodeName != "" {
+		agent += " node/" + nodeName
+	}
+	return agent
+}
+
+// restConfig returns the client config selected by config.
+func restConfig(config *SubnetManagerConfig) (*rest.Config, error) {
+	if config.RestConfig != nil {
+		cfg := *config.RestConfig
+		return &cfg, nil
+	}
+	// Use out of cluster config if the URL or kubeconfig have been specified. Otherwise use incluster config.
+	if config.ApiUrl == "" && config.Kubeconfig == "" {
+		cfg, err := inClusterConfig(config.TokenFile, config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize inclusterconfig: %v", err)
+		}
+		return cfg, nil
+	}
+
+	cfg, err := clientcmd.BuildConfigFromFlags(config.ApiUrl, config.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create k8s config: %v", err)
+	}
+	if err := reloadClientCert(cfg); err != nil {
+		return nil, fmt.Errorf("unable to create k8s config: %v", err)
+	}
+	if config.Kubeconfig == "" {
+		return cfg, nil
+	}
+	ec, err := kubeconfigExec(config.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create k8s config: %v", err)
+	}
+	if ec != nil {
+		creds := newExecCredentials(ec)
+		if wrap := cfg.WrapTransport; wrap != nil {
+			cfg.WrapTransport = func(rt http.RoundTripper) http.RoundTripper { return creds.wrap(wrap(rt)) }
+		} else {
+			cfg.WrapTransport = creds.wrap
+		}
+	}
+	return cfg, nil
+}
+
+// apiCall runs call with a context that expires after timeout, and says so if
+// that's why it failed.
+func apiCall(ctx context.Context, timeout time.Duration, what string, call func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := call(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s: no response from the API server within %v: %v", what, timeout, err)
+	}
+	return err
+}
+
+func getPod(ctx context.Context, c clientset.Interface, timeout time.Duration, namespace, name string) (*v1.Pod, error) {
+	result := &v1.Pod{}
+	err := apiCall(ctx, timeout, fmt.Sprintf("get pod %s/%s", namespace, name), func(ctx context.Context) error {
+		return c.CoreV1().RESTClient().Get().Context(ctx).
+			Namespace(namespace).Resource("pods").Name(name).
+			Do().Into(result)
+	})
+	return result, err
+}
+
+func getNode(ctx context.Context, c clientset.Interface, timeout time.Duration, name string) (*v1.Node, error) {
+	var result *v1.Node
+	err := apiCall(ctx, timeout, fmt.Sprintf("get node %q", name), func(ctx context.Context) error {
+		data, err := c.CoreV1().RESTClient().Get().Context(ctx).
+			Resource("nodes").Name(name).
+			SetHeader("Accept", "application/json").
+			Do().Raw()
+		if err != nil {
+			return err
+		}
+		result, err = decodeNode(data)
+		return err
+	})
+	return result, err
+}
+
+func listNodes(ctx context.Context, c clientset.Interface, timeout time.Duration) (*v1.NodeList, error) {
+	var result *v1.NodeList
+	err := apiCall(ctx, timeout, "list nodes", func(ctx context.Context) error {
+		data, err := c.CoreV1().RESTClient().Get().Context(ctx).
+			Resource("nodes").
+			SetHeader("Accept", "application/json").
+			Do().Raw()
+		if err != nil {
+			return err
+		}
+		result, err = decodeNodeList(data)
+		return err
+	})
+	return result, err
+}
+
+// listNodesWithOptions and watchNodes are the list and watch of the node
+// informers, which hand them no context.
+func listNodesWithOptions(c clientset.Interface, options metav1.ListOptions) (*v1.NodeList, error) {
+	data, err := c.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		VersionedParams(&options, scheme.ParameterCodec).
+		SetHeader("Accept", "application/json").
+		Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	return decodeNodeList(data)
+}
+
+func watchNodes(c clientset.Interface, options metav1.ListOptions) (watch.Interface, error) {
+	options.Watch = true
+	body, err := c.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		VersionedParams(&options, scheme.ParameterCodec).
+		SetHeader("Accept", "application/json").
+		Stream()
+	if err != nil {
+		return nil, err
+	}
+	return watch.NewStreamWatcher(newNodeWatchDecoder(body)), nil
+}
+
+func patchNode(ctx context.Context, c clientset.Interface, timeout time.Duration, name string, pt types.PatchType, data []byte) (*v1.Node, error) {
+	var result *v1.Node
+	err := apiCall(ctx, timeout, fmt.Sprintf("patch node %q", name), func(ctx context.Context) error {
+		raw, err := c.CoreV1().RESTClient().Patch(pt).Context(ctx).
+			Resource("nodes").Name(name).Body(data).
+			SetHeader("Accept", "application/json").
+			Do().Raw()
+		if err != nil {
+			return err
+		}
+		result, err = decodeNode(raw)
+		return err
+	})
+	return result, err
+}
+
+func createEvent(ctx context.Context, c clientset.Interface, timeout time.Duration, e *v1.Event) (*v1.Event, error) {
+	result := &v1.Event{}
+	err := apiCall(ctx, timeout, fmt.Sprintf("create event %s/%s", e.Namespace, e.Name), func(ctx context.Context) error {
+		return c.CoreV1().RESTClient().Post().Context(ctx).
+			Namespace(e.Namespace).Resource("events").Body(e).
+			Do().Into(result)
+	})
+	return result, err
+}
+
+func getConfigMap(ctx context.Context, c clientset.Interface, timeout time.Duration, namespace, name string) (*v1.ConfigMap, error) {
+	result := &v1.ConfigMap{}
+	err := apiCall(ctx, timeout, fmt.Sprintf("get configmap %s/%s", namespace, name), func(ctx context.Context) error {
+		return c.CoreV1().RESTClient().Get().Context(ctx).
+			Namespace(namespace).Resource("configmaps").Name(name).
+			Do().Into(result)
+	})
+	return result, err
+}
+
+func createConfigMap(ctx context.Context, c clientset.Interface, timeout time.Duration, cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	result := &v1.ConfigMap{}
+	err := apiCall(ctx, timeout, fmt.Sprintf("create configmap %s/%s", cm.Namespace, cm.Name), func(ctx context.Context) error {
+		return c.CoreV1().RESTClient().Post().Context(ctx).
+			Namespace(cm.Namespace).Resource("configmaps").Body(cm).
+			Do().Into(result)
+	})
+	return result, err
+}
+
+func updateConfigMap(ctx context.Context, c clientset.Interface, timeout time.Duration, cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	result := &v1.ConfigMap{}
+	err := apiCall(ctx, timeout, fmt.Sprintf("update configmap %s/%s", cm.Namespace, cm.Name), func(ctx context.Context) error {
+		return c.CoreV1().RESTClient().Put().Context(ctx).
+			Namespace(cm.Namespace).Resource("configmaps").Name(cm.Name).Body(cm).
+			Do().Into(result)
+	})
+	return result, err
+}
+
+// DefaultServiceAccountDir is where the service account token and CA
+// certificate are mounted in pods.
+const DefaultServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// inClusterConfig is rest.InClusterConfig with the token and CA certificate
+// read from tokenFile and caFile, if set. A CA certificate that was asked for
+// must load; the default one is optional, as with rest.InClusterConfig.
+func inClusterConfig(tokenFile, caFile string) (*rest.Config, error) {
+	if tokenFile == "" && caFile == "" {
+		return rest.InClusterConfig()
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("unable to load in-cluster configuration, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
+	}
+
+	if tokenFile == "" {
+		tokenFile = filepath.Join(DefaultServiceAccountDir, "token")
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %v", err)
+	}
+
+	tlsClientConfig := rest.TLSClientConfig{}
+	if caFile != "" {
+		if _, err := certutil.NewPool(caFile); err != nil {
+			return nil, fmt.Errorf("failed to load CA certificate: %v", err)
+		}
+		tlsClientConfig.CAFile = caFile
+	} else {
+		caFile = filepath.Join(DefaultServiceAccountDir, "ca.crt")
+		if _, err := certutil.NewPool(caFile); err != nil {
+			glog.Errorf("Expected to load root CA config from %s, but got err: %v", caFile, err)
+		} else {
+			tlsClientConfig.CAFile = caFile
+		}
+	}
+
+	return &rest.Config{
+		Host:            "https://" + net.JoinHostPort(host, port),
+		BearerToken:     string(token),
+		TLSClientConfig: tlsClientConfig,
+	}, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// maxClockSkew is how far the local clock may be off the API server's before
+// it is worth a warning.
+const maxClockSkew = 10 * time.Second
+
+// serverClock tells the time by the API server's clock, estimated from the
+// Date header of its responses, so lease expirations of all nodes are on the
+// same clock even if the nodes' clocks disagree. Until a response has been
+// seen, or if the server sends no Date header, it falls back to the local
+// clock. The header only has second precision, which is plenty for
+// expirations hours away.
+type serverClock struct {
+	log Logger
+
+	// offset is the server's clock minus the local one, in nanoseconds, and
+	// known is 1 once it has been measured. Accessed atomically.
+	offset int64
+	known  int32
+	// skewed is 1 while the offset is beyond maxClockSkew. Accessed
+	// atomically.
+	skewed int32
+}
+
+// now returns the current time by the server's clock. A nil clock is the
+// local one.
+func (c *serverClock) now() time.Time {
+	if c == nil || atomic.LoadInt32(&c.known) == 0 {
+		return time.Now()
+	}
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&c.offset)))
+}
+
+// observe records the offset of the server's clock, warning when it starts
+// or stops being beyond maxClockSkew.
+func (c *serverClock) observe(offset time.Duration) {
+	atomic.StoreInt64(&c.offset, int64(offset))
+	atomic.StoreInt32(&c.known, 1)
+
+	var skewed int32
+	if offset > maxClockSkew || offset < -maxClockSkew {
+		skewed = 1
+	}
+	if atomic.SwapInt32(&c.skewed, skewed) == skewed {
+		return
+	}
+	if skewed == 1 {
+		c.log.Warningf("Local clock is %v off the API server's, using the API server's for lease expirations", offset)
+	} else {
+		c.log.Infof("Local clock is back in line with the API server's")
+	}
+}
+
+// wrap returns rt measuring the server's clock from each response it passes
+// on. It fits rest.Config.WrapTransport.
+func (c *serverClock) wrap(rt http.RoundTripper) http.RoundTripper {
+	return &clockRoundTripper{rt: rt, clock: c}
+}
+
+type clockRoundTripper struct {
+	rt    http.RoundTripper
+	clock *serverClock
+}
+
+func (t *clockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	sent := time.Now()
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		// The server read its clock somewhere between sending and
+		// receiving, and truncated it to the second.
+		received := time.Now()
+		local := sent.Add(received.Sub(sent) / 2)
+		t.clock.observe(date.Add(500 * time.Millisecond).Sub(local))
+	}
+	return resp, nil
+}
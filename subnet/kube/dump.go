@@ -0,0 +1,108 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/coreos/flannel/subnet"
+
+	"golang.org/x/net/context"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+// LeaseInfo describes the lease of a node, as printed by DumpLeases callers.
+type LeaseInfo struct {
+	Node        string `json:"node"`
+	Subnet      string `json:"subnet,omitempty"`
+	IPv6Subnet  string `json:"ipv6Subnet,omitempty"`
+	PublicIP    string `json:"publicIP,omitempty"`
+	PublicIPv6  string `json:"publicIPv6,omitempty"`
+	BackendType string `json:"backendType"`
+	// Expiration is unset for leases that never expire, which is the case
+	// of all leases read from nodes: they last as long as their node.
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+// DumpLeases returns the leases of all flannel managed nodes, sorted by node
+// name. It connects to the API server as NewSubnetManager does, but only
+// lists the nodes once: it neither resolves the local node nor modifies any
+// node, so it is safe to run from anywhere. Nodes whose lease can't be read
+// are skipped with a warning.
+func DumpLeases(ctx context.Context, config *SubnetManagerConfig) ([]LeaseInfo, error) {
+	cfg, err := restConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	log := config.Logger
+	if log == nil {
+		log = glogLogger{}
+	}
+	setRateLimits(cfg, config, log)
+	setUserAgent(cfg, config, "")
+	c, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize client: %v", err)
+	}
+	return dumpLeases(ctx, c, config)
+}
+
+func dumpLeases(ctx context.Context, c clientset.Interface, config *SubnetManagerConfig) ([]LeaseInfo, error) {
+	// The network config is left out: the nodes' leases are dumped as they
+	// are, whatever backends or address families it allows.
+	ksm, err := newKubeSubnetManager(c, &subnet.Config{EnableIPv6: true}, "", config)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := listNodes(ctx, c, ksm.apiTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	var infos []LeaseInfo
+	for i := range nodes.Items {
+		n := &nodes.Items[i]
+		if n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" || ksm.drainTaint(n) != "" {
+			continue
+		}
+		l, err := ksm.nodeToLease(*n)
+		if err != nil {
+			ksm.log.WithValues("node", n.Name).Warningf("Skipping lease of node %q: %v", n.Name, err)
+			continue
+		}
+		info := LeaseInfo{Node: n.Name, BackendType: l.Attrs.BackendType}
+		if !l.Subnet.Empty() {
+			info.Subnet = l.Subnet.String()
+		}
+		if !l.IPv6Subnet.Empty() {
+			info.IPv6Subnet = l.IPv6Subnet.String()
+		}
+		if l.Attrs.PublicIP != 0 {
+			info.PublicIP = l.Attrs.PublicIP.String()
+		}
+		if l.Attrs.PublicIPv6 != nil {
+			info.PublicIPv6 = l.Attrs.PublicIPv6.String()
+		}
+		if !l.Expiration.IsZero() {
+			exp := l.Expiration
+			info.Expiration = &exp
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Node < infos[j].Node })
+	return infos, nil
+}
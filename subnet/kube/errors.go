@@ -0,0 +1,75 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The reasons NewSubnetManager fails for. The errors it returns are
+// *InitError values carrying one of them as Reason.
+var (
+	// ErrClientInit means no Kubernetes client could be set up from the
+	// kubeconfig, API URL or in cluster config.
+	ErrClientInit = errors.New("kubernetes client initialization failed")
+	// ErrNodeNameUnresolved means the name of the node flannel runs on
+	// couldn't be determined.
+	ErrNodeNameUnresolved = errors.New("node name unresolved")
+	// ErrConfigRead means the network config couldn't be read or parsed.
+	ErrConfigRead = errors.New("network config unreadable")
+	// ErrInvalidConfig means the SubnetManagerConfig is invalid.
+	ErrInvalidConfig = errors.New("invalid subnet manager config")
+	// ErrSyncTimeout means the node cache didn't sync in time.
+	ErrSyncTimeout = errors.New("node controller sync timed out")
+)
+
+// ErrInformerUnhealthy is returned by WatchLeases once the node informer has
+// been unhealthy, as reported by the healthz handler, for longer than the
+// UnhealthyTimeout: leases may be changing without WatchLeases hearing of it.
+var ErrInformerUnhealthy = errors.New("node informer unhealthy")
+
+// InitError is the error returned by NewSubnetManager. Callers can branch on
+// Reason, or use errors.Is with the reason and errors.As with the type of the
+// underlying error.
+type InitError struct {
+	// Reason is one of ErrClientInit, ErrNodeNameUnresolved, ErrConfigRead,
+	// ErrInvalidConfig and ErrSyncTimeout.
+	Reason error
+	// Err is the underlying error, if any.
+	Err error
+
+	msg string
+}
+
+// initError returns an InitError for reason wrapping err. The message is
+// formatted from format and args, which should include err.
+func initError(reason, err error, format string, args ...interface{}) *InitError {
+	return &InitError{Reason: reason, Err: err, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *InitError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the underlying error.
+func (e *InitError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the reason of e.
+func (e *InitError) Is(target error) bool {
+	return target == e.Reason
+}
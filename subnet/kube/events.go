@@ -0,0 +1,124 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const eventSourceComponent = "flannel"
+
+// A lease acquisition failing acquireFailureThreshold times in a row is
+// recorded as an event on the local node, at most once per
+// acquireFailureEventInterval.
+const (
+	acquireFailureThreshold     = 3
+	acquireFailureEventInterval = 10 * time.Minute
+)
+
+// recordNodeEvent creates a Kubernetes Event on the node, as shown by
+// `kubectl describe node`. The vendored client-go has no event recorder, so
+// events are created directly and not aggregated. Failing to record an event
+// is logged and otherwise ignored.
+func (ksm *kubeSubnetManager) recordNodeEvent(ctx context.Context, nodeName, eventType, reason, message string) {
+	if ksm.client == nil {
+		return // FakeSubnetManager, nowhere to record events
+	}
+	if ksm.dryRun {
+		ksm.log.WithValues("node", nodeName, "reason", reason).Infof("Dry run, not recording event %s on node %q: %s", reason, nodeName, message)
+		return
+	}
+
+	now := metav1.Now()
+	e := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", nodeName, now.UnixNano()),
+			Namespace: metav1.NamespaceDefault,
+		},
+		// Node events are matched by a UID equal to the node name, as the
+		// kubelet does.
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+			UID:  types.UID(nodeName),
+		},
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: eventSourceComponent, Host: ksm.nodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+	if _, err := createEvent(ctx, ksm.client, ksm.apiTimeout, e); err != nil {
+		ksm.log.WithValues("node", nodeName, "reason", reason).Warningf("Failed to record event %s on node %q: %v", reason, nodeName, err)
+	}
+}
+
+// acquireFailures counts the consecutive failures of AcquireLease.
+type acquireFailures struct {
+	mux       sync.Mutex
+	count     int
+	lastEvent time.Time
+}
+
+// failed records a failure, and reports whether it is worth an event: the
+// failures have persisted and no event was recorded recently.
+func (f *acquireFailures) failed(now time.Time) (int, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.count++
+	if f.count < acquireFailureThreshold || now.Sub(f.lastEvent) < acquireFailureEventInterval {
+		return f.count, false
+	}
+	f.lastEvent = now
+	return f.count, true
+}
+
+// succeeded ends a run of failures. Should failures start again they are
+// recorded as soon as they persist.
+func (f *acquireFailures) succeeded() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.count = 0
+	f.lastEvent = time.Time{}
+}
+
+// noteAcquireResult keeps track of AcquireLease failures, recording a warning
+// event on the local node when they persist. Without the event the failure is
+// only in flannel's logs, while `kubectl describe node` is where one looks to
+// find out why the pods on a node have no network.
+func (ksm *kubeSubnetManager) noteAcquireResult(ctx context.Context, err error) {
+	if err == nil {
+		ksm.acquireFailures.succeeded()
+		return
+	}
+	if ctx.Err() != nil || err == ErrNotLeader {
+		return // Not a failure of this node
+	}
+	count, record := ksm.acquireFailures.failed(time.Now())
+	if !record {
+		return
+	}
+	ksm.recordNodeEvent(ctx, ksm.nodeName, v1.EventTypeWarning, "LeaseAcquisitionFailed",
+		fmt.Sprintf("Flannel failed to acquire a subnet lease %d times in a row, pods on this node have no network: %v", count, err))
+}
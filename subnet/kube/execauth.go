@@ -0,0 +1,198 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// The vendored client library predates exec credential plugins: it ignores
+// the exec section of a kubeconfig user. Kubeconfigs relying on one, e.g. for
+// short-lived tokens, get their tokens from the plugin through a transport
+// wrapper instead, which runs the plugin as kubectl would.
+
+// defaultExecAPIVersion is the ExecCredential version asked of plugins whose
+// kubeconfig doesn't say.
+const defaultExecAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// execConfig is the exec section of a kubeconfig user.
+type execConfig struct {
+	Command    string       `json:"command"`
+	Args       []string     `json:"args"`
+	Env        []execEnvVar `json:"env"`
+	APIVersion string       `json:"apiVersion"`
+}
+
+type execEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// kubeconfigExec returns the exec section of the current context's user in
+// the kubeconfig at path, nil if it has none.
+func kubeconfigExec(path string) (*execConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kc struct {
+		CurrentContext string `json:"current-context"`
+		Contexts       []struct {
+			Name    string `json:"name"`
+			Context struct {
+				User string `json:"user"`
+			} `json:"context"`
+		} `json:"contexts"`
+		Users []struct {
+			Name string `json:"name"`
+			User struct {
+				Exec *execConfig `json:"exec"`
+			} `json:"user"`
+		} `json:"users"`
+	}
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %s: %v", path, err)
+	}
+
+	var user string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			user = c.Context.User
+		}
+	}
+	for _, u := range kc.Users {
+		if u.Name == user && u.User.Exec != nil {
+			if u.User.Exec.Command == "" {
+				return nil, fmt.Errorf("exec credential plugin of user %q in kubeconfig %s has no command", user, path)
+			}
+			return u.User.Exec, nil
+		}
+	}
+	return nil, nil
+}
+
+// execCredentials runs an exec credential plugin for tokens, and caches them
+// until they expire or the API server rejects them.
+type execCredentials struct {
+	config *execConfig
+
+	mux    sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newExecCredentials(config *execConfig) *execCredentials {
+	return &execCredentials{config: config}
+}
+
+// get returns the current token, running the plugin if there is none.
+func (c *execCredentials) get() (string, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.token != "" && (c.expiry.IsZero() || time.Now().Before(c.expiry)) {
+		return c.token, nil
+	}
+
+	apiVersion := c.config.APIVersion
+	if apiVersion == "" {
+		apiVersion = defaultExecAPIVersion
+	}
+	info, err := json.Marshal(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]interface{}{"interactive": false},
+	})
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(c.config.Command, c.config.Args...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+	for _, e := range c.config.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("exec credential plugin %s failed: %v: %s", c.config.Command, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var cred struct {
+		Status struct {
+			Token               string    `json:"token"`
+			ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(out, &cred); err != nil {
+		return "", fmt.Errorf("failed to decode the output of exec credential plugin %s: %v", c.config.Command, err)
+	}
+	if cred.Status.Token == "" {
+		return "", fmt.Errorf("exec credential plugin %s returned no token", c.config.Command)
+	}
+	c.token, c.expiry = cred.Status.Token, cred.Status.ExpirationTimestamp
+	return c.token, nil
+}
+
+// reset drops token if it is still the current one, so the next request runs
+// the plugin again.
+func (c *execCredentials) reset(token string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// wrap returns rt authenticating its requests with the plugin's tokens.
+func (c *execCredentials) wrap(rt http.RoundTripper) http.RoundTripper {
+	return &execRoundTripper{creds: c, rt: rt}
+}
+
+type execRoundTripper struct {
+	creds *execCredentials
+	rt    http.RoundTripper
+}
+
+func (rt *execRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return rt.rt.RoundTrip(req)
+	}
+	token, err := rt.creds.get()
+	if err != nil {
+		return nil, err
+	}
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := rt.rt.RoundTrip(r)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		rt.creds.reset(token)
+	}
+	return resp, err
+}
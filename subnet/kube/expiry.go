@@ -0,0 +1,132 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/subnet"
+
+	"golang.org/x/net/context"
+)
+
+// Leases of the kube subnet manager go away when their node is deleted, they
+// don't expire. Consumers written for etcd, where a lease that isn't renewed
+// expires, can have the leases of nodes that stopped being updated, e.g.
+// because their kubelet no longer reports status, handed out as expired. A
+// node that is updated again has its lease handed out as added again.
+
+// expirySweeper remembers when each node was last updated. A nil
+// expirySweeper never expires anything.
+type expirySweeper struct {
+	window time.Duration
+
+	mux     sync.Mutex
+	seen    map[string]time.Time
+	expired map[string]bool
+}
+
+func newExpirySweeper(window time.Duration) *expirySweeper {
+	return &expirySweeper{
+		window:  window,
+		seen:    make(map[string]time.Time),
+		expired: make(map[string]bool),
+	}
+}
+
+// see records that node name was updated at now, and reports whether its
+// lease had expired.
+func (s *expirySweeper) see(name string, now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.seen[name] = now
+	expired := s.expired[name]
+	delete(s.expired, name)
+	return expired
+}
+
+// forget forgets node name.
+func (s *expirySweeper) forget(name string) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.seen, name)
+	delete(s.expired, name)
+}
+
+// expire reports whether node name was last updated more than the window
+// before now and its lease hasn't been expired yet, and marks it expired if
+// so. Nodes never seen count as seen now.
+func (s *expirySweeper) expire(name string, now time.Time) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	seen, ok := s.seen[name]
+	if !ok {
+		s.seen[name] = now
+		return false
+	}
+	if s.expired[name] || now.Sub(seen) <= s.window {
+		return false
+	}
+	s.expired[name] = true
+	return true
+}
+
+// expiryLoop sweeps the expired leases a few times per window until ctx is
+// done.
+func (ksm *kubeSubnetManager) expiryLoop(ctx context.Context) {
+	ticker := time.NewTicker(ksm.expiry.window / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ksm.sweepExpiredLeases(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweepExpiredLeases hands out the leases of the nodes not updated within the
+// window as expired. The local node, which renews its own lease, and drained
+// nodes, whose lease is withdrawn already, are left alone.
+func (ksm *kubeSubnetManager) sweepExpiredLeases(now time.Time) {
+	nodes, err := ksm.managedNodes()
+	if err != nil {
+		ksm.log.Warningf("Failed to list nodes to expire their leases: %v", err)
+		return
+	}
+	for _, n := range nodes {
+		name := n.ObjectMeta.Name
+		if name == ksm.nodeName || ksm.drainTaint(n) != "" {
+			continue
+		}
+		if !ksm.expiry.expire(name, now) {
+			continue
+		}
+		l, err := ksm.nodeToLease(*n)
+		if err != nil {
+			continue
+		}
+		ksm.log.WithValues("node", name, "event", subnet.EventExpired).Infof("Node %q wasn't updated for %v, handing out its lease %s as expired", name, ksm.expiry.window, l.Subnet)
+		ksm.dispatchNodeEvent(n, subnet.Event{Type: subnet.EventExpired, Lease: l}, false)
+	}
+}
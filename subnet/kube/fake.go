@@ -0,0 +1,185 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/coreos/flannel/subnet"
+
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// FakeSubnetManager is a kube subnet manager for tests that keeps its nodes in
+// memory instead of talking to an API server. Nodes are added, updated and
+// deleted with AddNode, UpdateNode and DeleteNode, which deliver the
+// resulting lease events before returning (there is no debounce), so
+// WatchLeases sees them in order.
+// Leases acquired through AcquireLease are written to the in-memory node the
+// same way they would be to the real one.
+type FakeSubnetManager struct {
+	*kubeSubnetManager
+
+	mux             sync.Mutex
+	indexer         cache.Indexer
+	resourceVersion int
+}
+
+var _ subnet.Manager = &FakeSubnetManager{}
+
+// NewFakeSubnetManager returns a FakeSubnetManager for the network sc running
+// on node nodeName, starting with the given nodes.
+func NewFakeSubnetManager(sc *subnet.Config, nodeName string, nodes ...*v1.Node) (*FakeSubnetManager, error) {
+	ksm, err := newKubeSubnetManager(nil, sc, nodeName, &SubnetManagerConfig{EventDebounce: -1, UnhealthyTimeout: -1})
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FakeSubnetManager{
+		kubeSubnetManager: ksm,
+		indexer:           cache.NewIndexer(cache.MetaNamespaceKeyFunc, ksm.annotations.nodeIndexers()),
+	}
+	ksm.nodeStore = newIndexedNodeLister(f.indexer)
+	ksm.nodePatcher = f.patch
+	for _, n := range nodes {
+		f.AddNode(n)
+	}
+	return f, nil
+}
+
+// Run waits for ctx to be done and then shuts down like the real manager.
+func (f *FakeSubnetManager) Run(ctx context.Context) {
+	<-ctx.Done()
+	f.flushPendingEvents()
+	close(f.events)
+	f.closeSubscribers()
+}
+
+// AddNode adds a node, or replaces it if it exists.
+func (f *FakeSubnetManager) AddNode(n *v1.Node) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.store(n)
+}
+
+// UpdateNode replaces a node, or adds it if it doesn't exist.
+func (f *FakeSubnetManager) UpdateNode(n *v1.Node) {
+	f.AddNode(n)
+}
+
+// DeleteNode deletes a node. Deleting a node that doesn't exist does nothing.
+func (f *FakeSubnetManager) DeleteNode(name string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	obj, ok, _ := f.indexer.GetByKey(name)
+	if !ok {
+		return
+	}
+	f.indexer.Delete(obj)
+	f.handleDeleteLeaseEvent(obj)
+}
+
+// Node returns a copy of a node as currently stored, or nil if there is no
+// such node.
+func (f *FakeSubnetManager) Node(name string) *v1.Node {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	obj, ok, _ := f.indexer.GetByKey(name)
+	if !ok {
+		return nil
+	}
+	return copyNode(obj.(*v1.Node))
+}
+
+// store saves a copy of n and delivers the events. f.mux must be held.
+func (f *FakeSubnetManager) store(n *v1.Node) {
+	n = copyNode(n)
+	f.resourceVersion++
+	n.ResourceVersion = strconv.Itoa(f.resourceVersion)
+
+	old, ok, _ := f.indexer.GetByKey(n.Name)
+	if ok {
+		f.indexer.Update(n)
+		f.handleUpdateLeaseEvent(old, n)
+	} else {
+		f.indexer.Add(n)
+		f.handleAddLeaseEvent(subnet.EventAdded, n)
+	}
+}
+
+// patch applies a strategic merge patch to a stored node.
+func (f *FakeSubnetManager) patch(ctx context.Context, name string, patch []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	obj, ok, _ := f.indexer.GetByKey(name)
+	if !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "nodes"}, name)
+	}
+
+	if !patchPreconditionMet(obj.(*v1.Node), patch) {
+		return apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, name, fmt.Errorf("the object has been modified"))
+	}
+	orig, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(orig, patch, v1.Node{})
+	if err != nil {
+		return err
+	}
+	n := &v1.Node{}
+	if err := json.Unmarshal(patched, n); err != nil {
+		return err
+	}
+	f.store(n)
+	return nil
+}
+
+// patchPreconditionMet reports whether patch applies to n, i.e. it names no
+// resource version or that of n, as the API server checks.
+func patchPreconditionMet(n *v1.Node, patch []byte) bool {
+	var p struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return true // Left for the patch itself to fail
+	}
+	rv := p.Metadata.ResourceVersion
+	return rv == "" || rv == n.ResourceVersion
+}
+
+// copyNode returns a deep copy of n, so callers can't change stored nodes
+// behind the informer handlers' back.
+func copyNode(n *v1.Node) *v1.Node {
+	b, err := json.Marshal(n)
+	if err != nil {
+		panic(err)
+	}
+	c := &v1.Node{}
+	if err := json.Unmarshal(b, c); err != nil {
+		panic(err)
+	}
+	return c
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+func (ksm *kubeSubnetManager) markSynced() {
+	atomic.StoreInt64(&ksm.lastSync, time.Now().UnixNano())
+}
+
+// healthy returns an error describing why the node informer isn't healthy, or
+// nil if it has synced and delivered nodes within the last two resync periods.
+func (ksm *kubeSubnetManager) healthy() error {
+	if !ksm.nodeController.HasSynced() {
+		return fmt.Errorf("node controller has not synced")
+	}
+	last := time.Unix(0, atomic.LoadInt64(&ksm.lastSync))
+	if since := time.Since(last); since > 2*ksm.resyncPeriod {
+		return fmt.Errorf("node controller last synced %v ago", since)
+	}
+	return nil
+}
+
+// checkUnhealthy returns ErrInformerUnhealthy if the node informer has been
+// unhealthy since a check more than the unhealthy timeout before now.
+func (ksm *kubeSubnetManager) checkUnhealthy(now time.Time) error {
+	err := ksm.healthy()
+	if err == nil {
+		atomic.StoreInt64(&ksm.unhealthySince, 0)
+		return nil
+	}
+	if atomic.CompareAndSwapInt64(&ksm.unhealthySince, 0, now.UnixNano()) {
+		return nil
+	}
+	since := now.Sub(time.Unix(0, atomic.LoadInt64(&ksm.unhealthySince)))
+	if since <= ksm.unhealthyTimeout {
+		return nil
+	}
+	ksm.log.Warningf("Node informer unhealthy for %v, failing lease watch: %v", since/time.Second*time.Second, err)
+	return ErrInformerUnhealthy
+}
+
+// HealthzHandler reports 200 when the node informer is synced and keeping up,
+// so it can back a readiness probe.
+func (ksm *kubeSubnetManager) HealthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := ksm.healthy(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("kube subnet manager is ready"))
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// managedIndex is the node cache index of the flannel managed nodes, all of
+// them under "true". Most lookups only care about those, which can be a small
+// part of a large cluster. Nodes aren't namespaced, so unlike most caches the
+// node cache has no namespace index.
+const managedIndex = "managed"
+
+// nodeIndexers returns the indexers of the node cache.
+func (a annotations) nodeIndexers() cache.Indexers {
+	return cache.Indexers{
+		managedIndex: func(obj interface{}) ([]string, error) {
+			if n, ok := obj.(*v1.Node); ok && n.Annotations[a.SubnetKubeManaged] == "true" {
+				return []string{"true"}, nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+// nodeLister lists the cached nodes, and looks them up by index.
+type nodeLister interface {
+	listers.NodeLister
+	// ByIndex returns the nodes whose indexName index has value.
+	ByIndex(indexName, value string) ([]*v1.Node, error)
+}
+
+// indexedNodeLister is the nodeLister of a single cache.
+type indexedNodeLister struct {
+	listers.NodeLister
+	indexer cache.Indexer
+}
+
+func newIndexedNodeLister(indexer cache.Indexer) *indexedNodeLister {
+	return &indexedNodeLister{NodeLister: listers.NewNodeLister(indexer), indexer: indexer}
+}
+
+func (l *indexedNodeLister) ByIndex(indexName, value string) ([]*v1.Node, error) {
+	objs, err := l.indexer.ByIndex(indexName, value)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*v1.Node, 0, len(objs))
+	for _, obj := range objs {
+		nodes = append(nodes, obj.(*v1.Node))
+	}
+	return nodes, nil
+}
+
+// managedNodes returns the flannel managed nodes in the cache.
+func (ksm *kubeSubnetManager) managedNodes() ([]*v1.Node, error) {
+	return ksm.nodeStore.ByIndex(managedIndex, "true")
+}
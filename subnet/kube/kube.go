@@ -15,311 +15,2663 @@
 package kube
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/version"
 
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	clientset "k8s.io/client-go/kubernetes"
-	listers "k8s.io/client-go/listers/core/v1"
-	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
 	ErrUnimplemented = errors.New("unimplemented")
+	ErrNodeNotFound  = errors.New("node not found")
+	ErrLeaseNotFound = errors.New("lease not found")
 )
 
 const (
-	resyncPeriod              = 5 * time.Minute
-	nodeControllerSyncTimeout = 10 * time.Minute
+	DefaultResyncPeriod    = 5 * time.Minute
+	DefaultResyncJitter    = 0.1
+	DefaultLeaseExpiration = 24 * time.Hour
+	DefaultNetConfPath     = "/etc/kube-flannel/net-conf.json"
 
-	subnetKubeManagedAnnotation        = "flannel.alpha.coreos.com/kube-subnet-manager"
-	backendDataAnnotation              = "flannel.alpha.coreos.com/backend-data"
-	backendTypeAnnotation              = "flannel.alpha.coreos.com/backend-type"
-	backendPublicIPAnnotation          = "flannel.alpha.coreos.com/public-ip"
-	backendPublicIPOverwriteAnnotation = "flannel.alpha.coreos.com/public-ip-overwrite"
+	DefaultPodCIDRWaitTimeout = time.Minute
+	DefaultPodLookupTimeout   = 2 * time.Minute
+	DefaultSyncTimeout        = 10 * time.Minute
+	DefaultUnhealthyTimeout   = 5 * time.Minute
+	DefaultEventDebounce      = time.Second
+	DefaultReconcileInterval  = time.Minute
+	DefaultWatchBatchSize     = 64
 
-	netConfPath = "/etc/kube-flannel/net-conf.json"
+	// MaxLeaseNodeAnnotations and MaxLeaseNodeAnnotationSize bound what
+	// LeaseNodeAnnotations copies into each lease, which every instance
+	// holds for every node.
+	MaxLeaseNodeAnnotations    = 16
+	MaxLeaseNodeAnnotationSize = 1024
+
+	// UnschedulableTaint is the taint of cordoned nodes. As a drain taint it
+	// also matches nodes marked unschedulable by older clusters, which
+	// don't taint them.
+	UnschedulableTaint = "node.kubernetes.io/unschedulable"
+)
+
+const (
+	eventSendTimeout = 5 * time.Second
+	patchRetries     = 5
+
+	// minMTU and maxMTU bound the MTU an mtu-override annotation may set:
+	// the minimum IPv4 datagram every host must accept, and the usual
+	// jumbo frame size.
+	minMTU = 576
+	maxMTU = 9000
+)
+
+// podCIDRPollInterval is how often waitForPodCIDR checks the node.
+var podCIDRPollInterval = time.Second
+
+// syncBackoff is how often waitForSync checks the node controller: the
+// interval doubles after every check, up to maxSyncInterval.
+var (
+	syncBackoff     = wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1}
+	maxSyncInterval = 30 * time.Second
 )
 
+// SubnetManagerConfig holds the settings of the kube subnet manager.
+type SubnetManagerConfig struct {
+	// AnnotationPrefix is the prefix of the node annotations flannel
+	// writes. Empty means DefaultAnnotationPrefix.
+	AnnotationPrefix string
+
+	// ApiUrl and Kubeconfig select an out of cluster config. If both are
+	// empty the in cluster config is used. A kubeconfig user may get its
+	// tokens from an exec credential plugin.
+	ApiUrl     string
+	Kubeconfig string
+	// RestConfig, if set, is used instead of all of the above, for auth
+	// they can't express. It is copied, and the manager's rate limits and
+	// transport wrappers are applied to the copy.
+	RestConfig *rest.Config
+
+	// TokenFile and CAFile replace the service account token and CA
+	// certificate of the in cluster config, for runtimes that mount them
+	// somewhere other than DefaultServiceAccountDir. Empty means the file
+	// in DefaultServiceAccountDir.
+	TokenFile string
+	CAFile    string
+
+	// QPS and Burst limit the rate of requests to the API server, node
+	// list and watch included. Zero means DefaultQPS and DefaultBurst.
+	QPS   float32
+	Burst int
+	// UserAgent is the user agent of the manager's API requests. Empty
+	// means that of RestConfig if it has one, else one naming flannel, its
+	// version and the node it runs on, for its requests to be told apart
+	// in the API server's audit logs.
+	UserAgent string
+
+	// NodeNameStrategies are the ways of finding out the name of the node
+	// flannel runs on, tried in order. Empty means
+	// DefaultNodeNameStrategies.
+	NodeNameStrategies []NodeNameStrategy
+	// HostnameFile is read by NodeNameFromHostname. Empty means the
+	// kernel's hostname.
+	HostnameFile string
+
+	// NetConfPath is the network config file. If empty, the NET_CONF_PATH
+	// environment variable is used, falling back to DefaultNetConfPath.
+	NetConfPath string
+
+	// NetConfConfigMap names a ConfigMap, as namespace/name, to read the
+	// network config from through the API, for environments that can't
+	// mount it as a file. NetConfPath is ignored then. Empty means the
+	// file.
+	NetConfConfigMap string
+	// NetConfConfigMapKey is the key of the network config in
+	// NetConfConfigMap. Empty means DefaultNetConfConfigMapKey.
+	NetConfConfigMapKey string
+	// StrictNetConf makes unknown keys in the network config an error
+	// instead of being ignored, and logs warnings about settings that
+	// likely don't do what was meant. See subnet.ParseConfigStrict.
+	StrictNetConf bool
+	// NetConfCheckInterval is how often the network config is checked for
+	// changes, which are logged and handed out by NetConfChanges; they take
+	// a restart to apply. Zero means the resync period, negative disables
+	// the check.
+	NetConfCheckInterval time.Duration
+
+	// ResyncPeriod is how often the node informer does a full resync.
+	// Zero means DefaultResyncPeriod.
+	ResyncPeriod time.Duration
+	// ResyncJitter is the fraction of ResyncPeriod by which each instance
+	// randomly lengthens or shortens its period, so instances started
+	// together don't all resync at once. The mean period stays
+	// ResyncPeriod. Zero means DefaultResyncJitter, a negative value
+	// disables the jitter. It must be below 1.
+	ResyncJitter float64
+	// LeaseExpiration is how far in the future acquired and renewed leases
+	// expire. Zero means DefaultLeaseExpiration. Expirations are set by the
+	// API server's clock, as far as the manager can tell from its responses,
+	// and by the local clock until it has heard from the server.
+	LeaseExpiration time.Duration
+	// NoLeaseExpiration hands out leases that never expire, overriding
+	// LeaseExpiration: the node's existence decides whether its lease is
+	// held, so there is nothing to renew.
+	NoLeaseExpiration bool
+
+	// LeaderElection, if set, restricts the writes of the node's
+	// annotations to the instance elected among those managing the node.
+	LeaderElection *LeaderElectionConfig
+
+	// Logger receives the manager's log messages. Nil means glog.
+	Logger Logger
+
+	// NodeLabelSelector, if set, limits the nodes the manager caches and
+	// sees leases of to those matching this label selector, e.g. to shard
+	// flannel across instances. The local node is always watched. Empty
+	// means all nodes.
+	NodeLabelSelector string
+	// NodeFieldSelector is like NodeLabelSelector, for node fields:
+	// metadata.name and spec.unschedulable. Both must match if set.
+	NodeFieldSelector string
+
+	// APITimeout bounds each call the manager makes to the API server,
+	// other than the node informer's list and watch. Zero means
+	// DefaultAPITimeout.
+	APITimeout time.Duration
+
+	// PodCIDRWaitTimeout is how long AcquireLease waits for the local node
+	// to be assigned a pod CIDR before failing. Zero means
+	// DefaultPodCIDRWaitTimeout.
+	PodCIDRWaitTimeout time.Duration
+
+	// PodLookupTimeout is how long the pod node name strategy keeps
+	// retrying to get flannel's pod while the API server fails, e.g. right
+	// after the cluster booted. Zero means DefaultPodLookupTimeout.
+	PodLookupTimeout time.Duration
+
+	// SyncTimeout is how long NewSubnetManager waits for the node cache to
+	// sync, which can take a while when the API server is overloaded, e.g.
+	// while the whole cluster restarts. The wait also ends when the
+	// context passed to NewSubnetManager is done. Zero means
+	// DefaultSyncTimeout.
+	SyncTimeout time.Duration
+
+	// EventDebounce is how long lease events caused by node updates are
+	// held back, so that a burst of updates to a node results in a single
+	// event with its latest lease. Zero means DefaultEventDebounce, a
+	// negative value hands out every event right away.
+	EventDebounce time.Duration
+
+	// WatchBatchSize is the most events WatchLeases hands out at once, if
+	// that many are waiting. Zero means DefaultWatchBatchSize.
+	WatchBatchSize int
+
+	// DryRun makes the manager log the node patches it would make instead of
+	// making them, leaving the nodes untouched. AcquireLease still returns
+	// the lease it would have written.
+	DryRun bool
+
+	// TolerateFailedPatch makes AcquireLease succeed when patching the
+	// local node fails, e.g. with a timeout, if the node read again
+	// already has the lease's annotations, as set by a previous flannel
+	// process or by a patch whose response was lost. Without it any patch
+	// failure fails AcquireLease.
+	TolerateFailedPatch bool
+
+	// ReconcileInterval is how often the local node's flannel annotations
+	// are checked against the last acquired or renewed lease, and restored
+	// if something removed or changed them. Zero means
+	// DefaultReconcileInterval, a negative value disables the check.
+	ReconcileInterval time.Duration
+
+	// LeaseNodeLabels are the keys of the node labels copied into
+	// LeaseAttrs.NodeLabels, e.g. topology.kubernetes.io/zone. Labels are
+	// read from the node objects, so every instance sees the same values.
+	// Empty means none.
+	LeaseNodeLabels []string
+
+	// LeaseNodeAnnotations are the keys of the node annotations copied into
+	// LeaseAttrs.NodeAnnotations, for custom backends. At most
+	// MaxLeaseNodeAnnotations keys may be given; values longer than
+	// MaxLeaseNodeAnnotationSize bytes are left out with a warning. Empty
+	// means none.
+	LeaseNodeAnnotations []string
+
+	// DrainTaints are the keys of the node taints that pull a node out of
+	// the overlay, e.g. during maintenance: while a node has one of them,
+	// its lease is handed out as removed, and added back once the taint is
+	// gone. The node keeps its subnet meanwhile. Empty means none.
+	DrainTaints []string
+
+	// PodCIDRCheckWarnOnly makes a pod CIDR of the local node that isn't
+	// within the flannel network a warning instead of an AcquireLease
+	// error, for rolling out the check gradually.
+	PodCIDRCheckWarnOnly bool
+
+	// PublicIPFromInternalIP makes a node without a public IP annotation
+	// get its InternalIP as the public IP of its lease, e.g. while rolling
+	// out flannel on nodes annotated by older tooling. It is short for a
+	// PublicIPAddressType of InternalIP.
+	PublicIPFromInternalIP bool
+
+	// PublicIPAddressType is the type of node address, InternalIP or
+	// ExternalIP, that a node without a public IP annotation gets as the
+	// public IP of its lease, e.g. for clusters whose nodes talk over their
+	// ExternalIPs. The first address of that type that is routable is used,
+	// and in dual-stack mode the first routable IPv6 address as well. The
+	// public IP annotations always win. Empty means none.
+	PublicIPAddressType string
+
+	// ManagedNodeLabel is the key of a node label, e.g. flannel.io/managed,
+	// set to "true" on the local node along with its lease annotations and
+	// removed by ReleaseLease, so flannel managed nodes can be selected by
+	// label. Empty means no label is set.
+	ManagedNodeLabel string
+
+	// PolicyEnforcedLabel is the key of a node label that the network
+	// policy agent, or whoever deploys it, sets to "true" on nodes it
+	// enforces policy on. The local node's lease is then marked as
+	// PolicyEnforced, as are leases acquired with PolicyEnforced set.
+	// Empty means only the latter are.
+	PolicyEnforcedLabel string
+
+	// ExpireLeasesAfter makes the lease of a node that isn't updated for
+	// this long handed out as EventExpired, for consumers expecting leases
+	// to expire as they do with etcd, and as added again once the node is
+	// updated. It must be well above how often kubelets report node status.
+	// Zero, the default, disables it: nodes being deleted is what counts.
+	ExpireLeasesAfter time.Duration
+
+	// CompressionThreshold makes backend data larger than this many bytes
+	// written gzip compressed and base64 encoded, for backends whose data
+	// approaches the annotation size limit. Only flannel versions that can
+	// read it may share the nodes. Zero, the default, always writes plain
+	// JSON; compressed data is read either way.
+	CompressionThreshold int
+
+	// AcquireLeaseWindow makes AcquireLease calls with the same attributes
+	// as the previous one, within this long of it, return the same lease
+	// again without reading or patching the node, for callers acquiring
+	// the lease in a tight loop. The node changing so that it no longer
+	// hands out the lease, or the lease being released, ends the window
+	// early; changes that haven't reached the node cache yet don't. Zero,
+	// the default, disables it.
+	AcquireLeaseWindow time.Duration
+
+	// WatchdogTimeout is how long a synced node informer may go without a
+	// watch event before it is restarted, in case its watch stopped
+	// delivering events without failing. Resyncs don't count. It must be
+	// well above how often nodes are updated, which kubelets do when
+	// reporting status. Zero, the default, disables the watchdog.
+	WatchdogTimeout time.Duration
+
+	// UnhealthyTimeout is how long the node informer may stay unhealthy,
+	// i.e. unsynced or not delivering nodes, e.g. while it fails to relist
+	// after a restart, before WatchLeases fails with ErrInformerUnhealthy
+	// instead of waiting for events that may never come. Zero means
+	// DefaultUnhealthyTimeout, a negative value disables the check.
+	UnhealthyTimeout time.Duration
+
+	// ReleaseLeaseOnShutdown makes Run release the local node's lease, as
+	// ReleaseLease does, once its context is done.
+	ReleaseLeaseOnShutdown bool
+}
+
 type kubeSubnetManager struct {
-	client         clientset.Interface
-	nodeName       string
-	nodeStore      listers.NodeLister
-	nodeController cache.Controller
-	subnetConf     *subnet.Config
-	events         chan subnet.Event
+	client          clientset.Interface
+	nodeName        string
+	nodeStore       nodeLister
+	nodeController  cache.Controller
+	informers       []*nodeInformer
+	subnetConf      *subnet.Config
+	annotations     annotations
+	events          chan leaseEvent
+	resyncPeriod    time.Duration
+	leaseExpiration time.Duration
+	clock           *serverClock
+
+	// netConfSrc is where the network config netConf was read from, nil
+	// for managers not started by NewSubnetManager.
+	netConfSrc           netConfSource
+	netConf              string
+	strictNetConf        bool
+	netConfCheckInterval time.Duration
+	netConfChanges       chan *subnet.Config
+
+	elector         *leaderElector
+	log             Logger
+	apiTimeout      time.Duration
+	podCIDRWait     time.Duration
+	releaseOnStop   bool
+	dryRun          bool
+	leaseNodeLabels []string
+	leaseNodeAnnos  []string
+	drainTaints     []string
+
+	podCIDRCheckWarnOnly bool
+	tolerateFailedPatch  bool
+	publicIPAddressType  v1.NodeAddressType
+	managedNodeLabel     string
+	policyEnforcedLabel  string
+	compressionThreshold int
+	watchdogTimeout      time.Duration
+	// expiry is nil unless leases of nodes no longer updated expire.
+	expiry *expirySweeper
+
+	reconcileInterval time.Duration
+	watchBatchSize    int
+	// leaseAttrs are the attributes of the last lease acquired or renewed,
+	// nil if there is none (anymore). Guarded by mux.
+	leaseAttrs *subnet.LeaseAttrs
+
+	// nodePatcher, if set, replaces the API server as the target of node
+	// patches. Used by FakeSubnetManager.
+	nodePatcher func(ctx context.Context, name string, patch []byte) error
+
+	eventDebounce   time.Duration
+	debounceMux     sync.Mutex
+	debounceStopped bool
+	pending         map[string]*pendingEvent
+	// lastSeq is the sequence number of the last event dispatched. Guarded
+	// by debounceMux.
+	lastSeq uint64
+
+	// lastSync is the time (in unix nanoseconds) the informer last delivered
+	// a node, resyncs included. Accessed atomically.
+	lastSync int64
+	// unhealthySince is the time (in unix nanoseconds) WatchLeases first
+	// found the informer unhealthy, zero if it was healthy when last
+	// checked. Accessed atomically.
+	unhealthySince   int64
+	unhealthyTimeout time.Duration
+
+	subnets         subnetTracker
+	managed         managedNodeSet
+	acquired        acquireCache
+	acquireFailures acquireFailures
+	// logged keeps messages about a node's annotations from being logged
+	// again on every resync.
+	logged changeLog
+
+	mux                 sync.Mutex
+	leaseWatches        map[*leaseWatch]struct{}
+	leaseWatchesStopped bool
+
+	subscribers subscribers
 }
 
-func NewSubnetManager(apiUrl, kubeconfig string) (subnet.Manager, error) {
+// pendingEvent is a node's lease event held back by the debounce.
+type pendingEvent struct {
+	event leaseEvent
+	timer *time.Timer
+}
 
-	var cfg *rest.Config
-	var err error
-	// Use out of cluster config if the URL or kubeconfig have been specified. Otherwise use incluster config.
-	if apiUrl != "" || kubeconfig != "" {
-		cfg, err = clientcmd.BuildConfigFromFlags(apiUrl, kubeconfig)
-		if err != nil {
-			return nil, fmt.Errorf("unable to create k8s config: %v", err)
-		}
+// leaseEvent is a lease event along with its place in the order events are
+// dispatched, which WatchLeases cursors are compared against. Events are
+// numbered from 1.
+type leaseEvent struct {
+	subnet.Event
+	seq uint64
+}
+
+// watchCursor is the cursor handed out by WatchLeases: events numbered below
+// seq have been seen already, either handed out or as part of a snapshot.
+// Events are numbered as they are dispatched rather than by the node versions
+// they are made from, as a held back event can be dispatched after events of
+// other nodes' later versions.
+type watchCursor struct {
+	seq uint64
+}
+
+// leaseWatch is the cursor handed out by WatchLease. It is only registered
+// with the manager while a WatchLease call waits for an event, so a cursor
+// that is dropped holds on to nothing. Changes made between calls are caught
+// up with from the node cache, against the lease last handed out.
+type leaseWatch struct {
+	sn     ip.IP4Net
+	events chan subnet.Event
+	// last is the lease last handed out, nil if none or it was removed.
+	last *subnet.Lease
+}
+
+// NewSubnetManager returns a kube subnet manager with its node cache synced.
+// The manager runs until ctx is done: cancelling it stops the node informer,
+// after which WatchLeases returns subnet.ErrShuttingDown. Cancel ctx after a
+// failure too, as the informer may have been started already. Errors are
+// *InitError values saying why it failed; cancelling ctx while the node cache
+// syncs fails with ErrSyncTimeout right away.
+func NewSubnetManager(ctx context.Context, config *SubnetManagerConfig) (subnet.Manager, error) {
+
+	cfg, err := restConfig(config)
+	if err != nil {
+		return nil, initError(ErrClientInit, err, "%v", err)
+	}
+
+	log := config.Logger
+	if log == nil {
+		log = glogLogger{}
+	}
+	setRateLimits(cfg, config, log)
+	customUserAgent := setUserAgent(cfg, config, "")
+	clock := &serverClock{log: log}
+	if wrap := cfg.WrapTransport; wrap != nil {
+		cfg.WrapTransport = func(rt http.RoundTripper) http.RoundTripper { return clock.wrap(wrap(rt)) }
 	} else {
-		cfg, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, fmt.Errorf("unable to initialize inclusterconfig: %v", err)
-		}
+		cfg.WrapTransport = clock.wrap
 	}
 
 	c, err := clientset.NewForConfig(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize client: %v", err)
+		return nil, initError(ErrClientInit, err, "unable to initialize client: %v", err)
 	}
 
 	// The kube subnet mgr needs to know the k8s node name that it's running on so it can annotate it.
-	// If we're running as a pod then the POD_NAME and POD_NAMESPACE will be populated and can be used to find the node
-	// name. Otherwise, the environment variable NODE_NAME can be passed in.
-	nodeName := os.Getenv("NODE_NAME")
-	if nodeName == "" {
-		podName := os.Getenv("POD_NAME")
-		podNamespace := os.Getenv("POD_NAMESPACE")
-		if podName == "" || podNamespace == "" {
-			return nil, fmt.Errorf("env variables POD_NAME and POD_NAMESPACE must be set")
+	apiTimeout := config.APITimeout
+	if apiTimeout <= 0 {
+		apiTimeout = DefaultAPITimeout
+	}
+	podLookupTimeout := config.PodLookupTimeout
+	switch {
+	case podLookupTimeout == 0:
+		podLookupTimeout = DefaultPodLookupTimeout
+	case podLookupTimeout < 0:
+		log.Warningf("Invalid pod lookup timeout %v, using default of %v", podLookupTimeout, DefaultPodLookupTimeout)
+		podLookupTimeout = DefaultPodLookupTimeout
+	}
+	r := &nodeNameResolver{
+		client:           c,
+		apiTimeout:       apiTimeout,
+		hostnameFile:     config.HostnameFile,
+		podLookupTimeout: podLookupTimeout,
+		log:              log,
+		tokenFile:        config.TokenFile,
+	}
+	nodeName, err := r.resolve(ctx, config.NodeNameStrategies)
+	if err != nil {
+		return nil, initError(ErrNodeNameUnresolved, err, "%v", err)
+	}
+	log.Infof("Running on node %q", nodeName)
+	if !customUserAgent {
+		// The client that resolved the node name couldn't have it in its
+		// user agent yet
+		setUserAgent(cfg, config, nodeName)
+		if c, err = clientset.NewForConfig(cfg); err != nil {
+			return nil, initError(ErrClientInit, err, "unable to initialize client: %v", err)
 		}
+	}
 
-		pod, err := c.Pods(podNamespace).Get(podName, metav1.GetOptions{})
+	var src netConfSource
+	if config.NetConfConfigMap != "" {
+		src, err = parseNetConfConfigMap(config.NetConfConfigMap, config.NetConfConfigMapKey)
 		if err != nil {
-			return nil, fmt.Errorf("error retrieving pod spec for '%s/%s': %v", podNamespace, podName, err)
+			return nil, initError(ErrInvalidConfig, err, "%v", err)
 		}
-		nodeName = pod.Spec.NodeName
-		if nodeName == "" {
-			return nil, fmt.Errorf("node name not present in pod spec '%s/%s'", podNamespace, podName)
+	} else {
+		netConfPath := config.NetConfPath
+		if netConfPath == "" {
+			netConfPath = os.Getenv("NET_CONF_PATH")
+		}
+		if netConfPath == "" {
+			netConfPath = DefaultNetConfPath
 		}
+		src = netConfFile(netConfPath)
 	}
-
-	netConf, err := ioutil.ReadFile(netConfPath)
+	netConf, err := src.read(ctx, c, apiTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read net conf: %v", err)
+		return nil, initError(ErrConfigRead, err, "failed to read net conf %s: %v", src, err)
 	}
-
-	sc, err := subnet.ParseConfig(string(netConf))
+	sc, err := parseNetConf(netConf, config.StrictNetConf, src, log)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing subnet config: %s", err)
+		return nil, initError(ErrConfigRead, err, "error parsing subnet config %s: %s", src, err)
 	}
 
-	sm, err := newKubeSubnetManager(c, sc, nodeName)
+	sm, err := newKubeSubnetManager(c, sc, nodeName, config)
 	if err != nil {
-		return nil, fmt.Errorf("error creating network manager: %s", err)
+		return nil, initError(ErrInvalidConfig, err, "error creating network manager: %s", err)
 	}
-	go sm.Run(context.Background())
+	sm.clock = clock
+	sm.netConfSrc = src
+	sm.netConf = netConf
+	go sm.Run(ctx)
 
-	glog.Infof("Waiting %s for node controller to sync", nodeControllerSyncTimeout)
-	err = wait.Poll(time.Second, nodeControllerSyncTimeout, func() (bool, error) {
-		return sm.nodeController.HasSynced(), nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error waiting for nodeController to sync state: %v", err)
+	syncTimeout := config.SyncTimeout
+	switch {
+	case syncTimeout == 0:
+		syncTimeout = DefaultSyncTimeout
+	case syncTimeout < 0:
+		sm.log.Warningf("Invalid sync timeout %v, using default of %v", syncTimeout, DefaultSyncTimeout)
+		syncTimeout = DefaultSyncTimeout
 	}
-	glog.Infof("Node controller sync successful")
+	sm.log.Infof("Waiting %s for node controller to sync", syncTimeout)
+	if err := sm.waitForSync(ctx, syncTimeout); err != nil {
+		return nil, initError(ErrSyncTimeout, err, "error waiting for nodeController to sync state: %v", err)
+	}
+	sm.log.Infof("Node controller sync successful")
 
 	return sm, nil
 }
 
-func newKubeSubnetManager(c clientset.Interface, sc *subnet.Config, nodeName string) (*kubeSubnetManager, error) {
+func newKubeSubnetManager(c clientset.Interface, sc *subnet.Config, nodeName string, config *SubnetManagerConfig) (*kubeSubnetManager, error) {
+	log := config.Logger
+	if log == nil {
+		log = glogLogger{}
+	}
+
+	resyncPeriod := config.ResyncPeriod
+	switch {
+	case resyncPeriod == 0:
+		resyncPeriod = DefaultResyncPeriod
+	case resyncPeriod < 0:
+		log.Warningf("Invalid resync period %v, using default of %v", resyncPeriod, DefaultResyncPeriod)
+		resyncPeriod = DefaultResyncPeriod
+	}
+	jitter := config.ResyncJitter
+	switch {
+	case jitter == 0:
+		jitter = DefaultResyncJitter
+	case jitter >= 1:
+		log.Warningf("Invalid resync jitter %v, using default of %v", jitter, DefaultResyncJitter)
+		jitter = DefaultResyncJitter
+	}
+	if jitter > 0 {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		resyncPeriod = jitteredPeriod(resyncPeriod, jitter, r.Float64())
+	}
+
+	prefix := config.AnnotationPrefix
+	if prefix == "" {
+		prefix = DefaultAnnotationPrefix
+	}
+	a, err := newAnnotations(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := parseNodeSelector(config.NodeLabelSelector, config.NodeFieldSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ManagedNodeLabel != "" {
+		if errs := validation.IsQualifiedName(config.ManagedNodeLabel); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid managed node label %q: %s", config.ManagedNodeLabel, strings.Join(errs, ", "))
+		}
+	}
+	if config.PolicyEnforcedLabel != "" {
+		if errs := validation.IsQualifiedName(config.PolicyEnforcedLabel); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid policy enforced label %q: %s", config.PolicyEnforcedLabel, strings.Join(errs, ", "))
+		}
+	}
+
+	addressType := v1.NodeAddressType(config.PublicIPAddressType)
+	switch addressType {
+	case "", v1.NodeInternalIP, v1.NodeExternalIP:
+	default:
+		return nil, fmt.Errorf("invalid public IP address type %q, must be %s or %s", addressType, v1.NodeInternalIP, v1.NodeExternalIP)
+	}
+	if config.PublicIPFromInternalIP {
+		if addressType != "" && addressType != v1.NodeInternalIP {
+			return nil, fmt.Errorf("public IP from InternalIP conflicts with public IP address type %s", addressType)
+		}
+		addressType = v1.NodeInternalIP
+	}
+
+	if len(config.LeaseNodeAnnotations) > MaxLeaseNodeAnnotations {
+		return nil, fmt.Errorf("%d lease node annotations given, at most %d are allowed", len(config.LeaseNodeAnnotations), MaxLeaseNodeAnnotations)
+	}
+
 	var ksm kubeSubnetManager
 	ksm.client = c
+	ksm.log = log
+	ksm.annotations = a
 	ksm.nodeName = nodeName
 	ksm.subnetConf = sc
-	ksm.events = make(chan subnet.Event, 5000)
-	indexer, controller := cache.NewIndexerInformer(
-		&cache.ListWatch{
-			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				return ksm.client.CoreV1().Nodes().List(options)
-			},
-			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				return ksm.client.CoreV1().Nodes().Watch(options)
-			},
-		},
-		&v1.Node{},
-		resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				ksm.handleAddLeaseEvent(subnet.EventAdded, obj)
-			},
-			UpdateFunc: ksm.handleUpdateLeaseEvent,
-			DeleteFunc: func(obj interface{}) {
-				ksm.handleAddLeaseEvent(subnet.EventRemoved, obj)
-			},
-		},
-		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
-	)
-	ksm.nodeController = controller
-	ksm.nodeStore = listers.NewNodeLister(indexer)
+	ksm.resyncPeriod = resyncPeriod
+	ksm.strictNetConf = config.StrictNetConf
+	ksm.netConfCheckInterval = config.NetConfCheckInterval
+	if ksm.netConfCheckInterval == 0 {
+		ksm.netConfCheckInterval = resyncPeriod
+	}
+	ksm.netConfChanges = make(chan *subnet.Config, 1)
+	ksm.releaseOnStop = config.ReleaseLeaseOnShutdown
+	ksm.dryRun = config.DryRun
+	ksm.tolerateFailedPatch = config.TolerateFailedPatch
+	ksm.leaseNodeLabels = config.LeaseNodeLabels
+	ksm.leaseNodeAnnos = config.LeaseNodeAnnotations
+	ksm.drainTaints = config.DrainTaints
+	ksm.podCIDRCheckWarnOnly = config.PodCIDRCheckWarnOnly
+	ksm.acquired.window = config.AcquireLeaseWindow
+	ksm.publicIPAddressType = addressType
+	ksm.managedNodeLabel = config.ManagedNodeLabel
+	ksm.policyEnforcedLabel = config.PolicyEnforcedLabel
+	ksm.compressionThreshold = config.CompressionThreshold
+	ksm.watchdogTimeout = config.WatchdogTimeout
+	ksm.unhealthyTimeout = config.UnhealthyTimeout
+	switch {
+	case ksm.unhealthyTimeout == 0:
+		ksm.unhealthyTimeout = DefaultUnhealthyTimeout
+	case ksm.unhealthyTimeout < 0:
+		ksm.unhealthyTimeout = 0
+	}
+	if ksm.watchdogTimeout < 0 {
+		log.Warningf("Invalid informer watchdog timeout %v, disabling the watchdog", ksm.watchdogTimeout)
+		ksm.watchdogTimeout = 0
+	}
+	if ksm.compressionThreshold < 0 {
+		log.Warningf("Invalid backend data compression threshold %d, not compressing", ksm.compressionThreshold)
+		ksm.compressionThreshold = 0
+	}
+	switch {
+	case config.ExpireLeasesAfter > 0:
+		ksm.expiry = newExpirySweeper(config.ExpireLeasesAfter)
+	case config.ExpireLeasesAfter < 0:
+		log.Warningf("Invalid lease expiry window %v, leases won't expire", config.ExpireLeasesAfter)
+	}
+	ksm.watchBatchSize = config.WatchBatchSize
+	switch {
+	case ksm.watchBatchSize == 0:
+		ksm.watchBatchSize = DefaultWatchBatchSize
+	case ksm.watchBatchSize < 0:
+		log.Warningf("Invalid watch batch size %d, using default of %d", ksm.watchBatchSize, DefaultWatchBatchSize)
+		ksm.watchBatchSize = DefaultWatchBatchSize
+	}
+	ksm.reconcileInterval = config.ReconcileInterval
+	if ksm.reconcileInterval == 0 {
+		ksm.reconcileInterval = DefaultReconcileInterval
+	}
+	ksm.eventDebounce = config.EventDebounce
+	if ksm.eventDebounce == 0 {
+		ksm.eventDebounce = DefaultEventDebounce
+	}
+	ksm.pending = make(map[string]*pendingEvent)
+	ksm.apiTimeout = config.APITimeout
+	switch {
+	case ksm.apiTimeout == 0:
+		ksm.apiTimeout = DefaultAPITimeout
+	case ksm.apiTimeout < 0:
+		log.Warningf("Invalid API timeout %v, using default of %v", ksm.apiTimeout, DefaultAPITimeout)
+		ksm.apiTimeout = DefaultAPITimeout
+	}
+	ksm.podCIDRWait = config.PodCIDRWaitTimeout
+	switch {
+	case ksm.podCIDRWait == 0:
+		ksm.podCIDRWait = DefaultPodCIDRWaitTimeout
+	case ksm.podCIDRWait < 0:
+		log.Warningf("Invalid pod CIDR wait timeout %v, using default of %v", ksm.podCIDRWait, DefaultPodCIDRWaitTimeout)
+		ksm.podCIDRWait = DefaultPodCIDRWaitTimeout
+	}
+	ksm.leaseExpiration = config.LeaseExpiration
+	switch {
+	case ksm.leaseExpiration == 0:
+		ksm.leaseExpiration = DefaultLeaseExpiration
+	case ksm.leaseExpiration < 0:
+		log.Warningf("Invalid lease expiration %v, using default of %v", ksm.leaseExpiration, DefaultLeaseExpiration)
+		ksm.leaseExpiration = DefaultLeaseExpiration
+	}
+	if config.NoLeaseExpiration {
+		ksm.leaseExpiration = 0
+	}
+	if config.LeaderElection != nil {
+		ksm.elector, err = newLeaderElector(c, config.LeaderElection, nodeName, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ksm.events = make(chan leaseEvent, 5000)
+	ksm.leaseWatches = make(map[*leaseWatch]struct{})
+	if selector.everything() {
+		informer := ksm.newNodeInformer(selector, resyncPeriod, func(*v1.Node) bool { return false })
+		ksm.nodeController = informer
+		ksm.nodeStore = newIndexedNodeLister(informer.indexer)
+		return &ksm, nil
+	}
+
+	// The local node is left to its own informer, so its events are handed
+	// out once whether or not it is in the shard.
+	shard := ksm.newNodeInformer(selector, resyncPeriod, func(n *v1.Node) bool { return n.Name == nodeName })
+	local := nodeSelector{labels: labels.Everything(), fields: fields.OneTermEqualSelector("metadata.name", nodeName)}
+	localInformer := ksm.newNodeInformer(local, resyncPeriod, func(*v1.Node) bool { return false })
+	ksm.nodeController = controllers{shard, localInformer}
+	ksm.nodeStore = &shardNodeLister{
+		nodeLister: newIndexedNodeLister(shard.indexer),
+		local:      newIndexedNodeLister(localInformer.indexer),
+		localName:  nodeName,
+	}
 	return &ksm, nil
 }
 
 func (ksm *kubeSubnetManager) handleAddLeaseEvent(et subnet.EventType, obj interface{}) {
+	ksm.markSynced()
 	n := obj.(*v1.Node)
-	if s, ok := n.Annotations[subnetKubeManagedAnnotation]; !ok || s != "true" {
+	ksm.noteLocalNode(n, et == subnet.EventRemoved)
+	managed := n.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	if et == subnet.EventRemoved {
+		ksm.subnets.remove(n.ObjectMeta.Name)
+		ksm.managed.set(n.ObjectMeta.Name, "", false)
+		ksm.expiry.forget(n.ObjectMeta.Name)
+		ksm.logged.forget(n.ObjectMeta.Name)
+	} else {
+		ksm.managed.set(n.ObjectMeta.Name, n.Annotations[ksm.annotations.BackendType], managed)
+		ksm.expiry.see(n.ObjectMeta.Name, time.Now())
+	}
+	if !managed {
 		return
 	}
 
-	l, err := nodeToLease(*n)
+	l, err := ksm.nodeToLease(*n)
 	if err != nil {
-		glog.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
+		ksm.log.WithValues("node", n.ObjectMeta.Name, "event", et).Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
+		return
+	}
+	if et == subnet.EventAdded {
+		ksm.trackLease(n.ObjectMeta.Name, l)
+		if taint := ksm.drainTaint(n); taint != "" {
+			ksm.log.WithValues("node", n.ObjectMeta.Name).Infof("Not handing out lease %s of node %q, it has drain taint %s", l.Subnet, n.ObjectMeta.Name, taint)
+			return
+		}
+	}
+	ksm.dispatchNodeEvent(n, subnet.Event{Type: et, Lease: l}, false)
+}
+
+// handleDeleteLeaseEvent hands out the removal of a deleted node's lease. If
+// the informer missed the deletion, e.g. because the watch broke and the node
+// was gone by the time it relisted, obj is a DeletedFinalStateUnknown holding
+// the last state of the node it knew.
+func (ksm *kubeSubnetManager) handleDeleteLeaseEvent(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if _, ok := obj.(*v1.Node); !ok {
+		ksm.log.Errorf("Ignoring deletion of unexpected object %T, not a node", obj)
 		return
 	}
-	ksm.events <- subnet.Event{et, l}
+	ksm.handleAddLeaseEvent(subnet.EventRemoved, obj)
 }
 
 func (ksm *kubeSubnetManager) handleUpdateLeaseEvent(oldObj, newObj interface{}) {
+	ksm.markSynced()
 	o := oldObj.(*v1.Node)
 	n := newObj.(*v1.Node)
-	if s, ok := n.Annotations[subnetKubeManagedAnnotation]; !ok || s != "true" {
+	// A node deleted and re-added under the same name, as the cluster
+	// autoscaler does, only looks updated if the informer missed both while
+	// relisting. It still is another node: the old one's lease goes away
+	// before the new one's is handed out.
+	if o.UID != n.UID {
+		ksm.log.WithValues("node", n.ObjectMeta.Name).Infof("Node %q was re-created", n.ObjectMeta.Name)
+		ksm.handleAddLeaseEvent(subnet.EventRemoved, o)
+		ksm.handleAddLeaseEvent(subnet.EventAdded, n)
+		return
+	}
+	ksm.noteLocalNode(n, false)
+	// Resyncs hand out the same node again, which doesn't count as an update
+	expired := false
+	if o.ResourceVersion != n.ResourceVersion {
+		expired = ksm.expiry.see(n.ObjectMeta.Name, time.Now())
+	}
+	oldManaged := o.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	// A drained node's lease is handed out as removed, and as added again
+	// once it no longer is. So is an expired lease.
+	wasDrained := ksm.drainTaint(o) != ""
+	withdrawn := wasDrained || expired
+
+	// A node no longer managed, e.g. because its lease was released, takes
+	// its lease with it
+	if s, ok := n.Annotations[ksm.annotations.SubnetKubeManaged]; !ok || s != "true" {
+		ksm.subnets.remove(n.ObjectMeta.Name)
+		ksm.managed.set(n.ObjectMeta.Name, "", false)
+		if oldManaged && !withdrawn {
+			if ol, err := ksm.nodeToLease(*o); err == nil {
+				ksm.log.WithValues("node", n.ObjectMeta.Name, "event", subnet.EventRemoved).Infof("Node %q is no longer managed by flannel, withdrawing its lease %s", n.ObjectMeta.Name, ol.Subnet)
+				ksm.dispatchNodeEvent(n, subnet.Event{Type: subnet.EventRemoved, Lease: ol}, false)
+			}
+		}
+		return
+	}
+	ksm.managed.set(n.ObjectMeta.Name, n.Annotations[ksm.annotations.BackendType], true)
+	if taint := ksm.drainTaint(n); taint != "" {
+		if withdrawn || !oldManaged {
+			return
+		}
+		if ol, err := ksm.nodeToLease(*o); err == nil {
+			ksm.log.WithValues("node", n.ObjectMeta.Name, "event", subnet.EventRemoved).Infof("Node %q has drain taint %s, withdrawing its lease %s", n.ObjectMeta.Name, taint, ol.Subnet)
+			ksm.dispatchNodeEvent(n, subnet.Event{Type: subnet.EventRemoved, Lease: ol}, false)
+		}
 		return
 	}
-	if o.Annotations[backendDataAnnotation] == n.Annotations[backendDataAnnotation] &&
-		o.Annotations[backendTypeAnnotation] == n.Annotations[backendTypeAnnotation] &&
-		o.Annotations[backendPublicIPAnnotation] == n.Annotations[backendPublicIPAnnotation] {
+	if !withdrawn && !ksm.needsUpdate(o, n) {
 		return // No change to lease
 	}
+	subnetChanged := !stringSlicesEqual(podCIDRs(o), podCIDRs(n)) ||
+		!valueEqual(o.Annotations, n.Annotations, ksm.annotations.SubnetOverride)
 
-	l, err := nodeToLease(*n)
+	log := ksm.log.WithValues("node", n.ObjectMeta.Name, "event", subnet.EventAdded)
+	l, err := ksm.nodeToLease(*n)
 	if err != nil {
-		glog.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
+		log.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
 		return
 	}
-	ksm.events <- subnet.Event{subnet.EventAdded, l}
-}
+	ksm.trackLease(n.ObjectMeta.Name, l)
+	switch {
+	case wasDrained:
+		log.Infof("Node %q no longer has a drain taint, handing out its lease %s again", n.ObjectMeta.Name, l.Subnet)
+	case expired:
+		log.Infof("Node %q was updated again, handing out its expired lease %s again", n.ObjectMeta.Name, l.Subnet)
+	}
 
-func (ksm *kubeSubnetManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
-	return ksm.subnetConf, nil
-}
+	// A new pod CIDR or subnet override means the node moved to a different
+	// subnet, so the lease for the old one goes away. A drained node's old
+	// lease is gone already.
+	removed := false
+	if subnetChanged && oldManaged && !withdrawn {
+		if ol, err := ksm.nodeToLease(*o); err == nil && ol.Subnet != l.Subnet {
+			log.Infof("Subnet of node %q changed from %s to %s", n.ObjectMeta.Name, ol.Subnet, l.Subnet)
+			ksm.dispatchNodeEvent(n, subnet.Event{Type: subnet.EventRemoved, Lease: ol}, false)
+			removed = true
+		}
+	}
 
-func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
-	cachedNode, err := ksm.nodeStore.Get(ksm.nodeName)
-	if err != nil {
-		return nil, err
+	// A node switching backend type has its old lease handed out as removed,
+	// for the backend of the old type to tear down what it set up, unless
+	// it's the local node, whose lease must not look revoked.
+	ev := subnet.Event{Type: subnet.EventAdded, Lease: l}
+	if bt := o.Annotations[ksm.annotations.BackendType]; oldManaged && !withdrawn && bt != l.Attrs.BackendType {
+		log.Infof("Backend type of node %q changed from %q to %q", n.ObjectMeta.Name, bt, l.Attrs.BackendType)
+		ev.PreviousBackendType = bt
+		if !removed && n.ObjectMeta.Name != ksm.nodeName {
+			if ol, err := ksm.nodeToLease(*o); err == nil {
+				ksm.dispatchNodeEvent(n, subnet.Event{Type: subnet.EventRemoved, Lease: ol}, false)
+			}
+		}
 	}
-	nobj, err := api.Scheme.DeepCopy(cachedNode)
-	if err != nil {
-		return nil, err
+	ksm.dispatchNodeEvent(n, ev, true)
+}
+
+// drainTaint returns the drain taint n has, empty if it has none.
+func (ksm *kubeSubnetManager) drainTaint(n *v1.Node) string {
+	for _, key := range ksm.drainTaints {
+		if key == UnschedulableTaint && n.Spec.Unschedulable {
+			return key
+		}
+		for _, t := range n.Spec.Taints {
+			if t.Key == key {
+				return key
+			}
+		}
 	}
-	n := nobj.(*v1.Node)
+	return ""
+}
 
-	if n.Spec.PodCIDR == "" {
-		return nil, fmt.Errorf("node %q pod cidr not assigned", ksm.nodeName)
+// needsUpdate reports whether the change of a node from o to n changes its
+// lease, and so has to be handed out. This is the one place listing what a
+// lease is made from: anything nodeToLease reads has to be compared here too.
+// Whether the node is flannel managed is up to the caller.
+func (ksm *kubeSubnetManager) needsUpdate(o, n *v1.Node) bool {
+	for _, k := range []string{
+		ksm.annotations.BackendData,
+		ksm.annotations.BackendDataEncoding,
+		ksm.annotations.BackendV6Data,
+		ksm.annotations.BackendType,
+		ksm.annotations.BackendPublicIP,
+		ksm.annotations.BackendPublicIPv6,
+		ksm.annotations.MTUOverride,
+		ksm.annotations.SubnetOverride,
+		ksm.annotations.PolicyEnforced,
+	} {
+		if !valueEqual(o.Annotations, n.Annotations, k) {
+			return true
+		}
 	}
-	bd, err := attrs.BackendData.MarshalJSON()
-	if err != nil {
-		return nil, err
+	for _, k := range ksm.leaseNodeLabels {
+		if !valueEqual(o.Labels, n.Labels, k) {
+			return true
+		}
 	}
-	_, cidr, err := net.ParseCIDR(n.Spec.PodCIDR)
-	if err != nil {
-		return nil, err
+	for _, k := range ksm.leaseNodeAnnos {
+		if !valueEqual(o.Annotations, n.Annotations, k) {
+			return true
+		}
 	}
-	if n.Annotations[backendDataAnnotation] != string(bd) ||
-		n.Annotations[backendTypeAnnotation] != attrs.BackendType ||
-		n.Annotations[backendPublicIPAnnotation] != attrs.PublicIP.String() ||
-		n.Annotations[subnetKubeManagedAnnotation] != "true" ||
-		(n.Annotations[backendPublicIPOverwriteAnnotation] != "" && n.Annotations[backendPublicIPOverwriteAnnotation] != attrs.PublicIP.String()) {
-		n.Annotations[backendTypeAnnotation] = attrs.BackendType
-		n.Annotations[backendDataAnnotation] = string(bd)
-		if n.Annotations[backendPublicIPOverwriteAnnotation] != "" {
-			if n.Annotations[backendPublicIPAnnotation] != n.Annotations[backendPublicIPOverwriteAnnotation] {
-				glog.Infof("Overriding public ip with '%s' from node annotation '%s'",
-					n.Annotations[backendPublicIPOverwriteAnnotation],
-					backendPublicIPOverwriteAnnotation)
-				n.Annotations[backendPublicIPAnnotation] = n.Annotations[backendPublicIPOverwriteAnnotation]
-			}
-		} else {
-			n.Annotations[backendPublicIPAnnotation] = attrs.PublicIP.String()
+	if ksm.publicIPAddressType != "" {
+		oip, oip6 := ksm.addressPublicIPs(o)
+		nip, nip6 := ksm.addressPublicIPs(n)
+		if oip != nip || oip6 != nip6 {
+			return true
 		}
-		n.Annotations[subnetKubeManagedAnnotation] = "true"
+	}
+	return !stringSlicesEqual(podCIDRs(o), podCIDRs(n))
+}
 
-		oldData, err := json.Marshal(cachedNode)
-		if err != nil {
-			return nil, err
+// addressPublicIPs returns the public IPs n gets from its addresses of the
+// public IP address type: its first routable IPv4 address and, in dual-stack
+// mode, its first routable IPv6 address. Either is empty if n has none.
+func (ksm *kubeSubnetManager) addressPublicIPs(n *v1.Node) (publicIP, publicIPv6 string) {
+	for _, a := range n.Status.Addresses {
+		if a.Type != ksm.publicIPAddressType || ksm.checkRoutable(a.Address) != nil {
+			continue
 		}
-
-		newData, err := json.Marshal(n)
-		if err != nil {
-			return nil, err
+		switch v4 := net.ParseIP(a.Address).To4() != nil; {
+		case v4 && publicIP == "":
+			publicIP = a.Address
+		case !v4 && publicIPv6 == "" && ksm.subnetConf.EnableIPv6:
+			publicIPv6 = a.Address
 		}
+	}
+	return publicIP, publicIPv6
+}
 
-		patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, v1.Node{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to create patch for node %q: %v", ksm.nodeName, err)
+// valueEqual reports whether key is set to the same value in a and b, or in
+// neither.
+func valueEqual(a, b map[string]string, key string) bool {
+	av, aok := a[key]
+	bv, bok := b[key]
+	return av == bv && aok == bok
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
+	}
+	return true
+}
 
-		_, err = ksm.client.CoreV1().Nodes().Patch(ksm.nodeName, types.StrategicMergePatchType, patchBytes, "status")
-		if err != nil {
-			return nil, err
+// dispatchNodeEvent hands out a lease event made from node n. A debounced
+// event is held back for eventDebounce, during which later debounced events of
+// the node replace it, so only the node's latest lease is handed out. An event
+// handed out right away supersedes whatever is held back for the node.
+func (ksm *kubeSubnetManager) dispatchNodeEvent(n *v1.Node, ev subnet.Event, debounce bool) {
+	ksm.debounceMux.Lock()
+	defer ksm.debounceMux.Unlock()
+	if ksm.debounceStopped {
+		return
+	}
+
+	name := n.ObjectMeta.Name
+	e := leaseEvent{Event: ev}
+	// A lease withdrawn because the node changed is as of that change
+	e.Lease.Asof = parseResourceVersion(n.ResourceVersion)
+
+	p := ksm.pending[name]
+	if !debounce || ksm.eventDebounce < 0 {
+		if p != nil {
+			p.timer.Stop()
+			delete(ksm.pending, name)
 		}
+		ksm.dispatch(e)
+		return
 	}
-	return &subnet.Lease{
-		Subnet:     ip.FromIPNet(cidr),
-		Attrs:      *attrs,
-		Expiration: time.Now().Add(24 * time.Hour),
-	}, nil
+	if p != nil {
+		// The held back event may be the one telling of a backend type
+		// change
+		if prev := p.event.PreviousBackendType; prev != "" {
+			e.PreviousBackendType = prev
+		}
+		if e.PreviousBackendType == e.Lease.Attrs.BackendType {
+			e.PreviousBackendType = ""
+		}
+		p.event = e
+		return
+	}
+	p = &pendingEvent{event: e}
+	p.timer = time.AfterFunc(ksm.eventDebounce, func() {
+		ksm.debounceMux.Lock()
+		defer ksm.debounceMux.Unlock()
+		if ksm.pending[name] != p {
+			return // Superseded or flushed
+		}
+		delete(ksm.pending, name)
+		ksm.dispatch(p.event)
+	})
+	ksm.pending[name] = p
 }
 
-func (ksm *kubeSubnetManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
-	select {
-	case event := <-ksm.events:
-		return subnet.LeaseWatchResult{
-			Events: []subnet.Event{event},
-		}, nil
-	case <-ctx.Done():
-		return subnet.LeaseWatchResult{}, nil
+// flushPendingEvents hands out all held back events. No events are handed out
+// afterwards, so the event channel can be closed.
+func (ksm *kubeSubnetManager) flushPendingEvents() {
+	ksm.debounceMux.Lock()
+	defer ksm.debounceMux.Unlock()
+	for name, p := range ksm.pending {
+		p.timer.Stop()
+		delete(ksm.pending, name)
+		ksm.dispatch(p.event)
 	}
+	ksm.debounceStopped = true
 }
 
-func (ksm *kubeSubnetManager) Run(ctx context.Context) {
-	glog.Infof("Starting kube subnet manager")
-	ksm.nodeController.Run(ctx.Done())
+// dispatch hands an event to WatchLeases, to any WatchLease watching the
+// event's subnet and to the subscribers. It runs on the informer goroutine, so it never blocks for
+// long: if the event buffer stays full for eventSendTimeout the event is
+// dropped and counted in flannel_kube_events_dropped_total. A dropped event
+// is lost for good; the lease is only seen again when the node next changes.
+// The caller holds debounceMux, which keeps the events in sequence.
+func (ksm *kubeSubnetManager) dispatch(e leaseEvent) {
+	ksm.lastSeq++
+	e.seq = ksm.lastSeq
+	select {
+	case ksm.events <- e:
+	default:
+		eventsBlockedTotal.Add(1)
+		select {
+		case ksm.events <- e:
+		case <-time.After(eventSendTimeout):
+			eventsDroppedTotal.Add(1)
+			ksm.log.WithValues("event", e.Type, "subnet", e.Lease.Subnet).Errorf("Dropping lease event for subnet %s, lease watcher is not keeping up", e.Lease.Subnet)
+		}
+	}
+	eventsQueueLength.Set(int64(len(ksm.events)))
+
+	ksm.mux.Lock()
+	defer ksm.mux.Unlock()
+	for lw := range ksm.leaseWatches {
+		// Leases of IPv6 only networks have no IPv4 subnet to be watched by
+		if e.Lease.Subnet.Empty() || !lw.sn.Equal(e.Lease.Subnet) {
+			continue
+		}
+		select {
+		case lw.events <- e.Event:
+		default:
+			ksm.log.WithValues("event", e.Type, "subnet", lw.sn).Warningf("Dropping event for subnet %s, watcher is not keeping up", lw.sn)
+		}
+	}
+	ksm.publish(e.Event)
 }
 
-func nodeToLease(n v1.Node) (l subnet.Lease, err error) {
-	l.Attrs.PublicIP, err = ip.ParseIP4(n.Annotations[backendPublicIPAnnotation])
+// GetNetworkConfig returns the network config read at startup. If the local
+// node has a backend-type-override annotation, a copy of the config is
+// returned instead, with the backend type taken from the annotation: the
+// annotation takes precedence over the Type of the Backend section, whose
+// other settings are kept. Likewise, the settings of a backend-config-override
+// annotation, a JSON object, are merged into the Backend section of a copy.
+// Invalid config overrides are logged and ignored. The base config itself is
+// never modified.
+func (ksm *kubeSubnetManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	n, err := ksm.nodeStore.Get(ksm.nodeName)
 	if err != nil {
-		return l, err
+		if apierrors.IsNotFound(err) {
+			return ksm.subnetConf, nil
+		}
+		return nil, err
 	}
 
-	l.Attrs.BackendType = n.Annotations[backendTypeAnnotation]
-	l.Attrs.BackendData = json.RawMessage(n.Annotations[backendDataAnnotation])
+	sc := ksm.subnetConf
+	if bt := n.Annotations[ksm.annotations.BackendTypeOverride]; bt != "" && bt != sc.BackendType {
+		if _, ok := backendSettings[bt]; !ok {
+			return nil, fmt.Errorf("node %q has unknown backend type %q in annotation %s", ksm.nodeName, bt, ksm.annotations.BackendTypeOverride)
+		}
+		if !sc.BackendAllowed(bt) {
+			return nil, fmt.Errorf("node %q selects backend type %q in annotation %s, which is not allowed by the network config", ksm.nodeName, bt, ksm.annotations.BackendTypeOverride)
+		}
+		ksm.log.WithValues("node", ksm.nodeName).Infof("Using backend type %q from node annotation %s instead of %q", bt, ksm.annotations.BackendTypeOverride, sc.BackendType)
+		if sc, err = withBackendType(sc, bt); err != nil {
+			return nil, err
+		}
+	}
+	if override, ok := n.Annotations[ksm.annotations.BackendConfigOverride]; ok {
+		c, err := withBackendConfig(sc, override)
+		if err != nil {
+			ksm.log.WithValues("node", ksm.nodeName).Warningf("Ignoring invalid %s annotation of node %q: %v", ksm.annotations.BackendConfigOverride, ksm.nodeName, err)
+		} else {
+			ksm.log.WithValues("node", ksm.nodeName).Infof("Using backend settings %s from node annotation %s", override, ksm.annotations.BackendConfigOverride)
+			sc = c
+		}
+	}
+	return sc, nil
+}
 
-	_, cidr, err := net.ParseCIDR(n.Spec.PodCIDR)
+// withBackendType returns a copy of sc using backend type bt.
+func withBackendType(sc *subnet.Config, bt string) (*subnet.Config, error) {
+	be := map[string]interface{}{}
+	if len(sc.Backend) > 0 {
+		if err := json.Unmarshal(sc.Backend, &be); err != nil {
+			return nil, fmt.Errorf("error decoding Backend property of config: %v", err)
+		}
+	}
+	be["Type"] = bt
+	backend, err := json.Marshal(be)
 	if err != nil {
-		return l, err
+		return nil, err
 	}
 
-	l.Subnet = ip.FromIPNet(cidr)
-	return l, nil
+	c := *sc
+	c.BackendType = bt
+	c.Backend = backend
+	return &c, nil
 }
 
-// unimplemented
-func (ksm *kubeSubnetManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
-	return ErrUnimplemented
+func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	res, err := ksm.AcquireLeaseDetailed(ctx, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return res.Lease, nil
 }
 
-func (ksm *kubeSubnetManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
-	return subnet.LeaseWatchResult{}, ErrUnimplemented
+// AcquireStatus tells what acquiring a lease did to the flannel annotations
+// of the local node. In dry-run mode, it is what would have been done.
+type AcquireStatus string
+
+const (
+	// AcquireCreated means the node wasn't flannel managed before.
+	AcquireCreated AcquireStatus = "Created"
+	// AcquireUpdated means the node's flannel annotations were changed.
+	AcquireUpdated AcquireStatus = "Updated"
+	// AcquireUnchanged means the node already had the lease's annotations,
+	// and wasn't patched.
+	AcquireUnchanged AcquireStatus = "Unchanged"
+)
+
+// AcquireResult is the outcome of AcquireLeaseDetailed.
+type AcquireResult struct {
+	// Lease is the acquired lease.
+	Lease *subnet.Lease
+	// Previous is the lease the local node held before, as cached, or nil
+	// if it wasn't flannel managed. Its expiration isn't known.
+	Previous *subnet.Lease
+	// Changed reports whether Lease differs from Previous, other than by
+	// its expiration, so callers can skip redundant work when it doesn't.
+	Changed bool
+	// Status tells whether the node's annotations were created, updated
+	// or left alone. It may be AcquireUpdated with Changed false, when only
+	// annotations not handed out with the lease changed, such as the
+	// flannel version.
+	Status AcquireStatus
+}
+
+// AcquireLeaseDetailed is AcquireLease, also returning the lease the local
+// node held before, whether the acquired one differs from it, and what was
+// done to the node's annotations. Acquiring the same lease again is
+// idempotent: the node is only patched if its annotations differ. Within
+// the acquire window, it isn't even read, see AcquireLeaseWindow. attrs
+// isn't modified.
+func (ksm *kubeSubnetManager) AcquireLeaseDetailed(ctx context.Context, attrs *subnet.LeaseAttrs) (*AcquireResult, error) {
+	// Merging backend data changes the attributes the lease is acquired
+	// with; the caller's are left alone.
+	in := *attrs
+	a := in
+	attrs = &a
+
+	var prev *subnet.Lease
+	if n, err := ksm.nodeStore.Get(ksm.nodeName); err == nil && n.Annotations[ksm.annotations.SubnetKubeManaged] == "true" {
+		if l, err := ksm.nodeToLease(*n); err == nil {
+			prev = &l
+		}
+	}
+
+	now := time.Now()
+	if ksm.elector == nil || ksm.elector.isLeader() {
+		if l := ksm.acquired.get(&in, now); l != nil {
+			leaseAcquisitionsTotal.Add("coalesced", 1)
+			// As if it had just been acquired again
+			l.Expiration = ksm.expiration()
+			return &AcquireResult{
+				Lease:    l,
+				Previous: prev,
+				Changed:  prev == nil || !sameLease(prev, l),
+				Status:   AcquireUnchanged,
+			}, nil
+		}
+	}
+
+	l, status, err := ksm.acquireLease(ctx, attrs)
+	if err != nil {
+		return nil, err
+	}
+	ksm.acquired.put(in, l, now)
+	return &AcquireResult{
+		Lease:    l,
+		Previous: prev,
+		Changed:  prev == nil || !sameLease(prev, l),
+		Status:   status,
+	}, nil
+}
+
+// sameLease reports whether a and b hand out the same subnets and attributes.
+func sameLease(a, b *subnet.Lease) bool {
+	return a.Subnet.Equal(b.Subnet) &&
+		a.IPv6Subnet.Equal(b.IPv6Subnet) &&
+		a.Attrs.PublicIP == b.Attrs.PublicIP &&
+		(a.Attrs.PublicIPv6 == nil) == (b.Attrs.PublicIPv6 == nil) &&
+		(a.Attrs.PublicIPv6 == nil || *a.Attrs.PublicIPv6 == *b.Attrs.PublicIPv6) &&
+		a.Attrs.BackendType == b.Attrs.BackendType &&
+		bytes.Equal(a.Attrs.BackendData, b.Attrs.BackendData) &&
+		bytes.Equal(a.Attrs.BackendV6Data, b.Attrs.BackendV6Data) &&
+		a.Attrs.MTU == b.Attrs.MTU &&
+		a.Attrs.PolicyEnforced == b.Attrs.PolicyEnforced
+}
+
+func (ksm *kubeSubnetManager) acquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, AcquireStatus, error) {
+	start := time.Now()
+	sn, sn6, status, err := ksm.syncNodeAnnotations(ctx, attrs, true)
+	leaseAcquireDuration.observe(time.Since(start))
+	leaseAcquisitionsTotal.Add(acquireOutcome(err), 1)
+	ksm.noteAcquireResult(ctx, err)
+	if err != nil {
+		return nil, "", err
+	}
+	ksm.setLeaseAttrs(attrs)
+	l := &subnet.Lease{
+		Subnet:     sn,
+		IPv6Subnet: sn6,
+		Attrs:      *attrs,
+		Expiration: ksm.expiration(),
+	}
+	// The local backend gets the node's MTU override like its peers do
+	if n, err := ksm.nodeStore.Get(ksm.nodeName); err == nil {
+		l.Attrs.MTU = ksm.mtuOverride(n)
+		l.Attrs.PolicyEnforced = ksm.policyEnforced(n, attrs)
+	}
+	return l, status, nil
+}
+
+// acquireOutcome classifies the result of an AcquireLease call for
+// flannel_kube_lease_acquisitions_total.
+func acquireOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case apierrors.IsConflict(err):
+		return "conflict"
+	case err == ErrNodeNotFound || apierrors.IsNotFound(err):
+		return "not_found"
+	default:
+		return "error"
+	}
+}
+
+// syncNodeAnnotations makes sure the flannel annotations on the local node
+// match attrs, patching the node only if something changed. With leader
+// election enabled only the instance elected for the node may do so. It
+// returns the node's IPv4 pod CIDR and, in dual-stack mode, its IPv6 pod
+// CIDR, along with what was done to the annotations.
+// The patch is built from the node as last seen and only applies to that
+// version of it. If the node has changed since, the patch hits a conflict and
+// the node is re-read from the API and the patch rebuilt, up to patchRetries
+// times. With fresh, the node is checked against
+// the API first, see localNode.
+func (ksm *kubeSubnetManager) syncNodeAnnotations(ctx context.Context, attrs *subnet.LeaseAttrs, fresh bool) (ip.IP4Net, ip.IP6Net, AcquireStatus, error) {
+	if ksm.elector != nil && !ksm.elector.isLeader() {
+		return ip.IP4Net{}, ip.IP6Net{}, "", ErrNotLeader
+	}
+	if !ksm.subnetConf.BackendAllowed(attrs.BackendType) {
+		return ip.IP4Net{}, ip.IP6Net{}, "", fmt.Errorf("backend type %q is not allowed by the network config", attrs.BackendType)
+	}
+
+	cachedNode, err := ksm.localNode(ctx, fresh)
+	if err == nil {
+		cachedNode, err = ksm.waitForPodCIDR(ctx, cachedNode)
+	}
+	for i := 1; ; i++ {
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return ip.IP4Net{}, ip.IP6Net{}, "", ErrNodeNotFound
+			}
+			return ip.IP4Net{}, ip.IP6Net{}, "", err
+		}
+
+		sn, sn6, status, err := ksm.patchNodeAnnotations(ctx, cachedNode, attrs)
+		if !apierrors.IsConflict(err) || i == patchRetries {
+			return sn, sn6, status, err
+		}
+		ksm.log.WithValues("node", ksm.nodeName).Debugf("Conflict patching node %q, retrying (%d/%d): %v", ksm.nodeName, i, patchRetries, err)
+		cachedNode, err = getNode(ctx, ksm.client, ksm.apiTimeout, ksm.nodeName)
+	}
+}
+
+// localNode returns the local node from the cache. With fresh, a node the
+// cache doesn't have, or has without its pod CIDRs, is read from the API as
+// well, and used instead if the cache doesn't have it or has another node of
+// the same name: a node deleted and re-added, which has yet to be assigned
+// pod CIDRs, may not have reached the cache yet. A cached node with its pod
+// CIDRs is taken as is, sparing the API a read per acquisition. Nodes patched
+// through nodePatcher only live in the cache, which is never stale then.
+func (ksm *kubeSubnetManager) localNode(ctx context.Context, fresh bool) (*v1.Node, error) {
+	cached, err := ksm.nodeStore.Get(ksm.nodeName)
+	if !fresh || ksm.nodePatcher != nil || (err == nil && ksm.hasPodCIDRs(cached)) {
+		return cached, err
+	}
+	n, apiErr := getNode(ctx, ksm.client, ksm.apiTimeout, ksm.nodeName)
+	switch {
+	case apiErr != nil:
+		// The cache will have to do
+		return cached, err
+	case err != nil:
+		return n, nil
+	case cached.UID != n.UID:
+		ksm.log.WithValues("node", ksm.nodeName).Infof("Node %q was re-created, its cached copy is out of date", ksm.nodeName)
+		return n, nil
+	}
+	return cached, nil
+}
+
+// waitForSync waits up to timeout, or until ctx is done, for the node
+// controller to sync. While the
+// API server is overloaded, e.g. when the whole cluster restarts, the initial
+// list can take a while; checking less and less often, and logging progress,
+// beats giving up and having the process restart into another full list.
+func (ksm *kubeSubnetManager) waitForSync(ctx context.Context, timeout time.Duration) error {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	interval := syncBackoff.Duration
+	for !ksm.nodeController.HasSynced() {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return wait.ErrWaitTimeout
+		}
+		d := interval
+		if syncBackoff.Jitter > 0 {
+			d = wait.Jitter(interval, syncBackoff.Jitter)
+		}
+		if d > remaining {
+			d = remaining
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if ksm.nodeController.HasSynced() {
+			break
+		}
+		ksm.log.Infof("Node controller not yet synced after %v", time.Since(start)/time.Second*time.Second)
+		interval = time.Duration(float64(interval) * syncBackoff.Factor)
+		if interval > maxSyncInterval {
+			interval = maxSyncInterval
+		}
+	}
+	return nil
+}
+
+// waitForPodCIDR waits for the controller manager to assign the local node
+// its pod CIDRs, which freshly joined nodes don't have yet. It gives up after
+// podCIDRWait and returns the node as last seen, leaving the error to the
+// caller.
+func (ksm *kubeSubnetManager) waitForPodCIDR(ctx context.Context, n *v1.Node) (*v1.Node, error) {
+	if ksm.hasPodCIDRs(n) {
+		return n, nil
+	}
+
+	ksm.log.WithValues("node", ksm.nodeName).Infof("Waiting up to %v for node %q to be assigned a pod cidr", ksm.podCIDRWait, ksm.nodeName)
+	timeout := time.NewTimer(ksm.podCIDRWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(podCIDRPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cached, err := ksm.nodeStore.Get(ksm.nodeName)
+			if err == nil && cached.UID != n.UID {
+				continue // The cache has yet to see the node re-created
+			}
+			if err != nil || ksm.hasPodCIDRs(cached) {
+				return cached, err
+			}
+		case <-timeout.C:
+			return n, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// hasPodCIDRs reports whether n has the pod CIDRs the network needs. A
+// subnet override stands in for the IPv4 pod CIDR.
+func (ksm *kubeSubnetManager) hasPodCIDRs(n *v1.Node) bool {
+	cidr, cidr6, err := parsePodCIDRs(n)
+	if err != nil {
+		return true // Nothing to wait for, it won't get any better
+	}
+	if cidr == nil && ksm.ipv4Enabled() {
+		if _, overridden := ksm.subnetOverride(n); !overridden {
+			return false
+		}
+	}
+	return cidr6 != nil || !ksm.subnetConf.EnableIPv6
+}
+
+// ipv4Enabled reports whether the network has IPv4 subnets. Only a network
+// with EnableIPv6 set and no IPv4 Network is IPv6 only.
+func (ksm *kubeSubnetManager) ipv4Enabled() bool {
+	return !ksm.subnetConf.EnableIPv6 || !ksm.subnetConf.Network.Empty()
+}
+
+// patchNodeAnnotations patches the flannel annotations of n to match attrs.
+// The patch is built from the annotations alone, so nothing is copied or
+// marshaled in the common case where they already match. n usually comes
+// from the informer cache, shared with the other readers, so it is never
+// modified: changes only go into the patch. With
+// attrs.MergeBackendData set, attrs.BackendData is merged into the node's
+// backend data and, once the node has it, replaced by the result.
+//
+// If the patch fails and failed patches are tolerated, the node is read
+// again: when it already has the annotations the patch would have set, e.g.
+// because a previous flannel process set them, the patch isn't needed and
+// the failure is only logged.
+func (ksm *kubeSubnetManager) patchNodeAnnotations(ctx context.Context, n *v1.Node, attrs *subnet.LeaseAttrs) (ip.IP4Net, ip.IP6Net, AcquireStatus, error) {
+	sn, sn6, patch, bd, err := ksm.nodeAnnotationPatch(n, attrs)
+	if err != nil {
+		return sn, sn6, "", err
+	}
+	status := AcquireUnchanged
+	if patch != nil {
+		status = AcquireUpdated
+		if n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" {
+			status = AcquireCreated
+		}
+		err = ksm.patchLocalNode(ctx, patch)
+		if apierrors.IsNotFound(err) {
+			return sn, sn6, "", ErrNodeNotFound
+		}
+		if err != nil {
+			if !ksm.tolerateFailedPatch {
+				return sn, sn6, "", err
+			}
+			var applied bool
+			sn, sn6, bd, applied = ksm.patchApplied(ctx, attrs)
+			if !applied {
+				return sn, sn6, "", err
+			}
+			ksm.log.WithValues("node", ksm.nodeName).Warningf("Failed to patch node %q, but it already has the lease's annotations: %v", ksm.nodeName, err)
+		} else {
+			ksm.recordPublicIPOverwrites(ctx, n, attrs)
+		}
+	}
+	if attrs.MergeBackendData {
+		// The lease carries what the node now has
+		attrs.BackendData = json.RawMessage(bd)
+	}
+	return sn, sn6, status, nil
+}
+
+// patchApplied reads the local node from the API, and reports whether it
+// already has the flannel annotations matching attrs, along with the pod
+// CIDRs and backend data they hand out.
+func (ksm *kubeSubnetManager) patchApplied(ctx context.Context, attrs *subnet.LeaseAttrs) (ip.IP4Net, ip.IP6Net, []byte, bool) {
+	n, err := getNode(ctx, ksm.client, ksm.apiTimeout, ksm.nodeName)
+	if err != nil {
+		ksm.log.WithValues("node", ksm.nodeName).Warningf("Failed to read node %q again after a failed patch: %v", ksm.nodeName, err)
+		return ip.IP4Net{}, ip.IP6Net{}, nil, false
+	}
+	sn, sn6, patch, bd, err := ksm.nodeAnnotationPatch(n, attrs)
+	return sn, sn6, bd, err == nil && patch == nil
+}
+
+// nodeAnnotationPatch returns the pod CIDRs n hands out, along with the patch
+// that makes the flannel annotations of n match attrs, nil if they already
+// do, and the backend data the patch sets.
+func (ksm *kubeSubnetManager) nodeAnnotationPatch(n *v1.Node, attrs *subnet.LeaseAttrs) (sn ip.IP4Net, sn6 ip.IP6Net, patch []byte, bd []byte, err error) {
+	cidr, cidr6, err := parsePodCIDRs(n)
+	if err != nil {
+		return sn, sn6, nil, nil, err
+	}
+	override, overridden := ksm.subnetOverride(n)
+	if cidr == nil && !overridden && ksm.ipv4Enabled() {
+		return sn, sn6, nil, nil, fmt.Errorf("node %q pod cidr not assigned", ksm.nodeName)
+	}
+	if ksm.subnetConf.EnableIPv6 && cidr6 == nil {
+		return sn, sn6, nil, nil, fmt.Errorf("node %q ipv6 pod cidr not assigned", ksm.nodeName)
+	}
+	switch {
+	case overridden:
+		podCIDR := "none"
+		if cidr != nil {
+			podCIDR = cidr.String()
+		}
+		if ksm.logged.changed(ksm.nodeName, "pinned-subnet", override.String()+" "+podCIDR) {
+			ksm.log.WithValues("node", ksm.nodeName).Warningf("Node %q holds subnet %s as pinned by its %s annotation, not its pod cidr (%s)",
+				ksm.nodeName, override, ksm.annotations.SubnetOverride, podCIDR)
+		}
+		sn = override
+	case cidr != nil:
+		ksm.logged.clear(ksm.nodeName, "pinned-subnet")
+		sn = ip.FromIPNet(cidr)
+	}
+	if cidr6 != nil {
+		sn6 = ip.FromIP6Net(cidr6)
+	}
+	ksm.checkPreferredSubnet(n, sn)
+	// An override is already known to be within the network
+	if err := ksm.checkPodCIDRs(sn, sn6); err != nil {
+		if !ksm.podCIDRCheckWarnOnly {
+			return sn, sn6, nil, nil, err
+		}
+		ksm.log.WithValues("node", ksm.nodeName).Warningf("%v, pods on it won't be reachable", err)
+	}
+
+	bd, err = attrs.BackendData.MarshalJSON()
+	if err != nil {
+		return sn, sn6, nil, nil, err
+	}
+	if attrs.MergeBackendData {
+		// Undecodable data is as good as malformed, the patch replaces it
+		cur, _ := ksm.nodeBackendData(n)
+		if len(cur) != 0 {
+			bd, err = mergeBackendData(cur, bd)
+			if err != nil {
+				return sn, sn6, nil, nil, fmt.Errorf("failed to merge backend data of node %q: %v", ksm.nodeName, err)
+			}
+		}
+	}
+	bdValue, bdEncoding, err := encodeBackendData(bd, ksm.compressionThreshold)
+	if err != nil {
+		return sn, sn6, nil, nil, fmt.Errorf("failed to encode backend data of node %q: %v", ksm.nodeName, err)
+	}
+	bd6, err := backendV6Data(attrs)
+	if err != nil {
+		return sn, sn6, nil, nil, err
+	}
+	var publicIP, publicIPv6 string
+	if attrs.PublicIP != 0 || attrs.PublicIPv6 == nil {
+		publicIP = publicIPAnnotationValue(n, ksm.annotations.BackendPublicIPOverwrite, attrs.PublicIP.String())
+	}
+	if attrs.PublicIPv6 != nil {
+		publicIPv6 = publicIPAnnotationValue(n, ksm.annotations.BackendPublicIPv6Overwrite, attrs.PublicIPv6.String())
+	}
+	if n.Annotations[ksm.annotations.AllowUnroutablePublicIP] != "true" {
+		for _, addr := range []string{publicIP, publicIPv6} {
+			if err := ksm.checkRoutable(addr); err != nil {
+				return sn, sn6, nil, nil, err
+			}
+		}
+	}
+
+	p := annotationPatch{}
+	p.set(n, ksm.annotations.BackendType, attrs.BackendType)
+	p.set(n, ksm.annotations.BackendData, bdValue)
+	p.setOrDelete(n, ksm.annotations.BackendDataEncoding, bdEncoding)
+	p.setOrDelete(n, ksm.annotations.BackendV6Data, bd6)
+	p.setOrDelete(n, ksm.annotations.BackendPublicIP, publicIP)
+	p.setOrDelete(n, ksm.annotations.BackendPublicIPv6, publicIPv6)
+	p.setOrDelete(n, ksm.annotations.PolicyEnforced, policyEnforcedValue(ksm.policyEnforced(n, attrs)))
+	p.set(n, ksm.annotations.SubnetKubeManaged, "true")
+	p.set(n, ksm.annotations.Version, version.Version)
+	var l map[string]interface{}
+	if ksm.managedNodeLabel != "" && n.Labels[ksm.managedNodeLabel] != "true" {
+		l = map[string]interface{}{ksm.managedNodeLabel: "true"}
+	}
+	if len(p) != 0 || len(l) != 0 {
+		patch, err = p.marshalAt(n.ResourceVersion, l)
+		if err != nil {
+			return sn, sn6, nil, nil, fmt.Errorf("failed to create patch for node %q: %v", ksm.nodeName, err)
+		}
+	}
+	return sn, sn6, patch, bd, nil
+}
+
+// backendV6Data returns the value of the IPv6 backend data annotation for
+// attrs, empty if there is none.
+func backendV6Data(attrs *subnet.LeaseAttrs) (string, error) {
+	if len(attrs.BackendV6Data) == 0 {
+		return "", nil
+	}
+	bd6, err := attrs.BackendV6Data.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	return string(bd6), nil
+}
+
+// checkPodCIDRs returns an error if a pod CIDR of the local node, sn or sn6,
+// isn't within the network it belongs to. Empty ones aren't checked.
+func (ksm *kubeSubnetManager) checkPodCIDRs(sn ip.IP4Net, sn6 ip.IP6Net) error {
+	if network := ksm.subnetConf.Network; !sn.Empty() && !network.Empty() &&
+		(!network.Contains(sn.IP) || sn.PrefixLen < network.PrefixLen) {
+		return fmt.Errorf("node %q pod cidr %s is not within the flannel network %s", ksm.nodeName, sn, network)
+	}
+	if network := ksm.subnetConf.IPv6Network; !sn6.Empty() && !network.Empty() &&
+		(!network.Contains(sn6.IP) || sn6.PrefixLen < network.PrefixLen) {
+		return fmt.Errorf("node %q ipv6 pod cidr %s is not within the flannel network %s", ksm.nodeName, sn6, network)
+	}
+	return nil
+}
+
+// mergeBackendData applies patch to the backend data cur as a JSON merge
+// patch (RFC 7386): objects are merged field by field, a null field is
+// removed and anything else replaces what was there.
+func mergeBackendData(cur, patch []byte) ([]byte, error) {
+	var c, p interface{}
+	if err := json.Unmarshal(cur, &c); err != nil {
+		// Nothing sensible to merge into, the patch replaces it
+		c = nil
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeJSON(c, p))
+}
+
+func mergeJSON(cur, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	c, ok := cur.(map[string]interface{})
+	if !ok {
+		c = make(map[string]interface{}, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = mergeJSON(c[k], v)
+		}
+	}
+	return c
+}
+
+// publicIPAnnotationValue returns the public IP to advertise for the node: the
+// value of the overwrite annotation if it is set, otherwise publicIP.
+func publicIPAnnotationValue(n *v1.Node, overwriteAnnotation, publicIP string) string {
+	if overwrite := n.Annotations[overwriteAnnotation]; overwrite != "" {
+		return overwrite
+	}
+	return publicIP
+}
+
+// recordPublicIPOverwrites counts and records as an event on the node each
+// public IP annotation that patching n to match attrs changed to the value of
+// an overwrite annotation, so there is a trail of why the node advertises a
+// non-default IP. Patches leaving the annotations as they were aren't
+// recorded.
+func (ksm *kubeSubnetManager) recordPublicIPOverwrites(ctx context.Context, n *v1.Node, attrs *subnet.LeaseAttrs) {
+	if attrs.PublicIP != 0 || attrs.PublicIPv6 == nil {
+		ksm.recordPublicIPOverwrite(ctx, n, ksm.annotations.BackendPublicIP, ksm.annotations.BackendPublicIPOverwrite, attrs.PublicIP.String())
+	}
+	if attrs.PublicIPv6 != nil {
+		ksm.recordPublicIPOverwrite(ctx, n, ksm.annotations.BackendPublicIPv6, ksm.annotations.BackendPublicIPv6Overwrite, attrs.PublicIPv6.String())
+	}
+}
+
+func (ksm *kubeSubnetManager) recordPublicIPOverwrite(ctx context.Context, n *v1.Node, annotation, overwriteAnnotation, publicIP string) {
+	overwrite := publicIPAnnotationValue(n, overwriteAnnotation, publicIP)
+	if overwrite == publicIP || n.Annotations[annotation] == overwrite {
+		return
+	}
+	ksm.log.WithValues("node", n.ObjectMeta.Name).Infof("Overriding public ip with '%s' from node annotation '%s'", overwrite, overwriteAnnotation)
+	publicIPOverwritesTotal.Add(1)
+	ksm.recordNodeEvent(ctx, n.ObjectMeta.Name, v1.EventTypeNormal, "PublicIPOverwritten",
+		fmt.Sprintf("Advertising public IP %s instead of %s as set by annotation %s", overwrite, publicIP, overwriteAnnotation))
+}
+
+// checkRoutable returns an error if the public IP addr can't be reached from
+// other hosts. Such an address usually means flannel picked the wrong
+// interface, and advertising it would break the overlay. An empty addr is
+// not advertised, so it is fine.
+func (ksm *kubeSubnetManager) checkRoutable(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	var reason string
+	switch parsed := net.ParseIP(addr); {
+	case parsed == nil:
+		reason = "not an IP address"
+	case parsed.IsUnspecified():
+		reason = "unspecified"
+	case parsed.IsLoopback():
+		reason = "a loopback address"
+	case parsed.IsLinkLocalUnicast(), parsed.IsLinkLocalMulticast():
+		reason = "a link-local address"
+	default:
+		return nil
+	}
+	return fmt.Errorf("public IP %s of node %q is %s; set the interface or public IP flannel should use, or annotate the node with %s=true to advertise it anyway",
+		addr, ksm.nodeName, reason, ksm.annotations.AllowUnroutablePublicIP)
+}
+
+// annotationPatch collects the annotation changes to make to a node. A nil
+// value deletes the annotation.
+type annotationPatch map[string]interface{}
+
+// set records key=value if the node doesn't have it already.
+func (p annotationPatch) set(n *v1.Node, key, value string) {
+	if cur, ok := n.Annotations[key]; !ok || cur != value {
+		p[key] = value
+	}
+}
+
+// setOrDelete is like set, but an empty value removes the annotation.
+func (p annotationPatch) setOrDelete(n *v1.Node, key, value string) {
+	if value != "" {
+		p.set(n, key, value)
+		return
+	}
+	if _, ok := n.Annotations[key]; ok {
+		p[key] = nil
+	}
+}
+
+// marshal returns p as a strategic merge patch of the node. The patch holds
+// the annotations in p and nothing else, so fields the server defaults or
+// other controllers own are never written back.
+func (p annotationPatch) marshal() ([]byte, error) {
+	return p.marshalWithLabels(nil)
+}
+
+// marshalWithLabels is like marshal, but the patch also sets the labels in l,
+// or removes those set to nil.
+func (p annotationPatch) marshalWithLabels(l map[string]interface{}) ([]byte, error) {
+	return p.marshalAt("", l)
+}
+
+// marshalAt is like marshalWithLabels, but the patch only applies to the
+// node at resourceVersion, the version it was built from: the API server
+// fails it with a conflict once the node has changed. An empty
+// resourceVersion applies to any version.
+func (p annotationPatch) marshalAt(resourceVersion string, l map[string]interface{}) ([]byte, error) {
+	metadata := map[string]interface{}{
+		"annotations": p,
+	}
+	if len(l) != 0 {
+		metadata["labels"] = l
+	}
+	if resourceVersion != "" {
+		metadata["resourceVersion"] = resourceVersion
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+	})
+}
+
+// WatchLeases watches the leases of all flannel managed nodes. The first call
+// (nil cursor) returns a snapshot of the current leases. Later calls, passing
+// back the cursor returned by the previous one, wait for the next event and
+// return it along with those queued behind it, up to watchBatchSize, in
+// order. Events the cursor has seen, whether handed out before or already
+// part of the snapshot, are skipped rather than replayed. Cursors count the
+// events the manager dispatched, so they only make sense to the manager that
+// issued them.
+//
+// Once the node informer has been unhealthy for longer than the
+// UnhealthyTimeout, WatchLeases fails with ErrInformerUnhealthy, right away
+// when called, until the informer recovers.
+func (ksm *kubeSubnetManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	if cursor == nil {
+		return ksm.leaseSnapshot()
+	}
+	c, ok := cursor.(watchCursor)
+	if !ok {
+		return subnet.LeaseWatchResult{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+
+	// The informer is checked every so often while waiting
+	var check <-chan time.Time
+	if ksm.unhealthyTimeout > 0 {
+		if err := ksm.checkUnhealthy(time.Now()); err != nil {
+			return subnet.LeaseWatchResult{}, err
+		}
+		ticker := time.NewTicker(ksm.unhealthyTimeout / 4)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	var events []subnet.Event
+	for len(events) == 0 {
+		select {
+		case e, ok := <-ksm.events:
+			if !ok {
+				return subnet.LeaseWatchResult{}, subnet.ErrShuttingDown
+			}
+			events = c.add(events, e)
+		case now := <-check:
+			if err := ksm.checkUnhealthy(now); err != nil {
+				return subnet.LeaseWatchResult{}, err
+			}
+		case <-ctx.Done():
+			return subnet.LeaseWatchResult{}, ctx.Err()
+		}
+	}
+	// Take what else is queued, without waiting for more
+drain:
+	for len(events) < ksm.watchBatchSize {
+		select {
+		case e, ok := <-ksm.events:
+			if !ok {
+				break drain // ErrShuttingDown on the next call
+			}
+			events = c.add(events, e)
+		default:
+			break drain
+		}
+	}
+	eventsQueueLength.Set(int64(len(ksm.events)))
+	return subnet.LeaseWatchResult{
+		Events: events,
+		Cursor: c,
+	}, nil
+}
+
+// add appends e to events unless the cursor has seen it, and moves the cursor
+// past it.
+func (c *watchCursor) add(events []subnet.Event, e leaseEvent) []subnet.Event {
+	if e.seq < c.seq {
+		return events // Seen already
+	}
+	c.seq = e.seq + 1
+	return append(events, e.Event)
+}
+
+// Snapshot returns the leases of all flannel managed nodes as one batch of
+// EventAdded events, without waiting for anything to change. It suits tools
+// that read the leases once and exit. The cursor returned can be passed to
+// WatchLeases to follow the changes from there.
+func (ksm *kubeSubnetManager) Snapshot(ctx context.Context) (subnet.LeaseWatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+	res, err := ksm.leaseSnapshot()
+	if err != nil {
+		return res, err
+	}
+	events := make([]subnet.Event, 0, len(res.Snapshot))
+	for _, l := range res.Snapshot {
+		events = append(events, subnet.Event{Type: subnet.EventAdded, Lease: l})
+	}
+	return subnet.LeaseWatchResult{Events: events, Cursor: res.Cursor}, nil
+}
+
+// Resync hands out the leases of all flannel managed nodes again, as
+// EventAdded events through WatchLeases, for consumers that reset their state
+// and need to rebuild it without a restart. The events are queued behind
+// those already handed out, and are not skipped by cursors that have seen the
+// nodes' current leases. It may be called at any time; changes made
+// meanwhile are handed out after the lease they change.
+func (ksm *kubeSubnetManager) Resync(ctx context.Context) error {
+	// Node changes are handed out under the same lock, so none can slip
+	// between listing the leases and queueing them.
+	ksm.debounceMux.Lock()
+	defer ksm.debounceMux.Unlock()
+	if ksm.debounceStopped {
+		return subnet.ErrShuttingDown
+	}
+	leases, err := ksm.leases()
+	if err != nil {
+		return err
+	}
+	ksm.log.Infof("Handing out the leases of %d nodes again", len(leases))
+	for _, l := range leases {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ksm.dispatch(leaseEvent{Event: subnet.Event{Type: subnet.EventAdded, Lease: l}})
+	}
+	return nil
+}
+
+// leaseSnapshot returns the leases of all flannel managed nodes, along with a
+// cursor past the events they reflect. The cursor is taken before the nodes
+// are listed: the store is updated before the handlers run, so it reflects at
+// least the events the cursor covers. Events of changes that make it into the
+// snapshot after that are handed out again, which watchers take in stride.
+func (ksm *kubeSubnetManager) leaseSnapshot() (subnet.LeaseWatchResult, error) {
+	ksm.debounceMux.Lock()
+	c := watchCursor{seq: ksm.lastSeq + 1}
+	ksm.debounceMux.Unlock()
+
+	leases, err := ksm.leases()
+	if err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+	return subnet.LeaseWatchResult{
+		Snapshot: leases,
+		Cursor:   c,
+	}, nil
+}
+
+// jitteredPeriod returns period lengthened or shortened by up to jitter times
+// itself, r in [0, 1) picking where in that range.
+func jitteredPeriod(period time.Duration, jitter, r float64) time.Duration {
+	return period + time.Duration(float64(period)*jitter*(2*r-1))
+}
+
+// validJSON reports whether b is a valid JSON encoding. json.Valid is not
+// available before Go 1.9.
+func validJSON(b []byte) bool {
+	var raw json.RawMessage
+	return json.Unmarshal(b, &raw) == nil
+}
+
+// parseResourceVersion returns a node resource version as a number. The API
+// server doesn't promise resource versions are numbers; one that isn't is
+// returned as 0.
+func parseResourceVersion(rv string) uint64 {
+	v, err := strconv.ParseUint(rv, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// Run runs the node informer until ctx is done. Once the informer has stopped
+// the event channel is closed: WatchLeases keeps handing out the events still
+// buffered and then returns subnet.ErrShuttingDown, WatchLease returns it
+// right away, and the channels of the subscribers are closed. With
+// ReleaseLeaseOnShutdown set, the lease of the local node is released too.
+func (ksm *kubeSubnetManager) Run(ctx context.Context) {
+	ksm.log.Infof("Starting kube subnet manager")
+	if ksm.elector != nil {
+		go ksm.elector.run(ctx)
+	}
+	if ksm.reconcileInterval > 0 && !ksm.dryRun {
+		go ksm.reconcileLoop(ctx)
+	}
+	go ksm.recountLoop(ctx)
+	if ksm.expiry != nil {
+		go ksm.expiryLoop(ctx)
+	}
+	if ksm.watchdogTimeout > 0 {
+		go ksm.watchdogLoop(ctx)
+	}
+	if ksm.netConfSrc != nil && ksm.netConfCheckInterval > 0 {
+		go ksm.watchNetConf(ctx)
+	}
+	ksm.nodeController.Run(ctx.Done())
+	ksm.flushPendingEvents()
+	ksm.log.Infof("Kube subnet manager stopped, %d lease events left to drain", len(ksm.events))
+	close(ksm.events)
+	ksm.stopLeaseWatches()
+	ksm.closeSubscribers()
+
+	if ksm.releaseOnStop {
+		if err := ksm.ReleaseLease(context.Background()); err != nil {
+			ksm.log.WithValues("node", ksm.nodeName).Errorf("Failed to release lease of node %q: %v", ksm.nodeName, err)
+		}
+	}
+}
+
+// ReleaseLease removes the flannel annotations from the local node, giving
+// up its lease while leaving the node in place. Peers see the lease go away;
+// the node's pod CIDR stays assigned, so the next AcquireLease gets the same
+// subnet back. With leader election enabled only the instance elected for
+// the node may do so.
+func (ksm *kubeSubnetManager) ReleaseLease(ctx context.Context) error {
+	if ksm.elector != nil && !ksm.elector.isLeader() {
+		return ErrNotLeader
+	}
+	ksm.log.WithValues("node", ksm.nodeName).Infof("Releasing lease of node %q", ksm.nodeName)
+	patchBytes, err := releaseLeasePatch(ksm.annotations, ksm.managedNodeLabel)
+	if err != nil {
+		return err
+	}
+	err = ksm.patchLocalNode(ctx, patchBytes)
+	if apierrors.IsNotFound(err) {
+		return ErrNodeNotFound
+	}
+	if err == nil {
+		ksm.setLeaseAttrs(nil)
+		ksm.acquired.forget()
+	}
+	return err
+}
+
+// setLeaseAttrs records the attributes of the lease the local node now holds
+// for the reconcile loop, or that it holds none if attrs is nil.
+func (ksm *kubeSubnetManager) setLeaseAttrs(attrs *subnet.LeaseAttrs) {
+	var a *subnet.LeaseAttrs
+	if attrs != nil {
+		c := *attrs
+		a = &c
+	}
+	ksm.mux.Lock()
+	ksm.leaseAttrs = a
+	ksm.mux.Unlock()
+}
+
+// recountLoop recounts the managed nodes from the node cache every resync
+// period until ctx is done, so a missed event can't skew the gauges for long.
+func (ksm *kubeSubnetManager) recountLoop(ctx context.Context) {
+	ticker := time.NewTicker(ksm.resyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ksm.recountManagedNodes()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recountManagedNodes resets the managed nodes, and their backend types, to
+// those in the node cache.
+func (ksm *kubeSubnetManager) recountManagedNodes() {
+	nodes, err := ksm.managedNodes()
+	if err != nil {
+		ksm.log.Warningf("Failed to list nodes to count the managed ones: %v", err)
+		return
+	}
+	managed := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		managed[n.ObjectMeta.Name] = n.Annotations[ksm.annotations.BackendType]
+	}
+	ksm.managed.reset(managed)
+}
+
+// reconcileLoop runs reconcileAnnotations every reconcileInterval until ctx
+// is done.
+func (ksm *kubeSubnetManager) reconcileLoop(ctx context.Context) {
+	ticker := time.NewTicker(ksm.reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ksm.reconcileAnnotations(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcileAnnotations restores the flannel annotations of the local node if
+// they no longer match the lease it holds, e.g. because an admission webhook
+// or a manual edit removed them. Peers would otherwise lose the lease until
+// the next renewal. Each repair is logged and counted so whoever keeps
+// removing them can be tracked down.
+func (ksm *kubeSubnetManager) reconcileAnnotations(ctx context.Context) {
+	ksm.mux.Lock()
+	attrs := ksm.leaseAttrs
+	ksm.mux.Unlock()
+	if attrs == nil || (ksm.elector != nil && !ksm.elector.isLeader()) {
+		return
+	}
+
+	n, err := ksm.nodeStore.Get(ksm.nodeName)
+	if err != nil {
+		return // Nothing to repair, RenewLease reports the node missing
+	}
+	drifted := ksm.driftedAnnotations(n, attrs)
+	if len(drifted) == 0 {
+		return
+	}
+
+	log := ksm.log.WithValues("node", ksm.nodeName)
+	log.Warningf("Flannel annotations %s of node %q were removed or changed, restoring them", strings.Join(drifted, ", "), ksm.nodeName)
+	annotationRepairsTotal.Add(1)
+	// Merging would merge into whatever is there now
+	a := *attrs
+	a.MergeBackendData = false
+	if _, _, _, err := ksm.syncNodeAnnotations(ctx, &a, false); err != nil {
+		log.Errorf("Failed to restore flannel annotations of node %q: %v", ksm.nodeName, err)
+	}
+}
+
+// driftedAnnotations returns the flannel annotations of n that don't match
+// attrs.
+func (ksm *kubeSubnetManager) driftedAnnotations(n *v1.Node, attrs *subnet.LeaseAttrs) []string {
+	bd, err := attrs.BackendData.MarshalJSON()
+	if err != nil {
+		return nil
+	}
+	bdValue, bdEncoding, err := encodeBackendData(bd, ksm.compressionThreshold)
+	if err != nil {
+		return nil
+	}
+	want := map[string]string{
+		ksm.annotations.SubnetKubeManaged: "true",
+		ksm.annotations.BackendType:       attrs.BackendType,
+		ksm.annotations.BackendData:       bdValue,
+	}
+	if bdEncoding != "" {
+		want[ksm.annotations.BackendDataEncoding] = bdEncoding
+	}
+	if bd6, err := backendV6Data(attrs); err == nil && bd6 != "" {
+		want[ksm.annotations.BackendV6Data] = bd6
+	}
+	if attrs.PublicIP != 0 || attrs.PublicIPv6 == nil {
+		want[ksm.annotations.BackendPublicIP] = attrs.PublicIP.String()
+		if overwrite := n.Annotations[ksm.annotations.BackendPublicIPOverwrite]; overwrite != "" {
+			want[ksm.annotations.BackendPublicIP] = overwrite
+		}
+	}
+	if attrs.PublicIPv6 != nil {
+		want[ksm.annotations.BackendPublicIPv6] = attrs.PublicIPv6.String()
+		if overwrite := n.Annotations[ksm.annotations.BackendPublicIPv6Overwrite]; overwrite != "" {
+			want[ksm.annotations.BackendPublicIPv6] = overwrite
+		}
+	}
+
+	if ksm.policyEnforced(n, attrs) {
+		want[ksm.annotations.PolicyEnforced] = "true"
+	}
+
+	var drifted []string
+	for k, v := range want {
+		if cur, ok := n.Annotations[k]; !ok || cur != v {
+			drifted = append(drifted, k)
+		}
+	}
+	if _, ok := want[ksm.annotations.PolicyEnforced]; !ok && n.Annotations[ksm.annotations.PolicyEnforced] != "" {
+		drifted = append(drifted, ksm.annotations.PolicyEnforced)
+	}
+	sort.Strings(drifted)
+	return drifted
+}
+
+// ReleaseNodeLease removes the flannel annotations with the given prefix
+// (empty means DefaultAnnotationPrefix) from a node, giving up its lease
+// without deleting the node. Releasing a node that holds no lease does
+// nothing. ErrNodeNotFound is returned if the node doesn't exist.
+func ReleaseNodeLease(ctx context.Context, c clientset.Interface, nodeName, annotationPrefix string) error {
+	if annotationPrefix == "" {
+		annotationPrefix = DefaultAnnotationPrefix
+	}
+	a, err := newAnnotations(annotationPrefix)
+	if err != nil {
+		return err
+	}
+	patchBytes, err := releaseLeasePatch(a, "")
+	if err != nil {
+		return err
+	}
+	_, err = patchNode(ctx, c, DefaultAPITimeout, nodeName, types.StrategicMergePatchType, patchBytes)
+	if apierrors.IsNotFound(err) {
+		return ErrNodeNotFound
+	}
+	return err
+}
+
+// releaseLeasePatch returns the patch removing the lease annotations, and the
+// managed node label if not empty. The overwrite and override annotations are
+// set by the administrator, so they are kept.
+func releaseLeasePatch(a annotations, managedNodeLabel string) ([]byte, error) {
+	p := annotationPatch{
+		a.SubnetKubeManaged:   nil,
+		a.BackendType:         nil,
+		a.BackendData:         nil,
+		a.BackendDataEncoding: nil,
+		a.BackendV6Data:       nil,
+		a.BackendPublicIP:     nil,
+		a.BackendPublicIPv6:   nil,
+		a.PolicyEnforced:      nil,
+		a.Version:             nil,
+	}
+	if managedNodeLabel != "" {
+		return p.marshalWithLabels(map[string]interface{}{managedNodeLabel: nil})
+	}
+	return p.marshal()
+}
+
+// patchLocalNode applies a strategic merge patch to the local node, or only
+// logs it in dry run mode.
+func (ksm *kubeSubnetManager) patchLocalNode(ctx context.Context, patch []byte) error {
+	if ksm.dryRun {
+		ksm.log.WithValues("node", ksm.nodeName).Infof("Dry run, not patching node %q with: %s", ksm.nodeName, patch)
+		return nil
+	}
+	if ksm.nodePatcher != nil {
+		return ksm.nodePatcher(ctx, ksm.nodeName, patch)
+	}
+	_, err := patchNode(ctx, ksm.client, ksm.apiTimeout, ksm.nodeName, types.StrategicMergePatchType, patch)
+	return err
+}
+
+func (ksm *kubeSubnetManager) nodeToLease(n v1.Node) (l subnet.Lease, err error) {
+	publicIP := n.Annotations[ksm.annotations.BackendPublicIP]
+	publicIPv6 := n.Annotations[ksm.annotations.BackendPublicIPv6]
+	if publicIP == "" && publicIPv6 == "" && ksm.publicIPAddressType != "" {
+		publicIP, publicIPv6 = ksm.addressPublicIPs(&n)
+		if ksm.logged.changed(n.ObjectMeta.Name, "address-public-ip", publicIP+" "+publicIPv6) {
+			for _, addr := range []string{publicIP, publicIPv6} {
+				if addr != "" {
+					ksm.log.WithValues("node", n.ObjectMeta.Name).Infof("Node %q has no %s annotation, using its %s %s as public IP",
+						n.ObjectMeta.Name, ksm.annotations.BackendPublicIP, ksm.publicIPAddressType, addr)
+				}
+			}
+		}
+	} else {
+		ksm.logged.clear(n.ObjectMeta.Name, "address-public-ip")
+	}
+	if publicIP != "" || publicIPv6 == "" {
+		l.Attrs.PublicIP, err = ip.ParseIP4(publicIP)
+		if err != nil {
+			return l, err
+		}
+	}
+	if publicIPv6 != "" {
+		ip6, err := ip.ParseIP6(publicIPv6)
+		if err != nil {
+			return l, err
+		}
+		l.Attrs.PublicIPv6 = &ip6
+	}
+
+	l.Attrs.BackendType = n.Annotations[ksm.annotations.BackendType]
+	if !ksm.subnetConf.BackendAllowed(l.Attrs.BackendType) {
+		return l, fmt.Errorf("node %q uses backend type %q, which is not allowed by the network config", n.ObjectMeta.Name, l.Attrs.BackendType)
+	}
+	bd, err := ksm.nodeBackendData(&n)
+	if err != nil {
+		return l, fmt.Errorf("node %q has malformed %s annotation: %v", n.ObjectMeta.Name, ksm.annotations.BackendData, err)
+	}
+	if len(bd) != 0 {
+		if !validJSON(bd) {
+			return l, fmt.Errorf("node %q has malformed %s annotation", n.ObjectMeta.Name, ksm.annotations.BackendData)
+		}
+		l.Attrs.BackendData = json.RawMessage(bd)
+	}
+	if bd6 := n.Annotations[ksm.annotations.BackendV6Data]; bd6 != "" {
+		if !validJSON([]byte(bd6)) {
+			return l, fmt.Errorf("node %q has malformed %s annotation", n.ObjectMeta.Name, ksm.annotations.BackendV6Data)
+		}
+		l.Attrs.BackendV6Data = json.RawMessage(bd6)
+	}
+	l.Attrs.MTU = ksm.mtuOverride(&n)
+	l.Attrs.PolicyEnforced = n.Annotations[ksm.annotations.PolicyEnforced] == "true"
+	for _, k := range ksm.leaseNodeLabels {
+		if v, ok := n.Labels[k]; ok {
+			if l.Attrs.NodeLabels == nil {
+				l.Attrs.NodeLabels = make(map[string]string, len(ksm.leaseNodeLabels))
+			}
+			l.Attrs.NodeLabels[k] = v
+		}
+	}
+	for _, k := range ksm.leaseNodeAnnos {
+		v, ok := n.Annotations[k]
+		if !ok {
+			continue
+		}
+		if len(v) > MaxLeaseNodeAnnotationSize {
+			ksm.log.WithValues("node", n.ObjectMeta.Name).Warningf("Not passing on annotation %s of node %q, its value is longer than %d bytes",
+				k, n.ObjectMeta.Name, MaxLeaseNodeAnnotationSize)
+			continue
+		}
+		if l.Attrs.NodeAnnotations == nil {
+			l.Attrs.NodeAnnotations = make(map[string]string, len(ksm.leaseNodeAnnos))
+		}
+		l.Attrs.NodeAnnotations[k] = v
+	}
+
+	cidr, cidr6, err := parsePodCIDRs(&n)
+	if err != nil {
+		return l, err
+	}
+	override, overridden := ksm.subnetOverride(&n)
+	// Leases are known by their IPv4 subnet wherever the network has one, so
+	// a node with only an IPv6 pod CIDR has no lease there. Only a network
+	// without IPv4, like the one leases are dumped with, takes such nodes.
+	if cidr == nil && !overridden && (ksm.ipv4Enabled() || cidr6 == nil) {
+		return l, fmt.Errorf("node %q pod cidr not assigned", n.ObjectMeta.Name)
+	}
+
+	switch {
+	case overridden:
+		l.Subnet = override
+	case cidr != nil:
+		l.Subnet = ip.FromIPNet(cidr)
+	}
+	if cidr6 != nil {
+		l.IPv6Subnet = ip.FromIP6Net(cidr6)
+	}
+	l.Asof = parseResourceVersion(n.ResourceVersion)
+	return l, nil
+}
+
+// policyEnforced reports whether the lease of the local node n, acquired with
+// attrs, is to be marked as enforcing network policy.
+func (ksm *kubeSubnetManager) policyEnforced(n *v1.Node, attrs *subnet.LeaseAttrs) bool {
+	return attrs.PolicyEnforced || (ksm.policyEnforcedLabel != "" && n.Labels[ksm.policyEnforcedLabel] == "true")
+}
+
+// policyEnforcedValue returns the network-policy-enforced annotation value
+// for enforced, empty meaning no annotation.
+func policyEnforcedValue(enforced bool) string {
+	if enforced {
+		return "true"
+	}
+	return ""
+}
+
+// mtuOverride returns the MTU set by the node's mtu-override annotation, or 0
+// if there is none. Values that aren't a number between minMTU and maxMTU are
+// ignored with a warning, logged once per value rather than on every resync.
+func (ksm *kubeSubnetManager) mtuOverride(n *v1.Node) int {
+	s, ok := n.Annotations[ksm.annotations.MTUOverride]
+	if !ok {
+		ksm.logged.clear(n.ObjectMeta.Name, ksm.annotations.MTUOverride)
+		return 0
+	}
+	mtu, err := strconv.Atoi(s)
+	if err != nil || mtu < minMTU || mtu > maxMTU {
+		if ksm.logged.changed(n.ObjectMeta.Name, ksm.annotations.MTUOverride, s) {
+			ksm.log.WithValues("node", n.ObjectMeta.Name).Warningf("Ignoring %s annotation %q of node %q, the MTU must be between %d and %d",
+				ksm.annotations.MTUOverride, s, n.ObjectMeta.Name, minMTU, maxMTU)
+		}
+		return 0
+	}
+	ksm.logged.clear(n.ObjectMeta.Name, ksm.annotations.MTUOverride)
+	return mtu
+}
+
+// subnetOverride returns the subnet set by the node's subnet-override
+// annotation, if it has one. Values that aren't an IPv4 subnet within the
+// network are ignored with a warning, logged once per value rather than on
+// every resync.
+func (ksm *kubeSubnetManager) subnetOverride(n *v1.Node) (ip.IP4Net, bool) {
+	s, ok := n.Annotations[ksm.annotations.SubnetOverride]
+	if !ok {
+		ksm.logged.clear(n.ObjectMeta.Name, ksm.annotations.SubnetOverride)
+		return ip.IP4Net{}, false
+	}
+	sn, err := ksm.parseNetworkSubnet(s)
+	if err != nil {
+		if ksm.logged.changed(n.ObjectMeta.Name, ksm.annotations.SubnetOverride, s) {
+			ksm.log.WithValues("node", n.ObjectMeta.Name).Warningf("Ignoring %s annotation %q of node %q: %v",
+				ksm.annotations.SubnetOverride, s, n.ObjectMeta.Name, err)
+		}
+		return ip.IP4Net{}, false
+	}
+	ksm.logged.clear(n.ObjectMeta.Name, ksm.annotations.SubnetOverride)
+	return sn, true
+}
+
+// parseNetworkSubnet parses s as an IPv4 subnet within the flannel network.
+func (ksm *kubeSubnetManager) parseNetworkSubnet(s string) (ip.IP4Net, error) {
+	ipAddr, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		return ip.IP4Net{}, err
+	}
+	if ipAddr.To4() == nil || len(cidr.Mask) != net.IPv4len || !ipAddr.Equal(cidr.IP) {
+		return ip.IP4Net{}, fmt.Errorf("not an IPv4 subnet")
+	}
+	sn := ip.FromIPNet(cidr)
+	network := ksm.subnetConf.Network
+	if network.Empty() {
+		return ip.IP4Net{}, fmt.Errorf("the network has no IPv4 subnets")
+	}
+	if !network.Contains(sn.IP) || sn.PrefixLen < network.PrefixLen {
+		return ip.IP4Net{}, fmt.Errorf("not within network %s", network)
+	}
+	return sn, nil
+}
+
+// checkPreferredSubnet warns if the local node n, which holds subnet sn,
+// prefers another subnet. Flannel can't pick the pod CIDR of a node in kube
+// mode, so the preference only tells operators when the controller manager's
+// IPAM diverges from their intent.
+func (ksm *kubeSubnetManager) checkPreferredSubnet(n *v1.Node, sn ip.IP4Net) {
+	s, ok := n.Annotations[ksm.annotations.PreferredSubnet]
+	if !ok {
+		return
+	}
+	log := ksm.log.WithValues("node", n.ObjectMeta.Name)
+	preferred, err := ksm.parseNetworkSubnet(s)
+	switch {
+	case err != nil:
+		log.Warningf("Ignoring %s annotation %q of node %q: %v", ksm.annotations.PreferredSubnet, s, n.ObjectMeta.Name, err)
+	case !preferred.Equal(sn):
+		log.Warningf("Node %q prefers subnet %s per its %s annotation, but holds %s", n.ObjectMeta.Name, preferred, ksm.annotations.PreferredSubnet, sn)
+	}
+}
+
+// podCIDRs returns the pod CIDRs assigned to the node: its spec.podCIDRs as
+// kept by decodeNode, or else its single PodCIDR.
+func podCIDRs(n *v1.Node) []string {
+	if s := n.Annotations[podCIDRsAnnotation]; s != "" {
+		return strings.Split(s, ",")
+	}
+	if n.Spec.PodCIDR == "" {
+		return nil
+	}
+	return []string{n.Spec.PodCIDR}
+}
+
+// parsePodCIDRs splits the node's pod CIDRs into the IPv4 and IPv6 ranges.
+// Either may be nil if the node has no range of that family. Ranges covering
+// all addresses, and IPv4-mapped IPv6 ranges, whose prefix length doesn't
+// fit an IPv4 subnet, are rejected.
+func parsePodCIDRs(n *v1.Node) (cidr, cidr6 *net.IPNet, err error) {
+	for _, s := range podCIDRs(n) {
+		_, c, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ones, _ := c.Mask.Size(); ones == 0 {
+			return nil, nil, fmt.Errorf("pod cidr %s covers all addresses", s)
+		}
+		if c.IP.To4() != nil {
+			if len(c.Mask) != net.IPv4len {
+				return nil, nil, fmt.Errorf("pod cidr %s is an IPv4-mapped IPv6 range", s)
+			}
+			if cidr == nil {
+				cidr = c
+			}
+		} else if cidr6 == nil {
+			cidr6 = c
+		}
+	}
+	return cidr, cidr6, nil
+}
+
+// GetLease returns the lease currently held by the local node, without
+// touching the node. ErrLeaseNotFound is returned if the node isn't flannel
+// managed yet. The returned lease has no expiration.
+func (ksm *kubeSubnetManager) GetLease(ctx context.Context) (*subnet.Lease, error) {
+	n, err := ksm.nodeStore.Get(ksm.nodeName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, err
+	}
+	if n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" {
+		return nil, ErrLeaseNotFound
+	}
+
+	l, err := ksm.nodeToLease(*n)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// RenewLease re-asserts the lease annotations on the local node and pushes
+// out the lease expiration. The node is only patched if its annotations have
+// drifted from the lease attributes, so renewing is cheap in the steady state.
+// ErrNodeNotFound is returned if the local node no longer exists.
+func (ksm *kubeSubnetManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
+	if _, _, _, err := ksm.syncNodeAnnotations(ctx, &lease.Attrs, false); err != nil {
+		return err
+	}
+	ksm.setLeaseAttrs(&lease.Attrs)
+
+	lease.Expiration = ksm.expiration()
+	return nil
+}
+
+// expiration returns the expiration of a lease acquired or renewed now, zero
+// if leases don't expire.
+func (ksm *kubeSubnetManager) expiration() time.Time {
+	if ksm.leaseExpiration == 0 {
+		return time.Time{}
+	}
+	return ksm.clock.now().Add(ksm.leaseExpiration)
+}
+
+// WatchLease watches the lease of the node whose pod CIDR is sn. The first call
+// (nil cursor) returns a snapshot of the current lease if a node owns sn,
+// otherwise it blocks until one shows up. Later calls return the next change
+// of the lease, including any made between the calls. Once Run has stopped,
+// WatchLease returns subnet.ErrShuttingDown.
+func (ksm *kubeSubnetManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	lw, ok := cursor.(*leaseWatch)
+	if cursor != nil && !ok {
+		return subnet.LeaseWatchResult{}, fmt.Errorf("internal error: watch cursor is of unknown type")
+	}
+	if lw == nil {
+		lw = &leaseWatch{sn: sn}
+	}
+
+	events := make(chan subnet.Event, 100)
+	ksm.mux.Lock()
+	if ksm.leaseWatchesStopped {
+		ksm.mux.Unlock()
+		return subnet.LeaseWatchResult{}, subnet.ErrShuttingDown
+	}
+	lw.events = events
+	ksm.leaseWatches[lw] = struct{}{}
+	ksm.mux.Unlock()
+	defer func() {
+		ksm.mux.Lock()
+		delete(ksm.leaseWatches, lw)
+		ksm.mux.Unlock()
+	}()
+
+	l, err := ksm.leaseForSubnet(lw.sn)
+	if err != nil {
+		return subnet.LeaseWatchResult{}, err
+	}
+	if cursor == nil {
+		if l != nil {
+			lw.last = l
+			return subnet.LeaseWatchResult{
+				Snapshot: []subnet.Lease{*l},
+				Cursor:   lw,
+			}, nil
+		}
+	} else if e, ok := lw.catchUp(l); ok {
+		return lw.result(e), nil
+	}
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return subnet.LeaseWatchResult{}, subnet.ErrShuttingDown
+			}
+			if lw.seen(e) {
+				continue
+			}
+			return lw.result(e), nil
+		case <-ctx.Done():
+			return subnet.LeaseWatchResult{}, ctx.Err()
+		}
+	}
+}
+
+// catchUp returns the event taking the watch from the lease it last handed out
+// to l, the current one, unless they are the same.
+func (lw *leaseWatch) catchUp(l *subnet.Lease) (subnet.Event, bool) {
+	switch {
+	case l != nil && (lw.last == nil || !sameLease(lw.last, l)):
+		return subnet.Event{Type: subnet.EventAdded, Lease: *l}, true
+	case l == nil && lw.last != nil:
+		return subnet.Event{Type: subnet.EventRemoved, Lease: *lw.last}, true
+	}
+	return subnet.Event{}, false
+}
+
+// seen reports whether e leaves the lease as the watch last handed it out, as
+// it does when catchUp got to the change first.
+func (lw *leaseWatch) seen(e subnet.Event) bool {
+	if e.Type == subnet.EventAdded {
+		return lw.last != nil && sameLease(lw.last, &e.Lease)
+	}
+	return lw.last == nil
+}
+
+// result hands out e.
+func (lw *leaseWatch) result(e subnet.Event) subnet.LeaseWatchResult {
+	lw.last = nil
+	if e.Type == subnet.EventAdded {
+		l := e.Lease
+		lw.last = &l
+	}
+	return subnet.LeaseWatchResult{
+		Events: []subnet.Event{e},
+		Cursor: lw,
+	}
+}
+
+// stopLeaseWatches ends the WatchLease calls waiting for an event, and fails
+// those made afterwards, with subnet.ErrShuttingDown. No events are
+// dispatched anymore when it is called.
+func (ksm *kubeSubnetManager) stopLeaseWatches() {
+	ksm.mux.Lock()
+	defer ksm.mux.Unlock()
+	for lw := range ksm.leaseWatches {
+		delete(ksm.leaseWatches, lw)
+		close(lw.events)
+	}
+	ksm.leaseWatchesStopped = true
+}
+
+// leaseForSubnet returns the lease of the flannel managed node owning sn, or
+// nil if there is no such node.
+func (ksm *kubeSubnetManager) leaseForSubnet(sn ip.IP4Net) (*subnet.Lease, error) {
+	leases, err := ksm.leases()
+	if err != nil {
+		return nil, err
+	}
+	for i := range leases {
+		if !leases[i].Subnet.Empty() && leases[i].Subnet.Equal(sn) {
+			return &leases[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// ListLeases returns the leases of all flannel managed nodes, as currently
+// cached. It doesn't call the API server, so it is cheap; once the cache has
+// synced the result is as up to date as what WatchLeases hands out.
+func (ksm *kubeSubnetManager) ListLeases(ctx context.Context) ([]subnet.Lease, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ksm.leases()
+}
+
+// leases returns the leases of the flannel managed nodes in the cache. Nodes
+// that can't be turned into a lease are left out with a warning, drained
+// nodes quietly.
+func (ksm *kubeSubnetManager) leases() ([]subnet.Lease, error) {
+	nodes, err := ksm.managedNodes()
+	if err != nil {
+		return nil, err
+	}
+	var leases []subnet.Lease
+	for _, n := range nodes {
+		if ksm.drainTaint(n) != "" {
+			continue
+		}
+		l, err := ksm.nodeToLease(*n)
+		if err != nil {
+			ksm.log.WithValues("node", n.ObjectMeta.Name).Warningf("Skipping lease of node %q: %v", n.ObjectMeta.Name, err)
+			continue
+		}
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+// Capabilities reports that all operations are supported: leases can be
+// renewed, watched one at a time, and given up with ReleaseLease.
+func (ksm *kubeSubnetManager) Capabilities() subnet.Capabilities {
+	return subnet.Capabilities{SupportsRenew: true, SupportsSingleLeaseWatch: true, SupportsDelete: true}
 }
 
 func (ksm *kubeSubnetManager) Name() string {
@@ -0,0 +1,4957 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/version"
+
+	fuzz "github.com/google/gofuzz"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+// fakeAPIServer is a minimal stand-in for the nodes API. Lists return the
+// current nodes, watches stream changes made through setNode, deleteNode and
+// patches since the resource version they ask for, and patches are applied to
+// the stored node and recorded, unless they name another resource version
+// than the node's. Reads of single nodes are counted. Created events are
+// recorded too, and ConfigMaps set in configMaps can be read.
+type fakeAPIServer struct {
+	*httptest.Server
+
+	mux             sync.Mutex
+	nodes           map[string]*v1.Node
+	patches         []fakePatch
+	gets            int
+	events          []*v1.Event
+	configMaps      map[string]*v1.ConfigMap // By namespace/name
+	watchers        map[chan fakeWatchEvent]nodeSelector
+	history         []fakeWatchEvent
+	resourceVersion int
+}
+
+// selects reports whether sel matches n, by its labels and the fields the API
+// server lets nodes be selected by.
+func selects(sel nodeSelector, n *v1.Node) bool {
+	nodeFields := fields.Set{
+		"metadata.name":      n.Name,
+		"spec.unschedulable": strconv.FormatBool(n.Spec.Unschedulable),
+	}
+	return sel.labels.Matches(labels.Set(n.Labels)) && sel.fields.Matches(nodeFields)
+}
+
+type fakeWatchEvent struct {
+	Type   string  `json:"type"`
+	Object apiNode `json:"object"`
+}
+
+// apiNode is a node as the API server sends it, with the pod CIDRs kept in
+// its podCIDRsAnnotation as spec.podCIDRs.
+type apiNode struct {
+	*v1.Node
+}
+
+func (n apiNode) MarshalJSON() ([]byte, error) {
+	cidrs := n.Annotations[podCIDRsAnnotation]
+	if cidrs == "" {
+		return json.Marshal(n.Node)
+	}
+	nn := copyNode(n.Node)
+	delete(nn.Annotations, podCIDRsAnnotation)
+	data, err := json.Marshal(nn)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	obj["spec"].(map[string]interface{})["podCIDRs"] = strings.Split(cidrs, ",")
+	return json.Marshal(obj)
+}
+
+type apiNodeList struct {
+	metav1.TypeMeta `json:",inline"`
+	ListMeta        metav1.ListMeta `json:"metadata"`
+	Items           []apiNode       `json:"items"`
+}
+
+type fakePatch struct {
+	path string
+	body []byte
+}
+
+func newFakeAPIServer(nodes ...*v1.Node) *fakeAPIServer {
+	s := &fakeAPIServer{
+		nodes:           make(map[string]*v1.Node),
+		configMaps:      make(map[string]*v1.ConfigMap),
+		watchers:        make(map[chan fakeWatchEvent]nodeSelector),
+		resourceVersion: 1,
+	}
+	for _, n := range nodes {
+		s.nodes[n.Name] = n
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *fakeAPIServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/events") {
+		e := &v1.Event{}
+		json.NewDecoder(r.Body).Decode(e)
+		s.events = append(s.events, e)
+		writeJSON(w, http.StatusCreated, e)
+		return
+	}
+
+	var ns, cmName string
+	if n, err := fmt.Sscanf(strings.Replace(r.URL.Path, "/", " ", -1), " api v1 namespaces %s configmaps %s", &ns, &cmName); err == nil && n == 2 && r.Method == "GET" {
+		cm, ok := s.configMaps[ns+"/"+cmName]
+		if !ok {
+			writeNotFound(w, cmName)
+			return
+		}
+		writeJSON(w, http.StatusOK, cm)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/nodes")
+	name := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	selector, err := parseNodeSelector(r.URL.Query().Get("labelSelector"), r.URL.Query().Get("fieldSelector"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == "GET" && name == "" && r.URL.Query().Get("watch") == "true":
+		// Like the API server's, the watch starts with the changes made since
+		// the version it asks for, so none made after a list are missed
+		ch := make(chan fakeWatchEvent, 100+len(s.history))
+		since, _ := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+		for _, e := range s.history {
+			if v, _ := strconv.Atoi(e.Object.ResourceVersion); v > since && selects(selector, e.Object.Node) {
+				ch <- e
+			}
+		}
+		s.watchers[ch] = selector
+		s.mux.Unlock()
+		defer func() {
+			s.mux.Lock()
+			delete(s.watchers, ch)
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case e := <-ch:
+				enc.Encode(&e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+	case r.Method == "GET" && name == "":
+		list := apiNodeList{
+			TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"},
+			ListMeta: metav1.ListMeta{ResourceVersion: strconv.Itoa(s.resourceVersion)},
+		}
+		for _, n := range s.nodes {
+			if selects(selector, n) {
+				list.Items = append(list.Items, apiNode{n})
+			}
+		}
+		writeJSON(w, http.StatusOK, &list)
+
+	case r.Method == "GET":
+		s.gets++
+		n, ok := s.nodes[name]
+		if !ok {
+			writeNotFound(w, name)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiNode{n})
+
+	case r.Method == "PATCH":
+		n, ok := s.nodes[name]
+		if !ok {
+			writeNotFound(w, name)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.patches = append(s.patches, fakePatch{path: r.URL.Path, body: body})
+		if !patchPreconditionMet(n, body) {
+			writeJSON(w, http.StatusConflict, &metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Reason:   metav1.StatusReasonConflict,
+				Code:     http.StatusConflict,
+			})
+			return
+		}
+
+		orig, _ := json.Marshal(n)
+		patched, err := strategicpatch.StrategicMergePatch(orig, body, v1.Node{})
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		nn := &v1.Node{}
+		json.Unmarshal(patched, nn)
+		s.storeNode("MODIFIED", nn)
+		writeJSON(w, http.StatusOK, apiNode{nn})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// storeNode saves n and tells the watchers about it. s.mux must be held.
+func (s *fakeAPIServer) storeNode(eventType string, n *v1.Node) {
+	s.resourceVersion++
+	n.ResourceVersion = strconv.Itoa(s.resourceVersion)
+	if eventType == "DELETED" {
+		delete(s.nodes, n.Name)
+	} else {
+		s.nodes[n.Name] = n
+	}
+	e := fakeWatchEvent{Type: eventType, Object: apiNode{n}}
+	s.history = append(s.history, e)
+	for ch, selector := range s.watchers {
+		if selects(selector, n) {
+			ch <- e
+		}
+	}
+}
+
+// setNode adds or replaces a node.
+func (s *fakeAPIServer) setNode(n *v1.Node) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	eventType := "ADDED"
+	if _, ok := s.nodes[n.Name]; ok {
+		eventType = "MODIFIED"
+	}
+	s.storeNode(eventType, n)
+}
+
+func (s *fakeAPIServer) deleteNode(name string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if n, ok := s.nodes[name]; ok {
+		s.storeNode("DELETED", n)
+	}
+}
+
+func (s *fakeAPIServer) node(name string) *v1.Node {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.nodes[name]
+}
+
+func (s *fakeAPIServer) recordedPatches() []fakePatch {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]fakePatch(nil), s.patches...)
+}
+
+func (s *fakeAPIServer) nodeGets() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.gets
+}
+
+func (s *fakeAPIServer) recordedEvents() []*v1.Event {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]*v1.Event(nil), s.events...)
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeNotFound(w http.ResponseWriter, name string) {
+	writeJSON(w, http.StatusNotFound, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   metav1.StatusReasonNotFound,
+		Details:  &metav1.StatusDetails{Name: name, Kind: "nodes"},
+		Code:     http.StatusNotFound,
+	})
+}
+
+func newTestNode(name, podCIDR string) *v1.Node {
+	return &v1.Node{
+		TypeMeta: metav1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			ResourceVersion: "1",
+			Annotations:     map[string]string{},
+		},
+		Spec: v1.NodeSpec{PodCIDR: podCIDR},
+		Status: v1.NodeStatus{
+			Phase: v1.NodeRunning,
+		},
+	}
+}
+
+// newUnstartedTestManager returns a kube subnet manager without a client, for
+// exercising code that doesn't talk to the API.
+func newUnstartedTestManager(t *testing.T, config *SubnetManagerConfig) *kubeSubnetManager {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	ksm, err := newKubeSubnetManager(nil, sc, "node1", config)
+	if err != nil {
+		t.Fatalf("failed to create subnet manager: %v", err)
+	}
+	return ksm
+}
+
+// waitForCachedNode waits until the manager's node cache satisfies cond.
+func waitForCachedNode(t *testing.T, ksm *kubeSubnetManager, name string, cond func(n *v1.Node) bool) {
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		n, err := ksm.nodeStore.Get(name)
+		return err == nil && cond(n), nil
+	})
+	if err != nil {
+		t.Fatalf("node %q never showed up in the cache as expected", name)
+	}
+}
+
+// newTestManager starts a kube subnet manager for nodeName against the fake
+// API server and waits for its informer to sync.
+func newTestManager(t *testing.T, s *fakeAPIServer, nodeName string) (*kubeSubnetManager, context.CancelFunc) {
+	return newTestManagerWithConfig(t, s, nodeName, &SubnetManagerConfig{})
+}
+
+func newTestManagerWithConfig(t *testing.T, s *fakeAPIServer, nodeName string, config *SubnetManagerConfig) (*kubeSubnetManager, context.CancelFunc) {
+	return newTestManagerWithNetwork(t, s, nodeName, `{"Network": "10.244.0.0/16"}`, config)
+}
+
+func newTestManagerWithNetwork(t *testing.T, s *fakeAPIServer, nodeName, netConf string, config *SubnetManagerConfig) (*kubeSubnetManager, context.CancelFunc) {
+	c, err := clientset.NewForConfig(&rest.Config{Host: s.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	sc, err := subnet.ParseConfig(netConf)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	ksm, err := newKubeSubnetManager(c, sc, nodeName, config)
+	if err != nil {
+		t.Fatalf("failed to create subnet manager: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go ksm.Run(ctx)
+	err = wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return ksm.nodeController.HasSynced(), nil
+	})
+	if err != nil {
+		cancel()
+		t.Fatalf("node controller never synced: %v", err)
+	}
+	return ksm, cancel
+}
+
+func TestAcquireLeasePatchesAnnotationsOnly(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+
+	attrs := &subnet.LeaseAttrs{
+		PublicIP:    ip.MustParseIP4("192.168.0.1"),
+		BackendType: "vxlan",
+		BackendData: json.RawMessage(`{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`),
+	}
+	l, err := ksm.AcquireLease(context.Background(), attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("expected subnet 10.244.1.0/24, got %s", l.Subnet)
+	}
+
+	patches := s.recordedPatches()
+	if len(patches) != 1 {
+		t.Fatalf("expected 1 patch, got %d", len(patches))
+	}
+	if patches[0].path != "/api/v1/nodes/node1" {
+		t.Errorf("expected patch of the node resource, got %s", patches[0].path)
+	}
+	var p map[string]interface{}
+	if err := json.Unmarshal(patches[0].body, &p); err != nil {
+		t.Fatalf("failed to decode patch: %v", err)
+	}
+	if _, ok := p["status"]; ok {
+		t.Errorf("patch touches node status: %s", patches[0].body)
+	}
+
+	n := s.node("node1")
+	if n.Status.Phase != v1.NodeRunning {
+		t.Errorf("node status was modified: %+v", n.Status)
+	}
+	expected := map[string]string{
+		ksm.annotations.SubnetKubeManaged: "true",
+		ksm.annotations.BackendType:       "vxlan",
+		ksm.annotations.BackendData:       `{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`,
+		ksm.annotations.BackendPublicIP:   "192.168.0.1",
+	}
+	for k, v := range expected {
+		if n.Annotations[k] != v {
+			t.Errorf("expected annotation %s=%q, got %q", k, v, n.Annotations[k])
+		}
+	}
+}
+
+func TestNodeToLease(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	n := newTestNode("node1", "10.244.1.0/24")
+	n.Annotations[ksm.annotations.BackendPublicIP] = "192.168.0.1"
+	n.Annotations[ksm.annotations.BackendType] = "vxlan"
+	n.Annotations[ksm.annotations.BackendData] = `{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`
+
+	l, err := ksm.nodeToLease(*n)
+	if err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	_, cidr, _ := net.ParseCIDR("10.244.1.0/24")
+	if !l.Subnet.Equal(ip.FromIPNet(cidr)) {
+		t.Errorf("expected subnet %s, got %s", cidr, l.Subnet)
+	}
+	if l.Attrs.PublicIP.String() != "192.168.0.1" || l.Attrs.BackendType != "vxlan" {
+		t.Errorf("unexpected lease attrs: %+v", l.Attrs)
+	}
+
+	n.Annotations[ksm.annotations.BackendData] = `{"VtepMAC":`
+	if _, err := ksm.nodeToLease(*n); err == nil {
+		t.Error("nodeToLease accepted malformed backend data")
+	}
+}
+
+// fuzzedNode holds the fields of a node that nodeToLease parses, as filled
+// in by TestNodeToLeaseFuzz.
+type fuzzedNode struct {
+	PodCIDR             string
+	ResourceVersion     string
+	PublicIP            string
+	PublicIPv6          string
+	BackendType         string
+	BackendData         string
+	BackendDataEncoding string
+	BackendV6Data       string
+	MTUOverride         string
+	SubnetOverride      string
+	PolicyEnforced      string
+	Custom              string
+	Addresses           []string
+}
+
+// fuzzSeeds are values, valid or nearly so, that fuzzed node fields start
+// from before being mutated.
+var fuzzSeeds = []string{
+	"10.244.1.0/24", "10.244.1.5/24", "fd00:10:244:1::/64", "::ffff:10.244.1.0/120", "0.0.0.0/0",
+	"10.244.1.0/33", "10.244.1.0/-1", "192.168.0.1", "::ffff:192.168.0.1", "2001:db8::1", "fe80::1%eth0",
+	"vxlan", "host-gw", "null", `{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`, `{"VNI":1`, `[]`, `"`,
+	BackendDataEncodingGzip, "H4sIAAAAAAAA/6quVkpUslJKSU0qzs/NzczPU8jPS0lVqgUAAAD//w==",
+	"1400", "-1", "99999999999999999999", "true", "false", "18446744073709551616",
+}
+
+func TestNodeToLeaseFuzz(t *testing.T) {
+	// Half of the fuzzed fields are left empty, keeping the value of a
+	// valid node so that parsing gets past the other fields. The others
+	// start from a seed, and get bytes flipped, inserted or cut, or are
+	// random strings altogether.
+	f := fuzz.New().RandSource(rand.NewSource(1)).NilChance(0).NumElements(0, 3).Funcs(
+		func(s *string, c fuzz.Continue) {
+			switch c.Intn(8) {
+			case 0, 1, 2, 3:
+				return
+			case 4:
+				*s = c.RandString()
+				return
+			}
+			b := []byte(fuzzSeeds[c.Intn(len(fuzzSeeds))])
+			for i := c.Intn(3); i > 0 && len(b) > 0; i-- {
+				j := c.Intn(len(b))
+				switch c.Intn(3) {
+				case 0:
+					b[j] = byte(c.Intn(256))
+				case 1:
+					b = append(b[:j], append([]byte{byte(c.Intn(256))}, b[j:]...)...)
+				default:
+					b = b[:j]
+				}
+			}
+			*s = string(b)
+		},
+	)
+
+	out := &recordedLog{}
+	var managers []*kubeSubnetManager
+	for _, conf := range []string{
+		`{"Network": "10.244.0.0/16"}`,
+		`{"Network": "10.244.0.0/16", "EnableIPv6": true, "IPv6Network": "fd00:10:244::/56"}`,
+		`{"EnableIPv6": true, "IPv6Network": "fd00:10:244::/56"}`,
+	} {
+		sc, err := subnet.ParseConfig(conf)
+		if err != nil {
+			t.Fatalf("failed to parse config: %v", err)
+		}
+		ksm, err := newKubeSubnetManager(nil, sc, "node1", &SubnetManagerConfig{
+			Logger:               recordingLogger{out: out},
+			PublicIPAddressType:  "ExternalIP",
+			LeaseNodeAnnotations: []string{"example.com/custom"},
+		})
+		if err != nil {
+			t.Fatalf("failed to create subnet manager: %v", err)
+		}
+		managers = append(managers, ksm)
+	}
+
+	for i := 0; i < 20000; i++ {
+		var fn fuzzedNode
+		f.Fuzz(&fn)
+		for _, ksm := range managers {
+			n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+			for k, v := range map[string]string{
+				ksm.annotations.BackendPublicIP:     fn.PublicIP,
+				ksm.annotations.BackendPublicIPv6:   fn.PublicIPv6,
+				ksm.annotations.BackendType:         fn.BackendType,
+				ksm.annotations.BackendData:         fn.BackendData,
+				ksm.annotations.BackendDataEncoding: fn.BackendDataEncoding,
+				ksm.annotations.BackendV6Data:       fn.BackendV6Data,
+				ksm.annotations.MTUOverride:         fn.MTUOverride,
+				ksm.annotations.SubnetOverride:      fn.SubnetOverride,
+				ksm.annotations.PolicyEnforced:      fn.PolicyEnforced,
+				"example.com/custom":                fn.Custom,
+			} {
+				if v != "" {
+					n.Annotations[k] = v
+				}
+			}
+			if fn.PodCIDR != "" {
+				n.Spec.PodCIDR = fn.PodCIDR
+			}
+			if fn.ResourceVersion != "" {
+				n.ResourceVersion = fn.ResourceVersion
+			}
+			for _, a := range fn.Addresses {
+				n.Status.Addresses = append(n.Status.Addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: a})
+			}
+
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("nodeToLease panicked on %#v: %v", fn, r)
+					}
+				}()
+				l, err := ksm.nodeToLease(*n)
+				if err != nil {
+					return
+				}
+				if l.Subnet.PrefixLen > 32 || l.IPv6Subnet.PrefixLen > 128 || (l.Subnet.Empty() && l.IPv6Subnet.Empty()) {
+					t.Errorf("nodeToLease returned lease with subnets %s and %s for %#v", l.Subnet, l.IPv6Subnet, fn)
+				}
+				if len(l.Attrs.BackendData) > 0 && !validJSON(l.Attrs.BackendData) {
+					t.Errorf("nodeToLease returned malformed backend data for %#v", fn)
+				}
+			}()
+		}
+	}
+}
+
+func TestAnnotationPrefix(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{AnnotationPrefix: "flannel-secondary.example.com/"})
+	if ksm.annotations.BackendData != "flannel-secondary.example.com/backend-data" {
+		t.Errorf("unexpected backend data annotation %q", ksm.annotations.BackendData)
+	}
+
+	sc, _ := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if _, err := newKubeSubnetManager(nil, sc, "node1", &SubnetManagerConfig{AnnotationPrefix: "Not A Prefix"}); err == nil {
+		t.Error("newKubeSubnetManager accepted an invalid annotation prefix")
+	}
+}
+
+func TestNodeToLeaseIPv6PublicIP(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	n := newTestNode("node1", "10.244.1.0/24")
+	n.Annotations[ksm.annotations.BackendPublicIPv6] = "fd00::1"
+
+	l, err := ksm.nodeToLease(*n)
+	if err != nil {
+		t.Fatalf("nodeToLease failed for an IPv6 only node: %v", err)
+	}
+	if l.Attrs.PublicIPv6 == nil || l.Attrs.PublicIPv6.String() != "fd00::1" {
+		t.Errorf("expected IPv6 public IP fd00::1, got %v", l.Attrs.PublicIPv6)
+	}
+
+	n.Annotations[ksm.annotations.BackendPublicIP] = "fd00::2"
+	if _, err := ksm.nodeToLease(*n); err == nil {
+		t.Error("nodeToLease accepted an IPv6 address as the IPv4 public IP")
+	}
+}
+
+func TestWatchLeasesDrainsOnShutdown(t *testing.T) {
+	s := newFakeAPIServer()
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+
+	l := subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.244.1.0"), PrefixLen: 24}}
+	ksm.dispatch(leaseEvent{Event: subnet.Event{Type: subnet.EventAdded, Lease: l}})
+	cancel()
+
+	ctx := context.Background()
+	res, err := ksm.WatchLeases(ctx, watchCursor{})
+	if err != nil {
+		t.Fatalf("WatchLeases failed to hand out a buffered event: %v", err)
+	}
+	if len(res.Events) != 1 || !res.Events[0].Lease.Subnet.Equal(l.Subnet) {
+		t.Errorf("unexpected watch result: %+v", res)
+	}
+
+	if _, err := ksm.WatchLeases(ctx, watchCursor{}); err != subnet.ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown after draining, got %v", err)
+	}
+}
+
+func TestGetLease(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+
+	if _, err := ksm.GetLease(context.Background()); err != ErrLeaseNotFound {
+		t.Errorf("expected ErrLeaseNotFound for an unmanaged node, got %v", err)
+	}
+
+	n := newTestNode("node1", "10.244.1.0/24")
+	n.Annotations[ksm.annotations.SubnetKubeManaged] = "true"
+	n.Annotations[ksm.annotations.BackendPublicIP] = "192.168.0.1"
+	n.Annotations[ksm.annotations.BackendType] = "host-gw"
+	s.setNode(n)
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	})
+
+	l, err := ksm.GetLease(context.Background())
+	if err != nil {
+		t.Fatalf("GetLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" || l.Attrs.BackendType != "host-gw" {
+		t.Errorf("unexpected lease: %+v", l)
+	}
+	if len(s.recordedPatches()) != 0 {
+		t.Error("GetLease patched the node")
+	}
+}
+
+func newManagedTestNode(ksm *kubeSubnetManager, name, podCIDR, publicIP string) *v1.Node {
+	n := newTestNode(name, podCIDR)
+	n.Annotations[ksm.annotations.SubnetKubeManaged] = "true"
+	n.Annotations[ksm.annotations.BackendPublicIP] = publicIP
+	n.Annotations[ksm.annotations.BackendType] = "vxlan"
+	n.Annotations[ksm.annotations.BackendData] = "null"
+	return n
+}
+
+// nextEvent returns the next lease event handed out by WatchLeases, from the
+// start of the buffered events.
+func nextEvent(t *testing.T, ksm *kubeSubnetManager) subnet.Event {
+	defer func(n int) { ksm.watchBatchSize = n }(ksm.watchBatchSize)
+	ksm.watchBatchSize = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := ksm.WatchLeases(ctx, watchCursor{})
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(res.Events) == 0 {
+		t.Fatal("timed out waiting for a lease event")
+	}
+	return res.Events[0]
+}
+
+func TestPodCIDRChangeProducesEvents(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n := newManagedTestNode(ksm, "node2", "10.244.3.0/24", "192.168.0.2")
+
+	ksm.handleUpdateLeaseEvent(o, n)
+
+	e := nextEvent(t, ksm)
+	if e.Type != subnet.EventRemoved || e.Lease.Subnet.String() != "10.244.2.0/24" {
+		t.Errorf("expected removal of 10.244.2.0/24, got %+v", e)
+	}
+	e = nextEvent(t, ksm)
+	if e.Type != subnet.EventAdded || e.Lease.Subnet.String() != "10.244.3.0/24" {
+		t.Errorf("expected addition of 10.244.3.0/24, got %+v", e)
+	}
+
+	// Nothing changed, nothing to tell
+	ksm.handleUpdateLeaseEvent(n, n)
+	if len(ksm.events) != 0 {
+		t.Errorf("unexpected event for an unchanged node")
+	}
+}
+
+func TestRecreatedNodeProducesEvents(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	node := func(uid, podCIDR string) *v1.Node {
+		n := newManagedTestNode(ksm, "node2", podCIDR, "192.168.0.2")
+		n.UID = types.UID(uid)
+		return n
+	}
+	expect := func(et subnet.EventType, sn string) {
+		if e := nextEvent(t, ksm); e.Type != et || e.Lease.Subnet.String() != sn {
+			t.Errorf("expected event %v of %s, got %+v", et, sn, e)
+		}
+	}
+
+	// Deleted and added in quick succession
+	o := node("a", "10.244.2.0/24")
+	ksm.handleAddLeaseEvent(subnet.EventAdded, o)
+	expect(subnet.EventAdded, "10.244.2.0/24")
+	n := node("b", "10.244.7.0/24")
+	ksm.handleDeleteLeaseEvent(o)
+	ksm.handleAddLeaseEvent(subnet.EventAdded, n)
+	expect(subnet.EventRemoved, "10.244.2.0/24")
+	expect(subnet.EventAdded, "10.244.7.0/24")
+
+	// Both missed while relisting, the informer sees an update, even of a
+	// node keeping its pod CIDR
+	o, n = n, node("c", "10.244.7.0/24")
+	ksm.handleUpdateLeaseEvent(o, n)
+	expect(subnet.EventRemoved, "10.244.7.0/24")
+	expect(subnet.EventAdded, "10.244.7.0/24")
+
+	// A new node flannel has yet to run on only has its predecessor's lease
+	// go away
+	o, n = n, newTestNode("node2", "10.244.8.0/24")
+	n.UID = "d"
+	ksm.handleUpdateLeaseEvent(o, n)
+	expect(subnet.EventRemoved, "10.244.7.0/24")
+	if len(ksm.events) != 0 {
+		t.Errorf("unexpected event for an unmanaged node")
+	}
+}
+
+// newFakeLockServer serves ConfigMaps, enforcing resource versions on updates
+// the way the API server does.
+func newFakeLockServer() *httptest.Server {
+	var mux sync.Mutex
+	cms := make(map[string]*v1.ConfigMap)
+	resourceVersion := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		name := path.Base(r.URL.Path)
+		switch r.Method {
+		case "GET":
+			cm, ok := cms[name]
+			if !ok {
+				writeNotFound(w, name)
+				return
+			}
+			writeJSON(w, http.StatusOK, cm)
+		case "POST", "PUT":
+			n := &v1.ConfigMap{}
+			json.NewDecoder(r.Body).Decode(n)
+			cm := cms[n.Name]
+			if (r.Method == "POST") != (cm == nil) ||
+				(cm != nil && n.ResourceVersion != cm.ResourceVersion) {
+				writeJSON(w, http.StatusConflict, &metav1.Status{
+					TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+					Status:   metav1.StatusFailure,
+					Reason:   metav1.StatusReasonConflict,
+					Code:     http.StatusConflict,
+				})
+				return
+			}
+			resourceVersion++
+			n.ResourceVersion = strconv.Itoa(resourceVersion)
+			cms[n.Name] = n
+			writeJSON(w, http.StatusOK, n)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func TestLeaderElection(t *testing.T) {
+	s := newFakeLockServer()
+	defer s.Close()
+	c, err := clientset.NewForConfig(&rest.Config{Host: s.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	newElector := func(identity, nodeName string) *leaderElector {
+		le, err := newLeaderElector(c, &LeaderElectionConfig{
+			Namespace:     "kube-system",
+			Name:          "flannel",
+			Identity:      identity,
+			LeaseDuration: 200 * time.Millisecond,
+			RetryPeriod:   50 * time.Millisecond,
+		}, nodeName, glogLogger{})
+		if err != nil {
+			t.Fatalf("failed to create leader elector: %v", err)
+		}
+		return le
+	}
+	a, b := newElector("a", "node1"), newElector("b", "node1")
+
+	if err := a.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("a failed to acquire the lock: %v", err)
+	}
+	if err := b.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("b failed to check the lock: %v", err)
+	}
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("expected a to lead, got a=%v b=%v", a.isLeader(), b.isLeader())
+	}
+
+	// a stops renewing, b takes over once the lease has run out
+	time.Sleep(250 * time.Millisecond)
+	if err := b.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("b failed to take over the lock: %v", err)
+	}
+	if a.isLeader() || !b.isLeader() {
+		t.Fatalf("expected b to lead, got a=%v b=%v", a.isLeader(), b.isLeader())
+	}
+	if b.observedRecord.LeaderTransitions != 1 {
+		t.Errorf("expected 1 leader transition, got %d", b.observedRecord.LeaderTransitions)
+	}
+
+	// The instances of other nodes elect their own leader
+	o := newElector("o", "node2")
+	if err := o.tryAcquireOrRenew(context.Background()); err != nil {
+		t.Fatalf("o failed to acquire the lock: %v", err)
+	}
+	if !o.isLeader() || !b.isLeader() {
+		t.Errorf("expected both nodes to have a leader, got o=%v b=%v", o.isLeader(), b.isLeader())
+	}
+	if o.name != "flannel-node2" {
+		t.Errorf("expected the lock of node2 to be flannel-node2, got %s", o.name)
+	}
+}
+
+func TestAcquireLeaseNotLeader(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{
+		LeaderElection: &LeaderElectionConfig{Namespace: "kube-system", Name: "flannel"},
+	})
+	_, err := ksm.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")})
+	if err != ErrNotLeader {
+		t.Errorf("expected ErrNotLeader from a follower, got %v", err)
+	}
+}
+
+func TestAcquireLeaseUnchangedSkipsPatch(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+
+	attrs := &subnet.LeaseAttrs{
+		PublicIP:    ip.MustParseIP4("192.168.0.1"),
+		BackendType: "vxlan",
+		BackendData: json.RawMessage(`{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`),
+	}
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	})
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if patches := s.recordedPatches(); len(patches) != 1 {
+		t.Errorf("expected 1 patch, got %d", len(patches))
+	}
+}
+
+func TestPatchNodeAnnotationsLeavesCachedNode(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{
+		ManagedNodeLabel:     "flannel.io/managed",
+		CompressionThreshold: 1,
+	})
+	defer cancel()
+
+	cached, err := ksm.nodeStore.Get("node1")
+	if err != nil {
+		t.Fatalf("failed to get cached node: %v", err)
+	}
+	before := copyNode(cached)
+	attrs := &subnet.LeaseAttrs{
+		PublicIP:         ip.MustParseIP4("192.168.0.1"),
+		BackendType:      "vxlan",
+		BackendData:      json.RawMessage(`{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`),
+		MergeBackendData: true,
+	}
+	if _, _, _, err := ksm.patchNodeAnnotations(context.Background(), cached, attrs); err != nil {
+		t.Fatalf("patchNodeAnnotations failed: %v", err)
+	}
+	if len(s.recordedPatches()) != 1 {
+		t.Fatalf("expected the node to be patched")
+	}
+	if !reflect.DeepEqual(cached, before) {
+		t.Errorf("the cached node was modified:\n%+v\nwas\n%+v", cached, before)
+	}
+}
+
+func BenchmarkPatchNodeAnnotationsUnchanged(b *testing.B) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		b.Fatalf("failed to parse config: %v", err)
+	}
+	ksm, err := newKubeSubnetManager(nil, sc, "node1", &SubnetManagerConfig{})
+	if err != nil {
+		b.Fatalf("failed to create subnet manager: %v", err)
+	}
+
+	// A node with plenty of unrelated labels and annotations that already
+	// carries the lease.
+	n := newManagedTestNode(ksm, "node1", "10.244.1.0/24", "192.168.0.1")
+	n.Labels = make(map[string]string)
+	for i := 0; i < 100; i++ {
+		n.Labels["example.com/label-"+strconv.Itoa(i)] = strings.Repeat("x", 32)
+		n.Annotations["example.com/annotation-"+strconv.Itoa(i)] = strings.Repeat("x", 256)
+	}
+	attrs := &subnet.LeaseAttrs{
+		PublicIP:    ip.MustParseIP4("192.168.0.1"),
+		BackendType: "vxlan",
+		BackendData: json.RawMessage("null"),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := ksm.patchNodeAnnotations(context.Background(), n, attrs); err != nil {
+			b.Fatalf("patchNodeAnnotations failed: %v", err)
+		}
+	}
+}
+
+// recordingLogger keeps the messages logged through it along with their
+// fields.
+type recordingLogger struct {
+	fields []interface{}
+	out    *recordedLog
+}
+
+type recordedLog struct {
+	sync.Mutex
+	entries []recordedLogEntry
+}
+
+func (l *recordedLog) get() []recordedLogEntry {
+	l.Lock()
+	defer l.Unlock()
+	return append([]recordedLogEntry(nil), l.entries...)
+}
+
+type recordedLogEntry struct {
+	msg    string
+	fields []interface{}
+}
+
+func (l recordingLogger) WithValues(keysAndValues ...interface{}) Logger {
+	return recordingLogger{
+		fields: append(append([]interface{}(nil), l.fields...), keysAndValues...),
+		out:    l.out,
+	}
+}
+
+func (l recordingLogger) log(format string, args ...interface{}) {
+	l.out.Lock()
+	defer l.out.Unlock()
+	l.out.entries = append(l.out.entries, recordedLogEntry{msg: fmt.Sprintf(format, args...), fields: l.fields})
+}
+
+func (l recordingLogger) Infof(format string, args ...interface{})    { l.log(format, args...) }
+func (l recordingLogger) Warningf(format string, args ...interface{}) { l.log(format, args...) }
+func (l recordingLogger) Errorf(format string, args ...interface{})   { l.log(format, args...) }
+func (l recordingLogger) Debugf(format string, args ...interface{})   { l.log(format, args...) }
+
+func TestAcquireLeaseTolerateFailedPatch(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{TolerateFailedPatch: true})
+	defer cancel()
+	ctx := context.Background()
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan", BackendData: json.RawMessage(`{"VNI":1}`)}
+
+	// A patch failing without reaching the node still fails
+	ksm.nodePatcher = func(ctx context.Context, name string, patch []byte) error {
+		return fmt.Errorf("connection reset")
+	}
+	if _, err := ksm.AcquireLease(ctx, attrs); err == nil {
+		t.Fatal("expected AcquireLease to fail when the node doesn't have the annotations")
+	}
+
+	// A patch whose response was lost, but that did reach the node
+	ksm.nodePatcher = func(ctx context.Context, name string, patch []byte) error {
+		if _, err := patchNode(ctx, ksm.client, ksm.apiTimeout, name, types.StrategicMergePatchType, patch); err != nil {
+			t.Errorf("failed to patch node: %v", err)
+		}
+		return fmt.Errorf("timeout awaiting response")
+	}
+	l, err := ksm.AcquireLease(ctx, attrs)
+	if err != nil {
+		t.Fatalf("expected AcquireLease to tolerate the failed patch: %v", err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("unexpected subnet %s", l.Subnet)
+	}
+
+	// Without the option the failure isn't looked into
+	ksm.tolerateFailedPatch = false
+	attrs.BackendData = json.RawMessage(`{"VNI":2}`)
+	if _, err := ksm.AcquireLease(ctx, attrs); err == nil {
+		t.Error("expected AcquireLease to fail")
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	log := &recordedLog{}
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{Logger: recordingLogger{out: log}})
+
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "not-an-ip")
+	ksm.handleAddLeaseEvent(subnet.EventAdded, n)
+	entries := log.get()
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(entries))
+	}
+	if !strings.HasPrefix(entries[0].msg, `Error turning node "node2" to lease`) {
+		t.Errorf("unexpected message %q", entries[0].msg)
+	}
+	expected := []interface{}{"node", "node2", "event", subnet.EventAdded}
+	if fmt.Sprint(entries[0].fields) != fmt.Sprint(expected) {
+		t.Errorf("expected fields %v, got %v", expected, entries[0].fields)
+	}
+}
+
+func TestPublicIPOverwriteRecordsEvent(t *testing.T) {
+	n := newTestNode("node1", "10.244.1.0/24")
+	s := newFakeAPIServer(n)
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+
+	n = s.node("node1")
+	n.Annotations[ksm.annotations.BackendPublicIPOverwrite] = "10.0.0.1"
+	s.setNode(n)
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != ""
+	})
+
+	before := publicIPOverwritesTotal.Value()
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	l, err := ksm.AcquireLease(context.Background(), attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	if got := s.node("node1").Annotations[ksm.annotations.BackendPublicIP]; got != "10.0.0.1" {
+		t.Errorf("expected public ip 10.0.0.1, got %q", got)
+	}
+	if got := publicIPOverwritesTotal.Value() - before; got != 1 {
+		t.Errorf("expected the overwrite to be counted once, got %d", got)
+	}
+	events := s.recordedEvents()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	e := events[0]
+	if e.Reason != "PublicIPOverwritten" || e.InvolvedObject.Kind != "Node" || e.InvolvedObject.Name != "node1" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if !strings.Contains(e.Message, "10.0.0.1") || !strings.Contains(e.Message, "192.168.0.1") {
+		t.Errorf("event message doesn't name both IPs: %q", e.Message)
+	}
+
+	// Once the node advertises the overwrite, there is nothing new to record
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.BackendPublicIP] == "10.0.0.1"
+	})
+	if err := ksm.RenewLease(context.Background(), l); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if got := publicIPOverwritesTotal.Value() - before; got != 1 {
+		t.Errorf("expected the overwrite to be counted once, got %d", got)
+	}
+	if events := s.recordedEvents(); len(events) != 1 {
+		t.Errorf("expected 1 event, got %d", len(events))
+	}
+}
+
+func TestAPICallTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+	c, err := clientset.NewForConfig(&rest.Config{Host: s.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	start := time.Now()
+	_, err = getNode(context.Background(), c, 100*time.Millisecond, "node1")
+	if err == nil || !strings.Contains(err.Error(), "no response from the API server") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("call took %v to time out", d)
+	}
+}
+
+func TestNodeLabelSelector(t *testing.T) {
+	labeled := newTestNode("node1", "10.244.1.0/24")
+	labeled.Labels = map[string]string{"flannel": "true"}
+	s := newFakeAPIServer(labeled, newTestNode("node2", "10.244.2.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{NodeLabelSelector: "flannel=true"})
+	defer cancel()
+
+	nodes, err := ksm.nodeStore.List(labels.Everything())
+	if err != nil {
+		t.Fatalf("failed to list cached nodes: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "node1" {
+		t.Errorf("expected only node1 to be cached, got %d nodes", len(nodes))
+	}
+
+	if _, err := newKubeSubnetManager(nil, ksm.subnetConf, "node1", &SubnetManagerConfig{NodeLabelSelector: "flannel in"}); err == nil {
+		t.Error("expected an invalid selector to be rejected")
+	}
+}
+
+func TestNodeSelectorShard(t *testing.T) {
+	shardNode := func(name, cidr, shard string, unschedulable bool) *v1.Node {
+		n := newTestNode(name, cidr)
+		n.Labels = map[string]string{"shard": shard}
+		n.Spec.Unschedulable = unschedulable
+		return n
+	}
+	s := newFakeAPIServer(
+		newTestNode("node1", "10.244.1.0/24"),
+		shardNode("node2", "10.244.2.0/24", "a", false),
+		shardNode("node3", "10.244.3.0/24", "b", false),
+		shardNode("node4", "10.244.4.0/24", "a", true),
+	)
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{
+		NodeLabelSelector: "shard=a",
+		NodeFieldSelector: "spec.unschedulable=false",
+		EventDebounce:     -1,
+	})
+	defer cancel()
+
+	// The local node is cached though it's outside the shard
+	nodes, err := ksm.nodeStore.List(labels.Everything())
+	if err != nil {
+		t.Fatalf("failed to list cached nodes: %v", err)
+	}
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "node1,node2" {
+		t.Errorf("expected node1 and node2 to be cached, got %v", names)
+	}
+
+	l, err := ksm.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("expected the local node's pod cidr, got %s", l.Subnet)
+	}
+	if e := nextEvent(t, ksm); e.Type != subnet.EventAdded || e.Lease.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("expected the local lease to be watched, got %+v", e)
+	}
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	})
+	if nodes, err := ksm.managedNodes(); err != nil || len(nodes) != 1 || nodes[0].Name != "node1" {
+		t.Errorf("expected the local node to be indexed as managed, got %v, %v", nodes, err)
+	}
+
+	if _, err := newKubeSubnetManager(nil, ksm.subnetConf, "node1", &SubnetManagerConfig{NodeFieldSelector: "spec.unschedulable"}); err == nil {
+		t.Error("expected an invalid field selector to be rejected")
+	}
+}
+
+func TestGetNetworkConfigBackendTypeOverride(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+	base, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlan", "VNI": 2}}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	ksm.subnetConf = base
+
+	setOverride := func(bt string) {
+		n := s.node("node1")
+		n.Annotations[ksm.annotations.BackendTypeOverride] = bt
+		s.setNode(n)
+		waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+			return n.Annotations[ksm.annotations.BackendTypeOverride] == bt
+		})
+	}
+
+	sc, err := ksm.GetNetworkConfig(context.Background())
+	if err != nil || sc != base {
+		t.Fatalf("expected the base config without an override, got %v, %v", sc, err)
+	}
+
+	setOverride("host-gw")
+	sc, err = ksm.GetNetworkConfig(context.Background())
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	if sc.BackendType != "host-gw" {
+		t.Errorf("expected backend type host-gw, got %q", sc.BackendType)
+	}
+	var be struct {
+		Type string
+		VNI  int
+	}
+	if err := json.Unmarshal(sc.Backend, &be); err != nil || be.Type != "host-gw" || be.VNI != 2 {
+		t.Errorf("unexpected backend config %s", sc.Backend)
+	}
+	if base.BackendType != "vxlan" {
+		t.Errorf("base config was modified")
+	}
+
+	setOverride("carrier-pigeon")
+	if _, err := ksm.GetNetworkConfig(context.Background()); err == nil {
+		t.Error("expected an unknown backend type to be rejected")
+	}
+}
+
+func TestGetNetworkConfigBackendConfigOverride(t *testing.T) {
+	base, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlan", "VNI": 2}}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(base, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	backendConfig := func(overrides map[string]string) json.RawMessage {
+		n := f.Node("node1")
+		if n.Annotations == nil {
+			n.Annotations = map[string]string{}
+		}
+		for k, v := range overrides {
+			n.Annotations[k] = v
+		}
+		f.UpdateNode(n)
+		sc, err := f.GetNetworkConfig(context.Background())
+		if err != nil {
+			t.Fatalf("GetNetworkConfig failed: %v", err)
+		}
+		return sc.Backend
+	}
+	configOverride := f.annotations.BackendConfigOverride
+
+	if be := backendConfig(map[string]string{configOverride: `{"Port": 8473, "DirectRouting": true}`}); string(be) != `{"DirectRouting":true,"Port":8473,"Type":"vxlan","VNI":2}` {
+		t.Errorf("expected the settings to be merged into the backend config, got %s", be)
+	}
+	if string(base.Backend) != `{"Type": "vxlan", "VNI": 2}` {
+		t.Errorf("base config was modified: %s", base.Backend)
+	}
+
+	// Invalid overrides are ignored
+	for _, override := range []string{`[1]`, `{"Port": "8473"}`, `{"VNI": 1.5}`, `{"Type": "udp"}`, `{"Directrouting": true}`} {
+		if be := backendConfig(map[string]string{configOverride: override}); string(be) != string(base.Backend) {
+			t.Errorf("expected override %s to be ignored, got backend config %s", override, be)
+		}
+	}
+
+	// Overrides apply to the backend type selected by the node
+	be := backendConfig(map[string]string{f.annotations.BackendTypeOverride: "udp", configOverride: `{"Port": 8286}`})
+	if string(be) != `{"Port":8286,"Type":"udp","VNI":2}` {
+		t.Errorf("expected the settings to apply to the overridden backend type, got %s", be)
+	}
+	if be := backendConfig(map[string]string{configOverride: `{"VNI": 3}`}); string(be) != `{"Type":"udp","VNI":2}` {
+		t.Errorf("expected settings of other backend types to be ignored, got %s", be)
+	}
+}
+
+// fakeLeaseSource is a subnet.Manager that only hands out a snapshot of
+// leases.
+type fakeLeaseSource struct {
+	subnet.Manager
+	leases []subnet.Lease
+}
+
+func (m *fakeLeaseSource) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	return subnet.LeaseWatchResult{Snapshot: m.leases}, nil
+}
+
+func (m *fakeLeaseSource) Name() string {
+	return "fake"
+}
+
+func TestMigrateLeases(t *testing.T) {
+	withAddress := func(n *v1.Node, address string) *v1.Node {
+		n.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: address}}
+		return n
+	}
+	s := newFakeAPIServer(
+		withAddress(newTestNode("node1", ""), "192.168.0.1"),
+		withAddress(newTestNode("node2", "10.244.2.0/24"), "192.168.0.2"),
+		withAddress(newTestNode("node3", "10.244.9.0/24"), "192.168.0.3"),
+	)
+	defer s.Close()
+	c, err := clientset.NewForConfig(&rest.Config{Host: s.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	lease := func(sn, publicIP string) subnet.Lease {
+		_, n, _ := net.ParseCIDR(sn)
+		return subnet.Lease{
+			Subnet: ip.FromIPNet(n),
+			Attrs: subnet.LeaseAttrs{
+				PublicIP:    ip.MustParseIP4(publicIP),
+				BackendType: "vxlan",
+				BackendData: json.RawMessage(`{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`),
+			},
+		}
+	}
+	from := &fakeLeaseSource{leases: []subnet.Lease{
+		lease("10.244.1.0/24", "192.168.0.1"),
+		lease("10.244.2.0/24", "192.168.0.2"),
+		lease("10.244.3.0/24", "192.168.0.3"),
+		lease("10.244.4.0/24", "192.168.0.4"),
+	}}
+
+	res, err := MigrateLeases(context.Background(), from, c, &MigrateConfig{DryRun: true})
+	if err != nil {
+		t.Fatalf("MigrateLeases failed: %v", err)
+	}
+	if len(res.Annotated) != 2 || len(res.Conflicts) != 1 || len(res.Unmatched) != 1 {
+		t.Errorf("unexpected dry run result %+v", res)
+	}
+	if len(s.recordedPatches()) != 0 {
+		t.Errorf("dry run patched nodes")
+	}
+
+	res, err = MigrateLeases(context.Background(), from, c, &MigrateConfig{})
+	if err != nil {
+		t.Fatalf("MigrateLeases failed: %v", err)
+	}
+	if strings.Join(res.Annotated, ",") != "node1,node2" {
+		t.Errorf("expected node1 and node2 to be annotated, got %v", res.Annotated)
+	}
+	if len(res.Conflicts) != 1 || res.Conflicts[0].Nodes[0] != "node3" {
+		t.Errorf("expected a conflict on node3, got %+v", res.Conflicts)
+	}
+	if len(res.Unmatched) != 1 || res.Unmatched[0].Subnet.String() != "10.244.4.0/24" {
+		t.Errorf("expected 10.244.4.0/24 to be unmatched, got %+v", res.Unmatched)
+	}
+
+	n := s.node("node1")
+	if n.Spec.PodCIDR != "10.244.1.0/24" {
+		t.Errorf("expected node1 to get pod cidr 10.244.1.0/24, got %q", n.Spec.PodCIDR)
+	}
+	if n.Annotations[DefaultAnnotationPrefix+"/kube-subnet-manager"] != "true" ||
+		n.Annotations[DefaultAnnotationPrefix+"/public-ip"] != "192.168.0.1" {
+		t.Errorf("node1 is missing its lease annotations: %v", n.Annotations)
+	}
+	if s.node("node3").Annotations[DefaultAnnotationPrefix+"/kube-subnet-manager"] != "" {
+		t.Errorf("conflicting node3 was annotated")
+	}
+
+	// Running it again changes nothing
+	patches := len(s.recordedPatches())
+	res, err = MigrateLeases(context.Background(), from, c, &MigrateConfig{})
+	if err != nil {
+		t.Fatalf("MigrateLeases failed: %v", err)
+	}
+	if len(res.Annotated) != 0 || len(res.Unchanged) != 2 || len(s.recordedPatches()) != patches {
+		t.Errorf("second migration wasn't a no-op: %+v", res)
+	}
+}
+
+func TestAcquireLeaseWaitsForPodCIDR(t *testing.T) {
+	defer func(d time.Duration) { podCIDRPollInterval = d }(podCIDRPollInterval)
+	podCIDRPollInterval = 10 * time.Millisecond
+
+	s := newFakeAPIServer(newTestNode("node1", ""))
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{PodCIDRWaitTimeout: 5 * time.Second})
+	defer cancel()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		n := s.node("node1")
+		n.Spec.PodCIDR = "10.244.1.0/24"
+		s.setNode(n)
+	}()
+	l, err := ksm.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("expected subnet 10.244.1.0/24, got %s", l.Subnet)
+	}
+
+	s.setNode(newTestNode("node2", ""))
+	ksm2, cancel2 := newTestManagerWithConfig(t, s, "node2", &SubnetManagerConfig{PodCIDRWaitTimeout: 50 * time.Millisecond})
+	defer cancel2()
+	waitForCachedNode(t, ksm2, "node2", func(n *v1.Node) bool { return true })
+	_, err = ksm2.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.2")})
+	if err == nil || !strings.Contains(err.Error(), "pod cidr not assigned") {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{ReleaseLeaseOnShutdown: true})
+	if !ksm.Capabilities().SupportsDelete {
+		t.Error("expected releasing the lease to be supported")
+	}
+
+	n := s.node("node1")
+	n.Annotations[ksm.annotations.BackendPublicIPOverwrite] = "10.0.0.1"
+	s.setNode(n)
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != ""
+	})
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	})
+	if v := s.node("node1").Annotations[ksm.annotations.Version]; v != version.Version {
+		t.Errorf("expected the node to be annotated with version %s, got %q", version.Version, v)
+	}
+
+	// Shutting down releases the lease
+	cancel()
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return s.node("node1").Annotations[ksm.annotations.SubnetKubeManaged] == "", nil
+	})
+	if err != nil {
+		t.Fatalf("lease wasn't released on shutdown")
+	}
+	n = s.node("node1")
+	for _, k := range []string{ksm.annotations.BackendType, ksm.annotations.BackendData, ksm.annotations.BackendPublicIP, ksm.annotations.Version} {
+		if v, ok := n.Annotations[k]; ok {
+			t.Errorf("annotation %s=%q was not removed", k, v)
+		}
+	}
+	if n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != "10.0.0.1" {
+		t.Errorf("administrator's overwrite annotation was removed")
+	}
+	if n.Spec.PodCIDR != "10.244.1.0/24" {
+		t.Errorf("pod cidr was modified")
+	}
+
+	if err := ReleaseNodeLease(context.Background(), ksm.client, "node2", ""); err != ErrNodeNotFound {
+		t.Errorf("expected ErrNodeNotFound, got %v", err)
+	}
+}
+
+func TestReleaseLeaseSeenByPeers(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"), newTestNode("node2", "10.244.2.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+	peer, cancelPeer := newTestManagerWithConfig(t, s, "node2", &SubnetManagerConfig{EventDebounce: -1})
+	defer cancelPeer()
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	waitForCachedNode(t, peer, "node1", func(n *v1.Node) bool {
+		return n.Annotations[peer.annotations.SubnetKubeManaged] == "true"
+	})
+	ctx, cancelWatch := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWatch()
+	res, err := peer.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+
+	if err := ksm.ReleaseLease(context.Background()); err != nil {
+		t.Fatalf("ReleaseLease failed: %v", err)
+	}
+	for {
+		res, err = peer.WatchLeases(ctx, res.Cursor)
+		if err != nil {
+			t.Fatalf("the peer never saw the lease go away: %v", err)
+		}
+		for _, e := range res.Events {
+			if e.Type == subnet.EventRemoved && e.Lease.Subnet.String() == "10.244.1.0/24" {
+				return
+			}
+		}
+	}
+}
+
+func TestManagedNodeLabel(t *testing.T) {
+	if _, err := newKubeSubnetManager(nil, nil, "node1", &SubnetManagerConfig{ManagedNodeLabel: "not a label"}); err == nil {
+		t.Error("expected an invalid label key to be rejected")
+	}
+
+	node := newTestNode("node1", "10.244.1.0/24")
+	node.Labels = map[string]string{"kubernetes.io/hostname": "node1"}
+	s := newFakeAPIServer(node)
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{ManagedNodeLabel: "flannel.io/managed"})
+	defer cancel()
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if v := s.node("node1").Labels["flannel.io/managed"]; v != "true" {
+		t.Errorf("expected the managed node label to be set, got %q", v)
+	}
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Labels["flannel.io/managed"] == "true"
+	})
+
+	// A labelled node isn't patched again
+	patches := len(s.recordedPatches())
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if n := len(s.recordedPatches()); n != patches {
+		t.Errorf("expected no patch for a labelled node, got %d", n-patches)
+	}
+
+	if err := ksm.ReleaseLease(context.Background()); err != nil {
+		t.Fatalf("ReleaseLease failed: %v", err)
+	}
+	n := s.node("node1")
+	if v, ok := n.Labels["flannel.io/managed"]; ok {
+		t.Errorf("expected the managed node label to be removed, got %q", v)
+	}
+	if _, ok := n.Labels["kubernetes.io/hostname"]; !ok {
+		t.Error("expected the other labels to be kept")
+	}
+}
+
+func TestPolicyEnforced(t *testing.T) {
+	if _, err := newKubeSubnetManager(nil, nil, "node1", &SubnetManagerConfig{PolicyEnforcedLabel: "not a label"}); err == nil {
+		t.Error("expected an invalid label key to be rejected")
+	}
+
+	node := newTestNode("node1", "10.244.1.0/24")
+	node.Labels = map[string]string{"example.com/policy-enforced": "true"}
+	s := newFakeAPIServer(node)
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{PolicyEnforcedLabel: "example.com/policy-enforced"})
+	defer cancel()
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	l, err := ksm.AcquireLease(context.Background(), attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if !l.Attrs.PolicyEnforced {
+		t.Error("expected the lease of a labelled node to be marked as enforcing policy")
+	}
+	n := copyNode(s.node("node1"))
+	if v := n.Annotations[ksm.annotations.PolicyEnforced]; v != "true" {
+		t.Errorf("expected the %s annotation to be set, got %q", ksm.annotations.PolicyEnforced, v)
+	}
+	if l, err := ksm.nodeToLease(*n); err != nil || !l.Attrs.PolicyEnforced {
+		t.Errorf("expected peers to see the lease enforcing policy, got %+v (%v)", l.Attrs, err)
+	}
+
+	// Removing the label is seen as drift of the annotation
+	n.Labels = nil
+	if drifted := ksm.driftedAnnotations(n, attrs); !reflect.DeepEqual(drifted, []string{ksm.annotations.PolicyEnforced}) {
+		t.Errorf("expected the %s annotation to have drifted, got %v", ksm.annotations.PolicyEnforced, drifted)
+	}
+	delete(n.Annotations, ksm.annotations.PolicyEnforced)
+	if l, err := ksm.nodeToLease(*n); err != nil || l.Attrs.PolicyEnforced {
+		t.Errorf("expected a lease without the annotation not to enforce policy, got %+v (%v)", l.Attrs, err)
+	}
+
+	// Leases of other subnet managers carry it along
+	b, err := json.Marshal(subnet.LeaseAttrs{PolicyEnforced: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded subnet.LeaseAttrs
+	if err := json.Unmarshal(b, &decoded); err != nil || !decoded.PolicyEnforced {
+		t.Errorf("expected PolicyEnforced to survive a JSON round trip, got %s", b)
+	}
+}
+
+func TestInformerWatchdog(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	s := newFakeAPIServer(
+		newTestNode("node1", "10.244.1.0/24"),
+		newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2"),
+		newManagedTestNode(ksm, "node3", "10.244.3.0/24", "192.168.0.3"),
+	)
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{WatchdogTimeout: time.Minute, EventDebounce: -1})
+	defer cancel()
+
+	// The watch misses node3 going away and node4 coming
+	s.mux.Lock()
+	delete(s.nodes, "node3")
+	s.nodes["node4"] = newManagedTestNode(ksm, "node4", "10.244.4.0/24", "192.168.0.4")
+	s.resourceVersion++
+	s.nodes["node4"].ResourceVersion = strconv.Itoa(s.resourceVersion)
+	s.mux.Unlock()
+
+	restarts := informerRestartsTotal.Value()
+	ksm.checkInformers(time.Now())
+	if informerRestartsTotal.Value() != restarts {
+		t.Fatal("expected no restart of an informer that received events recently")
+	}
+	ksm.checkInformers(time.Now().Add(2 * time.Minute))
+	if v := informerRestartsTotal.Value(); v != restarts+1 {
+		t.Fatalf("expected the informer to be restarted once, got %d restarts", v-restarts)
+	}
+
+	removed, added := false, false
+	for !removed || !added {
+		e := nextEvent(t, ksm)
+		switch {
+		case e.Type == subnet.EventRemoved && e.Lease.Subnet.String() == "10.244.3.0/24":
+			removed = true
+		case e.Type == subnet.EventAdded && e.Lease.Subnet.String() == "10.244.4.0/24":
+			added = true
+		}
+	}
+	if _, err := ksm.nodeStore.Get("node3"); err == nil {
+		t.Error("expected the deleted node to be gone from the cache")
+	}
+
+	// The restarted informer watches again. The fake API server doesn't
+	// replay changes made before the watch started, so keep making them.
+	err := wait.Poll(50*time.Millisecond, 5*time.Second, func() (bool, error) {
+		n := copyNode(s.node("node2"))
+		n.Annotations[ksm.annotations.MTUOverride] = "1400"
+		s.setNode(n)
+		c, err := ksm.nodeStore.Get("node2")
+		return err == nil && c.Annotations[ksm.annotations.MTUOverride] == "1400", nil
+	})
+	if err != nil {
+		t.Error("expected the restarted informer to see node updates")
+	}
+}
+
+func TestAllowedBackends(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlan"}, "AllowedBackends": ["vxlan"]}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	ksm.subnetConf = sc
+
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	if _, err := ksm.nodeToLease(*n); err != nil {
+		t.Errorf("nodeToLease rejected an allowed backend: %v", err)
+	}
+	n.Annotations[ksm.annotations.BackendType] = "udp"
+	if _, err := ksm.nodeToLease(*n); err == nil {
+		t.Error("nodeToLease accepted a backend that isn't allowed")
+	}
+	ksm.handleAddLeaseEvent(subnet.EventAdded, n)
+	if len(ksm.events) != 0 {
+		t.Error("lease with a backend that isn't allowed was passed on")
+	}
+
+	_, err = ksm.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "udp"})
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("expected AcquireLease to reject the backend, got %v", err)
+	}
+}
+
+func TestFakeSubnetManager(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	l, err := f.AcquireLease(context.Background(), attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("expected subnet 10.244.1.0/24, got %s", l.Subnet)
+	}
+	if f.Node("node1").Annotations[f.annotations.SubnetKubeManaged] != "true" {
+		t.Errorf("lease wasn't written to the node")
+	}
+
+	peer := newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2")
+	f.AddNode(peer)
+	f.DeleteNode("node2")
+
+	expected := []struct {
+		et subnet.EventType
+		sn string
+	}{
+		{subnet.EventAdded, "10.244.1.0/24"},
+		{subnet.EventAdded, "10.244.2.0/24"},
+		{subnet.EventRemoved, "10.244.2.0/24"},
+	}
+	for _, exp := range expected {
+		e := nextEvent(t, f.kubeSubnetManager)
+		if e.Type != exp.et || e.Lease.Subnet.String() != exp.sn {
+			t.Errorf("expected event %v for %s, got %+v", exp.et, exp.sn, e)
+		}
+	}
+}
+
+func TestEventDebounce(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: 100 * time.Millisecond})
+	n1 := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n2 := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.3")
+	n3 := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.4")
+
+	// A burst of updates results in one event with the latest lease
+	ksm.handleUpdateLeaseEvent(n1, n2)
+	ksm.handleUpdateLeaseEvent(n2, n3)
+	if len(ksm.events) != 0 {
+		t.Fatalf("update events were not held back")
+	}
+	e := nextEvent(t, ksm)
+	if e.Type != subnet.EventAdded || e.Lease.Attrs.PublicIP.String() != "192.168.0.4" {
+		t.Errorf("expected the latest lease, got %+v", e)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(ksm.events) != 0 {
+		t.Errorf("expected a single event, got %d more", len(ksm.events))
+	}
+
+	// Deleting the node drops the held back update
+	ksm.handleUpdateLeaseEvent(n1, n2)
+	ksm.handleAddLeaseEvent(subnet.EventRemoved, n2)
+	e = nextEvent(t, ksm)
+	if e.Type != subnet.EventRemoved {
+		t.Errorf("expected a removal, got %+v", e)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(ksm.events) != 0 {
+		t.Errorf("held back update was handed out after the removal")
+	}
+
+	// Held back events are handed out on shutdown
+	ksm.handleUpdateLeaseEvent(n1, n3)
+	ksm.flushPendingEvents()
+	if len(ksm.events) != 1 {
+		t.Errorf("expected the held back event to be flushed")
+	}
+	ksm.handleUpdateLeaseEvent(n3, n1)
+	time.Sleep(200 * time.Millisecond)
+	if len(ksm.events) != 1 {
+		t.Errorf("event handed out after shutdown")
+	}
+}
+
+func TestEventsBlocked(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	for len(ksm.events) < cap(ksm.events) {
+		ksm.events <- leaseEvent{}
+	}
+	blocked, dropped := eventsBlockedTotal.Value(), eventsDroppedTotal.Value()
+
+	// The event waits for room in the full channel, counted as blocked
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ksm.handleAddLeaseEvent(subnet.EventAdded, newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2"))
+	}()
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return eventsBlockedTotal.Value()-blocked == 1, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the blocked event to be counted, got %d", eventsBlockedTotal.Value()-blocked)
+	}
+	<-ksm.events
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocked event was never handed out")
+	}
+	if got := eventsDroppedTotal.Value() - dropped; got != 0 {
+		t.Errorf("expected no event to be dropped, got %d", got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	log := &recordedLog{}
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{
+		DryRun: true,
+		Logger: recordingLogger{out: log},
+	})
+	defer cancel()
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	l, err := ksm.AcquireLease(context.Background(), attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("expected subnet 10.244.1.0/24, got %s", l.Subnet)
+	}
+	if len(s.recordedPatches()) != 0 {
+		t.Errorf("node was patched in dry run mode")
+	}
+
+	logged := false
+	for _, e := range log.get() {
+		if strings.HasPrefix(e.msg, "Dry run") && strings.Contains(e.msg, ksm.annotations.SubnetKubeManaged) {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("patch wasn't logged")
+	}
+}
+
+func TestIPv6OnlyPodCIDR(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"EnableIPv6": true, "IPv6Network": "fd00:10:244::/56"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "fd00:10:244:1::/64"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+
+	publicIPv6 := ip.MustParseIP6("fd00::1")
+	l, err := f.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIPv6: &publicIPv6, BackendType: "vxlan"})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.IPv6Subnet.String() != "fd00:10:244:1::/64" || !l.Subnet.Empty() {
+		t.Errorf("expected only IPv6 subnet fd00:10:244:1::/64, got %s and %s", l.Subnet, l.IPv6Subnet)
+	}
+
+	l2, err := f.nodeToLease(*f.Node("node1"))
+	if err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	if l2.IPv6Subnet.String() != "fd00:10:244:1::/64" || *l2.Attrs.PublicIPv6 != publicIPv6 {
+		t.Errorf("unexpected lease %+v", l2)
+	}
+
+	// IPv4 networks are unaffected
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	n := newManagedTestNode(ksm, "node2", "fd00:10:244:2::/64", "192.168.0.2")
+	if _, err := ksm.nodeToLease(*n); err == nil {
+		t.Error("IPv4 network accepted a node with only an IPv6 pod cidr")
+	}
+}
+
+func TestDualStackPodCIDRs(t *testing.T) {
+	n := newTestNode("node1", "10.244.1.0/24")
+	n.Annotations[podCIDRsAnnotation] = "10.244.1.0/24,fd00:10:244:1::/64"
+	s := newFakeAPIServer(n)
+	defer s.Close()
+	ksm, cancel := newTestManagerWithNetwork(t, s, "node1",
+		`{"Network": "10.244.0.0/16", "EnableIPv6": true, "IPv6Network": "fd00:10:244::/56"}`, &SubnetManagerConfig{})
+	defer cancel()
+
+	l, err := ksm.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.244.1.0/24" || l.IPv6Subnet.String() != "fd00:10:244:1::/64" {
+		t.Errorf("expected both pod cidrs, got %s and %s", l.Subnet, l.IPv6Subnet)
+	}
+
+	// An annotation of the node can't pose as its pod CIDRs
+	nn, err := decodeNode([]byte(`{"metadata": {"annotations": {"` + podCIDRsAnnotation + `": "fd00::/64"}}}`))
+	if err != nil {
+		t.Fatalf("decodeNode failed: %v", err)
+	}
+	if cidrs := podCIDRs(nn); len(cidrs) != 0 {
+		t.Errorf("expected no pod cidrs, got %v", cidrs)
+	}
+}
+
+func TestIPv6OnlyLeasesWatched(t *testing.T) {
+	proto := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	newNode := func(name, cidr, publicIPv6 string) *v1.Node {
+		n := newManagedTestNode(proto, name, cidr, "")
+		n.Annotations[proto.annotations.BackendPublicIPv6] = publicIPv6
+		return n
+	}
+	s := newFakeAPIServer(newNode("node1", "fd00:10:244:1::/64", "fd00::1"), newNode("node2", "fd00:10:244:2::/64", "fd00::2"))
+	defer s.Close()
+	ksm, cancel := newTestManagerWithNetwork(t, s, "node1",
+		`{"EnableIPv6": true, "IPv6Network": "fd00:10:244::/56"}`, &SubnetManagerConfig{EventDebounce: -1})
+	defer cancel()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	receiver := make(chan []subnet.Event, 10)
+	go subnet.WatchLeases(ctx, ksm, nil, receiver)
+	next := func() []subnet.Event {
+		select {
+		case batch := <-receiver:
+			return batch
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for lease events")
+			return nil
+		}
+	}
+
+	added := map[string]bool{}
+	for len(added) < 2 {
+		for _, e := range next() {
+			if e.Type != subnet.EventAdded {
+				t.Fatalf("unexpected event %+v", e)
+			}
+			added[e.Lease.IPv6Subnet.String()] = true
+		}
+	}
+	if !added["fd00:10:244:1::/64"] || !added["fd00:10:244:2::/64"] {
+		t.Fatalf("expected both IPv6 leases, got %v", added)
+	}
+
+	s.deleteNode("node2")
+	batch := next()
+	if len(batch) != 1 || batch[0].Type != subnet.EventRemoved || batch[0].Lease.IPv6Subnet.String() != "fd00:10:244:2::/64" {
+		t.Errorf("expected the removal of fd00:10:244:2::/64, got %+v", batch)
+	}
+
+	// In a dual-stack network a node without an IPv4 pod cidr has no lease
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "EnableIPv6": true, "IPv6Network": "fd00:10:244::/56"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	dual, err := newKubeSubnetManager(nil, sc, "node1", &SubnetManagerConfig{})
+	if err != nil {
+		t.Fatalf("failed to create subnet manager: %v", err)
+	}
+	if l, err := dual.nodeToLease(*newNode("node3", "fd00:10:244:3::/64", "fd00::3")); err == nil {
+		t.Errorf("expected an error, got lease %+v", l)
+	}
+}
+
+// syncAfterController is a cache.Controller that reports synced after being
+// asked n times.
+type syncAfterController struct {
+	cache.Controller
+	n, checks int
+}
+
+func (c *syncAfterController) HasSynced() bool {
+	c.checks++
+	return c.checks > c.n
+}
+
+func TestWaitForSyncBackoff(t *testing.T) {
+	defer func(b wait.Backoff, m time.Duration) { syncBackoff, maxSyncInterval = b, m }(syncBackoff, maxSyncInterval)
+	syncBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 2}
+	maxSyncInterval = 4 * time.Millisecond
+
+	out := &recordedLog{}
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{Logger: recordingLogger{out: out}})
+	c := &syncAfterController{n: 9}
+	ksm.nodeController = c
+	if err := ksm.waitForSync(context.Background(), time.Minute); err != nil {
+		t.Fatalf("waitForSync failed: %v", err)
+	}
+	// The first check happens right away, then two per interval
+	if progress := len(out.get()); progress != 4 {
+		t.Errorf("expected 4 progress messages, got %d: %v", progress, out.get())
+	}
+
+	ksm.nodeController = &syncAfterController{n: 1 << 30}
+	if err := ksm.waitForSync(context.Background(), 20*time.Millisecond); err != wait.ErrWaitTimeout {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ksm.waitForSync(ctx, time.Minute); err != context.Canceled {
+		t.Errorf("expected waiting to stop with the context, got %v", err)
+	}
+}
+
+func TestWatchLeasesUnhealthyInformer(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{UnhealthyTimeout: 200 * time.Millisecond})
+	// Never synced, e.g. failing to relist after a restart
+	ksm.nodeController = &syncAfterController{n: 1 << 30}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := ksm.WatchLeases(ctx, watchCursor{}); err != ErrInformerUnhealthy {
+		t.Fatalf("expected ErrInformerUnhealthy, got %v", err)
+	}
+	// Later calls fail right away
+	start := time.Now()
+	if _, err := ksm.WatchLeases(ctx, watchCursor{}); err != ErrInformerUnhealthy {
+		t.Errorf("expected ErrInformerUnhealthy, got %v", err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("expected WatchLeases to fail right away, took %v", d)
+	}
+
+	// Once the informer recovers the watch waits for events again
+	ksm.nodeController = &syncAfterController{}
+	ksm.markSynced()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := ksm.WatchLeases(ctx, watchCursor{}); err != context.DeadlineExceeded {
+		t.Errorf("expected the watch to wait for events, got %v", err)
+	}
+
+	// Unless the check is disabled
+	ksm = newUnstartedTestManager(t, &SubnetManagerConfig{UnhealthyTimeout: -1})
+	ksm.nodeController = &syncAfterController{n: 1 << 30}
+	if _, err := ksm.WatchLeases(ctx, watchCursor{}); err != context.DeadlineExceeded {
+		t.Errorf("expected the watch to wait for events, got %v", err)
+	}
+}
+
+func TestHealthzHandler(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	get := func() (int, string) {
+		w := httptest.NewRecorder()
+		ksm.HealthzHandler()(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code, w.Body.String()
+	}
+
+	ksm.nodeController = &syncAfterController{n: 1 << 30}
+	if code, body := get(); code != http.StatusServiceUnavailable || !strings.Contains(body, "not synced") {
+		t.Errorf("expected the unsynced informer to be unready, got %d %q", code, body)
+	}
+
+	ksm.nodeController = &syncAfterController{}
+	ksm.markSynced()
+	if code, body := get(); code != http.StatusOK {
+		t.Errorf("expected the synced informer to be ready, got %d %q", code, body)
+	}
+
+	// No nodes delivered for more than two resync periods
+	atomic.StoreInt64(&ksm.lastSync, time.Now().Add(-3*ksm.resyncPeriod).UnixNano())
+	if code, body := get(); code != http.StatusServiceUnavailable || !strings.Contains(body, "last synced") {
+		t.Errorf("expected the stale informer to be unready, got %d %q", code, body)
+	}
+}
+
+func TestLeaseNodeLabels(t *testing.T) {
+	const zone = "topology.kubernetes.io/zone"
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1, LeaseNodeLabels: []string{zone}})
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	o.Labels = map[string]string{zone: "zone-a", "rack": "r1"}
+
+	l, err := ksm.nodeToLease(*o)
+	if err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	if len(l.Attrs.NodeLabels) != 1 || l.Attrs.NodeLabels[zone] != "zone-a" {
+		t.Errorf("expected only the zone label, got %v", l.Attrs.NodeLabels)
+	}
+
+	// Labels that aren't copied don't cause events
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n.Labels = map[string]string{zone: "zone-a", "rack": "r2"}
+	ksm.handleUpdateLeaseEvent(o, n)
+	if len(ksm.events) != 0 {
+		t.Errorf("unexpected event for a change of an uncopied label")
+	}
+
+	n.Labels[zone] = "zone-b"
+	ksm.handleUpdateLeaseEvent(o, n)
+	if e := nextEvent(t, ksm); e.Type != subnet.EventAdded || e.Lease.Attrs.NodeLabels[zone] != "zone-b" {
+		t.Errorf("expected the lease with the new zone, got %+v", e)
+	}
+
+	// Without configured labels, leases carry none
+	ksm = newUnstartedTestManager(t, &SubnetManagerConfig{})
+	if l, err := ksm.nodeToLease(*n); err != nil || l.Attrs.NodeLabels != nil {
+		t.Errorf("expected no labels, got %v (%v)", l.Attrs.NodeLabels, err)
+	}
+}
+
+func TestLeaseNodeAnnotations(t *testing.T) {
+	const qos, priority = "example.com/qos-class", "example.com/priority"
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1, LeaseNodeAnnotations: []string{qos, priority}})
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	o.Annotations[qos] = "gold"
+	o.Annotations[priority] = strings.Repeat("x", MaxLeaseNodeAnnotationSize+1)
+	o.Annotations["example.com/other"] = "ignored"
+
+	l, err := ksm.nodeToLease(*o)
+	if err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	if len(l.Attrs.NodeAnnotations) != 1 || l.Attrs.NodeAnnotations[qos] != "gold" {
+		t.Errorf("expected only the QoS annotation, got %v", l.Attrs.NodeAnnotations)
+	}
+
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	for k, v := range o.Annotations {
+		n.Annotations[k] = v
+	}
+	n.Annotations[qos] = "silver"
+	ksm.handleUpdateLeaseEvent(o, n)
+	if e := nextEvent(t, ksm); e.Type != subnet.EventAdded || e.Lease.Attrs.NodeAnnotations[qos] != "silver" {
+		t.Errorf("expected the lease with the new QoS class, got %+v", e)
+	}
+
+	keys := make([]string, MaxLeaseNodeAnnotations+1)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("example.com/a%d", i)
+	}
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if _, err := newKubeSubnetManager(nil, sc, "node1", &SubnetManagerConfig{LeaseNodeAnnotations: keys}); err == nil {
+		t.Error("expected too many lease node annotations to be rejected")
+	}
+}
+
+func TestWatchLeasesCursor(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1")
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := f.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(res.Events) != 0 || len(res.Snapshot) != 2 {
+		t.Fatalf("expected a snapshot of 2 leases, got %+v", res)
+	}
+
+	// The buffered events of the nodes in the snapshot aren't replayed
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node4", "10.244.4.0/24", "192.168.0.4"))
+	res, err = f.WatchLeases(ctx, res.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Lease.Subnet.String() != "10.244.4.0/24" {
+		t.Fatalf("expected the addition of node4, got %+v", res)
+	}
+
+	// Both events of a pod CIDR change carry the same resource version
+	n := newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.5.0/24", "192.168.0.2")
+	f.UpdateNode(n)
+	res, err = f.WatchLeases(ctx, res.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	want := []subnet.Event{
+		{Type: subnet.EventRemoved, Lease: subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.244.2.0"), PrefixLen: 24}}},
+		{Type: subnet.EventAdded, Lease: subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.244.5.0"), PrefixLen: 24}}},
+	}
+	if len(res.Events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), res)
+	}
+	for i := range want {
+		if res.Events[i].Type != want[i].Type || !res.Events[i].Lease.Subnet.Equal(want[i].Lease.Subnet) {
+			t.Errorf("expected %v of %s, got %+v", want[i].Type, want[i].Lease.Subnet, res.Events[i])
+		}
+	}
+
+	if _, err := f.WatchLeases(ctx, "bogus"); err == nil {
+		t.Error("WatchLeases accepted a cursor of unknown type")
+	}
+}
+
+func TestWatchLeasesCursorHeldBackEvent(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: 50 * time.Millisecond})
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	o.ResourceVersion = "5"
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.20")
+	n.ResourceVersion = "7"
+	added := newManagedTestNode(ksm, "node3", "10.244.3.0/24", "192.168.0.3")
+	added.ResourceVersion = "8"
+
+	// The update of node2 is held back, so it is handed out after the
+	// addition of node3 despite coming from an older version
+	ksm.handleUpdateLeaseEvent(o, n)
+	ksm.handleAddLeaseEvent(subnet.EventAdded, added)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var cursor interface{} = watchCursor{}
+	var got []string
+	for len(got) < 2 {
+		res, err := ksm.WatchLeases(ctx, cursor)
+		if err != nil {
+			t.Fatalf("WatchLeases failed after %v: %v", got, err)
+		}
+		for _, e := range res.Events {
+			got = append(got, e.Lease.Attrs.PublicIP.String())
+		}
+		cursor = res.Cursor
+	}
+	if want := "192.168.0.3 192.168.0.20"; strings.Join(got, " ") != want {
+		t.Errorf("expected the leases of %s, got %v", want, got)
+	}
+}
+
+func TestWatchLease(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+	s.setNode(newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2"))
+	waitForCachedNode(t, ksm, "node2", func(n *v1.Node) bool { return true })
+	watches := func() int {
+		ksm.mux.Lock()
+		defer ksm.mux.Unlock()
+		return len(ksm.leaseWatches)
+	}
+
+	// An owned subnet starts with a snapshot of its lease
+	ctx, cancelWatch := context.WithTimeout(context.Background(), 5*time.Second)
+	res, err := ksm.WatchLease(ctx, ip.IP4Net{IP: ip.MustParseIP4("10.244.2.0"), PrefixLen: 24}, nil)
+	if err != nil {
+		t.Fatalf("WatchLease failed: %v", err)
+	}
+	if len(res.Events) != 0 || len(res.Snapshot) != 1 || res.Snapshot[0].Attrs.PublicIP.String() != "192.168.0.2" {
+		t.Errorf("expected a snapshot of the lease of node2, got %+v", res)
+	}
+
+	// Nothing stays registered between calls
+	if n := watches(); n != 0 {
+		t.Errorf("expected no registered watches, got %d", n)
+	}
+
+	// A cancelled call leaves the cursor usable with another context, which
+	// catches up with the changes made in between
+	cancelWatch()
+	if _, err := ksm.WatchLease(ctx, ip.IP4Net{IP: ip.MustParseIP4("10.244.2.0"), PrefixLen: 24}, res.Cursor); err != context.Canceled {
+		t.Errorf("expected the cancelled watch to fail, got %v", err)
+	}
+	s.setNode(newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.22"))
+	waitForCachedNode(t, ksm, "node2", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.BackendPublicIP] == "192.168.0.22"
+	})
+	ctx, cancelWatch = context.WithTimeout(context.Background(), 5*time.Second)
+	res, err = ksm.WatchLease(ctx, ip.IP4Net{IP: ip.MustParseIP4("10.244.2.0"), PrefixLen: 24}, res.Cursor)
+	cancelWatch()
+	if err != nil {
+		t.Fatalf("WatchLease failed: %v", err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Type != subnet.EventAdded || res.Events[0].Lease.Attrs.PublicIP.String() != "192.168.0.22" {
+		t.Errorf("expected the changed lease of node2, got %+v", res)
+	}
+	if n := watches(); n != 0 {
+		t.Errorf("expected no registered watches, got %d", n)
+	}
+
+	// A subnet without an owner blocks until a node takes it
+	ctx, cancelWatch = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWatch()
+	done := make(chan subnet.LeaseWatchResult, 1)
+	go func() {
+		res, err := ksm.WatchLease(ctx, ip.IP4Net{IP: ip.MustParseIP4("10.244.3.0"), PrefixLen: 24}, nil)
+		if err != nil {
+			t.Errorf("WatchLease failed: %v", err)
+		}
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		t.Fatalf("WatchLease returned before the subnet had an owner: %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.setNode(newManagedTestNode(ksm, "node3", "10.244.3.0/24", "192.168.0.3"))
+	select {
+	case res := <-done:
+		if len(res.Events) != 1 || res.Events[0].Type != subnet.EventAdded || res.Events[0].Lease.Attrs.PublicIP.String() != "192.168.0.3" {
+			t.Errorf("expected the lease of node3 to be added, got %+v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchLease never returned the lease of node3")
+	}
+
+	// Stopping the manager ends the watch
+	go func() {
+		_, err := ksm.WatchLease(context.Background(), ip.IP4Net{IP: ip.MustParseIP4("10.244.4.0"), PrefixLen: 24}, nil)
+		if err != subnet.ErrShuttingDown {
+			t.Errorf("expected ErrShuttingDown, got %v", err)
+		}
+		done <- subnet.LeaseWatchResult{}
+	}()
+	err = wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return watches() == 1, nil
+	})
+	if err != nil {
+		t.Fatal("the watch was never registered")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchLease kept waiting after the manager stopped")
+	}
+	if _, err := ksm.WatchLease(context.Background(), ip.IP4Net{IP: ip.MustParseIP4("10.244.4.0"), PrefixLen: 24}, nil); err != subnet.ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+}
+
+func TestAcquireLeaseUnroutablePublicIP(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	ctx := context.Background()
+
+	for _, addr := range []string{"127.0.0.1", "169.254.1.1", "0.0.0.0"} {
+		_, err := f.AcquireLease(ctx, &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4(addr), BackendType: "vxlan"})
+		if err == nil || !strings.Contains(err.Error(), addr) {
+			t.Errorf("expected an error naming %s, got %v", addr, err)
+		}
+	}
+
+	// The overwrite is what gets advertised, so it is what's checked
+	n := f.Node("node1")
+	n.Annotations = map[string]string{f.annotations.BackendPublicIPOverwrite: "fe80::1"}
+	f.UpdateNode(n)
+	if _, err := f.AcquireLease(ctx, &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}); err == nil {
+		t.Error("AcquireLease accepted a link-local overwrite")
+	}
+
+	n.Annotations[f.annotations.AllowUnroutablePublicIP] = "true"
+	f.UpdateNode(n)
+	if _, err := f.AcquireLease(ctx, &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}); err != nil {
+		t.Errorf("AcquireLease failed despite the allow annotation: %v", err)
+	}
+}
+
+func TestAcquireLeaseMergeBackendData(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	ctx := context.Background()
+	publicIP := ip.MustParseIP4("192.168.0.1")
+
+	attrs := &subnet.LeaseAttrs{PublicIP: publicIP, BackendType: "vxlan", BackendData: json.RawMessage(`{"VtepMAC":"aa","VNI":1,"Opts":{"a":1,"b":2}}`)}
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	attrs = &subnet.LeaseAttrs{PublicIP: publicIP, BackendType: "vxlan", BackendData: json.RawMessage(`{"VtepMAC":"bb","Opts":{"b":null}}`), MergeBackendData: true}
+	l, err := f.AcquireLease(ctx, attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	const merged = `{"Opts":{"a":1},"VNI":1,"VtepMAC":"bb"}`
+	if got := f.Node("node1").Annotations[f.annotations.BackendData]; got != merged {
+		t.Errorf("expected backend data %s, got %s", merged, got)
+	}
+	if string(l.Attrs.BackendData) != merged {
+		t.Errorf("expected the lease to carry %s, got %s", merged, l.Attrs.BackendData)
+	}
+
+	// Without the flag the data is replaced
+	attrs = &subnet.LeaseAttrs{PublicIP: publicIP, BackendType: "vxlan", BackendData: json.RawMessage(`{"VtepMAC":"cc"}`)}
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if got := f.Node("node1").Annotations[f.annotations.BackendData]; got != `{"VtepMAC":"cc"}` {
+		t.Errorf("expected the backend data to be replaced, got %s", got)
+	}
+}
+
+func TestBackendDataCompression(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	f.compressionThreshold = 64
+	ctx := context.Background()
+	publicIP := ip.MustParseIP4("192.168.0.1")
+
+	// Small data stays plain
+	attrs := &subnet.LeaseAttrs{PublicIP: publicIP, BackendType: "vxlan", BackendData: json.RawMessage(`{"VtepMAC":"aa"}`)}
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	n := f.Node("node1")
+	if got := n.Annotations[f.annotations.BackendData]; got != `{"VtepMAC":"aa"}` {
+		t.Errorf("expected plain backend data, got %s", got)
+	}
+	if _, ok := n.Annotations[f.annotations.BackendDataEncoding]; ok {
+		t.Error("expected no encoding annotation for plain backend data")
+	}
+
+	large := fmt.Sprintf(`{"Routes":%q,"VtepMAC":"aa"}`, strings.Repeat("10.244.0.0/24,", 20))
+	attrs = &subnet.LeaseAttrs{PublicIP: publicIP, BackendType: "vxlan", BackendData: json.RawMessage(large)}
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	n = f.Node("node1")
+	if enc := n.Annotations[f.annotations.BackendDataEncoding]; enc != BackendDataEncodingGzip {
+		t.Fatalf("expected compressed backend data, got encoding %q", enc)
+	}
+	if v := n.Annotations[f.annotations.BackendData]; len(v) >= len(large) || validJSON([]byte(v)) {
+		t.Errorf("expected the annotation to hold compressed data, got %s", v)
+	}
+	l, err := f.nodeToLease(*n)
+	if err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	if string(l.Attrs.BackendData) != large {
+		t.Errorf("expected the lease to carry %s, got %s", large, l.Attrs.BackendData)
+	}
+	if drifted := f.driftedAnnotations(n, attrs); len(drifted) != 0 {
+		t.Errorf("expected no drift, got %v", drifted)
+	}
+
+	// Merging works on the decompressed data, and shrinking it goes back to plain
+	attrs = &subnet.LeaseAttrs{PublicIP: publicIP, BackendType: "vxlan", BackendData: json.RawMessage(`{"Routes":null}`), MergeBackendData: true}
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	n = f.Node("node1")
+	if got := n.Annotations[f.annotations.BackendData]; got != `{"VtepMAC":"aa"}` {
+		t.Errorf("expected merged plain backend data, got %s", got)
+	}
+	if _, ok := n.Annotations[f.annotations.BackendDataEncoding]; ok {
+		t.Error("expected the encoding annotation to be removed")
+	}
+
+	n.Annotations[f.annotations.BackendDataEncoding] = "zstd"
+	if _, err := f.nodeToLease(*n); err == nil {
+		t.Error("expected an unknown encoding to be rejected")
+	}
+}
+
+func TestReconcileAnnotations(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	out := &recordedLog{}
+	f.log = recordingLogger{out: out}
+	ctx := context.Background()
+
+	// No lease, nothing to restore
+	f.reconcileAnnotations(ctx)
+	if len(f.Node("node1").Annotations) != 0 {
+		t.Fatal("reconcile annotated a node without a lease")
+	}
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan", BackendData: json.RawMessage(`{"VNI":1}`)}
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	want := f.Node("node1").Annotations
+
+	f.reconcileAnnotations(ctx)
+	if len(out.get()) != 0 {
+		t.Errorf("unexpected repair of intact annotations: %v", out.get())
+	}
+
+	n := f.Node("node1")
+	delete(n.Annotations, f.annotations.BackendData)
+	n.Annotations[f.annotations.BackendPublicIP] = "192.168.0.9"
+	f.UpdateNode(n)
+	f.reconcileAnnotations(ctx)
+	if got := f.Node("node1").Annotations; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected annotations %v to be restored, got %v", want, got)
+	}
+	entries := out.get()
+	if len(entries) != 1 || !strings.Contains(entries[0].msg, f.annotations.BackendData) || !strings.Contains(entries[0].msg, f.annotations.BackendPublicIP) {
+		t.Errorf("expected the repair to be logged with the changed annotations, got %v", entries)
+	}
+
+	// A released lease stays released
+	if err := f.ReleaseLease(ctx); err != nil {
+		t.Fatalf("ReleaseLease failed: %v", err)
+	}
+	f.reconcileAnnotations(ctx)
+	if _, ok := f.Node("node1").Annotations[f.annotations.SubnetKubeManaged]; ok {
+		t.Error("reconcile restored a released lease")
+	}
+}
+
+func TestMTUOverride(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	for _, tc := range []struct {
+		value string
+		mtu   int
+	}{
+		{"", 0},
+		{"1400", 1400},
+		{"576", 576},
+		{"9000", 9000},
+		{"575", 0},
+		{"9001", 0},
+		{"jumbo", 0},
+	} {
+		n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+		if tc.value != "" {
+			n.Annotations[ksm.annotations.MTUOverride] = tc.value
+		}
+		l, err := ksm.nodeToLease(*n)
+		if err != nil {
+			t.Fatalf("nodeToLease failed: %v", err)
+		}
+		if l.Attrs.MTU != tc.mtu {
+			t.Errorf("override %q: expected MTU %d, got %d", tc.value, tc.mtu, l.Attrs.MTU)
+		}
+	}
+
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n.Annotations[ksm.annotations.MTUOverride] = "1450"
+	ksm.handleUpdateLeaseEvent(o, n)
+	if e := nextEvent(t, ksm); e.Lease.Attrs.MTU != 1450 {
+		t.Errorf("expected an event with the new MTU, got %+v", e)
+	}
+
+	// An invalid override is warned about once, not on every resync
+	out := &recordedLog{}
+	ksm = newUnstartedTestManager(t, &SubnetManagerConfig{Logger: recordingLogger{out: out}})
+	n = newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n.Annotations[ksm.annotations.MTUOverride] = "jumbo"
+	ksm.nodeToLease(*n)
+	ksm.nodeToLease(*n)
+	if entries := out.get(); len(entries) != 1 {
+		t.Errorf("expected a single warning, got %d", len(entries))
+	}
+}
+
+func TestSubnetOverride(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	for _, tc := range []struct {
+		value  string
+		subnet string
+	}{
+		{"", "10.244.2.0/24"},
+		{"10.244.7.0/24", "10.244.7.0/24"},
+		{"10.244.7.1/24", "10.244.2.0/24"},
+		{"10.245.7.0/24", "10.244.2.0/24"},
+		{"10.244.0.0/15", "10.244.2.0/24"},
+		{"fd00::/64", "10.244.2.0/24"},
+		{"gateway", "10.244.2.0/24"},
+	} {
+		n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+		if tc.value != "" {
+			n.Annotations[ksm.annotations.SubnetOverride] = tc.value
+		}
+		l, err := ksm.nodeToLease(*n)
+		if err != nil {
+			t.Fatalf("nodeToLease failed: %v", err)
+		}
+		if l.Subnet.String() != tc.subnet {
+			t.Errorf("override %q: expected subnet %s, got %s", tc.value, tc.subnet, l.Subnet)
+		}
+	}
+
+	// Pinning a node moves it away from its old subnet
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n.Annotations[ksm.annotations.SubnetOverride] = "10.244.7.0/24"
+	ksm.handleUpdateLeaseEvent(o, n)
+	if e := nextEvent(t, ksm); e.Type != subnet.EventRemoved || e.Lease.Subnet.String() != "10.244.2.0/24" {
+		t.Errorf("expected the removal of the old subnet, got %+v", e)
+	}
+	if e := nextEvent(t, ksm); e.Type != subnet.EventAdded || e.Lease.Subnet.String() != "10.244.7.0/24" {
+		t.Errorf("expected the pinned subnet to be added, got %+v", e)
+	}
+
+	// The local node doesn't need a pod CIDR to acquire a pinned subnet
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	node := newTestNode("node1", "")
+	node.Annotations = map[string]string{ksm.annotations.SubnetOverride: "10.244.9.0/24"}
+	f, err := NewFakeSubnetManager(sc, "node1", node)
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	l, err := f.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.244.9.0/24" {
+		t.Errorf("expected the pinned subnet, got %s", l.Subnet)
+	}
+
+	// An invalid override is warned about once, not on every resync
+	out := &recordedLog{}
+	ksm = newUnstartedTestManager(t, &SubnetManagerConfig{Logger: recordingLogger{out: out}})
+	n = newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n.Annotations[ksm.annotations.SubnetOverride] = "10.0.0.0/24"
+	ksm.nodeToLease(*n)
+	ksm.nodeToLease(*n)
+	if entries := out.get(); len(entries) != 1 {
+		t.Errorf("expected a single warning, got %d", len(entries))
+	}
+}
+
+func TestPublicIPFromInternalIP(t *testing.T) {
+	withInternalIP := func(ksm *kubeSubnetManager, address string) *v1.Node {
+		n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "")
+		delete(n.Annotations, ksm.annotations.BackendPublicIP)
+		n.Status.Addresses = []v1.NodeAddress{
+			{Type: v1.NodeExternalIP, Address: "203.0.113.2"},
+			{Type: v1.NodeInternalIP, Address: "fd00::2"},
+			{Type: v1.NodeInternalIP, Address: address},
+		}
+		return n
+	}
+
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	if _, err := ksm.nodeToLease(*withInternalIP(ksm, "192.168.0.2")); err == nil {
+		t.Error("expected a node without public IP to be rejected by default")
+	}
+
+	ksm = newUnstartedTestManager(t, &SubnetManagerConfig{PublicIPFromInternalIP: true})
+	n := withInternalIP(ksm, "192.168.0.2")
+	l, err := ksm.nodeToLease(*n)
+	if err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	if l.Attrs.PublicIP.String() != "192.168.0.2" {
+		t.Errorf("expected the InternalIP as public IP, got %s", l.Attrs.PublicIP)
+	}
+	if !ksm.needsUpdate(n, withInternalIP(ksm, "192.168.0.3")) {
+		t.Error("expected a new InternalIP to update the lease")
+	}
+
+	// The annotation wins
+	n.Annotations[ksm.annotations.BackendPublicIP] = "192.168.0.9"
+	if l, err = ksm.nodeToLease(*n); err != nil || l.Attrs.PublicIP.String() != "192.168.0.9" {
+		t.Errorf("expected the annotated public IP, got %v (%v)", l.Attrs.PublicIP, err)
+	}
+}
+
+func TestPublicIPAddressType(t *testing.T) {
+	withAddresses := func(ksm *kubeSubnetManager) *v1.Node {
+		n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "")
+		delete(n.Annotations, ksm.annotations.BackendPublicIP)
+		n.Status.Addresses = []v1.NodeAddress{
+			{Type: v1.NodeInternalIP, Address: "192.168.0.2"},
+			{Type: v1.NodeExternalIP, Address: "127.0.0.1"},
+			{Type: v1.NodeExternalIP, Address: "fe80::2"},
+			{Type: v1.NodeExternalIP, Address: "203.0.113.2"},
+			{Type: v1.NodeExternalIP, Address: "2001:db8::2"},
+		}
+		return n
+	}
+
+	// Unusable addresses are skipped
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{PublicIPAddressType: "ExternalIP"})
+	n := withAddresses(ksm)
+	l, err := ksm.nodeToLease(*n)
+	if err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	if l.Attrs.PublicIP.String() != "203.0.113.2" || l.Attrs.PublicIPv6 != nil {
+		t.Errorf("expected the ExternalIP as public IP, got %s and %v", l.Attrs.PublicIP, l.Attrs.PublicIPv6)
+	}
+	changed := withAddresses(ksm)
+	changed.Status.Addresses[3].Address = "203.0.113.3"
+	if !ksm.needsUpdate(n, changed) {
+		t.Error("expected a new ExternalIP to update the lease")
+	}
+	if ksm.needsUpdate(n, withAddresses(ksm)) {
+		t.Error("expected unchanged addresses not to update the lease")
+	}
+
+	// The annotation wins
+	n.Annotations[ksm.annotations.BackendPublicIP] = "192.168.0.9"
+	if l, err = ksm.nodeToLease(*n); err != nil || l.Attrs.PublicIP.String() != "192.168.0.9" {
+		t.Errorf("expected the annotated public IP, got %v (%v)", l.Attrs.PublicIP, err)
+	}
+
+	// In dual-stack mode the IPv6 address is used as well
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "EnableIPv6": true, "IPv6Network": "fd00:10:244::/56"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	ksm, err = newKubeSubnetManager(nil, sc, "node1", &SubnetManagerConfig{PublicIPAddressType: "ExternalIP"})
+	if err != nil {
+		t.Fatalf("failed to create subnet manager: %v", err)
+	}
+	n = withAddresses(ksm)
+	if l, err = ksm.nodeToLease(*n); err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	if l.Attrs.PublicIP.String() != "203.0.113.2" || l.Attrs.PublicIPv6 == nil || l.Attrs.PublicIPv6.String() != "2001:db8::2" {
+		t.Errorf("expected both ExternalIPs as public IPs, got %s and %v", l.Attrs.PublicIP, l.Attrs.PublicIPv6)
+	}
+
+	for _, config := range []*SubnetManagerConfig{
+		{PublicIPAddressType: "Hostname"},
+		{PublicIPAddressType: "ExternalIP", PublicIPFromInternalIP: true},
+	} {
+		if _, err := newKubeSubnetManager(nil, sc, "node1", config); err == nil {
+			t.Errorf("expected config %+v to be rejected", config)
+		}
+	}
+}
+
+func TestPublicIPAddressTypeLoggedOnce(t *testing.T) {
+	out := &recordedLog{}
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{PublicIPAddressType: "ExternalIP", Logger: recordingLogger{out: out}})
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "")
+	delete(n.Annotations, ksm.annotations.BackendPublicIP)
+	n.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "203.0.113.2"}}
+	logged := func() int {
+		var count int
+		for _, e := range out.get() {
+			if strings.Contains(e.msg, "as public IP") {
+				count++
+			}
+		}
+		return count
+	}
+	toLease := func() {
+		if _, err := ksm.nodeToLease(*n); err != nil {
+			t.Fatalf("nodeToLease failed: %v", err)
+		}
+	}
+
+	// Every resync turns the node into a lease, but the address is only
+	// logged when it changes
+	toLease()
+	toLease()
+	if got := logged(); got != 1 {
+		t.Errorf("expected the address to be logged once, got %d", got)
+	}
+	n.Status.Addresses[0].Address = "203.0.113.3"
+	toLease()
+	if got := logged(); got != 2 {
+		t.Errorf("expected the new address to be logged, got %d", got)
+	}
+
+	// Or the annotation it stood in for comes and goes
+	n.Annotations[ksm.annotations.BackendPublicIP] = "192.168.0.2"
+	toLease()
+	delete(n.Annotations, ksm.annotations.BackendPublicIP)
+	toLease()
+	if got := logged(); got != 3 {
+		t.Errorf("expected the address to be logged again, got %d", got)
+	}
+}
+
+func TestPreferredSubnet(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	for _, tc := range []struct {
+		preferred string
+		warning   string
+	}{
+		{"", ""},
+		{"10.244.1.0/24", ""},
+		{"10.244.7.0/24", "prefers subnet 10.244.7.0/24"},
+		{"10.245.7.0/24", "Ignoring"},
+		{"gateway", "Ignoring"},
+	} {
+		node := newTestNode("node1", "10.244.1.0/24")
+		if tc.preferred != "" {
+			node.Annotations = map[string]string{"flannel.alpha.coreos.com/preferred-subnet": tc.preferred}
+		}
+		f, err := NewFakeSubnetManager(sc, "node1", node)
+		if err != nil {
+			t.Fatalf("failed to create fake subnet manager: %v", err)
+		}
+		out := &recordedLog{}
+		f.log = recordingLogger{out: out}
+		l, err := f.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")})
+		if err != nil {
+			t.Fatalf("AcquireLease failed: %v", err)
+		}
+		if l.Subnet.String() != "10.244.1.0/24" {
+			t.Errorf("preferred %q: expected the pod cidr as subnet, got %s", tc.preferred, l.Subnet)
+		}
+		var warnings []string
+		for _, e := range out.get() {
+			if strings.Contains(e.msg, "prefer") {
+				warnings = append(warnings, e.msg)
+			}
+		}
+		switch {
+		case tc.warning == "" && len(warnings) != 0:
+			t.Errorf("preferred %q: unexpected warnings %v", tc.preferred, warnings)
+		case tc.warning != "" && (len(warnings) != 1 || !strings.Contains(warnings[0], tc.warning)):
+			t.Errorf("preferred %q: expected a warning containing %q, got %v", tc.preferred, tc.warning, warnings)
+		}
+	}
+}
+
+func TestPodCIDRCheck(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")}
+	for _, podCIDR := range []string{"10.245.1.0/24", "10.244.0.0/15"} {
+		f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", podCIDR))
+		if err != nil {
+			t.Fatalf("failed to create fake subnet manager: %v", err)
+		}
+		_, err = f.AcquireLease(context.Background(), attrs)
+		if err == nil || !strings.Contains(err.Error(), "is not within the flannel network 10.244.0.0/16") {
+			t.Errorf("pod cidr %s: expected an error, got %v", podCIDR, err)
+		}
+	}
+
+	// In warn-only mode the lease is acquired anyway
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.245.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	out := &recordedLog{}
+	f.log = recordingLogger{out: out}
+	f.podCIDRCheckWarnOnly = true
+	l, err := f.AcquireLease(context.Background(), attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.245.1.0/24" {
+		t.Errorf("expected the pod cidr as subnet, got %s", l.Subnet)
+	}
+	warned := false
+	for _, e := range out.get() {
+		warned = warned || strings.Contains(e.msg, "is not within the flannel network")
+	}
+	if !warned {
+		t.Error("expected a warning about the pod cidr")
+	}
+}
+
+func TestBackendTypeTransition(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	for _, name := range []string{"node2", "node1"} {
+		o := newManagedTestNode(ksm, name, "10.244.2.0/24", "192.168.0.2")
+		n := newManagedTestNode(ksm, name, "10.244.2.0/24", "192.168.0.2")
+		n.Annotations[ksm.annotations.BackendType] = "host-gw"
+		ksm.handleUpdateLeaseEvent(o, n)
+
+		// The local node's lease isn't withdrawn
+		if name != ksm.nodeName {
+			if e := nextEvent(t, ksm); e.Type != subnet.EventRemoved || e.Lease.Attrs.BackendType != "vxlan" {
+				t.Errorf("%s: expected the vxlan lease to be removed, got %+v", name, e)
+			}
+		}
+		e := nextEvent(t, ksm)
+		if e.Type != subnet.EventAdded || e.Lease.Attrs.BackendType != "host-gw" || e.PreviousBackendType != "vxlan" {
+			t.Errorf("%s: expected the host-gw lease to be added as a transition from vxlan, got %+v", name, e)
+		}
+		if len(ksm.events) != 0 {
+			t.Errorf("%s: unexpected events left: %d", name, len(ksm.events))
+		}
+	}
+
+	// Other changes aren't transitions
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.3")
+	ksm.handleUpdateLeaseEvent(o, n)
+	if e := nextEvent(t, ksm); e.Type != subnet.EventAdded || e.PreviousBackendType != "" {
+		t.Errorf("expected a plain update, got %+v", e)
+	}
+}
+
+func TestLeaseEventResourceVersion(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	o.ResourceVersion = "5"
+	ksm.handleAddLeaseEvent(subnet.EventAdded, o)
+	if e := nextEvent(t, ksm); e.Lease.Asof != 5 {
+		t.Errorf("expected the added lease as of version 5, got %d", e.Lease.Asof)
+	}
+
+	// Both the withdrawn and the new lease are as of the change
+	n := newManagedTestNode(ksm, "node2", "10.244.3.0/24", "192.168.0.2")
+	n.ResourceVersion = "7"
+	ksm.handleUpdateLeaseEvent(o, n)
+	for _, et := range []subnet.EventType{subnet.EventRemoved, subnet.EventAdded} {
+		if e := nextEvent(t, ksm); e.Type != et || e.Lease.Asof != 7 {
+			t.Errorf("expected event %v as of version 7, got %+v", et, e)
+		}
+	}
+}
+
+// setenv sets an environment variable for the duration of a test, returning
+// a func restoring it.
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestNewSubnetManagerErrors(t *testing.T) {
+	s := newFakeAPIServer()
+	defer s.Close()
+	defer setenv("POD_NAME", "")()
+	defer setenv("POD_NAMESPACE", "")()
+
+	restore := setenv("NODE_NAME", "")
+	_, err := NewSubnetManager(context.Background(), &SubnetManagerConfig{ApiUrl: s.URL})
+	restore()
+	if ie, ok := err.(*InitError); !ok || ie.Reason != ErrNodeNameUnresolved {
+		t.Errorf("expected ErrNodeNameUnresolved, got %#v", err)
+	}
+
+	defer setenv("NODE_NAME", "node1")()
+	_, err = NewSubnetManager(context.Background(), &SubnetManagerConfig{ApiUrl: s.URL, NetConfPath: "/nonexistent/net-conf.json"})
+	ie, ok := err.(*InitError)
+	if !ok || ie.Reason != ErrConfigRead {
+		t.Fatalf("expected ErrConfigRead, got %#v", err)
+	}
+	if !os.IsNotExist(ie.Err) {
+		t.Errorf("expected the underlying error to be kept, got %v", ie.Err)
+	}
+	if !ie.Is(ErrConfigRead) || ie.Is(ErrSyncTimeout) {
+		t.Error("Is doesn't match the reason")
+	}
+
+	// A typo only fails strict parsing
+	f, err := ioutil.TempFile("", "net-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Network": "10.244.0.0/16", "SubentLen": 26}`)
+	f.Close()
+	_, err = NewSubnetManager(context.Background(), &SubnetManagerConfig{ApiUrl: s.URL, NetConfPath: f.Name(), StrictNetConf: true})
+	if ie, ok := err.(*InitError); !ok || ie.Reason != ErrConfigRead || !strings.Contains(err.Error(), "SubentLen") {
+		t.Errorf("expected ErrConfigRead for the unknown key, got %#v", err)
+	}
+
+	_, err = NewSubnetManager(context.Background(), &SubnetManagerConfig{Kubeconfig: "/nonexistent/kubeconfig"})
+	if ie, ok := err.(*InitError); !ok || ie.Reason != ErrClientInit {
+		t.Errorf("expected ErrClientInit, got %#v", err)
+	}
+}
+
+func TestNewSubnetManagerContext(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	defer setenv("NODE_NAME", "node1")()
+	f, err := ioutil.TempFile("", "net-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Network": "10.244.0.0/16"}`)
+	f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sm, err := NewSubnetManager(ctx, &SubnetManagerConfig{ApiUrl: s.URL, NetConfPath: f.Name()})
+	if err != nil {
+		t.Fatalf("NewSubnetManager failed: %v", err)
+	}
+
+	// Cancelling the context stops the informer and ends a pending watch
+	done := make(chan error, 1)
+	go func() {
+		_, err := sm.WatchLeases(context.Background(), watchCursor{})
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != subnet.ErrShuttingDown {
+			t.Errorf("expected ErrShuttingDown, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("WatchLeases still blocked after the context was cancelled")
+	}
+}
+
+func TestNewSubnetManagerUserAgent(t *testing.T) {
+	fake := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer fake.Close()
+	var mux sync.Mutex
+	agents := make(map[string]bool)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		agents[r.UserAgent()] = true
+		mux.Unlock()
+		fake.serveHTTP(w, r)
+	}))
+	defer s.Close()
+	defer setenv("NODE_NAME", "node1")()
+	f, err := ioutil.TempFile("", "net-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Network": "10.244.0.0/16"}`)
+	f.Close()
+
+	for _, tc := range []struct {
+		userAgent, want string
+	}{
+		{"", fmt.Sprintf("flanneld/%s (%s/%s) node/node1", version.Version, runtime.GOOS, runtime.GOARCH)},
+		{"my-flannel/1.0", "my-flannel/1.0"},
+	} {
+		mux.Lock()
+		agents = make(map[string]bool)
+		mux.Unlock()
+		ctx, cancel := context.WithCancel(context.Background())
+		if _, err := NewSubnetManager(ctx, &SubnetManagerConfig{ApiUrl: s.URL, NetConfPath: f.Name(), UserAgent: tc.userAgent}); err != nil {
+			t.Fatalf("NewSubnetManager failed: %v", err)
+		}
+		cancel()
+		mux.Lock()
+		if len(agents) != 1 || !agents[tc.want] {
+			t.Errorf("expected all requests from %q, got %v", tc.want, agents)
+		}
+		mux.Unlock()
+	}
+}
+
+func TestNewSubnetManagerSyncTimeout(t *testing.T) {
+	// An API server failing to list nodes
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusInternalServerError)
+	}))
+	defer s.Close()
+	defer setenv("NODE_NAME", "node1")()
+	f, err := ioutil.TempFile("", "net-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Network": "10.244.0.0/16"}`)
+	f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	_, err = NewSubnetManager(ctx, &SubnetManagerConfig{ApiUrl: s.URL, NetConfPath: f.Name(), SyncTimeout: 100 * time.Millisecond})
+	if ie, ok := err.(*InitError); !ok || ie.Reason != ErrSyncTimeout {
+		t.Errorf("expected ErrSyncTimeout, got %#v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected the sync timeout to be used, waited %v", d)
+	}
+
+	// Cancelling the context ends the wait
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = NewSubnetManager(ctx, &SubnetManagerConfig{ApiUrl: s.URL, NetConfPath: f.Name()})
+	if ie, ok := err.(*InitError); !ok || ie.Err != context.Canceled {
+		t.Errorf("expected the wait to be cancelled, got %#v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected the wait to end with the context, waited %v", d)
+	}
+}
+
+func TestInClusterConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-sa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")()
+	defer setenv("KUBERNETES_SERVICE_PORT", "443")()
+
+	cfg, err := inClusterConfig(tokenFile, "")
+	if err != nil {
+		t.Fatalf("inClusterConfig failed: %v", err)
+	}
+	if cfg.Host != "https://10.0.0.1:443" || cfg.BearerToken != "secret" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	// A CA certificate that was asked for has to load
+	if _, err := inClusterConfig(tokenFile, filepath.Join(dir, "ca.crt")); err == nil {
+		t.Error("inClusterConfig accepted a missing CA certificate")
+	}
+	if _, err := inClusterConfig(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Error("inClusterConfig accepted a missing token")
+	}
+}
+
+func TestSetRateLimits(t *testing.T) {
+	for _, tc := range []struct {
+		qps, wantQPS     float32
+		burst, wantBurst int
+	}{
+		{0, DefaultQPS, 0, DefaultBurst},
+		{50, 50, 100, 100},
+		{-1, DefaultQPS, -1, DefaultBurst},
+	} {
+		cfg := &rest.Config{}
+		setRateLimits(cfg, &SubnetManagerConfig{QPS: tc.qps, Burst: tc.burst}, recordingLogger{out: &recordedLog{}})
+		if cfg.QPS != tc.wantQPS || cfg.Burst != tc.wantBurst {
+			t.Errorf("QPS %v, burst %d: expected %v and %d, got %v and %d", tc.qps, tc.burst, tc.wantQPS, tc.wantBurst, cfg.QPS, cfg.Burst)
+		}
+	}
+}
+
+func TestPodCIDROverlap(t *testing.T) {
+	out := &recordedLog{}
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1, Logger: recordingLogger{out: out}})
+	before := podCIDROverlapsTotal.Value()
+
+	ksm.handleAddLeaseEvent(subnet.EventAdded, newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2"))
+	ksm.handleAddLeaseEvent(subnet.EventAdded, newManagedTestNode(ksm, "node3", "10.244.3.0/24", "192.168.0.3"))
+	if len(out.get()) != 0 {
+		t.Fatalf("unexpected warnings for distinct pod cidrs: %v", out.get())
+	}
+
+	// A re-created node that got node2's range
+	ksm.handleAddLeaseEvent(subnet.EventAdded, newManagedTestNode(ksm, "node4", "10.244.2.0/23", "192.168.0.4"))
+	entries := out.get()
+	if len(entries) != 2 || podCIDROverlapsTotal.Value()-before != 2 {
+		t.Fatalf("expected overlaps with node2 and node3, got %v", entries)
+	}
+	if !strings.Contains(entries[0].msg, `"node2"`) || !strings.Contains(entries[1].msg, `"node3"`) {
+		t.Errorf("expected the overlapping nodes to be named, got %v", entries)
+	}
+
+	// Once node2 and node3 are gone, node4 may have their ranges
+	ksm.handleAddLeaseEvent(subnet.EventRemoved, newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2"))
+	o := newManagedTestNode(ksm, "node3", "10.244.3.0/24", "192.168.0.3")
+	n := newTestNode("node3", "10.244.3.0/24")
+	ksm.handleUpdateLeaseEvent(o, n)
+	ksm.handleUpdateLeaseEvent(newManagedTestNode(ksm, "node4", "10.244.4.0/24", "192.168.0.4"), newManagedTestNode(ksm, "node4", "10.244.2.0/23", "192.168.0.5"))
+	if podCIDROverlapsTotal.Value()-before != 2 {
+		t.Errorf("unexpected warnings after the overlapping nodes left: %v", out.get()[2:])
+	}
+}
+
+func TestNeedsUpdate(t *testing.T) {
+	const zone = "topology.kubernetes.io/zone"
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{LeaseNodeLabels: []string{zone}})
+	for _, tc := range []struct {
+		name   string
+		change func(n *v1.Node)
+		want   bool
+	}{
+		{"nothing", func(n *v1.Node) {}, false},
+		{"resource version", func(n *v1.Node) { n.ResourceVersion = "2" }, false},
+		{"status", func(n *v1.Node) { n.Status.Phase = v1.NodePending }, false},
+		{"other annotation", func(n *v1.Node) { n.Annotations["example.com/foo"] = "bar" }, false},
+		{"other label", func(n *v1.Node) { n.Labels = map[string]string{"rack": "r1"} }, false},
+		{"backend data", func(n *v1.Node) { n.Annotations[ksm.annotations.BackendData] = `{"VNI":2}` }, true},
+		{"backend type", func(n *v1.Node) { n.Annotations[ksm.annotations.BackendType] = "host-gw" }, true},
+		{"public ip", func(n *v1.Node) { n.Annotations[ksm.annotations.BackendPublicIP] = "192.168.0.9" }, true},
+		{"public ipv6", func(n *v1.Node) { n.Annotations[ksm.annotations.BackendPublicIPv6] = "fd00::9" }, true},
+		{"mtu", func(n *v1.Node) { n.Annotations[ksm.annotations.MTUOverride] = "1400" }, true},
+		{"copied label", func(n *v1.Node) { n.Labels = map[string]string{zone: "zone-a"} }, true},
+		{"copied label set empty", func(n *v1.Node) { n.Labels = map[string]string{zone: ""} }, true},
+		{"pod cidr", func(n *v1.Node) { n.Spec.PodCIDR = "10.244.9.0/24" }, true},
+	} {
+		o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+		n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+		tc.change(n)
+		if got := ksm.needsUpdate(o, n); got != tc.want {
+			t.Errorf("%s: expected needsUpdate %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestDeleteTombstone(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+
+	ksm.handleDeleteLeaseEvent(cache.DeletedFinalStateUnknown{Key: "node2", Obj: n})
+	if e := nextEvent(t, ksm); e.Type != subnet.EventRemoved || e.Lease.Subnet.String() != "10.244.2.0/24" {
+		t.Errorf("expected removal of 10.244.2.0/24, got %+v", e)
+	}
+
+	// Anything else is ignored rather than panicking
+	ksm.handleDeleteLeaseEvent(cache.DeletedFinalStateUnknown{Key: "pod", Obj: &v1.Pod{}})
+	ksm.handleDeleteLeaseEvent(nil)
+	if len(ksm.events) != 0 {
+		t.Errorf("unexpected event for a deleted non-node")
+	}
+}
+
+func TestNodeNameStrategies(t *testing.T) {
+	n2 := newTestNode("node2", "10.244.2.0/24")
+	n2.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.0.2"}}
+	n3 := newTestNode("node3", "10.244.3.0/24")
+	n3.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "192.168.0.3"}}
+	s := newFakeAPIServer(n2, n3)
+	defer s.Close()
+	c, err := clientset.NewForConfig(&rest.Config{Host: s.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "flannel-hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostnameFile := filepath.Join(dir, "hostname")
+	if err := ioutil.WriteFile(hostnameFile, []byte("Node4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(f func() ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	addrs := []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.0.3"), Mask: net.CIDRMask(24, 32)}}
+	interfaceAddrs = func() ([]net.Addr, error) { return addrs, nil }
+
+	defer setenv("NODE_NAME", "")()
+	defer setenv("POD_NAME", "")()
+	defer setenv("POD_NAMESPACE", "")()
+	r := &nodeNameResolver{client: c, apiTimeout: time.Second, hostnameFile: hostnameFile}
+	ctx := context.Background()
+
+	// Only external IPs match, so internal-ip finds nothing
+	_, err = r.resolve(ctx, []NodeNameStrategy{NodeNameFromInternalIP, NodeNameFromEnv, "bogus"})
+	if err == nil {
+		t.Fatal("resolve found a node name")
+	}
+	for _, s := range []string{"internal-ip: no node", "env: env variable NODE_NAME", "bogus: unknown strategy"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected the error to contain %q, got %v", s, err)
+		}
+	}
+
+	addrs = append(addrs, &net.IPNet{IP: net.ParseIP("192.168.0.2"), Mask: net.CIDRMask(24, 32)})
+	if name, err := r.resolve(ctx, []NodeNameStrategy{NodeNameFromEnv, NodeNameFromInternalIP}); err != nil || name != "node2" {
+		t.Errorf("expected node2 by internal IP, got %q (%v)", name, err)
+	}
+	if name, err := r.resolve(ctx, []NodeNameStrategy{NodeNameFromHostname}); err != nil || name != "node4" {
+		t.Errorf("expected node4 from the hostname file, got %q (%v)", name, err)
+	}
+
+	// Outside a pod the error says to set NODE_NAME, suggesting the hostname
+	r.tokenFile = filepath.Join(dir, "token")
+	_, err = r.resolve(ctx, nil)
+	if err == nil || !strings.Contains(err.Error(), "set NODE_NAME to the name of this node, e.g. NODE_NAME=node4") {
+		t.Errorf("expected an error telling to set NODE_NAME, got %v", err)
+	}
+	if err := ioutil.WriteFile(r.tokenFile, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.resolve(ctx, nil)
+	if err == nil || strings.Contains(err.Error(), "doesn't seem to run in a pod") {
+		t.Errorf("expected the in-pod error, got %v", err)
+	}
+
+	// The default strategies are env, then pod
+	defer setenv("NODE_NAME", "node5")()
+	if name, err := r.resolve(ctx, nil); err != nil || name != "node5" {
+		t.Errorf("expected node5 from the environment, got %q (%v)", name, err)
+	}
+}
+
+func TestNodeNameFromPodRetries(t *testing.T) {
+	defer func(b wait.Backoff, m time.Duration) { podLookupBackoff, maxPodLookupInterval = b, m }(podLookupBackoff, maxPodLookupInterval)
+	podLookupBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 2}
+	maxPodLookupInterval = 10 * time.Millisecond
+
+	var failures, attempts int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/pods/missing"):
+			writeNotFound(w, "missing")
+		case atomic.AddInt32(&failures, -1) >= 0:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			writeJSON(w, http.StatusOK, &v1.Pod{Spec: v1.PodSpec{NodeName: "node1"}})
+		}
+	}))
+	defer s.Close()
+	c, err := clientset.NewForConfig(&rest.Config{Host: s.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	out := &recordedLog{}
+	r := &nodeNameResolver{client: c, apiTimeout: time.Second, podLookupTimeout: time.Second, log: recordingLogger{out: out}}
+	defer setenv("POD_NAMESPACE", "kube-system")()
+
+	// The API server comes up after a few failures
+	defer setenv("POD_NAME", "flannel")()
+	atomic.StoreInt32(&failures, 3)
+	if name, err := r.fromPod(context.Background()); err != nil || name != "node1" {
+		t.Errorf("expected node1 once the API server answered, got %q (%v)", name, err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 4 {
+		t.Errorf("expected 4 attempts, got %d", n)
+	}
+	if entries := out.get(); len(entries) != 3 {
+		t.Errorf("expected each failed attempt to be logged, got %v", entries)
+	}
+
+	// A missing pod isn't retried
+	atomic.StoreInt32(&attempts, 0)
+	defer setenv("POD_NAME", "missing")()
+	if _, err := r.fromPod(context.Background()); err == nil {
+		t.Error("expected an error for a missing pod")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected a single attempt for a missing pod, got %d", n)
+	}
+
+	// Retrying is bounded
+	defer setenv("POD_NAME", "flannel")()
+	atomic.StoreInt32(&failures, 1<<30)
+	r.podLookupTimeout = 50 * time.Millisecond
+	_, err = r.fromPod(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "giving up after") {
+		t.Errorf("expected to give up, got %v", err)
+	}
+}
+
+func TestExecCredentialPlugin(t *testing.T) {
+	var auth struct {
+		sync.Mutex
+		headers []string
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.Lock()
+		auth.headers = append(auth.headers, r.Header.Get("Authorization"))
+		auth.Unlock()
+		writeJSON(w, http.StatusOK, newTestNode("node1", "10.244.1.0/24"))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "flannel-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugin := filepath.Join(dir, "plugin.sh")
+	script := `#!/bin/sh
+case "$KUBERNETES_EXEC_INFO" in *ExecCredential*) ;; *) exit 1 ;; esac
+echo '{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"'$TOKEN_PREFIX'-token"}}'
+`
+	if err := ioutil.WriteFile(plugin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	kc := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: flannel
+clusters:
+- name: cluster
+  cluster:
+    server: %s
+contexts:
+- name: flannel
+  context:
+    cluster: cluster
+    user: flannel
+users:
+- name: flannel
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: %s
+      env:
+      - name: TOKEN_PREFIX
+        value: exec
+`, s.URL, plugin)
+	if err := ioutil.WriteFile(kubeconfig, []byte(kc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := restConfig(&SubnetManagerConfig{Kubeconfig: kubeconfig})
+	if err != nil {
+		t.Fatalf("restConfig failed: %v", err)
+	}
+	c, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := getNode(context.Background(), c, time.Second, "node1"); err != nil {
+			t.Fatalf("getNode failed: %v", err)
+		}
+	}
+	auth.Lock()
+	defer auth.Unlock()
+	if len(auth.headers) != 2 || auth.headers[0] != "Bearer exec-token" || auth.headers[1] != "Bearer exec-token" {
+		t.Errorf("expected requests authenticated with the plugin's token, got %v", auth.headers)
+	}
+
+	// A rest config is taken as is, but copied
+	rc := &rest.Config{Host: s.URL, BearerToken: "static"}
+	cfg, err = restConfig(&SubnetManagerConfig{RestConfig: rc, Kubeconfig: kubeconfig})
+	if err != nil {
+		t.Fatalf("restConfig failed: %v", err)
+	}
+	if cfg == rc || cfg.Host != s.URL || cfg.BearerToken != "static" || cfg.WrapTransport != nil {
+		t.Errorf("expected a copy of the rest config, got %+v", cfg)
+	}
+}
+
+func TestClientCertRotation(t *testing.T) {
+	var seen struct {
+		sync.Mutex
+		certs [][]byte
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen.Lock()
+		seen.certs = append(seen.certs, r.TLS.PeerCertificates[0].Raw)
+		seen.Unlock()
+		// Each request makes a new connection
+		w.Header().Set("Connection", "close")
+		writeJSON(w, http.StatusOK, newTestNode("node1", "10.244.1.0/24"))
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	s.StartTLS()
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "flannel-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeCert := func() []byte {
+		certPEM, keyPEM, err := certutil.GenerateSelfSignedCertKey("flannel", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		certs, err := certutil.ParseCertsPEM(certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certs[0].Raw
+	}
+	first := writeCert()
+
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	kc := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: flannel
+clusters:
+- name: cluster
+  cluster:
+    server: %s
+    insecure-skip-tls-verify: true
+contexts:
+- name: flannel
+  context:
+    cluster: cluster
+    user: flannel
+users:
+- name: flannel
+  user:
+    client-certificate: %s
+    client-key: %s
+`, s.URL, certFile, keyFile)
+	if err := ioutil.WriteFile(kubeconfig, []byte(kc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := restConfig(&SubnetManagerConfig{Kubeconfig: kubeconfig})
+	if err != nil {
+		t.Fatalf("restConfig failed: %v", err)
+	}
+	c, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	get := func() {
+		if _, err := getNode(context.Background(), c, 5*time.Second, "node1"); err != nil {
+			t.Fatalf("getNode failed: %v", err)
+		}
+	}
+
+	get()
+	second := writeCert()
+	get()
+	// A half-written pair is ignored
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	get()
+
+	seen.Lock()
+	defer seen.Unlock()
+	if len(seen.certs) != 3 || !bytes.Equal(seen.certs[0], first) || !bytes.Equal(seen.certs[1], second) || !bytes.Equal(seen.certs[2], second) {
+		t.Errorf("expected the rotated certificate to be used for new connections, got %d requests", len(seen.certs))
+	}
+}
+
+func TestAcquireLeaseMetrics(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	outcome := func(o string) int64 {
+		if v, ok := leaseAcquisitionsTotal.Get(o).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	success, notFound := outcome("success"), outcome("not_found")
+	leaseAcquireDuration.mux.Lock()
+	count := leaseAcquireDuration.count
+	leaseAcquireDuration.mux.Unlock()
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	if _, err := f.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	f.DeleteNode("node1")
+	if _, err := f.AcquireLease(context.Background(), attrs); err != ErrNodeNotFound {
+		t.Fatalf("expected ErrNodeNotFound, got %v", err)
+	}
+
+	if outcome("success")-success != 1 || outcome("not_found")-notFound != 1 {
+		t.Errorf("unexpected outcome counts %s", leaseAcquisitionsTotal)
+	}
+	var h struct {
+		Buckets map[string]int64
+		Count   int64
+	}
+	if err := json.Unmarshal([]byte(leaseAcquireDuration.String()), &h); err != nil {
+		t.Fatalf("histogram isn't valid JSON: %v", err)
+	}
+	if h.Count-count != 2 || h.Buckets["+Inf"] != h.Count || h.Buckets["60"] != h.Count {
+		t.Errorf("unexpected histogram %s", leaseAcquireDuration)
+	}
+}
+
+func TestWatchLeasesBatch(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1, WatchBatchSize: 3})
+	for i := 2; i <= 6; i++ {
+		n := newManagedTestNode(ksm, fmt.Sprintf("node%d", i), fmt.Sprintf("10.244.%d.0/24", i), fmt.Sprintf("192.168.0.%d", i))
+		n.ResourceVersion = strconv.Itoa(i)
+		ksm.handleAddLeaseEvent(subnet.EventAdded, n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var cursor interface{} = watchCursor{}
+	var subnets []string
+	for _, size := range []int{3, 2} {
+		res, err := ksm.WatchLeases(ctx, cursor)
+		if err != nil {
+			t.Fatalf("WatchLeases failed: %v", err)
+		}
+		if len(res.Events) != size {
+			t.Fatalf("expected a batch of %d events, got %d", size, len(res.Events))
+		}
+		for _, e := range res.Events {
+			subnets = append(subnets, e.Lease.Subnet.String())
+		}
+		cursor = res.Cursor
+	}
+	if want := "10.244.2.0/24 10.244.3.0/24 10.244.4.0/24 10.244.5.0/24 10.244.6.0/24"; strings.Join(subnets, " ") != want {
+		t.Errorf("expected events in order %s, got %v", want, subnets)
+	}
+}
+
+func TestListLeases(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	out := &recordedLog{}
+	f.log = recordingLogger{out: out}
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3"))
+	malformed := newManagedTestNode(f.kubeSubnetManager, "node4", "10.244.4.0/24", "192.168.0.4")
+	malformed.Annotations[f.annotations.BackendData] = "{"
+	f.AddNode(malformed)
+	out.Lock()
+	out.entries = nil
+	out.Unlock()
+
+	leases, err := f.ListLeases(context.Background())
+	if err != nil {
+		t.Fatalf("ListLeases failed: %v", err)
+	}
+	var subnets []string
+	for _, l := range leases {
+		subnets = append(subnets, l.Subnet.String())
+	}
+	sort.Strings(subnets)
+	if strings.Join(subnets, " ") != "10.244.2.0/24 10.244.3.0/24" {
+		t.Errorf("expected the leases of node2 and node3, got %v", subnets)
+	}
+	if entries := out.get(); len(entries) != 1 || !strings.Contains(entries[0].msg, `"node4"`) {
+		t.Errorf("expected a warning about node4, got %v", entries)
+	}
+}
+
+func TestBackendV6Data(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	ctx := context.Background()
+	publicIP := ip.MustParseIP4("192.168.0.1")
+
+	attrs := &subnet.LeaseAttrs{
+		PublicIP:      publicIP,
+		BackendType:   "vxlan",
+		BackendData:   json.RawMessage(`{"VtepMAC":"aa"}`),
+		BackendV6Data: json.RawMessage(`{"VtepMAC":"bb"}`),
+	}
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	n := f.Node("node1")
+	if got := n.Annotations[f.annotations.BackendData]; got != `{"VtepMAC":"aa"}` {
+		t.Errorf("expected the IPv4 backend data to be unchanged, got %s", got)
+	}
+	if got := n.Annotations[f.annotations.BackendV6Data]; got != `{"VtepMAC":"bb"}` {
+		t.Errorf("expected IPv6 backend data annotation, got %q", got)
+	}
+	l, err := f.nodeToLease(*n)
+	if err != nil {
+		t.Fatalf("nodeToLease failed: %v", err)
+	}
+	if string(l.Attrs.BackendData) != `{"VtepMAC":"aa"}` || string(l.Attrs.BackendV6Data) != `{"VtepMAC":"bb"}` {
+		t.Errorf("backend data didn't round-trip: %s, %s", l.Attrs.BackendData, l.Attrs.BackendV6Data)
+	}
+
+	// A lease without IPv6 backend data drops the annotation
+	attrs.BackendV6Data = nil
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if _, ok := f.Node("node1").Annotations[f.annotations.BackendV6Data]; ok {
+		t.Error("expected the IPv6 backend data annotation to be removed")
+	}
+
+	n.Annotations[f.annotations.BackendV6Data] = "{"
+	if _, err := f.nodeToLease(*n); err == nil {
+		t.Error("expected malformed IPv6 backend data to be rejected")
+	}
+}
+
+// resetGauges clears the gauges other tests' managers may have set, as they
+// are shared by all managers.
+func resetGauges() {
+	eventsQueueLength.Set(0)
+	managedNodes.Set(0)
+	leasesByBackendType.Init()
+}
+
+func TestManagedNodesGauge(t *testing.T) {
+	resetGauges()
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3"))
+	if v := managedNodes.Value(); v != 2 {
+		t.Errorf("expected 2 managed nodes, got %d", v)
+	}
+
+	// Updates that keep a node managed don't count it twice
+	n := newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3")
+	n.Annotations[f.annotations.MTUOverride] = "1400"
+	f.UpdateNode(n)
+	if v := managedNodes.Value(); v != 2 {
+		t.Errorf("expected 2 managed nodes after an update, got %d", v)
+	}
+
+	f.UpdateNode(newTestNode("node3", "10.244.3.0/24"))
+	f.DeleteNode("node2")
+	if v := managedNodes.Value(); v != 0 {
+		t.Errorf("expected no managed nodes, got %d", v)
+	}
+
+	// A recount fixes up drift
+	f.managed.set("ghost", "vxlan", true)
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node4", "10.244.4.0/24", "192.168.0.4"))
+	f.recountManagedNodes()
+	if v := managedNodes.Value(); v != 1 {
+		t.Errorf("expected 1 managed node after recounting, got %d", v)
+	}
+}
+
+func TestLeasesByBackendTypeGauge(t *testing.T) {
+	resetGauges()
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	count := func(backendType string) int64 {
+		v, ok := leasesByBackendType.Get(backendType).(*expvar.Int)
+		if !ok {
+			t.Fatalf("no lease count for backend type %q", backendType)
+		}
+		return v.Value()
+	}
+
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	n := newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3")
+	n.Annotations[f.annotations.BackendType] = "host-gw"
+	f.AddNode(n)
+	// Missing and unknown backend types share a bucket
+	n = newManagedTestNode(f.kubeSubnetManager, "node4", "10.244.4.0/24", "192.168.0.4")
+	delete(n.Annotations, f.annotations.BackendType)
+	f.AddNode(n)
+	n = newManagedTestNode(f.kubeSubnetManager, "node5", "10.244.5.0/24", "192.168.0.5")
+	n.Annotations[f.annotations.BackendType] = "carrier-pigeon"
+	f.AddNode(n)
+	if count("vxlan") != 1 || count("host-gw") != 1 || count(unknownBackendType) != 2 || count("udp") != 0 {
+		t.Errorf("unexpected lease counts %s", leasesByBackendType)
+	}
+
+	// A node changing backend type moves to the other bucket
+	n = newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3")
+	f.UpdateNode(n)
+	if count("vxlan") != 2 || count("host-gw") != 0 {
+		t.Errorf("unexpected lease counts after an update %s", leasesByBackendType)
+	}
+
+	f.DeleteNode("node2")
+	f.UpdateNode(newTestNode("node4", "10.244.4.0/24"))
+	if count("vxlan") != 1 || count(unknownBackendType) != 1 {
+		t.Errorf("unexpected lease counts after removals %s", leasesByBackendType)
+	}
+
+	// A recount fixes up drift
+	f.managed.set("ghost", "udp", true)
+	f.recountManagedNodes()
+	if count("udp") != 0 || count("vxlan") != 1 || count(unknownBackendType) != 1 {
+		t.Errorf("unexpected lease counts after recounting %s", leasesByBackendType)
+	}
+}
+
+func TestManagedNodeIndex(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	managed := func() string {
+		nodes, err := f.managedNodes()
+		if err != nil {
+			t.Fatalf("failed to list managed nodes: %v", err)
+		}
+		var names []string
+		for _, n := range nodes {
+			names = append(names, n.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	f.AddNode(newTestNode("node3", "10.244.3.0/24"))
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node4", "10.244.4.0/24", "192.168.0.4"))
+	if got := managed(); got != "node2,node4" {
+		t.Errorf("expected node2 and node4 to be managed, got %q", got)
+	}
+
+	// The index follows the annotation as nodes come and go
+	f.UpdateNode(newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3"))
+	f.UpdateNode(newTestNode("node2", "10.244.2.0/24"))
+	f.DeleteNode("node4")
+	if got := managed(); got != "node3" {
+		t.Errorf("expected only node3 to be managed, got %q", got)
+	}
+}
+
+func TestResync(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3"))
+	nextEvent(t, f.kubeSubnetManager)
+	nextEvent(t, f.kubeSubnetManager)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := f.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if err := f.Resync(ctx); err != nil {
+		t.Fatalf("Resync failed: %v", err)
+	}
+	// The cursor has seen the nodes, but gets their leases again
+	res, err = f.WatchLeases(ctx, res.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	var subnets []string
+	for _, e := range res.Events {
+		if e.Type != subnet.EventAdded {
+			t.Errorf("expected added leases, got %+v", e)
+		}
+		subnets = append(subnets, e.Lease.Subnet.String())
+	}
+	sort.Strings(subnets)
+	if !reflect.DeepEqual(subnets, []string{"10.244.2.0/24", "10.244.3.0/24"}) {
+		t.Errorf("expected the leases of node2 and node3, got %v", subnets)
+	}
+
+	// Changes are handed out after the resynced leases
+	if err := f.Resync(ctx); err != nil {
+		t.Fatalf("Resync failed: %v", err)
+	}
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.4.0/24", "192.168.0.2"))
+	res, err = f.WatchLeases(ctx, res.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if last := res.Events[len(res.Events)-1]; len(res.Events) != 4 || last.Lease.Subnet.String() != "10.244.4.0/24" {
+		t.Errorf("expected the resynced leases followed by the change, got %+v", res.Events)
+	}
+
+	cancel()
+	if err := f.Resync(ctx); err != context.Canceled {
+		t.Errorf("expected a canceled resync to fail, got %v", err)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	f.expiry = newExpirySweeper(time.Minute)
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node1", "10.244.1.0/24", "192.168.0.1"))
+	nextEvent(t, f.kubeSubnetManager)
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	if e := nextEvent(t, f.kubeSubnetManager); e.Type != subnet.EventAdded {
+		t.Fatalf("expected an added lease, got %+v", e)
+	}
+
+	now := time.Now()
+	f.sweepExpiredLeases(now)
+	if len(f.events) != 0 {
+		t.Fatalf("expected no lease to expire within the window, got %d events", len(f.events))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	snap, err := f.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	// Only the lease of the other node expires, and only once. Watchers
+	// following the snapshot see it expire, though the node is older than
+	// the snapshot.
+	f.sweepExpiredLeases(now.Add(2 * time.Minute))
+	f.sweepExpiredLeases(now.Add(3 * time.Minute))
+	if len(f.events) != 1 {
+		t.Fatalf("expected a single expired lease, got %d events", len(f.events))
+	}
+	res, err := f.WatchLeases(ctx, snap.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(res.Events) != 1 {
+		t.Fatalf("expected a single event, got %+v", res.Events)
+	}
+	if e := res.Events[0]; e.Type != subnet.EventExpired || e.Lease.Subnet.String() != "10.244.2.0/24" {
+		t.Errorf("expected the lease of node2 to expire, got %+v", e)
+	}
+
+	// An update of the node brings its lease back
+	f.UpdateNode(f.Node("node2"))
+	if e := nextEvent(t, f.kubeSubnetManager); e.Type != subnet.EventAdded || e.Lease.Subnet.String() != "10.244.2.0/24" {
+		t.Errorf("expected the lease of node2 to be added again, got %+v", e)
+	}
+
+	b, err := json.Marshal(subnet.Event{Type: subnet.EventExpired})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	var ev subnet.Event
+	if err := json.Unmarshal(b, &ev); err != nil || ev.Type != subnet.EventExpired {
+		t.Errorf("expected an expired event to round trip through JSON, got %s (%v)", b, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node3", "10.244.3.0/24", "192.168.0.3"))
+	ctx := context.Background()
+
+	// Returns right away, nothing happening after the snapshot
+	res, err := f.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	var subnets []string
+	for _, e := range res.Events {
+		if e.Type != subnet.EventAdded {
+			t.Errorf("expected only added events, got %+v", e)
+		}
+		subnets = append(subnets, e.Lease.Subnet.String())
+	}
+	sort.Strings(subnets)
+	if strings.Join(subnets, " ") != "10.244.2.0/24 10.244.3.0/24" {
+		t.Errorf("expected the leases of node2 and node3, got %v", subnets)
+	}
+
+	// The cursor skips what the snapshot covered
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node4", "10.244.4.0/24", "192.168.0.4"))
+	res, err = f.WatchLeases(ctx, res.Cursor)
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Lease.Subnet.String() != "10.244.4.0/24" {
+		t.Errorf("expected only the lease of node4, got %+v", res.Events)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := f.Snapshot(cctx); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestServerClock(t *testing.T) {
+	var nilClock *serverClock
+	if d := nilClock.now().Sub(time.Now()); d > time.Second || d < -time.Second {
+		t.Errorf("expected a nil clock to be the local one, off by %v", d)
+	}
+
+	skew := time.Hour
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+	}))
+	defer s.Close()
+
+	out := &recordedLog{}
+	c := &serverClock{log: recordingLogger{out: out}}
+	if d := c.now().Sub(time.Now()); d > time.Second || d < -time.Second {
+		t.Errorf("expected the local clock before any response, off by %v", d)
+	}
+	client := &http.Client{Transport: c.wrap(http.DefaultTransport)}
+	get := func() {
+		resp, err := client.Get(s.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	if d := c.now().Sub(time.Now().Add(skew)); d > 2*time.Second || d < -2*time.Second {
+		t.Errorf("expected the server's clock, off by %v", d)
+	}
+	get()
+	if entries := out.get(); len(entries) != 1 {
+		t.Errorf("expected a single skew warning, got %v", entries)
+	}
+
+	skew = 0
+	get()
+	if entries := out.get(); len(entries) != 2 {
+		t.Errorf("expected the skew to be reported gone, got %v", entries)
+	}
+}
+
+func TestLeaseExpirationServerClock(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	f.clock = &serverClock{log: f.log}
+	f.clock.observe(-2 * time.Hour)
+
+	l, err := f.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	want := time.Now().Add(DefaultLeaseExpiration - 2*time.Hour)
+	if d := l.Expiration.Sub(want); d > time.Second || d < -time.Second {
+		t.Errorf("expected the expiration by the server's clock, off by %v", d)
+	}
+}
+
+func TestAcquireLeaseRecreatedNode(t *testing.T) {
+	n := newTestNode("node1", "10.244.1.0/24")
+	n.UID = "a"
+	s := newFakeAPIServer(n)
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan", BackendData: json.RawMessage("null")}
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	})
+
+	// A cached node with a pod CIDR is not read from the API again
+	gets := s.nodeGets()
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if got := s.nodeGets() - gets; got != 0 {
+		t.Errorf("expected the cached node to be used, got %d reads", got)
+	}
+
+	// The node is deleted, then re-created with another pod CIDR before the
+	// cache hears of it
+	s.deleteNode("node1")
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, err := ksm.nodeStore.Get("node1")
+		return err != nil, nil
+	})
+	if err != nil {
+		t.Fatal("the deletion of node1 didn't reach the cache")
+	}
+	n = newTestNode("node1", "10.244.5.0/24")
+	n.UID = "b"
+	s.mux.Lock()
+	s.nodes["node1"] = n
+	s.mux.Unlock()
+	res, err := ksm.AcquireLeaseDetailed(context.Background(), attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if res.Lease.Subnet.String() != "10.244.5.0/24" || res.Status != AcquireCreated {
+		t.Errorf("expected a lease created for the new pod cidr, got %+v", res)
+	}
+	if n := s.node("node1"); n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" {
+		t.Errorf("expected the re-created node to be annotated, got %v", n.Annotations)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+	ctx := context.Background()
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	l, err := ksm.AcquireLease(ctx, attrs)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	})
+
+	// Renewing a lease the node still has sends no patch
+	patches := len(s.recordedPatches())
+	l.Expiration = time.Time{}
+	if err := ksm.RenewLease(ctx, l); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+	if got := len(s.recordedPatches()) - patches; got != 0 {
+		t.Errorf("expected no patch, got %d", got)
+	}
+	if !l.Expiration.After(time.Now()) {
+		t.Errorf("expected the expiration to be pushed out, got %v", l.Expiration)
+	}
+
+	// Annotations that drifted are patched back
+	n := s.node("node1")
+	n.Annotations[ksm.annotations.BackendPublicIP] = "192.168.0.9"
+	s.setNode(n)
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.BackendPublicIP] == "192.168.0.9"
+	})
+	if err := ksm.RenewLease(ctx, l); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+	if got := s.node("node1").Annotations[ksm.annotations.BackendPublicIP]; got != "192.168.0.1" {
+		t.Errorf("expected the public ip to be restored, got %q", got)
+	}
+
+	// A node that is gone can't renew
+	s.deleteNode("node1")
+	err = wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, err := ksm.nodeStore.Get("node1")
+		return err != nil, nil
+	})
+	if err != nil {
+		t.Fatal("the deletion of node1 didn't reach the cache")
+	}
+	if err := ksm.RenewLease(ctx, l); err != ErrNodeNotFound {
+		t.Errorf("expected ErrNodeNotFound, got %v", err)
+	}
+}
+
+func TestAcquireLeaseRetriesOnConflict(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManager(t, s, "node1")
+	defer cancel()
+
+	// The node changes before the cache hears of it, so the patch built
+	// from the cached node is rejected
+	s.mux.Lock()
+	n := copyNode(s.nodes["node1"])
+	n.Labels = map[string]string{"example.com/changed": "true"}
+	s.resourceVersion++
+	n.ResourceVersion = strconv.Itoa(s.resourceVersion)
+	s.nodes["node1"] = n
+	s.mux.Unlock()
+
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan"}
+	if _, err := ksm.AcquireLease(context.Background(), attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if patches := s.recordedPatches(); len(patches) != 2 {
+		t.Fatalf("expected a rejected patch and a retry, got %d patches", len(patches))
+	}
+	n = s.node("node1")
+	if n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" || n.Labels["example.com/changed"] != "true" {
+		t.Errorf("expected the changed node to be annotated, got %+v", n.ObjectMeta)
+	}
+}
+
+func TestAcquireLeaseWindow(t *testing.T) {
+	n := newTestNode("node1", "10.244.1.0/24")
+	n.UID = "a"
+	s := newFakeAPIServer(n)
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{AcquireLeaseWindow: time.Hour})
+	defer cancel()
+	coalesced := func() int64 {
+		if v, ok := leaseAcquisitionsTotal.Get("coalesced").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	acquire := func(publicIP string) *AcquireResult {
+		attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4(publicIP), BackendType: "vxlan", BackendData: json.RawMessage("null")}
+		res, err := ksm.AcquireLeaseDetailed(context.Background(), attrs)
+		if err != nil {
+			t.Fatalf("AcquireLease failed: %v", err)
+		}
+		return res
+	}
+	waitForLease := func(publicIP string) {
+		waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+			return n.Annotations[ksm.annotations.BackendPublicIP] == publicIP
+		})
+	}
+
+	acquire("192.168.0.1")
+	waitForLease("192.168.0.1")
+	before := coalesced()
+	patches := len(s.recordedPatches())
+
+	// The same call again returns the same lease without going to the API
+	// server, even if the node changed in a way the cache hasn't seen yet
+	s.mux.Lock()
+	n = copyNode(s.nodes["node1"])
+	n.Annotations[ksm.annotations.BackendPublicIP] = "192.168.0.9"
+	s.nodes["node1"] = n
+	s.mux.Unlock()
+	res := acquire("192.168.0.1")
+	if res.Lease.Subnet.String() != "10.244.1.0/24" || res.Status != AcquireUnchanged || res.Changed {
+		t.Errorf("expected the lease to be returned again, got %+v", res)
+	}
+	if coalesced()-before != 1 || len(s.recordedPatches()) != patches {
+		t.Errorf("expected a coalesced acquisition without patches, got %d and %d patches", coalesced()-before, len(s.recordedPatches())-patches)
+	}
+
+	// Other attributes make for another acquisition
+	res = acquire("192.168.0.2")
+	if res.Lease.Subnet.String() != "10.244.1.0/24" || res.Status != AcquireUpdated {
+		t.Errorf("expected the lease to be acquired again, got %+v", res)
+	}
+	waitForLease("192.168.0.2")
+
+	// So does the node no longer handing out the lease
+	n = s.node("node1")
+	n = copyNode(n)
+	n.Spec.PodCIDR = "10.244.6.0/24"
+	s.setNode(n)
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		ksm.acquired.mux.Lock()
+		defer ksm.acquired.mux.Unlock()
+		return ksm.acquired.lease == nil, nil
+	})
+	if err != nil {
+		t.Fatal("the acquisition wasn't forgotten when the pod cidr changed")
+	}
+	if res = acquire("192.168.0.2"); res.Lease.Subnet.String() != "10.244.6.0/24" {
+		t.Errorf("expected a lease for the new pod cidr, got %+v", res)
+	}
+
+	// And releasing it
+	if err := ksm.ReleaseLease(context.Background()); err != nil {
+		t.Fatalf("ReleaseLease failed: %v", err)
+	}
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.SubnetKubeManaged] != "true"
+	})
+	if res = acquire("192.168.0.2"); res.Status != AcquireCreated {
+		t.Errorf("expected the released lease to be acquired again, got %+v", res)
+	}
+	if coalesced()-before != 1 {
+		t.Errorf("expected a single coalesced acquisition, got %d", coalesced()-before)
+	}
+}
+
+func TestAcquireLeaseWindowMergeBackendData(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{AcquireLeaseWindow: time.Hour})
+	defer cancel()
+	n := newTestNode("node1", "10.244.1.0/24")
+	n.Annotations[ksm.annotations.BackendData] = `{"VNI":1}`
+	s.setNode(n)
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.BackendData] != ""
+	})
+	const data = `{"VtepMAC":"aa"}`
+	acquire := func() *AcquireResult {
+		attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan", BackendData: json.RawMessage(data), MergeBackendData: true}
+		res, err := ksm.AcquireLeaseDetailed(context.Background(), attrs)
+		if err != nil {
+			t.Fatalf("AcquireLease failed: %v", err)
+		}
+		if string(attrs.BackendData) != data {
+			t.Errorf("the caller's backend data was changed to %s", attrs.BackendData)
+		}
+		return res
+	}
+
+	first := acquire()
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool {
+		return n.Annotations[ksm.annotations.SubnetKubeManaged] == "true"
+	})
+	res := acquire()
+	const merged = `{"VNI":1,"VtepMAC":"aa"}`
+	if string(first.Lease.Attrs.BackendData) != merged || string(res.Lease.Attrs.BackendData) != merged {
+		t.Errorf("expected backend data %s, got %s and %s", merged, first.Lease.Attrs.BackendData, res.Lease.Attrs.BackendData)
+	}
+	if !res.Lease.Expiration.After(first.Lease.Expiration) {
+		t.Errorf("expected the expiration to be renewed, got %v after %v", res.Lease.Expiration, first.Lease.Expiration)
+	}
+	if res.Previous == nil || res.Changed {
+		t.Errorf("expected the lease to be unchanged from the cached one, got %+v", res)
+	}
+}
+
+func TestAcquireLeaseDetailed(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	attrs := subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan", BackendData: json.RawMessage(`{"VtepMAC":"aa:bb:cc:dd:ee:ff"}`)}
+
+	a := attrs
+	res, err := f.AcquireLeaseDetailed(context.Background(), &a)
+	if err != nil {
+		t.Fatalf("AcquireLeaseDetailed failed: %v", err)
+	}
+	if res.Previous != nil || !res.Changed || res.Status != AcquireCreated || res.Lease.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("expected a new lease without a previous one, got %+v", res)
+	}
+
+	a = attrs
+	if res, err = f.AcquireLeaseDetailed(context.Background(), &a); err != nil {
+		t.Fatalf("AcquireLeaseDetailed failed: %v", err)
+	}
+	if res.Previous == nil || res.Changed || res.Status != AcquireUnchanged {
+		t.Errorf("expected the same lease as before, got %+v", res)
+	}
+
+	a = attrs
+	a.PublicIP = ip.MustParseIP4("192.168.0.2")
+	if res, err = f.AcquireLeaseDetailed(context.Background(), &a); err != nil {
+		t.Fatalf("AcquireLeaseDetailed failed: %v", err)
+	}
+	if !res.Changed || res.Status != AcquireUpdated || res.Previous == nil || res.Previous.Attrs.PublicIP.String() != "192.168.0.1" {
+		t.Errorf("expected a changed lease with the old public IP as previous, got %+v", res)
+	}
+
+	// Annotations not handed out with the lease count as updates too
+	n, err := f.nodeStore.Get("node1")
+	if err != nil {
+		t.Fatalf("failed to get node1: %v", err)
+	}
+	n = copyNode(n)
+	delete(n.Annotations, f.annotations.Version)
+	f.UpdateNode(n)
+	if res, err = f.AcquireLeaseDetailed(context.Background(), &a); err != nil {
+		t.Fatalf("AcquireLeaseDetailed failed: %v", err)
+	}
+	if res.Changed || res.Status != AcquireUpdated {
+		t.Errorf("expected an updated node with an unchanged lease, got %+v", res)
+	}
+}
+
+func TestNoLeaseExpiration(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1", newTestNode("node1", "10.244.1.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	l, err := f.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if !l.Expires() {
+		t.Error("expected leases to expire by default")
+	}
+
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{LeaseExpiration: time.Hour, NoLeaseExpiration: true})
+	f.leaseExpiration = ksm.leaseExpiration
+	if l, err = f.AcquireLease(context.Background(), &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")}); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l.Expires() {
+		t.Errorf("expected a lease that never expires, got expiration %v", l.Expiration)
+	}
+	if err := f.RenewLease(context.Background(), l); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+	if l.Expires() {
+		t.Errorf("expected a renewed lease that never expires, got expiration %v", l.Expiration)
+	}
+}
+
+func TestDrainTaints(t *testing.T) {
+	const maintenance = "example.com/maintenance"
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1, DrainTaints: []string{maintenance, UnschedulableTaint}})
+	o := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+
+	// Other taints don't matter
+	n := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	n.Spec.Taints = []v1.Taint{{Key: "example.com/other", Effect: v1.TaintEffectNoSchedule}}
+	ksm.handleUpdateLeaseEvent(o, n)
+	if len(ksm.events) != 0 {
+		t.Fatal("unexpected event for an unrelated taint")
+	}
+
+	n.Spec.Taints = append(n.Spec.Taints, v1.Taint{Key: maintenance, Effect: v1.TaintEffectNoSchedule})
+	ksm.handleUpdateLeaseEvent(o, n)
+	if e := nextEvent(t, ksm); e.Type != subnet.EventRemoved || e.Lease.Subnet.String() != "10.244.2.0/24" {
+		t.Errorf("expected the lease to be withdrawn, got %+v", e)
+	}
+
+	// Changes while drained aren't handed out
+	d := newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2")
+	d.Spec.Taints = n.Spec.Taints
+	d.Annotations[ksm.annotations.MTUOverride] = "1400"
+	ksm.handleUpdateLeaseEvent(n, d)
+	if len(ksm.events) != 0 {
+		t.Fatal("unexpected event for a drained node")
+	}
+
+	ksm.handleUpdateLeaseEvent(d, o)
+	if e := nextEvent(t, ksm); e.Type != subnet.EventAdded || e.Lease.Subnet.String() != "10.244.2.0/24" {
+		t.Errorf("expected the lease to be added back, got %+v", e)
+	}
+
+	// Cordoned nodes of clusters that don't taint them
+	c := newManagedTestNode(ksm, "node3", "10.244.3.0/24", "192.168.0.3")
+	c.Spec.Unschedulable = true
+	ksm.handleAddLeaseEvent(subnet.EventAdded, c)
+	if len(ksm.events) != 0 {
+		t.Error("unexpected event for a cordoned node")
+	}
+
+	// Without drain taints, taints are ignored
+	ksm = newUnstartedTestManager(t, &SubnetManagerConfig{EventDebounce: -1})
+	ksm.handleAddLeaseEvent(subnet.EventAdded, c)
+	if e := nextEvent(t, ksm); e.Type != subnet.EventAdded {
+		t.Errorf("expected the lease of the cordoned node, got %+v", e)
+	}
+}
+
+func TestAcquireLeasePatchOnlyFlannelAnnotations(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	node := newTestNode("node1", "10.244.1.0/24")
+	node.Labels = map[string]string{"kubernetes.io/hostname": "node1"}
+	node.Annotations = map[string]string{"example.com/other": "kept"}
+	node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.0.1"}}
+	f, err := NewFakeSubnetManager(sc, "node1", node)
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	var patches [][]byte
+	f.nodePatcher = func(ctx context.Context, name string, patch []byte) error {
+		patches = append(patches, patch)
+		return f.patch(ctx, name, patch)
+	}
+	// annotationKeys returns the annotations a patch touches, failing if
+	// it touches anything else.
+	annotationKeys := func(patch []byte) []string {
+		var p map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(patch, &p); err != nil {
+			t.Fatalf("patch %s isn't an annotations only patch: %v", patch, err)
+		}
+		metadata := p["metadata"]
+		delete(metadata, "resourceVersion") // A precondition, not a change
+		if len(p) != 1 || len(metadata) != 1 || metadata["annotations"] == nil {
+			t.Fatalf("patch %s touches more than annotations", patch)
+		}
+		var annotations map[string]interface{}
+		if err := json.Unmarshal(metadata["annotations"], &annotations); err != nil {
+			t.Fatalf("patch %s has malformed annotations: %v", patch, err)
+		}
+		var keys []string
+		for k := range annotations {
+			if !strings.HasPrefix(k, DefaultAnnotationPrefix+"/") {
+				t.Errorf("patch %s touches non-flannel annotation %s", patch, k)
+			}
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	ctx := context.Background()
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1"), BackendType: "vxlan", BackendData: json.RawMessage(`{"VNI":1}`)}
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if len(patches) != 1 {
+		t.Fatalf("expected a single patch, got %d", len(patches))
+	}
+	annotationKeys(patches[0])
+
+	// Nothing changed, nothing written
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if len(patches) != 1 {
+		t.Fatalf("expected no patch for an unchanged lease, got %s", patches[len(patches)-1])
+	}
+
+	// Only what changed is written
+	attrs.BackendData = json.RawMessage(`{"VNI":2}`)
+	if _, err := f.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("expected a second patch, got %d", len(patches))
+	}
+	if keys := annotationKeys(patches[1]); len(keys) != 1 || keys[0] != f.annotations.BackendData {
+		t.Errorf("expected only the backend data to be written, got %v", keys)
+	}
+
+	n := f.Node("node1")
+	if n.Annotations["example.com/other"] != "kept" || n.Labels["kubernetes.io/hostname"] != "node1" || len(n.Status.Addresses) != 1 {
+		t.Errorf("patches changed more than flannel annotations: %+v", n)
+	}
+}
+
+func TestNetConfConfigMap(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", "10.244.1.0/24"))
+	defer s.Close()
+	defer setenv("NODE_NAME", "node1")()
+	s.mux.Lock()
+	s.configMaps["kube-system/kube-flannel-cfg"] = &v1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kube-flannel-cfg"},
+		Data:       map[string]string{"net-conf.json": `{"Network": "10.244.0.0/16", "Backend": {"Type": "host-gw"}}`},
+	}
+	s.mux.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sm, err := NewSubnetManager(ctx, &SubnetManagerConfig{
+		ApiUrl:           s.URL,
+		NetConfPath:      "/nonexistent/net-conf.json",
+		NetConfConfigMap: "kube-system/kube-flannel-cfg",
+	})
+	if err != nil {
+		t.Fatalf("NewSubnetManager failed: %v", err)
+	}
+	sc, err := sm.GetNetworkConfig(ctx)
+	if err != nil {
+		t.Fatalf("GetNetworkConfig failed: %v", err)
+	}
+	if sc.Network.String() != "10.244.0.0/16" || sc.BackendType != "host-gw" {
+		t.Errorf("expected the config from the ConfigMap, got %+v", sc)
+	}
+	cancel()
+
+	for _, tc := range []struct {
+		configMap, key string
+		reason         error
+	}{
+		{"kube-flannel-cfg", "", ErrInvalidConfig},
+		{"kube-system/missing", "", ErrConfigRead},
+		{"kube-system/kube-flannel-cfg", "cni-conf.json", ErrConfigRead},
+	} {
+		_, err := NewSubnetManager(context.Background(), &SubnetManagerConfig{ApiUrl: s.URL, NetConfConfigMap: tc.configMap, NetConfConfigMapKey: tc.key})
+		if ie, ok := err.(*InitError); !ok || ie.Reason != tc.reason {
+			t.Errorf("%s[%s]: expected %v, got %v", tc.configMap, tc.key, tc.reason, err)
+		}
+	}
+}
+
+func TestWatchNetConf(t *testing.T) {
+	s := newFakeAPIServer()
+	defer s.Close()
+	const netConf = `{"Network": "10.244.0.0/16"}`
+	cm := &v1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kube-flannel-cfg"},
+		Data:       map[string]string{"net-conf.json": netConf},
+	}
+	s.configMaps["kube-system/kube-flannel-cfg"] = cm
+
+	c, err := clientset.NewForConfig(&rest.Config{Host: s.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	sc, err := subnet.ParseConfig(netConf)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	out := &recordedLog{}
+	ksm, err := newKubeSubnetManager(c, sc, "node1", &SubnetManagerConfig{ResyncPeriod: 10 * time.Millisecond, Logger: recordingLogger{out: out}})
+	if err != nil {
+		t.Fatalf("failed to create subnet manager: %v", err)
+	}
+	ksm.netConfSrc, _ = parseNetConfConfigMap("kube-system/kube-flannel-cfg", "")
+	ksm.netConf = netConf
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ksm.watchNetConf(ctx)
+	time.Sleep(50 * time.Millisecond)
+	if entries := out.get(); len(entries) != 0 {
+		t.Fatalf("unexpected messages for an unchanged config: %v", entries)
+	}
+
+	s.mux.Lock()
+	cm.Data = map[string]string{"net-conf.json": `{"Network": "10.245.0.0/16"}`}
+	s.mux.Unlock()
+	select {
+	case sc := <-ksm.NetConfChanges():
+		if sc.Network.String() != "10.245.0.0/16" {
+			t.Errorf("expected the changed network, got %s", sc.Network)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the config change wasn't handed out")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if entries := out.get(); len(entries) != 1 || !strings.Contains(entries[0].msg, "restart flannel") {
+		t.Errorf("expected a single warning about the change, got %v", entries)
+	}
+}
+
+func TestWatchNetConfFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "net-conf")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	write := func(netConf string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(netConf), 0644); err != nil {
+			t.Fatalf("failed to write net conf: %v", err)
+		}
+	}
+	const netConf = `{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlan", "VNI": 1}}`
+	write(netConf)
+	sc, err := subnet.ParseConfig(netConf)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	out := &recordedLog{}
+	ksm, err := newKubeSubnetManager(nil, sc, "node1", &SubnetManagerConfig{NetConfCheckInterval: 10 * time.Millisecond, Logger: recordingLogger{out: out}})
+	if err != nil {
+		t.Fatalf("failed to create subnet manager: %v", err)
+	}
+	ksm.netConfSrc = netConfFile(f.Name())
+	ksm.netConf = netConf
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ksm.watchNetConf(ctx)
+	waitForLog := func(substr string) {
+		err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			for _, e := range out.get() {
+				if strings.Contains(e.msg, substr) {
+					return true, nil
+				}
+			}
+			return false, nil
+		})
+		if err != nil {
+			t.Fatalf("no message about %q, got %v", substr, out.get())
+		}
+	}
+	noChange := func() {
+		select {
+		case sc := <-ksm.NetConfChanges():
+			t.Errorf("unexpected config change %+v", sc)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Laying the config out differently changes nothing
+	write(`{"Backend": {"VNI": 1, "Type": "vxlan"}, "Network": "10.244.0.0/16"}`)
+	noChange()
+	// Neither do configs caught half written, or with unknown backends
+	write(`{"Network": "10.245.0.0/16", "Backend": {"Ty`)
+	waitForLog("Ignoring invalid network config")
+	noChange()
+	write(`{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlam"}}`)
+	waitForLog("unknown backend type")
+	noChange()
+
+	write(`{"Network": "10.244.0.0/16", "Backend": {"Type": "vxlan", "VNI": 2}}`)
+	select {
+	case sc := <-ksm.NetConfChanges():
+		if !strings.Contains(string(sc.Backend), `"VNI": 2`) {
+			t.Errorf("expected the changed backend, got %s", sc.Backend)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the config change wasn't handed out")
+	}
+	waitForLog("Backend differ")
+
+	write(netConf)
+	waitForLog("back to the one in use")
+	noChange()
+}
+
+func TestResyncJitter(t *testing.T) {
+	for _, tc := range []struct {
+		r    float64
+		want time.Duration
+	}{
+		{0, 90 * time.Second},
+		{0.25, 95 * time.Second},
+		{0.5, 100 * time.Second},
+		{0.75, 105 * time.Second},
+	} {
+		if got := jitteredPeriod(100*time.Second, 0.1, tc.r); got != tc.want {
+			t.Errorf("r=%v: expected %v, got %v", tc.r, tc.want, got)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		ksm := newUnstartedTestManager(t, &SubnetManagerConfig{ResyncPeriod: 100 * time.Second})
+		if ksm.resyncPeriod < 90*time.Second || ksm.resyncPeriod > 110*time.Second {
+			t.Errorf("expected a resync period within 10%% of 100s, got %v", ksm.resyncPeriod)
+		}
+	}
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{ResyncPeriod: 100 * time.Second, ResyncJitter: -1})
+	if ksm.resyncPeriod != 100*time.Second {
+		t.Errorf("expected no jitter, got %v", ksm.resyncPeriod)
+	}
+}
+
+func TestAcquireLeaseFailureEvent(t *testing.T) {
+	s := newFakeAPIServer(newTestNode("node1", ""))
+	defer s.Close()
+	ksm, cancel := newTestManagerWithConfig(t, s, "node1", &SubnetManagerConfig{PodCIDRWaitTimeout: time.Millisecond})
+	defer cancel()
+	ctx := context.Background()
+	attrs := &subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")}
+
+	for i := 1; i <= acquireFailureThreshold+2; i++ {
+		if _, err := ksm.AcquireLease(ctx, attrs); err == nil {
+			t.Fatal("expected AcquireLease to fail without a pod cidr")
+		}
+		want := 0
+		if i >= acquireFailureThreshold {
+			want = 1 // Rate limited after the first
+		}
+		if events := s.recordedEvents(); len(events) != want {
+			t.Fatalf("after %d failures: expected %d events, got %d", i, want, len(events))
+		}
+	}
+	e := s.recordedEvents()[0]
+	if e.Type != v1.EventTypeWarning || e.Reason != "LeaseAcquisitionFailed" || e.InvolvedObject.Name != "node1" ||
+		!strings.Contains(e.Message, "pod cidr not assigned") {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	// A success ends the run of failures
+	s.setNode(newTestNode("node1", "10.244.1.0/24"))
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool { return n.Spec.PodCIDR != "" })
+	if _, err := ksm.AcquireLease(ctx, attrs); err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	s.setNode(newTestNode("node1", ""))
+	waitForCachedNode(t, ksm, "node1", func(n *v1.Node) bool { return n.Spec.PodCIDR == "" })
+	for i := 0; i < acquireFailureThreshold; i++ {
+		ksm.AcquireLease(ctx, attrs)
+	}
+	if events := s.recordedEvents(); len(events) != 2 {
+		t.Errorf("expected a new run of failures to be recorded, got %d events", len(events))
+	}
+}
+
+func TestDumpLeases(t *testing.T) {
+	ksm := newUnstartedTestManager(t, &SubnetManagerConfig{})
+	malformed := newManagedTestNode(ksm, "node4", "10.244.4.0/24", "not-an-ip")
+	s := newFakeAPIServer(
+		newManagedTestNode(ksm, "node2", "10.244.2.0/24", "192.168.0.2"),
+		newManagedTestNode(ksm, "node1", "10.244.1.0/24", "192.168.0.1"),
+		newTestNode("node3", "10.244.3.0/24"),
+		malformed,
+	)
+	defer s.Close()
+
+	leases, err := DumpLeases(context.Background(), &SubnetManagerConfig{ApiUrl: s.URL})
+	if err != nil {
+		t.Fatalf("DumpLeases failed: %v", err)
+	}
+	expected := []LeaseInfo{
+		{Node: "node1", Subnet: "10.244.1.0/24", PublicIP: "192.168.0.1", BackendType: "vxlan"},
+		{Node: "node2", Subnet: "10.244.2.0/24", PublicIP: "192.168.0.2", BackendType: "vxlan"},
+	}
+	if !reflect.DeepEqual(leases, expected) {
+		t.Errorf("expected leases %+v, got %+v", expected, leases)
+	}
+	if patches := s.recordedPatches(); len(patches) != 0 {
+		t.Errorf("expected no node to be modified, got %d patches", len(patches))
+	}
+
+	b, err := json.Marshal(leases[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := `{"node":"node1","subnet":"10.244.1.0/24","publicIP":"192.168.0.1","backendType":"vxlan"}`; string(b) != s {
+		t.Errorf("expected %s, got %s", s, b)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16"}`)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	f, err := NewFakeSubnetManager(sc, "node1")
+	if err != nil {
+		t.Fatalf("failed to create fake subnet manager: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.Run(ctx)
+		close(done)
+	}()
+
+	a, b, slow := f.Subscribe(), f.Subscribe(), f.Subscribe()
+	f.AddNode(newManagedTestNode(f.kubeSubnetManager, "node2", "10.244.2.0/24", "192.168.0.2"))
+	for _, ch := range []<-chan subnet.Event{a, b} {
+		if e := <-ch; e.Type != subnet.EventAdded || e.Lease.Subnet.String() != "10.244.2.0/24" {
+			t.Errorf("expected every subscriber to get the added lease, got %+v", e)
+		}
+	}
+
+	// Unsubscribed channels are closed
+	f.Unsubscribe(b)
+	if _, ok := <-b; ok {
+		t.Error("expected the channel of an unsubscribed subscriber to be closed")
+	}
+	f.Unsubscribe(b)
+
+	// Subscribers falling too far behind are dropped, the others keep up
+	dropped := subscribersDroppedTotal.Value()
+	for i := 0; i < SubscriberBuffer; i++ {
+		f.dispatch(leaseEvent{Event: subnet.Event{Type: subnet.EventAdded}})
+		<-a
+	}
+	if n := subscribersDroppedTotal.Value() - dropped; n != 1 {
+		t.Errorf("expected the slow subscriber to be dropped, %d were", n)
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != SubscriberBuffer {
+		t.Errorf("expected the slow subscriber to get %d events before its channel was closed, got %d", SubscriberBuffer, n)
+	}
+
+	// Stopping the manager closes all channels, and those of later subscribers
+	cancel()
+	<-done
+	for _, ch := range []<-chan subnet.Event{a, f.Subscribe()} {
+		if _, ok := <-ch; ok {
+			t.Error("expected the channels of subscribers to be closed once the manager stopped")
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// The vendored client-go predates tools/leaderelection, so this is a small
+// ConfigMap based lock along the same lines. The record is stored in the same
+// annotation and format client-go uses.
+
+const (
+	leaderElectionRecordAnnotation = "control-plane.alpha.kubernetes.io/leader"
+
+	DefaultLeaderElectionLeaseDuration = 15 * time.Second
+	DefaultLeaderElectionRetryPeriod   = 2 * time.Second
+)
+
+var ErrNotLeader = errors.New("not the leader, node annotations are written by the instance elected for the node")
+
+// LeaderElectionConfig makes the subnet manager elect a leader among the
+// instances managing the same node. The manager only ever writes the
+// annotations of its own node, so leadership is per node: each node has its
+// own lock, and the instances of different nodes never wait for each other.
+// Only the leader acquires, renews and releases the node's lease;
+// AcquireLease, RenewLease and ReleaseLease return ErrNotLeader on the
+// followers, which keep watching leases as usual.
+type LeaderElectionConfig struct {
+	// Namespace and Name identify the ConfigMaps used as locks. The lock of
+	// a node is named Name-<node name>.
+	Namespace string
+	Name      string
+	// Identity names this instance in the lock. Empty means the hostname.
+	Identity string
+
+	// LeaseDuration is how long followers wait after the last renewal
+	// they saw before taking over. Zero means
+	// DefaultLeaderElectionLeaseDuration.
+	LeaseDuration time.Duration
+	// RetryPeriod is how often the lock is acquired or renewed. Zero means
+	// DefaultLeaderElectionRetryPeriod.
+	RetryPeriod time.Duration
+}
+
+type leaderElectionRecord struct {
+	HolderIdentity       string      `json:"holderIdentity"`
+	LeaseDurationSeconds int         `json:"leaseDurationSeconds"`
+	AcquireTime          metav1.Time `json:"acquireTime"`
+	RenewTime            metav1.Time `json:"renewTime"`
+	LeaderTransitions    int         `json:"leaderTransitions"`
+}
+
+type leaderElector struct {
+	client        clientset.Interface
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+	log           Logger
+
+	// observedRecord (and observedRaw, as stored) and observedTime are the
+	// last record seen in the lock and when it was seen. Expiry is judged against the local clock only.
+	observedRecord leaderElectionRecord
+	observedRaw    string
+	observedTime   time.Time
+
+	// renewed is the time (in unix nanoseconds) this instance last renewed
+	// the lock. Accessed atomically.
+	renewed int64
+}
+
+// newLeaderElector returns the elector of the leader among the instances
+// managing nodeName.
+func newLeaderElector(c clientset.Interface, config *LeaderElectionConfig, nodeName string, log Logger) (*leaderElector, error) {
+	if config.Namespace == "" || config.Name == "" {
+		return nil, fmt.Errorf("leader election lock namespace and name must be set")
+	}
+	if nodeName == "" {
+		return nil, fmt.Errorf("leader election needs the node name")
+	}
+
+	le := &leaderElector{
+		client:        c,
+		namespace:     config.Namespace,
+		name:          config.Name + "-" + nodeName,
+		identity:      config.Identity,
+		leaseDuration: config.LeaseDuration,
+		retryPeriod:   config.RetryPeriod,
+	}
+	if le.identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine leader election identity: %v", err)
+		}
+		le.identity = hostname
+	}
+	le.log = log.WithValues("lock", le.namespace+"/"+le.name, "identity", le.identity)
+	if le.leaseDuration <= 0 {
+		le.leaseDuration = DefaultLeaderElectionLeaseDuration
+	}
+	if le.retryPeriod <= 0 {
+		le.retryPeriod = DefaultLeaderElectionRetryPeriod
+	}
+	if le.retryPeriod >= le.leaseDuration {
+		return nil, fmt.Errorf("leader election retry period %v must be shorter than the lease duration %v", le.retryPeriod, le.leaseDuration)
+	}
+	return le, nil
+}
+
+// isLeader reports whether this instance renewed the lock recently enough
+// that no other instance can have taken it over.
+func (le *leaderElector) isLeader() bool {
+	renewed := atomic.LoadInt64(&le.renewed)
+	return renewed != 0 && time.Since(time.Unix(0, renewed)) < le.leaseDuration
+}
+
+// run tries to acquire or renew the lock every retry period until ctx is done.
+func (le *leaderElector) run(ctx context.Context) {
+	le.log.Infof("Starting leader election for lock %s/%s as %q", le.namespace, le.name, le.identity)
+	ticker := time.NewTicker(le.retryPeriod)
+	defer ticker.Stop()
+
+	wasLeader := false
+	for {
+		if err := le.tryAcquireOrRenew(ctx); err != nil {
+			le.log.Warningf("Error acquiring leader election lock %s/%s: %v", le.namespace, le.name, err)
+		}
+		if leader := le.isLeader(); leader != wasLeader {
+			if leader {
+				le.log.Infof("Became leader for lock %s/%s", le.namespace, le.name)
+			} else {
+				le.log.Infof("Lost leadership for lock %s/%s to %q", le.namespace, le.name, le.observedRecord.HolderIdentity)
+			}
+			wasLeader = leader
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tryAcquireOrRenew takes the lock if it is free or expired, or renews it if
+// this instance already holds it. Writes carry the resource version of the
+// lock that was read, so two instances can't both win. Each API call must
+// finish within the retry period.
+func (le *leaderElector) tryAcquireOrRenew(ctx context.Context) error {
+	now := metav1.Now()
+	rec := leaderElectionRecord{
+		HolderIdentity:       le.identity,
+		LeaseDurationSeconds: int(le.leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	cm, err := getConfigMap(ctx, le.client, le.retryPeriod, le.namespace, le.name)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: le.name, Namespace: le.namespace}}
+		if err := setLeaderElectionRecord(cm, rec); err != nil {
+			return err
+		}
+		if _, err := createConfigMap(ctx, le.client, le.retryPeriod, cm); err != nil {
+			return err
+		}
+		le.observe(cm, rec, now.Time)
+		return nil
+	}
+
+	var old leaderElectionRecord
+	raw := cm.Annotations[leaderElectionRecordAnnotation]
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &old); err != nil {
+			return fmt.Errorf("malformed leader election record: %v", err)
+		}
+	}
+	if raw != le.observedRaw {
+		le.observedRecord = old
+		le.observedRaw = raw
+		le.observedTime = now.Time
+	}
+	if old.HolderIdentity != "" && old.HolderIdentity != le.identity &&
+		now.Time.Before(le.observedTime.Add(le.leaseDuration)) {
+		return nil // Held by someone else
+	}
+
+	if old.HolderIdentity == le.identity {
+		rec.AcquireTime = old.AcquireTime
+		rec.LeaderTransitions = old.LeaderTransitions
+	} else {
+		rec.LeaderTransitions = old.LeaderTransitions + 1
+	}
+	if err := setLeaderElectionRecord(cm, rec); err != nil {
+		return err
+	}
+	if _, err := updateConfigMap(ctx, le.client, le.retryPeriod, cm); err != nil {
+		return err
+	}
+	le.observe(cm, rec, now.Time)
+	return nil
+}
+
+// observe notes a successful write of rec to the lock.
+func (le *leaderElector) observe(cm *v1.ConfigMap, rec leaderElectionRecord, t time.Time) {
+	le.observedRecord = rec
+	le.observedRaw = cm.Annotations[leaderElectionRecordAnnotation]
+	le.observedTime = t
+	atomic.StoreInt64(&le.renewed, t.UnixNano())
+}
+
+func setLeaderElectionRecord(cm *v1.ConfigMap, rec leaderElectionRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations[leaderElectionRecordAnnotation] = string(b)
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Logger is what the kube subnet manager logs through. Messages are the same
+// as with glog; in addition WithValues attaches key/value fields (node name,
+// event type, ...) that a structured implementation can emit as such.
+type Logger interface {
+	// WithValues returns a Logger that adds the given key/value pairs to
+	// every message.
+	WithValues(keysAndValues ...interface{}) Logger
+
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	// Debugf logs at glog verbosity 2.
+	Debugf(format string, args ...interface{})
+}
+
+// glogLogger is the default Logger. It drops the fields, so the output is
+// exactly what the manager logged through glog before.
+type glogLogger struct{}
+
+func (l glogLogger) WithValues(keysAndValues ...interface{}) Logger {
+	return l
+}
+
+func (glogLogger) Infof(format string, args ...interface{}) {
+	glog.InfoDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Warningf(format string, args ...interface{}) {
+	glog.WarningDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Debugf(format string, args ...interface{}) {
+	if glog.V(2) {
+		glog.InfoDepth(1, fmt.Sprintf(format, args...))
+	}
+}
+
+// changeLog remembers, per node, the value a message repeated on every
+// resync was last logged for, so the message is only logged again once the
+// value changes.
+type changeLog struct {
+	mux  sync.Mutex
+	last map[string]map[string]string // By node name, then message key
+}
+
+// changed records value as the one last logged for key of the node, and
+// reports whether it differs from the one recorded before.
+func (c *changeLog) changed(node, key, value string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if v, ok := c.last[node][key]; ok && v == value {
+		return false
+	}
+	if c.last == nil {
+		c.last = make(map[string]map[string]string)
+	}
+	if c.last[node] == nil {
+		c.last[node] = make(map[string]string)
+	}
+	c.last[node][key] = value
+	return true
+}
+
+// clear forgets what was logged for key of the node, once the message no
+// longer applies, so it is logged again should it apply again.
+func (c *changeLog) clear(node, key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.last[node], key)
+}
+
+// forget drops what was logged for the node, once it is removed.
+func (c *changeLog) forget(node string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.last, node)
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are published through expvar. flanneld serves them as JSON on
+// /debug/vars of the healthz server, whose own mux registers expvar.Handler
+// explicitly; the default mux, where expvar registers itself, isn't served.
+//
+// The metrics are process wide, shared by all kube subnet managers. flanneld
+// runs a single one; in a process running several, the counters add up
+// across managers, while the gauges are those of the manager that last set
+// them.
+var (
+	// eventsQueueLength is the number of lease events buffered for WatchLeases.
+	eventsQueueLength = expvar.NewInt("flannel_kube_events_queue_length")
+	// eventsBlockedTotal counts event sends that found the buffer full and
+	// had to wait for WatchLeases to catch up.
+	eventsBlockedTotal = expvar.NewInt("flannel_kube_events_blocked_total")
+	// eventsDroppedTotal counts events that were thrown away because the
+	// buffer stayed full for too long.
+	eventsDroppedTotal = expvar.NewInt("flannel_kube_events_dropped_total")
+	// subscribersDroppedTotal counts the subscribers dropped for falling
+	// too far behind.
+	subscribersDroppedTotal = expvar.NewInt("flannel_kube_subscribers_dropped_total")
+	// publicIPOverwritesTotal counts the times a public-ip-overwrite
+	// annotation replaced the public IP flannel detected.
+	publicIPOverwritesTotal = expvar.NewInt("flannel_kube_public_ip_overwrites_total")
+	// annotationRepairsTotal counts the times the reconcile loop found the
+	// local node's flannel annotations removed or changed.
+	annotationRepairsTotal = expvar.NewInt("flannel_kube_annotation_repairs_total")
+	// podCIDROverlapsTotal counts the times a node's lease was found to
+	// overlap another node's.
+	podCIDROverlapsTotal = expvar.NewInt("flannel_kube_pod_cidr_overlaps_total")
+	// informerRestartsTotal counts the node informers the watchdog restarted
+	// for not receiving watch events.
+	informerRestartsTotal = expvar.NewInt("flannel_kube_informer_restarts_total")
+	// leaseAcquireDuration is how long AcquireLease calls took, node patch
+	// included.
+	leaseAcquireDuration = newHistogram("flannel_kube_lease_acquire_duration_seconds",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+	// leaseAcquisitionsTotal counts AcquireLease calls by outcome: success,
+	// conflict, not_found, error, or coalesced into the previous call.
+	leaseAcquisitionsTotal = expvar.NewMap("flannel_kube_lease_acquisitions_total")
+	// managedNodes is the number of flannel managed nodes, i.e. of leases,
+	// known to the node informer.
+	managedNodes = expvar.NewInt("flannel_kube_managed_nodes")
+	// leasesByBackendType is the number of flannel managed nodes by the
+	// backend type of their lease.
+	leasesByBackendType = expvar.NewMap("flannel_kube_leases_by_backend_type")
+)
+
+// unknownBackendType is the leasesByBackendType key of the nodes whose
+// backend type is missing, or isn't a known one.
+const unknownBackendType = "unknown"
+
+// managedNodeSet keeps the names of the flannel managed nodes along with
+// their backend type, publishing their number as the managedNodes gauge and
+// their number by backend type as the leasesByBackendType one.
+type managedNodeSet struct {
+	mux   sync.Mutex
+	names map[string]string
+}
+
+// set records whether node name is flannel managed, and with which backend
+// type.
+func (s *managedNodeSet) set(name, backendType string, managed bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.names == nil {
+		s.names = make(map[string]string)
+	}
+	if managed {
+		s.names[name] = backendType
+	} else {
+		delete(s.names, name)
+	}
+	s.publish()
+}
+
+// reset replaces the managed nodes with nodes, a map of node names to
+// backend types.
+func (s *managedNodeSet) reset(nodes map[string]string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.names = nodes
+	s.publish()
+}
+
+// publish updates the gauges. Every known backend type is published, with a
+// count of zero if no node uses it, so that the gauges of the backend types
+// nodes no longer use drop to zero. s.mux must be held.
+func (s *managedNodeSet) publish() {
+	managedNodes.Set(int64(len(s.names)))
+	counts := map[string]int64{unknownBackendType: 0}
+	for backendType := range backendSettings {
+		counts[backendType] = 0
+	}
+	for _, backendType := range s.names {
+		if _, ok := backendSettings[backendType]; !ok {
+			backendType = unknownBackendType
+		}
+		counts[backendType]++
+	}
+	for backendType, n := range counts {
+		v := new(expvar.Int)
+		v.Set(n)
+		leasesByBackendType.Set(backendType, v)
+	}
+}
+
+// histogram is a cumulative histogram published through expvar, as
+// {"buckets": {"<upper bound>": count, ...}, "count": n, "sum": s}.
+type histogram struct {
+	mux    sync.Mutex
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newHistogram(name string, bounds []float64) *histogram {
+	h := &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+	expvar.Publish(name, h)
+	return h
+}
+
+// observe records a duration, in seconds.
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) String() string {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	buckets := make([]string, 0, len(h.bounds)+1)
+	for i, b := range h.bounds {
+		buckets = append(buckets, fmt.Sprintf("%q: %d", fmt.Sprint(b), h.counts[i]))
+	}
+	buckets = append(buckets, fmt.Sprintf(`"+Inf": %d`, h.count))
+	return fmt.Sprintf(`{"buckets": {%s}, "count": %d, "sum": %g}`, strings.Join(buckets, ", "), h.count, h.sum)
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/flannel/subnet"
+
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// MigrateConfig holds the settings of MigrateLeases.
+type MigrateConfig struct {
+	// AnnotationPrefix is the annotation prefix the kube subnet manager
+	// will be run with. Empty means DefaultAnnotationPrefix.
+	AnnotationPrefix string
+	// DryRun reports what would be done without modifying any node.
+	DryRun bool
+	// APITimeout bounds each API call. Zero means DefaultAPITimeout.
+	APITimeout time.Duration
+}
+
+// MigrationResult is the outcome of MigrateLeases.
+type MigrationResult struct {
+	// Annotated are the nodes that were annotated, or would have been in a
+	// dry run.
+	Annotated []string
+	// Unchanged are the nodes that already carried their lease.
+	Unchanged []string
+	// Conflicts are the leases that could not be carried over.
+	Conflicts []MigrationConflict
+	// Unmatched are the leases no node has the public IP of.
+	Unmatched []subnet.Lease
+}
+
+// MigrationConflict describes a lease that could not be carried over to a
+// node.
+type MigrationConflict struct {
+	Lease  subnet.Lease
+	Nodes  []string
+	Reason string
+}
+
+// MigrateLeases carries the leases held in another subnet manager (typically
+// the etcd one) over to the Kubernetes nodes, so switching to the kube subnet
+// manager doesn't hand every node a new subnet. Each lease is matched to the
+// node that has its public IP as one of its addresses. The node gets the
+// lease's flannel annotations and, if it has no pod CIDR yet, the lease's
+// subnet as pod CIDR. A node whose pod CIDR is already set to something else
+// is reported as a conflict and left alone.
+//
+// MigrateLeases only writes what is missing, so it can be run again safely.
+func MigrateLeases(ctx context.Context, from subnet.Manager, c clientset.Interface, config *MigrateConfig) (*MigrationResult, error) {
+	prefix := config.AnnotationPrefix
+	if prefix == "" {
+		prefix = DefaultAnnotationPrefix
+	}
+	a, err := newAnnotations(prefix)
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.APITimeout
+	if timeout <= 0 {
+		timeout = DefaultAPITimeout
+	}
+
+	// A watch without a cursor starts with a snapshot of all leases.
+	res, err := from.WatchLeases(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read leases from %s: %v", from.Name(), err)
+	}
+	nodes, err := listNodes(ctx, c, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	result := &MigrationResult{}
+	for _, l := range res.Snapshot {
+		matches := nodesWithAddress(nodes.Items, l.Attrs.PublicIP.String())
+		switch len(matches) {
+		case 0:
+			result.Unmatched = append(result.Unmatched, l)
+			continue
+		case 1:
+		default:
+			result.Conflicts = append(result.Conflicts, MigrationConflict{
+				Lease:  l,
+				Nodes:  nodeNames(matches),
+				Reason: fmt.Sprintf("several nodes have address %s", l.Attrs.PublicIP),
+			})
+			continue
+		}
+
+		n := matches[0]
+		patch, err := leaseMigrationPatch(a, n, l)
+		if err != nil {
+			result.Conflicts = append(result.Conflicts, MigrationConflict{
+				Lease:  l,
+				Nodes:  []string{n.Name},
+				Reason: err.Error(),
+			})
+			continue
+		}
+		if patch == nil {
+			result.Unchanged = append(result.Unchanged, n.Name)
+			continue
+		}
+		if !config.DryRun {
+			if _, err := patchNode(ctx, c, timeout, n.Name, types.StrategicMergePatchType, patch); err != nil {
+				return result, fmt.Errorf("failed to annotate node %q with lease %s: %v", n.Name, l.Subnet, err)
+			}
+		}
+		result.Annotated = append(result.Annotated, n.Name)
+	}
+	return result, nil
+}
+
+// leaseMigrationPatch returns the patch that gives n the lease l, or nil if
+// n has it already.
+func leaseMigrationPatch(a annotations, n *v1.Node, l subnet.Lease) ([]byte, error) {
+	var podCIDR string
+	switch n.Spec.PodCIDR {
+	case "":
+		podCIDR = l.Subnet.String()
+	case l.Subnet.String():
+	default:
+		return nil, fmt.Errorf("node pod cidr %s doesn't match the lease", n.Spec.PodCIDR)
+	}
+
+	bd, err := l.Attrs.BackendData.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	p := annotationPatch{}
+	p.set(n, a.BackendType, l.Attrs.BackendType)
+	p.set(n, a.BackendData, string(bd))
+	p.setOrDelete(n, a.BackendDataEncoding, "")
+	p.set(n, a.BackendPublicIP, l.Attrs.PublicIP.String())
+	p.setOrDelete(n, a.PolicyEnforced, policyEnforcedValue(l.Attrs.PolicyEnforced))
+	p.set(n, a.SubnetKubeManaged, "true")
+	if len(p) == 0 && podCIDR == "" {
+		return nil, nil
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": p,
+		},
+	}
+	if podCIDR != "" {
+		patch["spec"] = map[string]interface{}{"podCIDR": podCIDR}
+	}
+	return json.Marshal(patch)
+}
+
+func nodesWithAddress(nodes []v1.Node, address string) []*v1.Node {
+	var matches []*v1.Node
+	for i := range nodes {
+		for _, a := range nodes[i].Status.Addresses {
+			if a.Address == address {
+				matches = append(matches, &nodes[i])
+				break
+			}
+		}
+	}
+	return matches
+}
+
+func nodeNames(nodes []*v1.Node) []string {
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/coreos/flannel/subnet"
+
+	"golang.org/x/net/context"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+// DefaultNetConfConfigMapKey is the key of the network config in the
+// ConfigMap of the kube-flannel manifests.
+const DefaultNetConfConfigMapKey = "net-conf.json"
+
+// NetConfWatcher is implemented by the managers returned by NewSubnetManager,
+// for programs acting on changes to the network config. The manager itself
+// keeps running with the config it started with.
+type NetConfWatcher interface {
+	// NetConfChanges returns a channel getting the network config whenever
+	// its network or backend settings change from those the manager runs
+	// with. Configs that don't parse or aren't valid, e.g. files caught
+	// half written, aren't handed out. Only the latest change is kept for
+	// a receiver falling behind.
+	NetConfChanges() <-chan *subnet.Config
+}
+
+var _ NetConfWatcher = &kubeSubnetManager{}
+
+func (ksm *kubeSubnetManager) NetConfChanges() <-chan *subnet.Config {
+	return ksm.netConfChanges
+}
+
+// netConfSource is where the network config is read from.
+type netConfSource interface {
+	read(ctx context.Context, c clientset.Interface, timeout time.Duration) (string, error)
+	String() string
+}
+
+// netConfFile is the file the network config is read from.
+type netConfFile string
+
+func (f netConfFile) read(ctx context.Context, c clientset.Interface, timeout time.Duration) (string, error) {
+	b, err := ioutil.ReadFile(string(f))
+	return string(b), err
+}
+
+func (f netConfFile) String() string {
+	return fmt.Sprintf("%q", string(f))
+}
+
+// netConfConfigMap is the ConfigMap key the network config is read from.
+type netConfConfigMap struct {
+	namespace, name, key string
+}
+
+func parseNetConfConfigMap(ref, key string) (*netConfConfigMap, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid net conf ConfigMap %q, expected namespace/name", ref)
+	}
+	if key == "" {
+		key = DefaultNetConfConfigMapKey
+	}
+	return &netConfConfigMap{namespace: parts[0], name: parts[1], key: key}, nil
+}
+
+func (m *netConfConfigMap) String() string {
+	return fmt.Sprintf("ConfigMap %s/%s[%s]", m.namespace, m.name, m.key)
+}
+
+// read returns the network config held in the ConfigMap.
+func (m *netConfConfigMap) read(ctx context.Context, c clientset.Interface, timeout time.Duration) (string, error) {
+	cm, err := getConfigMap(ctx, c, timeout, m.namespace, m.name)
+	if err != nil {
+		return "", err
+	}
+	netConf, ok := cm.Data[m.key]
+	if !ok {
+		return "", fmt.Errorf("ConfigMap %s/%s has no key %q", m.namespace, m.name, m.key)
+	}
+	return netConf, nil
+}
+
+// parseNetConf parses the network config read from src, logging the
+// warnings of strict parsing.
+func parseNetConf(netConf string, strict bool, src netConfSource, log Logger) (*subnet.Config, error) {
+	if !strict {
+		return subnet.ParseConfig(netConf)
+	}
+	sc, warnings, err := subnet.ParseConfigStrict(netConf)
+	for _, w := range warnings {
+		log.Warningf("Network config %s: %s", src, w)
+	}
+	return sc, err
+}
+
+// watchNetConf checks the network config every netConfCheckInterval until
+// ctx is done. When its network or backend settings change, it warns and
+// hands the new config to NetConfChanges, once the config parses and has a
+// known backend type: a config caught half written is left alone until it
+// is complete. The config isn't reloaded, flannel has to be restarted to
+// apply it.
+func (ksm *kubeSubnetManager) watchNetConf(ctx context.Context) {
+	ticker := time.NewTicker(ksm.netConfCheckInterval)
+	defer ticker.Stop()
+	last, changed := ksm.netConf, false
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		netConf, err := ksm.netConfSrc.read(ctx, ksm.client, ksm.apiTimeout)
+		if err != nil {
+			ksm.log.Warningf("Failed to check network config %s: %v", ksm.netConfSrc, err)
+			continue
+		}
+		if netConf == last {
+			continue
+		}
+		last = netConf
+		sc, err := parseNetConf(netConf, ksm.strictNetConf, ksm.netConfSrc, ksm.log)
+		if err == nil {
+			if _, ok := backendSettings[sc.BackendType]; !ok {
+				err = fmt.Errorf("unknown backend type %q", sc.BackendType)
+			}
+		}
+		if err != nil {
+			ksm.log.Warningf("Ignoring invalid network config %s: %v", ksm.netConfSrc, err)
+			continue
+		}
+		diff := netConfDiff(ksm.subnetConf, sc)
+		switch {
+		case len(diff) > 0:
+			ksm.log.Warningf("Network config %s changed, restart flannel to apply it: %s differ", ksm.netConfSrc, strings.Join(diff, ", "))
+			ksm.notifyNetConf(sc)
+		case changed:
+			ksm.log.Infof("Network config %s is back to the one in use", ksm.netConfSrc)
+		}
+		changed = len(diff) > 0
+	}
+}
+
+// notifyNetConf hands sc to NetConfChanges, replacing a change not received
+// yet. Only watchNetConf sends, so there is room once the channel is drained.
+func (ksm *kubeSubnetManager) notifyNetConf(sc *subnet.Config) {
+	select {
+	case <-ksm.netConfChanges:
+	default:
+	}
+	ksm.netConfChanges <- sc
+}
+
+// netConfDiff returns the network and backend settings that differ between
+// a and b.
+func netConfDiff(a, b *subnet.Config) []string {
+	var diff []string
+	if !a.Network.Equal(b.Network) {
+		diff = append(diff, "Network")
+	}
+	if a.SubnetLen != b.SubnetLen {
+		diff = append(diff, "SubnetLen")
+	}
+	if a.SubnetMin != b.SubnetMin || a.SubnetMax != b.SubnetMax {
+		diff = append(diff, "SubnetMin/SubnetMax")
+	}
+	if a.EnableIPv6 != b.EnableIPv6 {
+		diff = append(diff, "EnableIPv6")
+	}
+	if !a.IPv6Network.Equal(b.IPv6Network) {
+		diff = append(diff, "IPv6Network")
+	}
+	if !sameJSON(a.Backend, b.Backend) {
+		diff = append(diff, "Backend")
+	}
+	if !reflect.DeepEqual(a.AllowedBackends, b.AllowedBackends) {
+		diff = append(diff, "AllowedBackends")
+	}
+	return diff
+}
+
+// sameJSON reports whether a and b hold the same JSON value, however it is
+// laid out.
+func sameJSON(a, b json.RawMessage) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
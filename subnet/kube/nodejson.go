@@ -0,0 +1,131 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// The vendored API types predate spec.podCIDRs, which carries both pod CIDRs
+// of a dual-stack node, and their decoder drops the fields it doesn't know.
+// Nodes are therefore decoded from the JSON the API server sends, and the pod
+// CIDRs found there are kept in an annotation of the decoded node. The
+// annotation only lives in the manager's copies of nodes: patches are built
+// from the flannel annotations alone, so it is never written back.
+
+// podCIDRsAnnotation holds the comma separated spec.podCIDRs of a node, as
+// read from the API server.
+const podCIDRsAnnotation = "flannel.alpha.coreos.com/internal-pod-cidrs"
+
+type nodePodCIDRs struct {
+	Spec struct {
+		PodCIDRs []string `json:"podCIDRs"`
+	} `json:"spec"`
+}
+
+// setPodCIDRs keeps cidrs in n. Whatever the annotation held before goes, so
+// it can't be set on the node itself.
+func setPodCIDRs(n *v1.Node, cidrs []string) {
+	delete(n.Annotations, podCIDRsAnnotation)
+	if len(cidrs) == 0 {
+		return
+	}
+	if n.Annotations == nil {
+		n.Annotations = make(map[string]string)
+	}
+	n.Annotations[podCIDRsAnnotation] = strings.Join(cidrs, ",")
+}
+
+func decodeNode(data []byte) (*v1.Node, error) {
+	n := &v1.Node{}
+	if err := json.Unmarshal(data, n); err != nil {
+		return nil, err
+	}
+	var cidrs nodePodCIDRs
+	if err := json.Unmarshal(data, &cidrs); err != nil {
+		return nil, err
+	}
+	setPodCIDRs(n, cidrs.Spec.PodCIDRs)
+	return n, nil
+}
+
+func decodeNodeList(data []byte) (*v1.NodeList, error) {
+	list := &v1.NodeList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+	var cidrs struct {
+		Items []nodePodCIDRs `json:"items"`
+	}
+	if err := json.Unmarshal(data, &cidrs); err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		var c []string
+		if i < len(cidrs.Items) {
+			c = cidrs.Items[i].Spec.PodCIDRs
+		}
+		setPodCIDRs(&list.Items[i], c)
+	}
+	return list, nil
+}
+
+// nodeWatchDecoder decodes the events of a node watch with decodeNode.
+type nodeWatchDecoder struct {
+	r   io.ReadCloser
+	dec *json.Decoder
+}
+
+func newNodeWatchDecoder(r io.ReadCloser) *nodeWatchDecoder {
+	return &nodeWatchDecoder{r: r, dec: json.NewDecoder(r)}
+}
+
+func (d *nodeWatchDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var e struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.dec.Decode(&e); err != nil {
+		return "", nil, err
+	}
+	switch e.Type {
+	case watch.Added, watch.Modified, watch.Deleted:
+		n, err := decodeNode(e.Object)
+		if err != nil {
+			return "", nil, err
+		}
+		return e.Type, n, nil
+	case watch.Error:
+		status := &metav1.Status{}
+		if err := json.Unmarshal(e.Object, status); err != nil {
+			return "", nil, err
+		}
+		return e.Type, status, nil
+	default:
+		return "", nil, fmt.Errorf("got invalid watch event type: %v", e.Type)
+	}
+}
+
+func (d *nodeWatchDecoder) Close() {
+	d.r.Close()
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// NodeNameStrategy is a way of finding out the name of the node flannel runs
+// on, which it needs to annotate it.
+type NodeNameStrategy string
+
+const (
+	// NodeNameFromEnv takes the NODE_NAME environment variable.
+	NodeNameFromEnv NodeNameStrategy = "env"
+	// NodeNameFromPod reads the node from the spec of the pod named by the
+	// POD_NAME and POD_NAMESPACE environment variables.
+	NodeNameFromPod NodeNameStrategy = "pod"
+	// NodeNameFromHostname takes the host name, lower cased as the kubelet
+	// does, from SubnetManagerConfig.HostnameFile or else the kernel.
+	NodeNameFromHostname NodeNameStrategy = "hostname"
+	// NodeNameFromInternalIP looks for the node that has one of the host's
+	// addresses as its InternalIP.
+	NodeNameFromInternalIP NodeNameStrategy = "internal-ip"
+)
+
+// DefaultNodeNameStrategies are the strategies tried if none are configured.
+var DefaultNodeNameStrategies = []NodeNameStrategy{NodeNameFromEnv, NodeNameFromPod}
+
+// interfaceAddrs returns the host's addresses. Tests replace it.
+var interfaceAddrs = net.InterfaceAddrs
+
+// podLookupBackoff is how often fromPod retries getting the pod: the interval
+// doubles after every attempt, up to maxPodLookupInterval.
+var (
+	podLookupBackoff     = wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1}
+	maxPodLookupInterval = 15 * time.Second
+)
+
+// nodeNameResolver runs the node name strategies.
+type nodeNameResolver struct {
+	client       clientset.Interface
+	apiTimeout   time.Duration
+	hostnameFile string
+	// podLookupTimeout is how long fromPod keeps retrying while the API
+	// server fails. Zero means a single attempt.
+	podLookupTimeout time.Duration
+	log              Logger
+	// tokenFile is the service account token file, which is there when
+	// running in a pod. Empty means the one in DefaultServiceAccountDir.
+	tokenFile string
+}
+
+// resolve tries strategies in order and returns the first node name found.
+// If none finds one, the error says what each of them tried.
+func (r *nodeNameResolver) resolve(ctx context.Context, strategies []NodeNameStrategy) (string, error) {
+	if len(strategies) == 0 {
+		strategies = DefaultNodeNameStrategies
+	}
+	var errs []string
+	for _, s := range strategies {
+		var name string
+		var err error
+		switch s {
+		case NodeNameFromEnv:
+			name, err = r.fromEnv()
+		case NodeNameFromPod:
+			name, err = r.fromPod(ctx)
+		case NodeNameFromHostname:
+			name, err = r.fromHostname()
+		case NodeNameFromInternalIP:
+			name, err = r.fromInternalIP(ctx)
+		default:
+			err = fmt.Errorf("unknown strategy")
+		}
+		if err == nil {
+			return name, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", s, err))
+	}
+	if r.onHost() {
+		return "", fmt.Errorf("flannel doesn't seem to run in a pod, so the node name can't be read from it: set NODE_NAME to the name of this node, e.g. NODE_NAME=%s (%s)",
+			r.suggestedNodeName(), strings.Join(errs, "; "))
+	}
+	return "", fmt.Errorf("unable to determine the node name (%s)", strings.Join(errs, "; "))
+}
+
+// onHost reports whether flannel looks to run on the host rather than in a
+// pod: none of the environment variables a pod would set are, and there is no
+// service account token.
+func (r *nodeNameResolver) onHost() bool {
+	for _, v := range []string{"NODE_NAME", "POD_NAME", "POD_NAMESPACE"} {
+		if os.Getenv(v) != "" {
+			return false
+		}
+	}
+	tokenFile := r.tokenFile
+	if tokenFile == "" {
+		tokenFile = filepath.Join(DefaultServiceAccountDir, "token")
+	}
+	_, err := os.Stat(tokenFile)
+	return os.IsNotExist(err)
+}
+
+// suggestedNodeName returns the node name the kubelet most likely registered
+// the host as.
+func (r *nodeNameResolver) suggestedNodeName() string {
+	if name, err := r.fromHostname(); err == nil {
+		return name
+	}
+	return "<hostname>"
+}
+
+func (r *nodeNameResolver) fromEnv() (string, error) {
+	name := os.Getenv("NODE_NAME")
+	if name == "" {
+		return "", fmt.Errorf("env variable NODE_NAME is not set")
+	}
+	return name, nil
+}
+
+func (r *nodeNameResolver) fromPod(ctx context.Context) (string, error) {
+	podName := os.Getenv("POD_NAME")
+	podNamespace := os.Getenv("POD_NAMESPACE")
+	if podName == "" || podNamespace == "" {
+		return "", fmt.Errorf("env variables POD_NAME and POD_NAMESPACE must be set")
+	}
+
+	pod, err := r.getPod(ctx, podNamespace, podName)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving pod spec for '%s/%s': %v", podNamespace, podName, err)
+	}
+	if pod.Spec.NodeName == "" {
+		return "", fmt.Errorf("node name not present in pod spec '%s/%s'", podNamespace, podName)
+	}
+	return pod.Spec.NodeName, nil
+}
+
+// getPod gets the pod, retrying with backoff for up to r.podLookupTimeout
+// while the API server fails, e.g. because it is still starting up along with
+// the rest of the cluster. A pod that doesn't exist or may not be read isn't
+// retried.
+func (r *nodeNameResolver) getPod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	start := time.Now()
+	deadline := start.Add(r.podLookupTimeout)
+	interval := podLookupBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		pod, err := getPod(ctx, r.client, r.apiTimeout, namespace, name)
+		if err == nil || apierrors.IsNotFound(err) || apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) {
+			return pod, err
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			if attempt > 1 {
+				err = fmt.Errorf("giving up after %d attempts in %v: %v", attempt, time.Since(start)/time.Second*time.Second, err)
+			}
+			return nil, err
+		}
+
+		d := wait.Jitter(interval, podLookupBackoff.Jitter)
+		if d > remaining {
+			d = remaining
+		}
+		r.log.Warningf("Attempt %d to get pod %s/%s failed, retrying in %v: %v", attempt, namespace, name, d/time.Millisecond*time.Millisecond, err)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		interval = time.Duration(float64(interval) * podLookupBackoff.Factor)
+		if interval > maxPodLookupInterval {
+			interval = maxPodLookupInterval
+		}
+	}
+}
+
+func (r *nodeNameResolver) fromHostname() (string, error) {
+	var hostname string
+	if r.hostnameFile != "" {
+		b, err := ioutil.ReadFile(r.hostnameFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read hostname file: %v", err)
+		}
+		hostname = strings.TrimSpace(string(b))
+		if hostname == "" {
+			return "", fmt.Errorf("hostname file %s is empty", r.hostnameFile)
+		}
+	} else {
+		var err error
+		hostname, err = os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("failed to get the hostname: %v", err)
+		}
+	}
+	return strings.ToLower(hostname), nil
+}
+
+func (r *nodeNameResolver) fromInternalIP(ctx context.Context) (string, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list the host's addresses: %v", err)
+	}
+	local := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			local[ipnet.IP.String()] = true
+		}
+	}
+
+	nodes, err := listNodes(ctx, r.client, r.apiTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to list nodes: %v", err)
+	}
+	var matches []string
+	for _, n := range nodes.Items {
+		for _, a := range n.Status.Addresses {
+			if a.Type == v1.NodeInternalIP && local[a.Address] {
+				matches = append(matches, n.Name)
+				break
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no node has one of the host's addresses as its internal IP")
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("nodes %s all have one of the host's addresses as their internal IP", strings.Join(matches, ", "))
+	}
+}
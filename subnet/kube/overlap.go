@@ -0,0 +1,80 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// subnetTracker remembers the subnets of the nodes holding leases, so that
+// two nodes ending up with overlapping pod CIDRs, e.g. after a node was
+// re-created, doesn't go unnoticed. Routing to such nodes is broken, but
+// which of them is right is for an operator to sort out: overlaps are only
+// reported.
+type subnetTracker struct {
+	mux     sync.Mutex
+	subnets map[string]trackedSubnets
+}
+
+type trackedSubnets struct {
+	sn  ip.IP4Net
+	sn6 ip.IP6Net
+}
+
+// set records the subnets of node name's lease, and returns the other nodes
+// whose subnets overlap them.
+func (t *subnetTracker) set(name string, l subnet.Lease) []string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.subnets == nil {
+		t.subnets = make(map[string]trackedSubnets)
+	}
+	t.subnets[name] = trackedSubnets{sn: l.Subnet, sn6: l.IPv6Subnet}
+
+	var overlaps []string
+	for other, s := range t.subnets {
+		if other == name {
+			continue
+		}
+		if (!l.Subnet.Empty() && !s.sn.Empty() && l.Subnet.Overlaps(s.sn)) ||
+			(!l.IPv6Subnet.Empty() && !s.sn6.Empty() && l.IPv6Subnet.Overlaps(s.sn6)) {
+			overlaps = append(overlaps, other)
+		}
+	}
+	sort.Strings(overlaps)
+	return overlaps
+}
+
+// remove forgets the subnets of node name.
+func (t *subnetTracker) remove(name string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.subnets, name)
+}
+
+// trackLease records the lease of node name, warning about every other node
+// whose subnet overlaps it.
+func (ksm *kubeSubnetManager) trackLease(name string, l subnet.Lease) {
+	for _, other := range ksm.subnets.set(name, l) {
+		podCIDROverlapsTotal.Add(1)
+		ksm.log.WithValues("node", name, "other", other).Errorf(
+			"Pod CIDRs of nodes %q (%s %s) and %q overlap, routing to their pods is broken until one of them gets a new pod CIDR",
+			name, l.Subnet, l.IPv6Subnet, other)
+	}
+}
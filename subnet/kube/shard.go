@@ -0,0 +1,207 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/subnet"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Very large clusters can shard flannel: each instance only watches the nodes
+// matching its node selector, its shard. The local node is watched on its own
+// whether or not it is in the shard, so the instance can always acquire and
+// watch its own lease.
+
+// nodeSelector selects the nodes of a shard by label and field.
+type nodeSelector struct {
+	labels labels.Selector
+	fields fields.Selector
+}
+
+func parseNodeSelector(labelSelector, fieldSelector string) (nodeSelector, error) {
+	sel := nodeSelector{labels: labels.Everything(), fields: fields.Everything()}
+	var err error
+	if labelSelector != "" {
+		if sel.labels, err = labels.Parse(labelSelector); err != nil {
+			return sel, fmt.Errorf("invalid node label selector %q: %v", labelSelector, err)
+		}
+	}
+	if fieldSelector != "" {
+		if sel.fields, err = fields.ParseSelector(fieldSelector); err != nil {
+			return sel, fmt.Errorf("invalid node field selector %q: %v", fieldSelector, err)
+		}
+	}
+	return sel, nil
+}
+
+// everything reports whether the selector selects all nodes.
+func (s nodeSelector) everything() bool {
+	return s.labels.Empty() && s.fields.Empty()
+}
+
+func (s nodeSelector) apply(options *metav1.ListOptions) {
+	options.LabelSelector = s.labels.String()
+	options.FieldSelector = s.fields.String()
+}
+
+// newNodeInformer returns an informer of the nodes selected by sel, handing
+// their events to the manager's handlers unless skip says otherwise. It is
+// one of the informers the watchdog looks after.
+func (ksm *kubeSubnetManager) newNodeInformer(sel nodeSelector, resyncPeriod time.Duration, skip func(n *v1.Node) bool) *nodeInformer {
+	skipObj := func(obj interface{}) bool {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		n, ok := obj.(*v1.Node)
+		return ok && skip(n)
+	}
+	i := newNodeInformerWithHandler(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				sel.apply(&options)
+				return listNodesWithOptions(ksm.client, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				sel.apply(&options)
+				return watchNodes(ksm.client, options)
+			},
+		},
+		resyncPeriod,
+		ksm.annotations.nodeIndexers(),
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if !skipObj(obj) {
+					ksm.handleAddLeaseEvent(subnet.EventAdded, obj)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if !skipObj(newObj) {
+					ksm.handleUpdateLeaseEvent(oldObj, newObj)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if !skipObj(obj) {
+					ksm.handleDeleteLeaseEvent(obj)
+				}
+			},
+		},
+	)
+	ksm.informers = append(ksm.informers, i)
+	return i
+}
+
+// shardNodeLister lists the nodes of the shard, and the local node from its
+// own informer.
+type shardNodeLister struct {
+	nodeLister
+	local     nodeLister
+	localName string
+}
+
+func (l *shardNodeLister) Get(name string) (*v1.Node, error) {
+	if name == l.localName {
+		return l.local.Get(name)
+	}
+	return l.nodeLister.Get(name)
+}
+
+func (l *shardNodeLister) List(selector labels.Selector) ([]*v1.Node, error) {
+	shard, err := l.nodeLister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := l.local.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return l.merge(nodes, shard), nil
+}
+
+func (l *shardNodeLister) ByIndex(indexName, value string) ([]*v1.Node, error) {
+	shard, err := l.nodeLister.ByIndex(indexName, value)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := l.local.ByIndex(indexName, value)
+	if err != nil {
+		return nil, err
+	}
+	return l.merge(nodes, shard), nil
+}
+
+// merge appends the nodes of the shard to the local ones, leaving out the
+// shard's copy of the local node.
+func (l *shardNodeLister) merge(local, shard []*v1.Node) []*v1.Node {
+	for _, n := range shard {
+		if n.Name != l.localName {
+			local = append(local, n)
+		}
+	}
+	return local
+}
+
+func (l *shardNodeLister) ListWithPredicate(predicate listers.NodeConditionPredicate) ([]*v1.Node, error) {
+	nodes, err := l.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var filtered []*v1.Node
+	for _, n := range nodes {
+		if predicate(n) {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered, nil
+}
+
+// controllers runs several informers as one.
+type controllers []cache.Controller
+
+func (cs controllers) Run(stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, c := range cs {
+		wg.Add(1)
+		go func(c cache.Controller) {
+			defer wg.Done()
+			c.Run(stopCh)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (cs controllers) HasSynced() bool {
+	for _, c := range cs {
+		if !c.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (cs controllers) LastSyncResourceVersion() string {
+	return cs[0].LastSyncResourceVersion()
+}
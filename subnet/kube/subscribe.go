@@ -0,0 +1,108 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"sync"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// SubscriberBuffer is how many lease events a subscriber may fall behind.
+const SubscriberBuffer = 1000
+
+// Subscriber is implemented by the managers returned by NewSubnetManager and
+// NewFakeSubnetManager, for programs embedding them that have several
+// consumers of lease events. Unlike WatchLeases, whose events are handed to
+// whichever caller takes them first, every subscriber gets every event.
+//
+// Subscribers can't hold up the node informer: one that falls more than
+// SubscriberBuffer events behind is dropped, its channel closed, and counted
+// in flannel_kube_subscribers_dropped_total. The channels of all subscribers
+// are closed when the manager stops as well. Either way, a consumer that
+// wants to carry on subscribes again and catches up with ListLeases.
+type Subscriber interface {
+	// Subscribe returns a channel getting the lease events handed out from
+	// now on. The channel is closed right away if the manager stopped.
+	Subscribe() <-chan subnet.Event
+	// Unsubscribe stops the events to a channel returned by Subscribe, and
+	// closes it. Unsubscribing a closed channel does nothing.
+	Unsubscribe(ch <-chan subnet.Event)
+}
+
+var _ Subscriber = &kubeSubnetManager{}
+
+// subscribers fans lease events out to the channels of Subscribe callers.
+type subscribers struct {
+	mux    sync.Mutex
+	chans  map[<-chan subnet.Event]chan subnet.Event
+	closed bool
+}
+
+func (ksm *kubeSubnetManager) Subscribe() <-chan subnet.Event {
+	s := &ksm.subscribers
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ch := make(chan subnet.Event, SubscriberBuffer)
+	if s.closed {
+		close(ch)
+		return ch
+	}
+	if s.chans == nil {
+		s.chans = make(map[<-chan subnet.Event]chan subnet.Event)
+	}
+	s.chans[ch] = ch
+	return ch
+}
+
+func (ksm *kubeSubnetManager) Unsubscribe(ch <-chan subnet.Event) {
+	s := &ksm.subscribers
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if c, ok := s.chans[ch]; ok {
+		delete(s.chans, ch)
+		close(c)
+	}
+}
+
+// publish hands e to all subscribers, dropping those whose buffer is full.
+func (ksm *kubeSubnetManager) publish(e subnet.Event) {
+	s := &ksm.subscribers
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for k, c := range s.chans {
+		select {
+		case c <- e:
+		default:
+			delete(s.chans, k)
+			close(c)
+			subscribersDroppedTotal.Add(1)
+			ksm.log.Warningf("Dropping lease event subscriber, it fell %d events behind", SubscriberBuffer)
+		}
+	}
+}
+
+// closeSubscribers closes the channels of all subscribers, and of those
+// subscribing later on.
+func (ksm *kubeSubnetManager) closeSubscribers() {
+	s := &ksm.subscribers
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for k, c := range s.chans {
+		delete(s.chans, k)
+		close(c)
+	}
+	s.closed = true
+}
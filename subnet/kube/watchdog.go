@@ -0,0 +1,195 @@
+// Copyright 2017 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// A node watch can stop delivering events without failing, e.g. after a long
+// partition from the API server, leaving flannel running but blind. Resyncs
+// replay the informer's cache, so they don't tell. The watchdog restarts an
+// informer that hasn't received a watch event for too long: the new one
+// relists the nodes into the same cache, handing out what changed meanwhile,
+// deleted nodes included, and watches from there.
+
+// nodeInformer is a node informer whose controller can be replaced while
+// keeping its cache.
+type nodeInformer struct {
+	indexer      cache.Indexer
+	lw           cache.ListerWatcher
+	resyncPeriod time.Duration
+	handler      cache.ResourceEventHandler
+
+	// lastEvent is when a watch event was last received, in Unix
+	// nanoseconds.
+	lastEvent int64
+
+	mux        sync.Mutex
+	controller cache.Controller
+	// stop stops the running controller, nil if none is running.
+	stop chan struct{}
+}
+
+func newNodeInformerWithHandler(lw cache.ListerWatcher, resyncPeriod time.Duration, indexers cache.Indexers, h cache.ResourceEventHandler) *nodeInformer {
+	i := &nodeInformer{
+		indexer:      cache.NewIndexer(cache.DeletionHandlingMetaNamespaceKeyFunc, indexers),
+		lw:           lw,
+		resyncPeriod: resyncPeriod,
+		handler:      h,
+		lastEvent:    time.Now().UnixNano(),
+	}
+	i.controller = i.newController()
+	return i
+}
+
+// newController returns a controller feeding the informer's cache, as
+// cache.NewIndexerInformer does. A relist by a new controller hands out
+// nodes missing from it as deleted, as they are in the cache.
+func (i *nodeInformer) newController() cache.Controller {
+	fifo := cache.NewDeltaFIFO(cache.MetaNamespaceKeyFunc, nil, i.indexer)
+	return cache.New(&cache.Config{
+		Queue:            fifo,
+		ListerWatcher:    i.lw,
+		ObjectType:       &v1.Node{},
+		FullResyncPeriod: i.resyncPeriod,
+		Process: func(obj interface{}) error {
+			for _, d := range obj.(cache.Deltas) {
+				// Sync deltas come from resyncs and relists, the others
+				// from the watch
+				if d.Type != cache.Sync {
+					atomic.StoreInt64(&i.lastEvent, time.Now().UnixNano())
+				}
+				switch d.Type {
+				case cache.Sync, cache.Added, cache.Updated:
+					if old, exists, err := i.indexer.Get(d.Object); err == nil && exists {
+						if err := i.indexer.Update(d.Object); err != nil {
+							return err
+						}
+						i.handler.OnUpdate(old, d.Object)
+					} else {
+						if err := i.indexer.Add(d.Object); err != nil {
+							return err
+						}
+						i.handler.OnAdd(d.Object)
+					}
+				case cache.Deleted:
+					if err := i.indexer.Delete(d.Object); err != nil {
+						return err
+					}
+					i.handler.OnDelete(d.Object)
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// Run runs the informer's controller, and the ones replacing it, until stopCh
+// is closed.
+func (i *nodeInformer) Run(stopCh <-chan struct{}) {
+	for {
+		i.mux.Lock()
+		c, stop := i.controller, make(chan struct{})
+		i.stop = stop
+		i.mux.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.Run(stop)
+		}()
+		select {
+		case <-stopCh:
+			i.mux.Lock()
+			if i.stop != nil {
+				close(i.stop)
+				i.stop = nil
+			}
+			i.mux.Unlock()
+			<-done
+			return
+		case <-done:
+			// Restarted
+		}
+	}
+}
+
+// restart replaces the running controller with a new one.
+func (i *nodeInformer) restart() {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if i.stop == nil {
+		return
+	}
+	close(i.stop)
+	i.stop = nil
+	i.controller = i.newController()
+	atomic.StoreInt64(&i.lastEvent, time.Now().UnixNano())
+}
+
+func (i *nodeInformer) HasSynced() bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	return i.controller.HasSynced()
+}
+
+func (i *nodeInformer) LastSyncResourceVersion() string {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	return i.controller.LastSyncResourceVersion()
+}
+
+// sinceLastEvent returns how long before now the last watch event was
+// received.
+func (i *nodeInformer) sinceLastEvent(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&i.lastEvent)))
+}
+
+// watchdogLoop checks the informers a few times per watchdog timeout until
+// ctx is done.
+func (ksm *kubeSubnetManager) watchdogLoop(ctx context.Context) {
+	ticker := time.NewTicker(ksm.watchdogTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ksm.checkInformers(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkInformers restarts the synced informers that haven't received a watch
+// event for longer than the watchdog timeout before now.
+func (ksm *kubeSubnetManager) checkInformers(now time.Time) {
+	for _, i := range ksm.informers {
+		if !i.HasSynced() {
+			continue
+		}
+		if since := i.sinceLastEvent(now); since > ksm.watchdogTimeout {
+			informerRestartsTotal.Add(1)
+			ksm.log.Warningf("Node informer received no watch event for %v, restarting it", since/time.Second*time.Second)
+			i.restart()
+		}
+	}
+}
@@ -30,20 +30,61 @@ import (
 var (
 	ErrLeaseTaken  = errors.New("subnet: lease already taken")
 	ErrNoMoreTries = errors.New("subnet: no more tries")
-	subnetRegex    = regexp.MustCompile(`(\d+\.\d+.\d+.\d+)-(\d+)`)
+	// ErrShuttingDown is returned by watches of a subnet manager that has
+	// been stopped and has no more events to hand out.
+	ErrShuttingDown = errors.New("subnet: manager is shutting down")
+	subnetRegex     = regexp.MustCompile(`(\d+\.\d+.\d+.\d+)-(\d+)`)
 )
 
 type LeaseAttrs struct {
 	PublicIP    ip.IP4
+	PublicIPv6  *ip.IP6         `json:",omitempty"`
 	BackendType string          `json:",omitempty"`
 	BackendData json.RawMessage `json:",omitempty"`
+	// BackendV6Data is the IPv6 counterpart of BackendData, for backends
+	// that advertise per address family data (such as the VTEP of each
+	// family) in dual-stack mode.
+	BackendV6Data json.RawMessage `json:",omitempty"`
+	// NodeLabels holds topology labels (zone, rack, ...) of the lease's
+	// host, for backends that route depending on them. The kube subnet
+	// manager fills in the labels it is configured to copy.
+	NodeLabels map[string]string `json:",omitempty"`
+	// NodeAnnotations holds node annotations (QoS class, priority, ...)
+	// passed through to custom backends. Flannel doesn't interpret them;
+	// the kube subnet manager fills in the annotations it is configured to
+	// copy.
+	NodeAnnotations map[string]string `json:",omitempty"`
+	// MTU is the MTU the host's backend should use, if it differs from
+	// the one derived for the whole network. Zero means no override.
+	MTU int `json:",omitempty"`
+	// PolicyEnforced reports whether the lease's host enforces network
+	// policy, so policy-aware backends can skip filtering its traffic
+	// again. False means it doesn't, or isn't known to.
+	PolicyEnforced bool `json:",omitempty"`
+
+	// MergeBackendData asks the subnet manager to merge BackendData into
+	// the backend data already stored for the lease instead of replacing
+	// it, so fields set by other code paths are kept. BackendData is then
+	// a JSON merge patch (RFC 7386): null removes a field. Only the kube
+	// subnet manager honors it. It is a request, not part of the lease,
+	// so it isn't stored.
+	MergeBackendData bool `json:"-"`
 }
 
 type Lease struct {
 	Subnet     ip.IP4Net
+	IPv6Subnet ip.IP6Net
 	Attrs      LeaseAttrs
+	// Expiration is when the lease expires unless renewed. The zero time
+	// means the lease never expires.
 	Expiration time.Time
 
+	// Asof is the version of the store the lease was read at: the etcd
+	// index, or with the kube subnet manager the resource version of the
+	// node at the change the event is about. Versions of a lease only
+	// grow, so a consumer getting an event whose lease is older than the
+	// last one it saw for the subnet, e.g. after a watch reconnected, can
+	// discard it.
 	Asof uint64
 }
 
@@ -51,18 +92,32 @@ func (l *Lease) Key() string {
 	return MakeSubnetKey(l.Subnet)
 }
 
+// Expires reports whether the lease has an expiration and so must be renewed.
+func (l *Lease) Expires() bool {
+	return !l.Expiration.IsZero()
+}
+
 type (
 	EventType int
 
 	Event struct {
 		Type  EventType `json:"type"`
 		Lease Lease     `json:"lease,omitempty"`
+		// PreviousBackendType is set on an EventAdded if the lease was
+		// handed out with this other backend type before. The lease of the
+		// old type is handed out as removed first, so its backend can tear
+		// down what it set up for it.
+		PreviousBackendType string `json:"previousBackendType,omitempty"`
 	}
 )
 
 const (
 	EventAdded EventType = iota
 	EventRemoved
+	// EventExpired is an EventRemoved telling that the lease expired, e.g.
+	// because its node stopped being updated. Consumers that don't care why
+	// a lease went away treat both alike.
+	EventExpired
 )
 
 type LeaseWatchResult struct {
@@ -82,6 +137,8 @@ func (et EventType) MarshalJSON() ([]byte, error) {
 		s = "added"
 	case EventRemoved:
 		s = "removed"
+	case EventExpired:
+		s = "expired"
 	default:
 		return nil, errors.New("bad event type")
 	}
@@ -94,6 +151,8 @@ func (et *EventType) UnmarshalJSON(data []byte) error {
 		*et = EventAdded
 	case "\"removed\"":
 		*et = EventRemoved
+	case "\"expired\"":
+		*et = EventExpired
 	default:
 		fmt.Println(string(data))
 		return errors.New("bad event type")
@@ -124,6 +183,19 @@ type Manager interface {
 	RenewLease(ctx context.Context, lease *Lease) error
 	WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error)
 	WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error)
+	Capabilities() Capabilities
 
 	Name() string
 }
+
+// Capabilities tells which operations a Manager supports, so code working
+// with any of them can branch without trying them first.
+type Capabilities struct {
+	// SupportsRenew is set if RenewLease extends the lease.
+	SupportsRenew bool
+	// SupportsSingleLeaseWatch is set if WatchLease watches a lease.
+	SupportsSingleLeaseWatch bool
+	// SupportsDelete is set if the manager can give up the local lease
+	// before it expires.
+	SupportsDelete bool
+}
@@ -39,6 +39,10 @@ func WatchLeases(ctx context.Context, sm Manager, ownLease *Lease, receiver chan
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				return
 			}
+			if err == ErrShuttingDown {
+				log.Info("Subnet manager shut down, stopping watch of subnets")
+				return
+			}
 
 			log.Errorf("Watch subnets: %v", err)
 			time.Sleep(time.Second)
@@ -70,13 +74,13 @@ func (lw *leaseWatcher) reset(leases []Lease) []Event {
 	batch := []Event{}
 
 	for _, nl := range leases {
-		if lw.ownLease != nil && nl.Subnet.Equal(lw.ownLease.Subnet) {
+		if lw.ownLease != nil && sameSubnet(&nl, lw.ownLease) {
 			continue
 		}
 
 		found := false
 		for i, ol := range lw.leases {
-			if ol.Subnet.Equal(nl.Subnet) {
+			if sameSubnet(&ol, &nl) {
 				lw.leases = deleteLease(lw.leases, i)
 				found = true
 				break
@@ -85,16 +89,16 @@ func (lw *leaseWatcher) reset(leases []Lease) []Event {
 
 		if !found {
 			// new lease
-			batch = append(batch, Event{EventAdded, nl})
+			batch = append(batch, Event{Type: EventAdded, Lease: nl})
 		}
 	}
 
 	// everything left in sm.leases has been deleted
 	for _, l := range lw.leases {
-		if lw.ownLease != nil && l.Subnet.Equal(lw.ownLease.Subnet) {
+		if lw.ownLease != nil && sameSubnet(&l, lw.ownLease) {
 			continue
 		}
-		batch = append(batch, Event{EventRemoved, l})
+		batch = append(batch, Event{Type: EventRemoved, Lease: l})
 	}
 
 	// copy the leases over (caution: don't just assign a slice)
@@ -108,16 +112,20 @@ func (lw *leaseWatcher) update(events []Event) []Event {
 	batch := []Event{}
 
 	for _, e := range events {
-		if lw.ownLease != nil && e.Lease.Subnet.Equal(lw.ownLease.Subnet) {
+		if lw.ownLease != nil && sameSubnet(&e.Lease, lw.ownLease) {
 			continue
 		}
 
 		switch e.Type {
 		case EventAdded:
-			batch = append(batch, lw.add(&e.Lease))
-
-		case EventRemoved:
-			batch = append(batch, lw.remove(&e.Lease))
+			ae := lw.add(&e.Lease)
+			ae.PreviousBackendType = e.PreviousBackendType
+			batch = append(batch, ae)
+
+		case EventRemoved, EventExpired:
+			re := lw.remove(&e.Lease)
+			re.Type = e.Type
+			batch = append(batch, re)
 		}
 	}
 
@@ -126,27 +134,33 @@ func (lw *leaseWatcher) update(events []Event) []Event {
 
 func (lw *leaseWatcher) add(lease *Lease) Event {
 	for i, l := range lw.leases {
-		if l.Subnet.Equal(lease.Subnet) {
+		if sameSubnet(&l, lease) {
 			lw.leases[i] = *lease
-			return Event{EventAdded, lw.leases[i]}
+			return Event{Type: EventAdded, Lease: lw.leases[i]}
 		}
 	}
 
 	lw.leases = append(lw.leases, *lease)
 
-	return Event{EventAdded, lw.leases[len(lw.leases)-1]}
+	return Event{Type: EventAdded, Lease: lw.leases[len(lw.leases)-1]}
 }
 
 func (lw *leaseWatcher) remove(lease *Lease) Event {
 	for i, l := range lw.leases {
-		if l.Subnet.Equal(lease.Subnet) {
+		if sameSubnet(&l, lease) {
 			lw.leases = deleteLease(lw.leases, i)
-			return Event{EventRemoved, l}
+			return Event{Type: EventRemoved, Lease: l}
 		}
 	}
 
 	log.Errorf("Removed subnet (%s) was not found", lease.Subnet)
-	return Event{EventRemoved, *lease}
+	return Event{Type: EventRemoved, Lease: *lease}
+}
+
+// sameSubnet reports whether a and b are leases of the same subnet, as
+// identified by leaseKey.
+func sameSubnet(a, b *Lease) bool {
+	return leaseKey(a) == leaseKey(b)
 }
 
 func deleteLease(l []Lease, i int) []Lease {
@@ -167,6 +181,10 @@ func WatchLease(ctx context.Context, sm Manager, sn ip.IP4Net, receiver chan Eve
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				return
 			}
+			if err == ErrShuttingDown {
+				log.Infof("Subnet manager shut down, stopping watch of subnet %s", sn)
+				return
+			}
 
 			log.Errorf("Subnet watch failed: %v", err)
 			time.Sleep(time.Second)